@@ -1,29 +1,200 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
 
+	"fastlive/pkg/graceful"
 	rtmpserver "fastlive/pkg/rtmp/server"
 )
 
+const usage = `Usage: fastlive [command] [flags]
+
+Commands:
+  serve          run the server (default)
+  check-config   validate the config and print the effective values
+  usage          aggregate usage records into CSV
+                 --from, --to   time range [from, to), RFC3339 or 2006-01-02 (local time)
+                 --group        app (default) or stream
+  version        print build information
+
+Flags:
+  -c, --config   config file or directory (default: ../config relative to the binary)
+  --addr         override addr
+  --log-level    override log.level
+
+Any config key can also be set by env, e.g. FASTLIVE_ADDR, FASTLIVE_LOG_LEVEL, FASTLIVE_API_ADDR.
+`
+
 func main() {
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && len(args[0]) > 0 && args[0][0] != '-' {
+		cmd, args = args[0], args[1:]
+	}
+
+	var err error
+	switch cmd {
+	case "serve":
+		err = serve(args)
+	case "check-config":
+		err = checkConfig(args)
+	case "usage":
+		err = exportUsage(args)
+	case "version":
+		printVersion()
+	case "help":
+		fmt.Fprint(os.Stdout, usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// parseFlags 解析公共参数, 返回创建server/加载配置使用的选项; extra用于注册子命令自己的参数
+func parseFlags(name string, args []string, extra ...func(fs *flag.FlagSet)) ([]rtmpserver.ServerOption, error) {
+	var configPath, addr, logLevel string
+
+	fs := flag.NewFlagSet("fastlive "+name, flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(fs.Output(), usage) }
+	fs.StringVar(&configPath, "c", "", "config file or directory")
+	fs.StringVar(&configPath, "config", "", "config file or directory")
+	fs.StringVar(&addr, "addr", "", "override addr")
+	fs.StringVar(&logLevel, "log-level", "", "override log.level")
+	for _, fn := range extra {
+		fn(fs)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	opts := make([]rtmpserver.ServerOption, 0)
+	if configPath != "" {
+		opts = append(opts, rtmpserver.WithConfigPath(configPath))
+	}
+
+	if addr != "" {
+		opts = append(opts, rtmpserver.WithConfigOverride("addr", addr))
+	}
+
+	if logLevel != "" {
+		opts = append(opts, rtmpserver.WithConfigOverride("log.level", logLevel))
+	}
+
+	return opts, nil
+}
+
+func checkConfig(args []string) error {
+	opts, err := parseFlags("check-config", args)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := rtmpserver.LoadConfig(opts...)
+	if err != nil {
+		return err
+	}
+
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "config ok")
+	_, err = os.Stdout.Write(out)
+	return err
+}
+
+func serve(args []string) error {
+	opts, err := parseFlags("serve", args)
+	if err != nil {
+		return err
+	}
+
 	logger, _ := zap.NewProduction()
-	srv, err := rtmpserver.New()
+	srv, err := rtmpserver.New(opts...)
 	if err != nil {
 		logger.Error("create rtmp server instance", zap.Error(err))
-		return
+		return err
 	}
 
-	if err := srv.ListenAndServe(); err != nil {
-		logger.Error("rtmp server listen and serve", zap.Error(err))
-		return
-	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ListenAndServe()
+	}()
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-	<-c
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2, syscall.SIGHUP)
+
+	for {
+		select {
+		case err := <-errCh:
+			if err != rtmpserver.ErrServerClosed {
+				logger.Error("rtmp server listen and serve", zap.Error(err))
+				return err
+			}
+			return nil
+		case sig := <-c:
+			if sig == syscall.SIGHUP {
+				logger.Info("recv SIGHUP, reloading config")
+				if err := srv.Reload(); err != nil {
+					logger.Error("reload config, keep current", zap.Error(err))
+				}
+				continue
+			}
+
+			if sig == syscall.SIGUSR2 {
+				if upgrade(logger, srv) {
+					return nil
+				}
+				continue
+			}
+
+			logger.Info("recv signal, shutting down", zap.String("signal", sig.String()))
+			ctx, cancel := context.WithTimeout(context.Background(), srv.ShutdownTimeout())
+			defer cancel()
+
+			if err := srv.Shutdown(ctx); err != nil {
+				logger.Error("rtmp server shutdown", zap.Error(err))
+			}
+			return nil
+		}
+	}
+}
+
+// upgrade 启动新进程接管listener, 成功后等待存量连接结束; 返回false表示升级失败, 继续服务
+func upgrade(logger *zap.Logger, srv *rtmpserver.Server) bool {
+	logger.Info("recv SIGUSR2, upgrading")
+
+	child, err := graceful.Upgrade(srv.Listeners(), 30*time.Second)
+	if err != nil {
+		logger.Error("upgrade, keep serving", zap.Error(err))
+		return false
+	}
+	logger.Info("new process ready, draining", zap.Int("pid", child.Pid))
+
+	ctx, cancel := context.WithTimeout(context.Background(), srv.DrainTimeout())
+	defer cancel()
+
+	if err := srv.Drain(ctx); err != nil {
+		logger.Error("rtmp server drain", zap.Error(err))
+	}
+
+	return true
 }
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// 编译时通过 -ldflags "-X main.version=... -X main.commit=... -X main.buildTime=..." 注入
+var (
+	version   = "dev"
+	commit    = ""
+	buildTime = ""
+)
+
+func printVersion() {
+	fmt.Printf("fastlive %s\n", version)
+
+	if info, ok := debug.ReadBuildInfo(); ok && version == "dev" {
+		fmt.Printf("module:     %s %s\n", info.Main.Path, info.Main.Version)
+	}
+
+	if commit != "" {
+		fmt.Printf("commit:     %s\n", commit)
+	}
+
+	if buildTime != "" {
+		fmt.Printf("build time: %s\n", buildTime)
+	}
+	fmt.Printf("go version: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
@@ -3,6 +3,7 @@ module fastlive
 go 1.15
 
 require (
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/gwuhaolin/livego v0.0.0-20210119152854-12948dfb6782
 	github.com/lestrrat-go/file-rotatelogs v2.4.0+incompatible
 	github.com/lestrrat-go/strftime v1.0.4 // indirect
@@ -10,4 +11,6 @@ require (
 	github.com/spf13/viper v1.6.3
 	github.com/stretchr/testify v1.4.0
 	go.uber.org/zap v1.10.0
+	golang.org/x/sys v0.0.0-20191010194322-b09406accb47
+	gopkg.in/yaml.v2 v2.2.4
 )
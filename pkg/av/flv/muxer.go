@@ -0,0 +1,48 @@
+package flv
+
+import (
+	"encoding/binary"
+
+	"fastlive/pkg/av"
+)
+
+const (
+	headerSize = 9  // FLV header
+	tagHdrSize = 11 // tag header
+
+	HeaderSize = headerSize + 4 // Header()的长度
+)
+
+// Header FLV header及PreviousTagSize0
+func Header(hasAudio, hasVideo bool) []byte {
+	flags := byte(0)
+	if hasAudio {
+		flags |= 0x04
+	}
+	if hasVideo {
+		flags |= 0x01
+	}
+
+	return []byte{'F', 'L', 'V', 0x01, flags, 0, 0, 0, headerSize, 0, 0, 0, 0}
+}
+
+// TagSize tag编码后的长度(含PreviousTagSize)
+func TagSize(dataSize int) int {
+	return tagHdrSize + dataSize + 4
+}
+
+// AppendTag 将packet数据编码为完整的FLV tag(tag header + data + PreviousTagSize)追加到dst
+func AppendTag(dst []byte, typ av.AVPacketType, timestamp uint32, data []byte) []byte {
+	dataSize := len(data)
+	dst = append(dst,
+		byte(typ),
+		byte(dataSize>>16), byte(dataSize>>8), byte(dataSize),
+		byte(timestamp>>16), byte(timestamp>>8), byte(timestamp), byte(timestamp>>24), // 低24位及扩展位
+		0, 0, 0, // StreamID, 总是0
+	)
+	dst = append(dst, data...)
+
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(tagHdrSize+dataSize))
+	return append(dst, size[:]...)
+}
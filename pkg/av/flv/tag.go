@@ -22,7 +22,7 @@ type mediaTag struct {
 
 	// 帧类型  1: keyframe  2: inter frame 3: disposable inter frame(h.263 only) 4: generated keyframe(server) 5: video info/command frame
 	FrameType     uint8
-	CodecID       uint8 // 编码ID  如：7（AVC/H.264）
+	CodecID       uint8 // 编码ID  如：7（AVC/H.264） 12（HEVC/H.265）
 	AvcPacketType uint8 // AVC编码数据类型  0: sequence header  1: NALU  2: end of sequence
 
 	CompostioinTime int32 // 合成时间
@@ -79,7 +79,7 @@ func (t *Tag) decodeVideoHeader(b []byte) (n int, err error) {
 	n = 1
 
 	switch t.mediaTag.CodecID {
-	case 7: // H.264
+	case 7, 12: // H.264, H.265(国内CDN扩展的CodecID)
 		switch t.mediaTag.FrameType {
 		case 1, 2: // 1: key frame  2: inter frame
 			t.mediaTag.AvcPacketType = b[1]
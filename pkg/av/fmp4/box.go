@@ -0,0 +1,60 @@
+package fmp4
+
+import "encoding/binary"
+
+// boxWriter 顺序写入ISO BMFF box, start/end成对使用, end时回填box大小
+type boxWriter struct {
+	b []byte
+}
+
+func (w *boxWriter) start(typ string) int {
+	pos := len(w.b)
+	w.b = append(w.b, 0, 0, 0, 0)
+	w.b = append(w.b, typ...)
+	return pos
+}
+
+// startFull full box: version(8) + flags(24)
+func (w *boxWriter) startFull(typ string, version uint8, flags uint32) int {
+	pos := w.start(typ)
+	w.u32(uint32(version)<<24 | flags&0xffffff)
+	return pos
+}
+
+func (w *boxWriter) end(pos int) {
+	binary.BigEndian.PutUint32(w.b[pos:], uint32(len(w.b)-pos))
+}
+
+func (w *boxWriter) u8(v uint8) {
+	w.b = append(w.b, v)
+}
+
+func (w *boxWriter) u16(v uint16) {
+	w.b = append(w.b, byte(v>>8), byte(v))
+}
+
+func (w *boxWriter) u32(v uint32) {
+	w.b = append(w.b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (w *boxWriter) u64(v uint64) {
+	w.u32(uint32(v >> 32))
+	w.u32(uint32(v))
+}
+
+func (w *boxWriter) bytes(v []byte) {
+	w.b = append(w.b, v...)
+}
+
+func (w *boxWriter) zeros(n int) {
+	for i := 0; i < n; i++ {
+		w.b = append(w.b, 0)
+	}
+}
+
+// matrix 单位矩阵(mvhd/tkhd)
+func (w *boxWriter) matrix() {
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		w.u32(v)
+	}
+}
@@ -0,0 +1,207 @@
+package fmp4
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"fastlive/pkg/av"
+	"fastlive/pkg/av/flv"
+)
+
+var (
+	testSps = []byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10}
+	testPps = []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}
+	testAsc = []byte{0x12, 0x10} // AAC LC, 44100Hz, stereo
+
+	// Main profile, level 5.1, 1920x1088, 裁剪为1080
+	testHevcSps = []byte{0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0xb0, 0x00, 0x00, 0x03, 0x00,
+		0x00, 0x03, 0x00, 0x5d, 0xa0, 0x03, 0xc0, 0x80, 0x11, 0x07, 0xcb}
+)
+
+func newTestPacket(t *testing.T, typ av.AVPacketType, timestamp uint32, data []byte) *av.Packet {
+	pkt := av.NewPacket(av.WithPacketType(typ), av.WithPacketTimestamp(timestamp), av.WithPacketData(data))
+	if err := flv.NewDemuxer().DecodeHeader(pkt); err != nil {
+		t.Fatal(err)
+	}
+	return pkt
+}
+
+func avcSeqHeader(t *testing.T) *av.Packet {
+	b := []byte{0x17, 0, 0, 0, 0, 1, testSps[1], testSps[2], testSps[3], 0xff, 0xe1, 0, byte(len(testSps))}
+	b = append(b, testSps...)
+	b = append(b, 1, 0, byte(len(testPps)))
+	b = append(b, testPps...)
+	return newTestPacket(t, av.VideoType, 0, b)
+}
+
+func hevcSeqHeader(t *testing.T) *av.Packet {
+	b := []byte{0x1c, 0, 0, 0, 0,
+		1, 0x01, 0x60, 0, 0, 0, 0xb0, 0, 0, 0, 0, 0, 93, 0xf0, 0, 0xfc, 0xfd, 0xf8, 0xf8, 0, 0, 0x0f,
+		1, 0x80 | hevcNaluTypeSps, 0, 1, 0, byte(len(testHevcSps))}
+	return newTestPacket(t, av.VideoType, 0, append(b, testHevcSps...))
+}
+
+func avcFrame(t *testing.T, timestamp uint32, key bool, cts int, size int) *av.Packet {
+	b := []byte{0x27, 1, byte(cts >> 16), byte(cts >> 8), byte(cts), byte(size >> 24), byte(size >> 16), byte(size >> 8), byte(size)}
+	if key {
+		b[0] = 0x17
+	}
+	return newTestPacket(t, av.VideoType, timestamp, append(b, make([]byte, size)...))
+}
+
+func aacFrame(t *testing.T, timestamp uint32, size int) *av.Packet {
+	return newTestPacket(t, av.AudioType, timestamp, append([]byte{0xaf, 1}, make([]byte, size)...))
+}
+
+// box 读取b开头的box, 返回类型, 内容及剩余部分
+func box(t *testing.T, b []byte) (string, []byte, []byte) {
+	if len(b) < 8 || int(binary.BigEndian.Uint32(b)) > len(b) || binary.BigEndian.Uint32(b) < 8 {
+		t.Fatalf("invalid box % x", b[:8])
+	}
+	size := binary.BigEndian.Uint32(b)
+	return string(b[4:8]), b[8:size], b[size:]
+}
+
+// children 依次读取容器box中的子box类型
+func children(t *testing.T, b []byte) map[string][]byte {
+	boxes := make(map[string][]byte)
+	for len(b) > 0 {
+		typ, payload, rest := box(t, b)
+		boxes[typ] = payload
+		b = rest
+	}
+	return boxes
+}
+
+func TestNewTrack(t *testing.T) {
+	video, err := NewTrack(1, avcSeqHeader(t))
+	if assert.Nil(t, err) {
+		assert.Equal(t, "avc1.64001f", video.Codec)
+		assert.Equal(t, 1280, video.Width)
+		assert.Equal(t, 720, video.Height)
+		assert.Equal(t, uint32(90000), video.Timescale)
+	}
+
+	hevc, err := NewTrack(1, hevcSeqHeader(t))
+	if assert.Nil(t, err) {
+		assert.Equal(t, "hvc1.1.6.L93.B0", hevc.Codec)
+		assert.Equal(t, 1920, hevc.Width)
+		assert.Equal(t, 1080, hevc.Height)
+	}
+
+	audio, err := NewTrack(2, newTestPacket(t, av.AudioType, 0, append([]byte{0xaf, 0}, testAsc...)))
+	if assert.Nil(t, err) {
+		assert.Equal(t, "mp4a.40.2", audio.Codec)
+		assert.Equal(t, 44100, audio.SampleRate)
+		assert.Equal(t, 2, audio.Channels)
+		assert.Equal(t, uint32(44100), audio.Timescale)
+	}
+
+	_, err = NewTrack(2, newTestPacket(t, av.AudioType, 0, []byte{0x2f, 0})) // MP3
+	assert.NotNil(t, err)
+}
+
+func TestInitSegment(t *testing.T) {
+	video, _ := NewTrack(1, avcSeqHeader(t))
+	audio, _ := NewTrack(2, newTestPacket(t, av.AudioType, 0, append([]byte{0xaf, 0}, testAsc...)))
+
+	top := children(t, InitSegment(video, audio))
+	assert.Equal(t, []byte("iso6"), top["ftyp"][:4])
+
+	moov := children(t, top["moov"])
+	for _, typ := range []string{"mvhd", "trak", "mvex"} {
+		assert.Contains(t, moov, typ)
+	}
+	assert.Equal(t, uint32(3), binary.BigEndian.Uint32(moov["mvhd"][96:]), "next_track_ID")
+
+	// 最后一个trak为音频, esds中包含AudioSpecificConfig
+	stbl := children(t, children(t, children(t, moov["trak"])["mdia"])["minf"])["stbl"]
+	stsd := children(t, stbl)["stsd"]
+	typ, mp4a, _ := box(t, stsd[8:])
+	assert.Equal(t, "mp4a", typ)
+	assert.Contains(t, string(mp4a), string([]byte{0x05, 0x02, 0x12, 0x10}))
+}
+
+func TestFragment(t *testing.T) {
+	video, _ := NewTrack(1, avcSeqHeader(t))
+	audio, _ := NewTrack(2, newTestPacket(t, av.AudioType, 0, append([]byte{0xaf, 0}, testAsc...)))
+
+	var vq, aq SampleQueue
+	for _, pkt := range []*av.Packet{avcFrame(t, 1000, true, 80, 100), avcFrame(t, 1040, false, 40, 50), avcFrame(t, 1080, false, 0, 60)} {
+		s, ok := video.Sample(pkt)
+		assert.True(t, ok)
+		vq.Push(s)
+	}
+	for _, pkt := range []*av.Packet{aacFrame(t, 1000, 10), aacFrame(t, 1023, 11)} {
+		s, ok := audio.Sample(pkt)
+		assert.True(t, ok)
+		aq.Push(s)
+	}
+	_, ok := video.Sample(avcSeqHeader(t))
+	assert.False(t, ok, "sequence header is not a sample")
+
+	vs := vq.Pop()
+	if assert.Len(t, vs, 2) {
+		assert.Equal(t, uint64(90000), vs[0].DTS)
+		assert.Equal(t, uint32(3600), vs[0].Duration)
+		assert.Equal(t, int32(7200), vs[0].CompositionOffset)
+		assert.True(t, vs[0].Keyframe)
+		assert.False(t, vs[1].Keyframe)
+	}
+	assert.Equal(t, 1, vq.Len(), "last sample waits for the next one")
+
+	as := aq.Flush()
+	if assert.Len(t, as, 2) {
+		assert.Equal(t, uint32(1014), as[0].Duration) // (1023-1000)ms * 44.1
+		assert.Equal(t, as[0].Duration, as[1].Duration, "flushed sample reuses previous duration")
+	}
+
+	frag := Fragment(7, TrackFragment{Track: video, Samples: vs}, TrackFragment{Track: audio, Samples: as})
+	typ, moof, rest := box(t, frag)
+	assert.Equal(t, "moof", typ)
+	typ, mdat, _ := box(t, rest)
+	assert.Equal(t, "mdat", typ)
+	assert.Equal(t, 4+100+4+50+10+11, len(mdat))
+
+	var trafs [][]byte
+	b := moof
+	for len(b) > 0 {
+		var payload []byte
+		typ, payload, b = box(t, b)
+		switch typ {
+		case "mfhd":
+			assert.Equal(t, uint32(7), binary.BigEndian.Uint32(payload[4:]))
+		case "traf":
+			trafs = append(trafs, payload)
+		}
+	}
+
+	moofSize := len(frag) - len(rest)
+	expectedOffsets := []int{moofSize + 8, moofSize + 8 + 4 + 100 + 4 + 50}
+	if assert.Len(t, trafs, 2) {
+		for i, traf := range trafs {
+			boxes := children(t, traf)
+			tfdt := boxes["tfdt"]
+			assert.Equal(t, byte(1), tfdt[0], "tfdt version 1")
+			trun := boxes["trun"]
+			assert.Equal(t, uint32(2), binary.BigEndian.Uint32(trun[4:]), "sample_count")
+			assert.Equal(t, uint32(expectedOffsets[i]), binary.BigEndian.Uint32(trun[8:]), "data_offset")
+		}
+		assert.Equal(t, uint64(90000), binary.BigEndian.Uint64(children(t, trafs[0])["tfdt"][4:]))
+
+		// 视频trun: duration, size, flags, composition offset
+		trun := children(t, trafs[0])["trun"]
+		assert.Equal(t, []uint32{3600, 104, sampleFlagsSync, 7200}, []uint32{
+			binary.BigEndian.Uint32(trun[12:]), binary.BigEndian.Uint32(trun[16:]),
+			binary.BigEndian.Uint32(trun[20:]), binary.BigEndian.Uint32(trun[24:]),
+		})
+		assert.Equal(t, uint32(sampleFlagsNonSync), binary.BigEndian.Uint32(trun[36:]))
+	}
+}
+
+func TestAppendDescriptor(t *testing.T) {
+	assert.Equal(t, []byte{0x05, 0x02, 0x12, 0x10}, appendDescriptor(nil, 0x05, testAsc))
+	assert.Equal(t, []byte{0x81, 0x00}, appendDescriptor(nil, 0x04, make([]byte, 128))[1:3])
+}
@@ -0,0 +1,173 @@
+package fmp4
+
+import "encoding/binary"
+
+/*
+fMP4分片: 每个分片为moof+mdat, moof中每个轨道一个traf
+1. tfhd使用default-base-is-moof, trun的data_offset相对moof起始位置
+2. tfdt为分片第一个sample的DTS(轨道timescale)
+3. trun逐sample记录duration/size/flags/composition offset, 使用version 1(有符号的composition offset)
+*/
+
+const (
+	tfhdDefaultBaseIsMoof = 0x020000
+
+	trunDataOffset        = 0x000001
+	trunSampleDuration    = 0x000100
+	trunSampleSize        = 0x000200
+	trunSampleFlags       = 0x000400
+	trunCompositionOffset = 0x000800
+
+	// sample_depends_on=2: 不依赖其他帧
+	sampleFlagsSync = 0x02000000
+	// sample_depends_on=1, sample_is_non_sync_sample=1
+	sampleFlagsNonSync = 0x01010000
+)
+
+// Sample 一个音视频帧, 时间单位为轨道timescale
+type Sample struct {
+	DTS               uint64
+	Duration          uint32
+	CompositionOffset int32 // PTS - DTS
+	Keyframe          bool
+	Data              []byte // 视频为长度前缀的NALU(与avcC/hvcC一致), 音频为raw AAC
+}
+
+// TrackFragment 一个轨道在分片中的sample
+type TrackFragment struct {
+	Track   *Track
+	Samples []Sample
+}
+
+// Duration 分片中sample时长之和
+func (f *TrackFragment) Duration() uint64 {
+	var d uint64
+	for _, s := range f.Samples {
+		d += uint64(s.Duration)
+	}
+	return d
+}
+
+// Fragment 生成moof+mdat, seq为mfhd中的sequence_number(从1开始递增); 没有sample的轨道被忽略
+func Fragment(seq uint32, fragments ...TrackFragment) []byte {
+	w := &boxWriter{}
+	var dataOffsets []int // 各trun中data_offset字段的位置
+
+	moof := w.start("moof")
+	mfhd := w.startFull("mfhd", 0, 0)
+	w.u32(seq)
+	w.end(mfhd)
+
+	for _, f := range fragments {
+		if len(f.Samples) == 0 {
+			continue
+		}
+
+		traf := w.start("traf")
+		tfhd := w.startFull("tfhd", 0, tfhdDefaultBaseIsMoof)
+		w.u32(f.Track.ID)
+		w.end(tfhd)
+
+		tfdt := w.startFull("tfdt", 1, 0)
+		w.u64(f.Samples[0].DTS)
+		w.end(tfdt)
+
+		flags := uint32(trunDataOffset | trunSampleDuration | trunSampleSize | trunSampleFlags)
+		if f.Track.Kind == VideoTrack {
+			flags |= trunCompositionOffset
+		}
+		trun := w.startFull("trun", 1, flags)
+		w.u32(uint32(len(f.Samples)))
+		dataOffsets = append(dataOffsets, len(w.b))
+		w.u32(0) // data_offset, moof完成后回填
+		for _, s := range f.Samples {
+			w.u32(s.Duration)
+			w.u32(uint32(len(s.Data)))
+			if s.Keyframe {
+				w.u32(sampleFlagsSync)
+			} else {
+				w.u32(sampleFlagsNonSync)
+			}
+			if flags&trunCompositionOffset != 0 {
+				w.u32(uint32(s.CompositionOffset))
+			}
+		}
+		w.end(trun)
+		w.end(traf)
+	}
+	w.end(moof)
+
+	// mdat中按traf顺序存放各轨道的sample数据
+	offset := len(w.b) + 8
+	mdat := w.start("mdat")
+	i := 0
+	for _, f := range fragments {
+		if len(f.Samples) == 0 {
+			continue
+		}
+		binary.BigEndian.PutUint32(w.b[dataOffsets[i]:], uint32(offset))
+		for _, s := range f.Samples {
+			w.bytes(s.Data)
+			offset += len(s.Data)
+		}
+		i++
+	}
+	w.end(mdat)
+
+	return w.b
+}
+
+// SampleQueue 缓存一个轨道的sample, 每个sample的时长由下一个sample的DTS确定
+// 因此最后一个sample在下一个sample到达前不能输出, 非并发安全
+type SampleQueue struct {
+	samples      []Sample
+	lastDuration uint32
+}
+
+// Push 加入sample并计算前一个sample的时长, DTS回退时沿用上一个时长
+func (q *SampleQueue) Push(s Sample) {
+	if n := len(q.samples); n > 0 {
+		prev := &q.samples[n-1]
+		if s.DTS > prev.DTS {
+			q.lastDuration = uint32(s.DTS - prev.DTS)
+		}
+		prev.Duration = q.lastDuration
+	}
+	q.samples = append(q.samples, s)
+}
+
+// Len 已缓存的sample数, 包含时长未确定的最后一个
+func (q *SampleQueue) Len() int {
+	return len(q.samples)
+}
+
+// Pending 时长未确定的最后一个sample
+func (q *SampleQueue) Pending() (Sample, bool) {
+	if len(q.samples) == 0 {
+		return Sample{}, false
+	}
+	return q.samples[len(q.samples)-1], true
+}
+
+// Pop 取出时长已确定的sample(除最后一个外的全部)
+func (q *SampleQueue) Pop() []Sample {
+	n := len(q.samples)
+	if n <= 1 {
+		return nil
+	}
+	out := make([]Sample, n-1)
+	copy(out, q.samples)
+	q.samples = append(q.samples[:0], q.samples[n-1])
+	return out
+}
+
+// Flush 取出全部sample, 最后一个使用上一个sample的时长(流结束或断开时)
+func (q *SampleQueue) Flush() []Sample {
+	if len(q.samples) == 0 {
+		return nil
+	}
+	q.samples[len(q.samples)-1].Duration = q.lastDuration
+	out := q.samples
+	q.samples = nil
+	return out
+}
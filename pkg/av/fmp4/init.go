@@ -0,0 +1,225 @@
+package fmp4
+
+// InitSegment 生成ftyp+moov, moov中不包含sample表, 通过mvex声明为分片文件
+func InitSegment(tracks ...*Track) []byte {
+	w := &boxWriter{}
+
+	ftyp := w.start("ftyp")
+	w.bytes([]byte("iso6")) // major brand
+	w.u32(0)                // minor version
+	for _, brand := range []string{"iso6", "iso5", "cmfc", "mp41"} {
+		w.bytes([]byte(brand))
+	}
+	w.end(ftyp)
+
+	moov := w.start("moov")
+	writeMvhd(w, tracks)
+	for _, t := range tracks {
+		writeTrak(w, t)
+	}
+
+	mvex := w.start("mvex")
+	for _, t := range tracks {
+		trex := w.startFull("trex", 0, 0)
+		w.u32(t.ID)
+		w.u32(1) // default_sample_description_index
+		w.u32(0) // default_sample_duration
+		w.u32(0) // default_sample_size
+		w.u32(0) // default_sample_flags
+		w.end(trex)
+	}
+	w.end(mvex)
+	w.end(moov)
+
+	return w.b
+}
+
+func writeMvhd(w *boxWriter, tracks []*Track) {
+	nextID := uint32(1)
+	for _, t := range tracks {
+		if t.ID >= nextID {
+			nextID = t.ID + 1
+		}
+	}
+
+	mvhd := w.startFull("mvhd", 0, 0)
+	w.u32(0)    // creation_time
+	w.u32(0)    // modification_time
+	w.u32(1000) // timescale
+	w.u32(0)    // duration
+	w.u32(0x00010000)
+	w.u16(0x0100) // volume
+	w.zeros(2 + 8)
+	w.matrix()
+	w.zeros(24) // pre_defined
+	w.u32(nextID)
+	w.end(mvhd)
+}
+
+func writeTrak(w *boxWriter, t *Track) {
+	trak := w.start("trak")
+
+	tkhd := w.startFull("tkhd", 0, 0x000003) // enabled, in movie
+	w.u32(0)                                 // creation_time
+	w.u32(0)                                 // modification_time
+	w.u32(t.ID)
+	w.u32(0) // reserved
+	w.u32(0) // duration
+	w.zeros(8)
+	w.u16(0) // layer
+	w.u16(0) // alternate_group
+	if t.Kind == AudioTrack {
+		w.u16(0x0100)
+	} else {
+		w.u16(0)
+	}
+	w.u16(0)
+	w.matrix()
+	w.u32(uint32(t.Width) << 16)
+	w.u32(uint32(t.Height) << 16)
+	w.end(tkhd)
+
+	mdia := w.start("mdia")
+
+	mdhd := w.startFull("mdhd", 0, 0)
+	w.u32(0) // creation_time
+	w.u32(0) // modification_time
+	w.u32(t.Timescale)
+	w.u32(0)      // duration
+	w.u16(0x55c4) // language: und
+	w.u16(0)
+	w.end(mdhd)
+
+	handler, name := "vide", "VideoHandler"
+	if t.Kind == AudioTrack {
+		handler, name = "soun", "SoundHandler"
+	}
+	hdlr := w.startFull("hdlr", 0, 0)
+	w.u32(0)
+	w.bytes([]byte(handler))
+	w.zeros(12)
+	w.bytes([]byte(name))
+	w.u8(0)
+	w.end(hdlr)
+
+	minf := w.start("minf")
+	if t.Kind == AudioTrack {
+		smhd := w.startFull("smhd", 0, 0)
+		w.u16(0) // balance
+		w.u16(0)
+		w.end(smhd)
+	} else {
+		vmhd := w.startFull("vmhd", 0, 1)
+		w.zeros(8) // graphicsmode, opcolor
+		w.end(vmhd)
+	}
+
+	dinf := w.start("dinf")
+	dref := w.startFull("dref", 0, 0)
+	w.u32(1)
+	url := w.startFull("url ", 0, 1) // 数据在同一文件中
+	w.end(url)
+	w.end(dref)
+	w.end(dinf)
+
+	stbl := w.start("stbl")
+	stsd := w.startFull("stsd", 0, 0)
+	w.u32(1)
+	if t.Kind == AudioTrack {
+		writeMp4a(w, t)
+	} else {
+		writeVisualSampleEntry(w, t)
+	}
+	w.end(stsd)
+	for _, typ := range []string{"stts", "stsc", "stco"} {
+		box := w.startFull(typ, 0, 0)
+		w.u32(0) // entry_count
+		w.end(box)
+	}
+	stsz := w.startFull("stsz", 0, 0)
+	w.u32(0) // sample_size
+	w.u32(0) // sample_count
+	w.end(stsz)
+	w.end(stbl)
+
+	w.end(minf)
+	w.end(mdia)
+	w.end(trak)
+}
+
+// writeVisualSampleEntry avc1/hvc1, 其中的avcC/hvcC直接使用sequence header中的配置
+func writeVisualSampleEntry(w *boxWriter, t *Track) {
+	entry := w.start(t.sampleEntry)
+	w.zeros(6)
+	w.u16(1) // data_reference_index
+	w.zeros(16)
+	w.u16(uint16(t.Width))
+	w.u16(uint16(t.Height))
+	w.u32(0x00480000) // 72dpi
+	w.u32(0x00480000)
+	w.u32(0)
+	w.u16(1)    // frame_count
+	w.zeros(32) // compressorname
+	w.u16(0x0018)
+	w.u16(0xffff)
+
+	configType := "avcC"
+	if t.sampleEntry == "hvc1" {
+		configType = "hvcC"
+	}
+	config := w.start(configType)
+	w.bytes(t.config)
+	w.end(config)
+
+	w.end(entry)
+}
+
+func writeMp4a(w *boxWriter, t *Track) {
+	entry := w.start("mp4a")
+	w.zeros(6)
+	w.u16(1) // data_reference_index
+	w.zeros(8)
+	w.u16(uint16(t.Channels))
+	w.u16(16) // samplesize
+	w.zeros(4)
+	w.u32(uint32(t.SampleRate&0xffff) << 16)
+
+	esds := w.startFull("esds", 0, 0)
+	decoderSpecific := appendDescriptor(nil, 0x05, t.config)
+
+	decoderConfig := []byte{
+		0x40,    // objectTypeIndication: MPEG-4 Audio
+		0x15,    // streamType: audio, upStream 0, reserved 1
+		0, 0, 0, // bufferSizeDB
+		0, 0, 0, 0, // maxBitrate
+		0, 0, 0, 0, // avgBitrate
+	}
+	decoderConfig = appendDescriptor(nil, 0x04, append(decoderConfig, decoderSpecific...))
+
+	es := []byte{byte(t.ID >> 8), byte(t.ID), 0} // ES_ID, flags
+	es = append(es, decoderConfig...)
+	es = appendDescriptor(es, 0x06, []byte{0x02}) // SLConfigDescriptor
+	w.bytes(appendDescriptor(nil, 0x03, es))
+	w.end(esds)
+
+	w.end(entry)
+}
+
+// appendDescriptor MPEG-4描述符, 长度为每字节7位的可变长编码
+func appendDescriptor(dst []byte, tag byte, payload []byte) []byte {
+	dst = append(dst, tag)
+	size := len(payload)
+	var lenBytes []byte
+	for {
+		lenBytes = append([]byte{byte(size & 0x7f)}, lenBytes...)
+		size >>= 7
+		if size == 0 {
+			break
+		}
+	}
+	for i := 0; i < len(lenBytes)-1; i++ {
+		lenBytes[i] |= 0x80
+	}
+	dst = append(dst, lenBytes...)
+	return append(dst, payload...)
+}
@@ -0,0 +1,222 @@
+package fmp4
+
+import "github.com/pkg/errors"
+
+var errBitsExhausted = errors.New("fmp4: sps truncated")
+
+// bitReader 读取去除emulation prevention字节后的RBSP
+type bitReader struct {
+	b   []byte
+	pos int // bit位置
+	err error
+}
+
+func newRbspReader(nalu []byte) *bitReader {
+	rbsp := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, v := range nalu {
+		if zeros >= 2 && v == 0x03 {
+			zeros = 0
+			continue
+		}
+		if v == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, v)
+	}
+	return &bitReader{b: rbsp}
+}
+
+func (r *bitReader) u(n int) uint32 {
+	v := uint32(0)
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.b)*8 {
+			r.err = errBitsExhausted
+			return 0
+		}
+		v = v<<1 | uint32(r.b[r.pos/8]>>(7-uint(r.pos%8))&1)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) skip(n int) {
+	r.pos += n
+	if r.pos > len(r.b)*8 {
+		r.err = errBitsExhausted
+	}
+}
+
+// ue Exp-Golomb无符号数
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for r.u(1) == 0 && r.err == nil {
+		if zeros++; zeros > 31 {
+			r.err = errors.New("fmp4: invalid exp-golomb code")
+			return 0
+		}
+	}
+	return 1<<uint(zeros) - 1 + r.u(zeros)
+}
+
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v&1 == 1 {
+		return int32(v/2 + 1)
+	}
+	return -int32(v / 2)
+}
+
+// parseAvcSps H.264 SPS中的分辨率
+func parseAvcSps(sps []byte) (width, height int, err error) {
+	if len(sps) < 4 {
+		return 0, 0, errors.New("fmp4: sps too short")
+	}
+
+	r := newRbspReader(sps[1:])
+	profile := r.u(8)
+	r.skip(16) // constraint flags, level_idc
+	r.ue()     // seq_parameter_set_id
+
+	chromaFormat := uint32(1)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = r.ue()
+		if chromaFormat == 3 {
+			r.skip(1) // separate_colour_plane_flag
+		}
+		r.ue()           // bit_depth_luma_minus8
+		r.ue()           // bit_depth_chroma_minus8
+		r.skip(1)        // qpprime_y_zero_transform_bypass_flag
+		if r.u(1) == 1 { // seq_scaling_matrix_present_flag
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.u(1) == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size && r.err == nil; j++ {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	r.ue()          // log2_max_frame_num_minus4
+	switch r.ue() { // pic_order_cnt_type
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.skip(1) // delta_pic_order_always_zero_flag
+		r.se()    // offset_for_non_ref_pic
+		r.se()    // offset_for_top_to_bottom_field
+		n := r.ue()
+		for i := uint32(0); i < n && r.err == nil; i++ {
+			r.se()
+		}
+	}
+
+	r.ue()    // max_num_ref_frames
+	r.skip(1) // gaps_in_frame_num_value_allowed_flag
+	widthMbs := int(r.ue()) + 1
+	heightMapUnits := int(r.ue()) + 1
+	frameMbsOnly := int(r.u(1))
+	if frameMbsOnly == 0 {
+		r.skip(1) // mb_adaptive_frame_field_flag
+	}
+	r.skip(1) // direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom int
+	if r.u(1) == 1 {
+		cropLeft, cropRight, cropTop, cropBottom = int(r.ue()), int(r.ue()), int(r.ue()), int(r.ue())
+	}
+
+	if r.err != nil {
+		return 0, 0, r.err
+	}
+
+	cropUnitX, cropUnitY := 1, 2-frameMbsOnly
+	if chromaFormat != 0 {
+		subWidth, subHeight := 2, 2
+		if chromaFormat == 2 {
+			subHeight = 1
+		} else if chromaFormat == 3 {
+			subWidth, subHeight = 1, 1
+		}
+		cropUnitX, cropUnitY = subWidth, subHeight*(2-frameMbsOnly)
+	}
+
+	width = widthMbs*16 - (cropLeft+cropRight)*cropUnitX
+	height = (2-frameMbsOnly)*heightMapUnits*16 - (cropTop+cropBottom)*cropUnitY
+	return width, height, nil
+}
+
+// parseHevcSps H.265 SPS中的分辨率
+func parseHevcSps(sps []byte) (width, height int, err error) {
+	if len(sps) < 4 {
+		return 0, 0, errors.New("fmp4: sps too short")
+	}
+
+	r := newRbspReader(sps[2:]) // 2字节NAL header
+	r.skip(4)                   // sps_video_parameter_set_id
+	maxSubLayersMinus1 := int(r.u(3))
+	r.skip(1) // sps_temporal_id_nesting_flag
+
+	// profile_tier_level
+	r.skip(2 + 1 + 5 + 32 + 48 + 8)
+	profilePresent := make([]bool, maxSubLayersMinus1)
+	levelPresent := make([]bool, maxSubLayersMinus1)
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		profilePresent[i] = r.u(1) == 1
+		levelPresent[i] = r.u(1) == 1
+	}
+	if maxSubLayersMinus1 > 0 {
+		r.skip(2 * (8 - maxSubLayersMinus1))
+	}
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		if profilePresent[i] {
+			r.skip(88)
+		}
+		if levelPresent[i] {
+			r.skip(8)
+		}
+	}
+
+	r.ue() // sps_seq_parameter_set_id
+	chromaFormat := r.ue()
+	if chromaFormat == 3 {
+		r.skip(1) // separate_colour_plane_flag
+	}
+	width, height = int(r.ue()), int(r.ue())
+	if r.u(1) == 1 { // conformance_window_flag
+		left, right, top, bottom := int(r.ue()), int(r.ue()), int(r.ue()), int(r.ue())
+		subWidth, subHeight := 1, 1
+		if chromaFormat == 1 || chromaFormat == 2 {
+			subWidth = 2
+		}
+		if chromaFormat == 1 {
+			subHeight = 2
+		}
+		width -= (left + right) * subWidth
+		height -= (top + bottom) * subHeight
+	}
+
+	if r.err != nil {
+		return 0, 0, r.err
+	}
+	return width, height, nil
+}
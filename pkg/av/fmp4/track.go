@@ -0,0 +1,272 @@
+package fmp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"fastlive/pkg/av"
+)
+
+/*
+fMP4(ISO BMFF分片)封装, 供DASH, LL-HLS及MP4录制使用:
+1. Track由session中的sequence header生成: H.264(avcC), H.265(hvcC, FLV CodecID 12), AAC(esds)
+2. InitSegment输出ftyp+moov; Fragment将各轨道的sample输出为moof+mdat
+3. Track.Sample将FLV格式的av.Packet转换为sample, SampleQueue根据相邻DTS确定sample时长
+*/
+
+// FLV中的编码ID
+const (
+	flvCodecAvc       = 7
+	flvCodecHevc      = 12 // 国内CDN扩展
+	flvSoundAac       = 10
+	flvVideoHeaderLen = 5 // FrameType/CodecID, AVCPacketType, CompositionTime
+	flvAacHeaderLen   = 2 // SoundFormat..., AACPacketType
+)
+
+const (
+	videoTimescale = 90000
+
+	hevcNaluTypeSps = 33
+)
+
+var ErrUnsupportedCodec = errors.New("fmp4: unsupported codec")
+
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+type TrackKind uint8
+
+const (
+	VideoTrack TrackKind = iota + 1
+	AudioTrack
+)
+
+// Track 由sequence header生成的轨道参数, 用于init segment及fragment
+type Track struct {
+	ID        uint32
+	Kind      TrackKind
+	Timescale uint32 // 视频90kHz, 音频为采样率
+	Codec     string // RFC 6381编码字符串, 如avc1.64001f, mp4a.40.2
+
+	Width, Height int // 视频分辨率
+	SampleRate    int
+	Channels      int
+
+	sampleEntry string // avc1/hvc1/mp4a
+	config      []byte // avcC/hvcC内容或AudioSpecificConfig
+}
+
+// NewTrack 根据音频或视频sequence header创建轨道, 支持H.264, H.265及AAC
+func NewTrack(id uint32, seqHeader *av.Packet) (*Track, error) {
+	switch seqHeader.PacketType {
+	case av.VideoType:
+		vh, ok := seqHeader.PacketHeader.(av.VideoPacketHeader)
+		if !ok || !vh.IsSequenceHeader() {
+			return nil, errors.New("fmp4: not a video sequence header")
+		}
+		if len(seqHeader.Data) < flvVideoHeaderLen {
+			return nil, errors.New("fmp4: video sequence header too short")
+		}
+		config := seqHeader.Data[flvVideoHeaderLen:]
+
+		switch vh.CodecID() {
+		case flvCodecAvc:
+			return newAvcTrack(id, config)
+		case flvCodecHevc:
+			return newHevcTrack(id, config)
+		}
+		return nil, errors.Wrapf(ErrUnsupportedCodec, "video codec id %d", vh.CodecID())
+
+	case av.AudioType:
+		ah, ok := seqHeader.PacketHeader.(av.AudioPacketHeader)
+		if !ok {
+			return nil, errors.New("fmp4: not an audio sequence header")
+		}
+		if ah.SoundFormat() != flvSoundAac {
+			return nil, errors.Wrapf(ErrUnsupportedCodec, "sound format %d", ah.SoundFormat())
+		}
+		if ah.AACPacketType() != 0 || len(seqHeader.Data) < flvAacHeaderLen {
+			return nil, errors.New("fmp4: not an aac sequence header")
+		}
+		return newAacTrack(id, seqHeader.Data[flvAacHeaderLen:])
+	}
+
+	return nil, errors.Errorf("fmp4: unexpected packet type %d", seqHeader.PacketType)
+}
+
+// newAvcTrack config为AVCDecoderConfigurationRecord
+func newAvcTrack(id uint32, config []byte) (*Track, error) {
+	if len(config) < 7 || config[0] != 1 {
+		return nil, errors.New("fmp4: invalid avc config")
+	}
+	if int(config[5]&0x1f) == 0 {
+		return nil, errors.New("fmp4: avc config without sps")
+	}
+
+	spsLen := int(binary.BigEndian.Uint16(config[6:]))
+	if len(config) < 8+spsLen {
+		return nil, errors.New("fmp4: avc config truncated")
+	}
+	width, height, err := parseAvcSps(config[8 : 8+spsLen])
+	if err != nil {
+		return nil, errors.Wrap(err, "parse avc sps")
+	}
+
+	return &Track{
+		ID:          id,
+		Kind:        VideoTrack,
+		Timescale:   videoTimescale,
+		Codec:       fmt.Sprintf("avc1.%02x%02x%02x", config[1], config[2], config[3]),
+		Width:       width,
+		Height:      height,
+		sampleEntry: "avc1",
+		config:      append([]byte(nil), config...),
+	}, nil
+}
+
+// newHevcTrack config为HEVCDecoderConfigurationRecord
+func newHevcTrack(id uint32, config []byte) (*Track, error) {
+	if len(config) < 23 || config[0] != 1 {
+		return nil, errors.New("fmp4: invalid hevc config")
+	}
+
+	var sps []byte
+	b, numArrays := config[23:], int(config[22])
+	for i := 0; i < numArrays && sps == nil; i++ {
+		if len(b) < 3 {
+			return nil, errors.New("fmp4: hevc config truncated")
+		}
+		typ, n := b[0]&0x3f, int(binary.BigEndian.Uint16(b[1:]))
+		b = b[3:]
+		for j := 0; j < n; j++ {
+			if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+				return nil, errors.New("fmp4: hevc config truncated")
+			}
+			size := int(binary.BigEndian.Uint16(b))
+			if typ == hevcNaluTypeSps && sps == nil {
+				sps = b[2 : 2+size]
+			}
+			b = b[2+size:]
+		}
+	}
+	if sps == nil {
+		return nil, errors.New("fmp4: hevc config without sps")
+	}
+
+	width, height, err := parseHevcSps(sps)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse hevc sps")
+	}
+
+	return &Track{
+		ID:          id,
+		Kind:        VideoTrack,
+		Timescale:   videoTimescale,
+		Codec:       hevcCodecString(config),
+		Width:       width,
+		Height:      height,
+		sampleEntry: "hvc1",
+		config:      append([]byte(nil), config...),
+	}, nil
+}
+
+// hevcCodecString ISO/IEC 14496-15 附录E, 如hvc1.1.6.L93.B0
+func hevcCodecString(config []byte) string {
+	var sb strings.Builder
+	sb.WriteString("hvc1.")
+	if space := config[1] >> 6; space > 0 {
+		sb.WriteByte('A' + space - 1)
+	}
+	fmt.Fprintf(&sb, "%d", config[1]&0x1f)
+
+	// general_profile_compatibility_flags按位反序
+	compat, reversed := binary.BigEndian.Uint32(config[2:]), uint32(0)
+	for i := 0; i < 32; i++ {
+		reversed = reversed<<1 | compat>>uint(i)&1
+	}
+	fmt.Fprintf(&sb, ".%x", reversed)
+
+	tier := byte('L')
+	if config[1]&0x20 != 0 {
+		tier = 'H'
+	}
+	fmt.Fprintf(&sb, ".%c%d", tier, config[12])
+
+	// constraint flags, 省略末尾的0字节
+	constraints := config[6:12]
+	for len(constraints) > 0 && constraints[len(constraints)-1] == 0 {
+		constraints = constraints[:len(constraints)-1]
+	}
+	for _, c := range constraints {
+		fmt.Fprintf(&sb, ".%X", c)
+	}
+	return sb.String()
+}
+
+// newAacTrack config为AudioSpecificConfig
+func newAacTrack(id uint32, config []byte) (*Track, error) {
+	if len(config) < 2 {
+		return nil, errors.New("fmp4: aac config too short")
+	}
+
+	objectType := int(config[0] >> 3)
+	freqIndex := int(config[0]&0x07<<1 | config[1]>>7)
+	channels := int(config[1] >> 3 & 0x0f)
+
+	var sampleRate int
+	switch {
+	case freqIndex < len(aacSampleRates):
+		sampleRate = aacSampleRates[freqIndex]
+	case freqIndex == 15 && len(config) >= 5: // 24位显式采样率
+		sampleRate = int(config[1]&0x7f)<<17 | int(config[2])<<9 | int(config[3])<<1 | int(config[4]>>7)
+		channels = int(config[4] >> 3 & 0x0f)
+	default:
+		return nil, errors.Errorf("fmp4: invalid aac sampling frequency index %d", freqIndex)
+	}
+	if objectType == 0 || objectType == 31 || sampleRate == 0 {
+		return nil, errors.Errorf("fmp4: unsupported aac config %x", config)
+	}
+
+	return &Track{
+		ID:          id,
+		Kind:        AudioTrack,
+		Timescale:   uint32(sampleRate),
+		Codec:       fmt.Sprintf("mp4a.40.%d", objectType),
+		SampleRate:  sampleRate,
+		Channels:    channels,
+		sampleEntry: "mp4a",
+		config:      append([]byte(nil), config...),
+	}, nil
+}
+
+// Sample 将音视频帧转换为sample, 时间戳换算为轨道timescale, Duration由SampleQueue填写
+// 返回ok为false表示不是该轨道的媒体数据(sequence header, end of sequence等)
+func (t *Track) Sample(pkt *av.Packet) (s Sample, ok bool) {
+	s.DTS = uint64(pkt.Timestamp) * uint64(t.Timescale) / 1000
+
+	switch t.Kind {
+	case VideoTrack:
+		vh, isVideo := pkt.PacketHeader.(av.VideoPacketHeader)
+		if pkt.PacketType != av.VideoType || !isVideo || vh.IsSequenceHeader() || len(pkt.Data) <= flvVideoHeaderLen {
+			return s, false
+		}
+		if pkt.Data[1] != 1 { // 只有NALU
+			return s, false
+		}
+		s.Keyframe = vh.IsKeyFrame()
+		s.CompositionOffset = int32(int64(vh.CompostioinTime()) * int64(t.Timescale) / 1000)
+		s.Data = pkt.Data[flvVideoHeaderLen:]
+
+	case AudioTrack:
+		ah, isAudio := pkt.PacketHeader.(av.AudioPacketHeader)
+		if pkt.PacketType != av.AudioType || !isAudio || ah.SoundFormat() != flvSoundAac || ah.AACPacketType() != 1 {
+			return s, false
+		}
+		s.Keyframe = true
+		s.Data = pkt.Data[flvAacHeaderLen:]
+	}
+
+	return s, true
+}
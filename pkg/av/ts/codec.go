@@ -0,0 +1,176 @@
+package ts
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+var startCode = []byte{0, 0, 0, 1}
+
+// audNalu access unit delimiter, 每个视频帧之前插入
+var audNalu = []byte{0, 0, 0, 1, 0x09, 0xf0}
+
+const (
+	naluTypeIdr = 5
+	naluTypeSps = 7
+	naluTypePps = 8
+	naluTypeAud = 9
+)
+
+// avcConfig AVCDecoderConfigurationRecord中解析出的参数
+type avcConfig struct {
+	lengthSize int
+	sps        [][]byte
+	pps        [][]byte
+}
+
+func parseAvcConfig(b []byte) (*avcConfig, error) {
+	if len(b) < 7 {
+		return nil, errors.Errorf("avc config too short: %d", len(b))
+	}
+
+	cfg := &avcConfig{lengthSize: int(b[4]&0x03) + 1}
+	if cfg.lengthSize == 3 {
+		return nil, errors.New("invalid avc nalu length size 3")
+	}
+
+	var err error
+	n := int(b[5] & 0x1f)
+	b = b[6:]
+	if cfg.sps, b, err = readParamSets(b, n); err != nil {
+		return nil, errors.Wrap(err, "sps")
+	}
+
+	if len(b) < 1 {
+		return nil, errors.New("avc config missing pps count")
+	}
+	if cfg.pps, _, err = readParamSets(b[1:], int(b[0])); err != nil {
+		return nil, errors.Wrap(err, "pps")
+	}
+
+	return cfg, nil
+}
+
+func readParamSets(b []byte, n int) ([][]byte, []byte, error) {
+	sets := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		if len(b) < 2 {
+			return nil, nil, errors.New("truncated")
+		}
+		size := int(binary.BigEndian.Uint16(b))
+		if len(b) < 2+size {
+			return nil, nil, errors.New("truncated")
+		}
+		sets = append(sets, b[2:2+size])
+		b = b[2+size:]
+	}
+	return sets, b, nil
+}
+
+// appendAnnexB 将AVCC格式(长度前缀)的NALU转为Annex-B格式追加到dst
+// 帧首插入AUD; IDR帧中没有SPS/PPS时在IDR之前插入sequence header中的SPS/PPS; enc不为nil时加密slice NALU
+func (c *avcConfig) appendAnnexB(dst, avcc []byte, enc *sampleEncrypter) ([]byte, error) {
+	nalus := make([][]byte, 0, 4)
+	hasParams, hasIdr := false, false
+	for b := avcc; len(b) > 0; {
+		if len(b) < c.lengthSize {
+			return nil, errors.New("truncated nalu length")
+		}
+
+		size := 0
+		for _, v := range b[:c.lengthSize] {
+			size = size<<8 | int(v)
+		}
+		b = b[c.lengthSize:]
+		if size > len(b) {
+			return nil, errors.Errorf("nalu size %d exceeds remaining %d", size, len(b))
+		}
+
+		nalu := b[:size]
+		b = b[size:]
+		if len(nalu) == 0 {
+			continue
+		}
+
+		switch nalu[0] & 0x1f {
+		case naluTypeAud:
+			continue
+		case naluTypeSps, naluTypePps:
+			hasParams = true
+		case naluTypeIdr:
+			hasIdr = true
+		}
+		nalus = append(nalus, nalu)
+	}
+
+	dst = append(dst, audNalu...)
+	paramsSent := hasParams || !hasIdr
+	for _, nalu := range nalus {
+		if !paramsSent && nalu[0]&0x1f == naluTypeIdr {
+			for _, ps := range [][][]byte{c.sps, c.pps} {
+				for _, p := range ps {
+					dst = append(append(dst, startCode...), p...)
+				}
+			}
+			paramsSent = true
+		}
+		dst = append(dst, startCode...)
+		if enc != nil {
+			dst = enc.appendAvcNalu(dst, nalu)
+		} else {
+			dst = append(dst, nalu...)
+		}
+	}
+
+	return dst, nil
+}
+
+// aacConfig AudioSpecificConfig中解析出的ADTS所需参数
+type aacConfig struct {
+	profile      uint8 // ADTS profile(audioObjectType-1)
+	freqIndex    uint8
+	channelCount uint8
+}
+
+// aacFreqIndexCount 可用的采样率索引数(96000 ~ 7350Hz)
+const aacFreqIndexCount = 13
+
+func parseAacConfig(b []byte) (*aacConfig, error) {
+	if len(b) < 2 {
+		return nil, errors.Errorf("aac config too short: %d", len(b))
+	}
+
+	objectType := b[0] >> 3
+	freqIndex := (b[0]&0x07)<<1 | b[1]>>7
+	channel := (b[1] >> 3) & 0x0f
+	if freqIndex >= aacFreqIndexCount {
+		return nil, errors.Errorf("unsupported aac sampling frequency index %d", freqIndex)
+	}
+
+	// ADTS只能表示前4种profile, HE-AAC等以LC + 隐式SBR表示
+	profile := uint8(1)
+	if objectType >= 1 && objectType <= 4 {
+		profile = objectType - 1
+	}
+
+	return &aacConfig{profile: profile, freqIndex: freqIndex, channelCount: channel}, nil
+}
+
+// adtsHeaderLen 无CRC的ADTS头长度
+const adtsHeaderLen = 7
+
+// appendAdts 追加ADTS头及raw AAC帧
+func (c *aacConfig) appendAdts(dst, raw []byte) []byte {
+	frameLen := adtsHeaderLen + len(raw)
+	dst = append(dst,
+		0xff,
+		0xf1, // MPEG-4, layer 0, 无CRC
+		c.profile<<6|c.freqIndex<<2|c.channelCount>>2,
+		(c.channelCount&0x03)<<6|byte(frameLen>>11),
+		byte(frameLen>>3),
+		byte(frameLen&0x07)<<5|0x1f,
+		0xfc,
+	)
+	return append(dst, raw...)
+}
@@ -0,0 +1,26 @@
+package ts
+
+// PSI section使用的CRC-32/MPEG-2(多项式0x04C11DB7, 不反转, 无最终异或)
+var crcTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func crc32(b []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, v := range b {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^v]
+	}
+	return crc
+}
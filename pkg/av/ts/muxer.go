@@ -0,0 +1,447 @@
+package ts
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"fastlive/pkg/av"
+)
+
+/*
+MPEG-TS封装: 输入FLV格式的av.Packet(AVCC H.264, raw AAC, MP3), 输出188字节的TS包
+1. 单节目, PAT/PMT由调用方通过WriteTables写入(HLS切片开头); 连续输出(HTTP-TS/UDP)可用WithTableInterval自动写入
+2. 视频转为Annex-B并在帧首插入AUD, IDR前补充SPS/PPS; AAC加ADTS头
+3. PTS/DTS为90kHz时钟, DTS取packet时间戳, PTS = DTS + CompostioinTime; PCR取DTS
+4. 可选SAMPLE-AES加密(SetSampleEncryption), 见sampleaes.go
+*/
+
+const PacketSize = 188
+
+const (
+	pidPat   = 0x0000
+	pidPmt   = 0x1000
+	pidVideo = 0x0100
+	pidAudio = 0x0101
+
+	streamTypeH264 = 0x1b
+	streamTypeAac  = 0x0f
+	streamTypeMp3  = 0x03
+
+	streamIdVideo = 0xe0
+	streamIdAudio = 0xc0
+)
+
+// FLV中的编码ID
+const (
+	flvCodecAvc     = 7
+	flvSoundMp3     = 2
+	flvSoundAac     = 10
+	flvAvcEndOfSeq  = 2
+	flvAvcHeaderLen = 5 // FrameType/CodecID, AVCPacketType, CompositionTime
+	flvAacHeaderLen = 2 // SoundFormat..., AACPacketType
+)
+
+var ErrUnsupportedCodec = errors.New("ts: unsupported codec")
+
+// Muxer 单个输出流的TS封装状态(sequence header, 连续计数器), 非并发安全
+type Muxer struct {
+	w io.Writer
+
+	avc         *avcConfig
+	aac         *aacConfig
+	audioFormat uint8 // FLV SoundFormat, 0表示尚未收到音频
+
+	// 最近一次写入的PMT中包含的流, 不在PMT中的流不输出
+	pmtVideo     bool
+	pmtAudioType byte // 0表示无音频
+	pmtVersion   uint8
+	pmtWritten   bool
+
+	// SAMPLE-AES: nextEncrypter在WriteTables时生效, 与PMT中的stream_type保持一致
+	encrypter     *sampleEncrypter
+	nextEncrypter *sampleEncrypter
+
+	tableInterval time.Duration // 大于0时自动写入PAT/PMT
+	lastTables    uint32        // 最近一次自动写入PAT/PMT时的packet时间戳(ms)
+
+	cc  map[uint16]uint8 // 各PID的continuity_counter
+	es  []byte           // 当前帧的ES数据
+	out []byte           // 当前帧的TS包, 一次写入
+}
+
+func NewMuxer(w io.Writer, opts ...muxerOption) *Muxer {
+	m := &Muxer{
+		w:  w,
+		cc: make(map[uint16]uint8, 4),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+type muxerOption func(*Muxer)
+
+// WithTableInterval 连续输出时自动写入PAT/PMT: 第一帧、编码变化、视频关键帧之前, 以及距上次超过interval时
+func WithTableInterval(interval time.Duration) muxerOption {
+	return func(m *Muxer) {
+		m.tableInterval = interval
+	}
+}
+
+// WriteTables 写入PAT/PMT, PMT包含已收到sequence header的音视频流; 流发生变化时PMT版本号递增
+func (m *Muxer) WriteTables() error {
+	video, audioType := m.avc != nil, m.audioStreamType()
+	if m.pmtWritten && m.streamsChanged() {
+		m.pmtVersion = (m.pmtVersion + 1) & 0x1f
+	}
+	m.pmtVideo, m.pmtAudioType, m.pmtWritten = video, audioType, true
+	m.encrypter = m.nextEncrypter
+
+	m.out = m.out[:0]
+	m.appendSection(pidPat, m.patSection())
+	m.appendSection(pidPmt, m.pmtSection())
+	return m.flush()
+}
+
+// WritePacket 封装一个音视频packet, sequence header只更新编码参数; metadata及不在PMT中的流忽略
+func (m *Muxer) WritePacket(pkt *av.Packet) error {
+	if pkt.PacketType != av.VideoType && pkt.PacketType != av.AudioType {
+		return nil
+	}
+
+	// mp3没有sequence header, 由首帧确定
+	if ah, ok := pkt.PacketHeader.(av.AudioPacketHeader); ok && pkt.PacketType == av.AudioType && ah.SoundFormat() == flvSoundMp3 {
+		m.audioFormat = flvSoundMp3
+	}
+
+	if m.tableInterval > 0 && m.tablesDue(pkt) {
+		if err := m.WriteTables(); err != nil {
+			return err
+		}
+		m.lastTables = pkt.Timestamp
+	}
+
+	if pkt.PacketType == av.VideoType {
+		return m.writeVideo(pkt)
+	}
+	return m.writeAudio(pkt)
+}
+
+// tablesDue 自动写入PAT/PMT的时机, sequence header本身不触发
+func (m *Muxer) tablesDue(pkt *av.Packet) bool {
+	keyFrame := false
+	if pkt.PacketType == av.VideoType {
+		vh, ok := pkt.PacketHeader.(av.VideoPacketHeader)
+		if !ok || vh.IsSequenceHeader() {
+			return false
+		}
+		keyFrame = vh.IsKeyFrame()
+	} else if ah, ok := pkt.PacketHeader.(av.AudioPacketHeader); ok && ah.SoundFormat() == flvSoundAac && ah.AACPacketType() == 0 {
+		return false
+	}
+
+	return !m.pmtWritten || keyFrame || m.streamsChanged() || pkt.Timestamp < m.lastTables ||
+		time.Duration(pkt.Timestamp-m.lastTables)*time.Millisecond >= m.tableInterval
+}
+
+// audioStreamType 按已收到的音频确定PMT中的stream_type, 0表示无音频
+func (m *Muxer) audioStreamType() byte {
+	switch {
+	case m.aac != nil:
+		return streamTypeAac
+	case m.audioFormat == flvSoundMp3:
+		return streamTypeMp3
+	default:
+		return 0
+	}
+}
+
+// streamsChanged 收到新的sequence header后与上次写入的PMT不一致
+func (m *Muxer) streamsChanged() bool {
+	return (m.avc != nil) != m.pmtVideo || m.audioStreamType() != m.pmtAudioType ||
+		(m.nextEncrypter != nil) != (m.encrypter != nil)
+}
+
+func (m *Muxer) writeVideo(pkt *av.Packet) error {
+	vh, ok := pkt.PacketHeader.(av.VideoPacketHeader)
+	if !ok {
+		return errors.New("ts: video packet header required")
+	}
+	if vh.CodecID() != flvCodecAvc {
+		return errors.Wrapf(ErrUnsupportedCodec, "video codec id %d", vh.CodecID())
+	}
+	if len(pkt.Data) < flvAvcHeaderLen {
+		return errors.Errorf("ts: video packet too short: %d", len(pkt.Data))
+	}
+
+	if vh.IsSequenceHeader() {
+		avc, err := parseAvcConfig(pkt.Data[flvAvcHeaderLen:])
+		if err != nil {
+			return errors.Wrap(err, "ts: parse avc sequence header")
+		}
+		m.avc = avc
+		return nil
+	}
+
+	if pkt.Data[1] == flvAvcEndOfSeq || !m.pmtVideo || m.avc == nil {
+		return nil
+	}
+
+	var err error
+	if m.es, err = m.avc.appendAnnexB(m.es[:0], pkt.Data[flvAvcHeaderLen:], m.encrypter); err != nil {
+		return errors.Wrap(err, "ts: convert avc to annex-b")
+	}
+
+	dts := uint64(pkt.Timestamp) * 90
+	pts := uint64(int64(dts) + int64(vh.CompostioinTime())*90)
+
+	m.out = m.out[:0]
+	m.appendPes(pidVideo, streamIdVideo, pts, dts, true, vh.IsKeyFrame())
+	return m.flush()
+}
+
+func (m *Muxer) writeAudio(pkt *av.Packet) error {
+	ah, ok := pkt.PacketHeader.(av.AudioPacketHeader)
+	if !ok {
+		return errors.New("ts: audio packet header required")
+	}
+
+	m.es = m.es[:0]
+	switch ah.SoundFormat() {
+	case flvSoundAac:
+		if len(pkt.Data) < flvAacHeaderLen {
+			return errors.Errorf("ts: audio packet too short: %d", len(pkt.Data))
+		}
+
+		if ah.AACPacketType() == 0 {
+			aac, err := parseAacConfig(pkt.Data[flvAacHeaderLen:])
+			if err != nil {
+				return errors.Wrap(err, "ts: parse aac sequence header")
+			}
+			m.aac, m.audioFormat = aac, flvSoundAac
+			return nil
+		}
+
+		if m.pmtAudioType != streamTypeAac || m.aac == nil {
+			return nil
+		}
+		m.es = m.aac.appendAdts(m.es, pkt.Data[flvAacHeaderLen:])
+		if m.encrypter != nil {
+			m.encrypter.encryptAdts(m.es, adtsHeaderLen)
+		}
+	case flvSoundMp3:
+		if m.pmtAudioType != streamTypeMp3 || len(pkt.Data) < 2 {
+			return nil
+		}
+		m.es = append(m.es, pkt.Data[1:]...)
+	default:
+		return errors.Wrapf(ErrUnsupportedCodec, "sound format %d", ah.SoundFormat())
+	}
+
+	pts := uint64(pkt.Timestamp) * 90
+
+	m.out = m.out[:0]
+	m.appendPes(pidAudio, streamIdAudio, pts, pts, !m.pmtVideo, false)
+	return m.flush()
+}
+
+func (m *Muxer) flush() error {
+	if len(m.out) == 0 {
+		return nil
+	}
+	_, err := m.w.Write(m.out)
+	return err
+}
+
+func (m *Muxer) nextCC(pid uint16) uint8 {
+	cc := m.cc[pid]
+	m.cc[pid] = (cc + 1) & 0x0f
+	return cc
+}
+
+func (m *Muxer) patSection() []byte {
+	return []byte{
+		0x00,       // table_id
+		0xb0, 0x0d, // section_syntax_indicator, section_length
+		0x00, 0x01, // transport_stream_id
+		0xc1,       // version 0, current_next_indicator
+		0x00, 0x00, // section_number, last_section_number
+		0x00, 0x01, // program_number
+		0xe0 | pidPmt>>8, pidPmt & 0xff,
+	}
+}
+
+func (m *Muxer) pmtSection() []byte {
+	pcrPid := uint16(pidVideo)
+	if !m.pmtVideo && m.pmtAudioType != 0 {
+		pcrPid = pidAudio
+	}
+
+	b := []byte{
+		0x02,       // table_id
+		0xb0, 0x00, // section_length稍后填写
+		0x00, 0x01, // program_number
+		0xc1 | m.pmtVersion<<1,
+		0x00, 0x00,
+		0xe0 | byte(pcrPid>>8), byte(pcrPid),
+		0xf0, 0x00, // program_info_length
+	}
+	if m.pmtVideo {
+		b = m.appendEs(b, streamTypeH264, pidVideo)
+	}
+	if m.pmtAudioType != 0 {
+		b = m.appendEs(b, m.pmtAudioType, pidAudio)
+	}
+
+	sectionLen := len(b) - 3 + 4 // 含CRC
+	b[1] |= byte(sectionLen >> 8)
+	b[2] = byte(sectionLen)
+	return b
+}
+
+// appendEs PMT中的一个ES, 加密时替换为SAMPLE-AES的stream_type及描述符
+func (m *Muxer) appendEs(b []byte, streamType byte, pid uint16) []byte {
+	var descriptors []byte
+	if m.encrypter != nil {
+		switch streamType {
+		case streamTypeH264:
+			streamType = streamTypeH264SampleAes
+		case streamTypeAac:
+			streamType = streamTypeAacSampleAes
+		}
+		descriptors = m.sampleAesDescriptors(streamType)
+	}
+
+	b = append(b, streamType, 0xe0|byte(pid>>8), byte(pid), 0xf0|byte(len(descriptors)>>8), byte(len(descriptors)))
+	return append(b, descriptors...)
+}
+
+// appendSection 将PSI section(追加CRC)作为单个TS包输出, 剩余部分填充0xff
+func (m *Muxer) appendSection(pid uint16, section []byte) {
+	var pkt [PacketSize]byte
+	pkt[0] = 0x47
+	pkt[1] = 0x40 | byte(pid>>8) // payload_unit_start_indicator
+	pkt[2] = byte(pid)
+	pkt[3] = 0x10 | m.nextCC(pid) // 仅payload
+	pkt[4] = 0x00                 // pointer_field
+
+	n := 5 + copy(pkt[5:], section)
+	binary.BigEndian.PutUint32(pkt[n:], crc32(section))
+	for i := n + 4; i < PacketSize; i++ {
+		pkt[i] = 0xff
+	}
+
+	m.out = append(m.out, pkt[:]...)
+}
+
+// appendPes 将m.es封装为PES并切分为TS包; withPcr时第一个TS包携带PCR, randomAccess标记关键帧
+func (m *Muxer) appendPes(pid uint16, streamId byte, pts, dts uint64, withPcr, randomAccess bool) {
+	pts &= 0x1ffffffff
+	dts &= 0x1ffffffff
+
+	var hdr [19]byte
+	hdr[2], hdr[3] = 0x01, streamId
+	hdr[6] = 0x80 // marker bits
+	n := 9
+	if pts != dts {
+		hdr[7], hdr[8] = 0xc0, 10
+		putTimestamp(hdr[9:], 0x30, pts)
+		putTimestamp(hdr[14:], 0x10, dts)
+		n = 19
+	} else {
+		hdr[7], hdr[8] = 0x80, 5
+		putTimestamp(hdr[9:], 0x20, pts)
+		n = 14
+	}
+
+	// PES_packet_length超过16位时为0(仅视频允许)
+	if pesLen := n - 6 + len(m.es); pesLen <= 0xffff {
+		binary.BigEndian.PutUint16(hdr[4:], uint16(pesLen))
+	}
+
+	payload := append(hdr[:n:n], m.es...)
+	first := true
+	for len(payload) > 0 {
+		var pkt [PacketSize]byte
+		pkt[0] = 0x47
+		pkt[1] = byte(pid>>8) & 0x1f
+		if first {
+			pkt[1] |= 0x40
+		}
+		pkt[2] = byte(pid)
+
+		// adaptation field: PCR/random_access_indicator, 以及最后一个包的填充
+		flags := byte(0)
+		afLen := -1 // 不含adaptation_field_length本身, -1表示没有adaptation field
+		if first && (withPcr || randomAccess) {
+			afLen = 1
+			if randomAccess {
+				flags |= 0x40
+			}
+			if withPcr {
+				flags |= 0x10
+				afLen += 6
+			}
+		}
+
+		space := PacketSize - 4
+		if afLen >= 0 {
+			space -= 1 + afLen
+		}
+		if len(payload) < space {
+			if afLen < 0 {
+				afLen = space - len(payload) - 1
+			} else {
+				afLen += space - len(payload)
+			}
+			space = len(payload)
+		}
+
+		if afLen >= 0 {
+			pkt[3] = 0x30 | m.nextCC(pid)
+			pkt[4] = byte(afLen)
+			if afLen > 0 {
+				pkt[5] = flags
+				i := 6
+				if flags&0x10 != 0 {
+					putPcr(pkt[6:], dts)
+					i += 6
+				}
+				for ; i < 5+afLen; i++ {
+					pkt[i] = 0xff
+				}
+			}
+		} else {
+			pkt[3] = 0x10 | m.nextCC(pid)
+		}
+
+		copy(pkt[PacketSize-space:], payload[:space])
+		payload = payload[space:]
+		first = false
+
+		m.out = append(m.out, pkt[:]...)
+	}
+}
+
+// putTimestamp PES中的PTS/DTS(33位), prefix为'0010'/'0011'/'0001'
+func putTimestamp(b []byte, prefix byte, ts uint64) {
+	b[0] = prefix | byte(ts>>29)&0x0e | 0x01
+	b[1] = byte(ts >> 22)
+	b[2] = byte(ts>>14)&0xfe | 0x01
+	b[3] = byte(ts >> 7)
+	b[4] = byte(ts<<1)&0xfe | 0x01
+}
+
+// putPcr program_clock_reference_base(33位), extension为0
+func putPcr(b []byte, base uint64) {
+	b[0] = byte(base >> 25)
+	b[1] = byte(base >> 17)
+	b[2] = byte(base >> 9)
+	b[3] = byte(base >> 1)
+	b[4] = byte(base<<7)&0x80 | 0x7e
+	b[5] = 0x00
+}
@@ -0,0 +1,209 @@
+package ts
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"fastlive/pkg/av"
+	"fastlive/pkg/av/flv"
+)
+
+// go test ./pkg/av/ts -update 重新生成testdata中的golden文件
+var update = flag.Bool("update", false, "update golden files")
+
+var (
+	testSps = []byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10}
+	testPps = []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}
+	testAsc = []byte{0x12, 0x10} // AAC LC, 44100Hz, stereo
+)
+
+func newTestPacket(t *testing.T, typ av.AVPacketType, timestamp uint32, data []byte) *av.Packet {
+	pkt := av.NewPacket(av.WithPacketType(typ), av.WithPacketTimestamp(timestamp), av.WithPacketData(data))
+	if err := flv.NewDemuxer().DecodeHeader(pkt); err != nil {
+		t.Fatal(err)
+	}
+	return pkt
+}
+
+func avcSeqHeader(t *testing.T) *av.Packet {
+	b := []byte{0x17, 0, 0, 0, 0, 1, testSps[1], testSps[2], testSps[3], 0xff, 0xe1, 0, byte(len(testSps))}
+	b = append(b, testSps...)
+	b = append(b, 1, 0, byte(len(testPps)))
+	b = append(b, testPps...)
+	return newTestPacket(t, av.VideoType, 0, b)
+}
+
+// avcFrame 4字节长度前缀的NALU, cts为CompositionTime(ms)
+func avcFrame(t *testing.T, timestamp uint32, key bool, cts int, nalus ...[]byte) *av.Packet {
+	b := []byte{0x27, 1, byte(cts >> 16), byte(cts >> 8), byte(cts)}
+	if key {
+		b[0] = 0x17
+	}
+	for _, nalu := range nalus {
+		b = append(b, byte(len(nalu)>>24), byte(len(nalu)>>16), byte(len(nalu)>>8), byte(len(nalu)))
+		b = append(b, nalu...)
+	}
+	return newTestPacket(t, av.VideoType, timestamp, b)
+}
+
+func aacSeqHeader(t *testing.T) *av.Packet {
+	return newTestPacket(t, av.AudioType, 0, append([]byte{0xaf, 0}, testAsc...))
+}
+
+func aacFrame(t *testing.T, timestamp uint32, size int) *av.Packet {
+	return newTestPacket(t, av.AudioType, timestamp, append([]byte{0xaf, 1}, pattern(size)...))
+}
+
+func nalu(typ byte, size int) []byte {
+	return append([]byte{typ}, pattern(size-1)...)
+}
+
+func pattern(size int) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+func TestMuxerGolden(t *testing.T) {
+	cases := []struct {
+		name    string
+		opts    []muxerOption
+		packets func(t *testing.T) []*av.Packet
+		tables  bool // 先写入PAT/PMT(HLS切片方式)
+	}{
+		{
+			name:   "h264_aac",
+			tables: true,
+			packets: func(t *testing.T) []*av.Packet {
+				return []*av.Packet{
+					avcFrame(t, 0, true, 80, nalu(0x06, 20), nalu(0x65, 600)), // 无SPS/PPS的IDR
+					aacFrame(t, 0, 180),
+					avcFrame(t, 40, false, 120, nalu(0x41, 300)),
+					aacFrame(t, 23, 2),
+					avcFrame(t, 80, false, 0, nalu(0x01, 182)),
+					avcFrame(t, 120, true, 80, nalu(0x09, 2), testSps, testPps, nalu(0x65, 400)), // 自带SPS/PPS及AUD
+				}
+			},
+		},
+		{
+			name:   "aac_only",
+			tables: true,
+			packets: func(t *testing.T) []*av.Packet {
+				return []*av.Packet{aacFrame(t, 0, 300), aacFrame(t, 23, 250), aacFrame(t, 46, 1)}
+			},
+		},
+		{
+			name: "continuous",
+			opts: []muxerOption{WithTableInterval(100 * time.Millisecond)},
+			packets: func(t *testing.T) []*av.Packet {
+				pkts := []*av.Packet{avcFrame(t, 0, true, 0, nalu(0x65, 200))}
+				for ts := uint32(40); ts <= 200; ts += 40 {
+					pkts = append(pkts, avcFrame(t, ts, false, 0, nalu(0x41, 50)), aacFrame(t, ts, 30))
+				}
+				return append(pkts, avcFrame(t, 240, true, 0, nalu(0x65, 200)))
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			m := NewMuxer(&buf, c.opts...)
+
+			pkts := []*av.Packet{avcSeqHeader(t), aacSeqHeader(t)}
+			if c.name == "aac_only" {
+				pkts = pkts[1:]
+			}
+			for _, pkt := range pkts {
+				assert.Nil(t, m.WritePacket(pkt))
+			}
+			assert.Equal(t, 0, buf.Len(), "sequence header produces no output")
+
+			if c.tables {
+				assert.Nil(t, m.WriteTables())
+			}
+			for _, pkt := range c.packets(t) {
+				assert.Nil(t, m.WritePacket(pkt))
+			}
+
+			out := buf.Bytes()
+			if assert.Equal(t, 0, len(out)%PacketSize) {
+				for i := 0; i < len(out); i += PacketSize {
+					assert.Equal(t, byte(0x47), out[i], "sync byte of packet %d", i/PacketSize)
+				}
+			}
+
+			golden := filepath.Join("testdata", c.name+".ts")
+			if *update {
+				if err := ioutil.WriteFile(golden, out, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			expected, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.True(t, bytes.Equal(expected, out), "output differs from %s", golden)
+		})
+	}
+}
+
+func TestAppendAnnexB(t *testing.T) {
+	cfg, err := parseAvcConfig(avcSeqHeader(t).Data[flvAvcHeaderLen:])
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, 4, cfg.lengthSize)
+
+	annexB := func(nalus ...[]byte) []byte {
+		b := append([]byte(nil), audNalu...)
+		for _, n := range nalus {
+			b = append(append(b, startCode...), n...)
+		}
+		return b
+	}
+
+	sei, idr, p := nalu(0x06, 3), nalu(0x65, 5), nalu(0x41, 5)
+
+	out, err := cfg.appendAnnexB(nil, avcFrame(t, 0, true, 0, sei, idr).Data[flvAvcHeaderLen:], nil)
+	assert.Nil(t, err)
+	assert.Equal(t, annexB(sei, testSps, testPps, idr), out, "sps/pps inserted before idr")
+
+	out, err = cfg.appendAnnexB(nil, avcFrame(t, 0, true, 0, nalu(0x09, 2), testSps, testPps, idr).Data[flvAvcHeaderLen:], nil)
+	assert.Nil(t, err)
+	assert.Equal(t, annexB(testSps, testPps, idr), out, "existing sps/pps kept, aud replaced")
+
+	out, err = cfg.appendAnnexB(nil, avcFrame(t, 0, false, 0, p).Data[flvAvcHeaderLen:], nil)
+	assert.Nil(t, err)
+	assert.Equal(t, annexB(p), out)
+
+	_, err = cfg.appendAnnexB(nil, []byte{0, 0, 0, 9, 0x41}, nil)
+	assert.NotNil(t, err, "truncated nalu")
+}
+
+func TestAppendAdts(t *testing.T) {
+	cfg, err := parseAacConfig(testAsc)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	out := cfg.appendAdts(nil, []byte{1, 2, 3})
+	assert.Equal(t, []byte{0xff, 0xf1, 0x50, 0x80, 0x01, 0x5f, 0xfc, 1, 2, 3}, out)
+
+	_, err = parseAacConfig([]byte{0x17, 0x90}) // 采样率索引15
+	assert.NotNil(t, err)
+}
+
+func TestCrc32(t *testing.T) {
+	// CRC-32/MPEG-2 check value
+	assert.Equal(t, uint32(0x0376e6e7), crc32([]byte("123456789")))
+}
@@ -0,0 +1,149 @@
+package ts
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+
+	"github.com/pkg/errors"
+)
+
+/*
+SAMPLE-AES(Apple MPEG-2 Stream Encryption Format for HTTP Live Streaming):
+1. H.264: 只加密长度大于48字节的slice NALU(type 1/5), 去除防竞争字节后前32字节明文, 之后每16字节加密块跟随最多144字节明文, 不足16字节的尾部为明文, 加密后重新插入防竞争字节
+2. AAC: ADTS头及之后16字节明文, 其后完整的16字节块加密, 尾部不足16字节为明文
+3. 每个NALU/ADTS帧的CBC链从IV重新开始
+4. PMT中视频stream_type为0xdb, AAC为0xcf, 并带有private_data_indicator及audio setup描述符; MP3不加密
+*/
+
+const (
+	streamTypeH264SampleAes = 0xdb
+	streamTypeAacSampleAes  = 0xcf
+
+	sampleAesVideoLeader = 32  // 含NALU头
+	sampleAesAudioLeader = 16  // 不含ADTS头
+	sampleAesMinNalu     = 48  // 不超过该长度的NALU不加密
+	sampleAesClearBlock  = 144 // 每个加密块之后的明文长度
+)
+
+// sampleEncrypter SAMPLE-AES加密状态
+type sampleEncrypter struct {
+	block cipher.Block
+	iv    []byte
+	raw   []byte // 去除防竞争字节后的NALU
+}
+
+func newSampleEncrypter(key, iv []byte) (*sampleEncrypter, error) {
+	if len(iv) != aes.BlockSize {
+		return nil, errors.Errorf("ts: sample-aes iv length %d", len(iv))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "ts: sample-aes key")
+	}
+	return &sampleEncrypter{block: block, iv: append([]byte(nil), iv...)}, nil
+}
+
+// appendAvcNalu 追加NALU, slice NALU按SAMPLE-AES规则加密
+func (e *sampleEncrypter) appendAvcNalu(dst, nalu []byte) []byte {
+	typ := nalu[0] & 0x1f
+	if typ != 1 && typ != naluTypeIdr || len(nalu) <= sampleAesMinNalu {
+		return append(dst, nalu...)
+	}
+
+	e.raw = unescapeNalu(e.raw[:0], nalu)
+	raw := e.raw
+	mode := cipher.NewCBCEncrypter(e.block, e.iv)
+	for p := sampleAesVideoLeader; p < len(raw); {
+		if len(raw)-p > aes.BlockSize {
+			mode.CryptBlocks(raw[p:p+aes.BlockSize], raw[p:p+aes.BlockSize])
+			p += aes.BlockSize
+		}
+		clear := len(raw) - p
+		if clear > sampleAesClearBlock {
+			clear = sampleAesClearBlock
+		}
+		p += clear
+	}
+	return escapeNalu(dst, raw)
+}
+
+// encryptAdts 原地加密一个ADTS帧, headerLen为ADTS头长度
+func (e *sampleEncrypter) encryptAdts(frame []byte, headerLen int) {
+	if len(frame) <= headerLen+sampleAesAudioLeader {
+		return
+	}
+	p := frame[headerLen+sampleAesAudioLeader:]
+	n := len(p) &^ (aes.BlockSize - 1)
+	if n > 0 {
+		cipher.NewCBCEncrypter(e.block, e.iv).CryptBlocks(p[:n], p[:n])
+	}
+}
+
+// unescapeNalu 去除防竞争字节(00 00 03中的03)
+func unescapeNalu(dst, nalu []byte) []byte {
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		dst = append(dst, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return dst
+}
+
+// escapeNalu 插入防竞争字节, 以00结尾时追加03
+func escapeNalu(dst, raw []byte) []byte {
+	zeros := 0
+	for _, b := range raw {
+		if zeros >= 2 && b <= 0x03 {
+			dst = append(dst, 0x03)
+			zeros = 0
+		}
+		dst = append(dst, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	if len(raw) > 0 && raw[len(raw)-1] == 0 {
+		dst = append(dst, 0x03)
+	}
+	return dst
+}
+
+// sampleAesDescriptors PMT中加密流的ES描述符
+func (m *Muxer) sampleAesDescriptors(streamType byte) []byte {
+	switch streamType {
+	case streamTypeH264SampleAes:
+		return []byte{0x0f, 4, 'z', 'a', 'v', 'c'} // private_data_indicator_descriptor
+	case streamTypeAacSampleAes:
+		// registration_descriptor('apad')携带audio_setup_information: audio_type, priming, version, setup_data(ADTS头)
+		setup := m.aac.appendAdts(nil, nil)
+		b := []byte{0x0f, 4, 'a', 'a', 'c', 'd', 0x05, byte(4 + 4 + 4 + len(setup)), 'a', 'p', 'a', 'd', 'z', 'a', 'a', 'c', 0, 0, 0, byte(len(setup))}
+		return append(b, setup...)
+	default:
+		return nil
+	}
+}
+
+// SetSampleEncryption 设置SAMPLE-AES的key及IV(各16字节), key为nil时不加密; 在下一次WriteTables时生效
+func (m *Muxer) SetSampleEncryption(key, iv []byte) error {
+	if key == nil {
+		m.nextEncrypter = nil
+		return nil
+	}
+
+	e, err := newSampleEncrypter(key, iv)
+	if err != nil {
+		return err
+	}
+	m.nextEncrypter = e
+	return nil
+}
@@ -0,0 +1,119 @@
+package ts
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testKey = []byte("0123456789abcdef")
+	testIv  = []byte("fedcba9876543210")
+)
+
+// decryptNalu 按规范解密一个SAMPLE-AES NALU
+func decryptNalu(t *testing.T, nalu []byte) []byte {
+	block, err := aes.NewCipher(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := unescapeNalu(nil, nalu)
+	mode := cipher.NewCBCDecrypter(block, testIv)
+	for p := 32; p < len(raw); {
+		if len(raw)-p > 16 {
+			mode.CryptBlocks(raw[p:p+16], raw[p:p+16])
+			p += 16
+		}
+		n := len(raw) - p
+		if n > 144 {
+			n = 144
+		}
+		p += n
+	}
+	return escapeNalu(nil, raw)
+}
+
+func TestEscapeNalu(t *testing.T) {
+	raw := []byte{0x65, 0, 0, 0, 1, 0, 0, 2, 0, 0, 3, 0, 0, 4, 0, 0}
+	escaped := escapeNalu(nil, raw)
+	assert.Equal(t, []byte{0x65, 0, 0, 3, 0, 1, 0, 0, 3, 2, 0, 0, 3, 3, 0, 0, 4, 0, 0, 3}, escaped)
+	assert.Equal(t, raw, unescapeNalu(nil, escaped))
+}
+
+func TestSampleAesNalu(t *testing.T) {
+	e, err := newSampleEncrypter(testKey, testIv)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// 明文前导及加密区中都有防竞争字节
+	idr := nalu(0x65, 500)
+	copy(idr[10:], []byte{0, 0, 3, 1})
+	copy(idr[60:], []byte{0, 0, 3, 0, 0, 3, 2})
+	src := append([]byte(nil), idr...)
+
+	out := e.appendAvcNalu(nil, idr)
+	assert.Equal(t, src, idr, "input not modified")
+	assert.Equal(t, idr[:32], out[:32], "clear leader")
+	assert.NotEqual(t, idr, out)
+	assert.Equal(t, idr, decryptNalu(t, out))
+	for i := 2; i < len(out); i++ {
+		if out[i-2] == 0 && out[i-1] == 0 {
+			assert.True(t, out[i] >= 3, "no start code emulation at %d", i)
+		}
+	}
+
+	// 短NALU及非slice NALU不加密
+	for _, n := range [][]byte{nalu(0x41, 48), testSps, nalu(0x06, 300)} {
+		assert.Equal(t, n, e.appendAvcNalu(nil, n))
+	}
+}
+
+func TestSampleAesAdts(t *testing.T) {
+	e, err := newSampleEncrypter(testKey, testIv)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	frame := append(make([]byte, 7), pattern(16+40)...)
+	src := append([]byte(nil), frame...)
+	e.encryptAdts(frame, 7)
+	assert.Equal(t, src[:7+16], frame[:7+16], "header and leader in clear")
+	assert.Equal(t, src[7+16+32:], frame[7+16+32:], "partial block in clear")
+
+	block, _ := aes.NewCipher(testKey)
+	cipher.NewCBCDecrypter(block, testIv).CryptBlocks(frame[23:55], frame[23:55])
+	assert.Equal(t, src, frame)
+}
+
+func TestSampleAesMuxer(t *testing.T) {
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	assert.Nil(t, m.WritePacket(avcSeqHeader(t)))
+	assert.Nil(t, m.WritePacket(aacSeqHeader(t)))
+	assert.Nil(t, m.SetSampleEncryption(testKey, testIv))
+	assert.Nil(t, m.WriteTables())
+
+	pmt := buf.Bytes()[PacketSize:]
+	assert.True(t, bytes.Contains(pmt, []byte{streamTypeH264SampleAes, 0xe1, 0x00, 0xf0, 6, 0x0f, 4, 'z', 'a', 'v', 'c'}))
+	assert.True(t, bytes.Contains(pmt, []byte{streamTypeAacSampleAes, 0xe1, 0x01}))
+	assert.True(t, bytes.Contains(pmt, []byte("apadzaac")))
+
+	pkt := avcFrame(t, 0, true, 0, nalu(0x65, 300))
+	src := append([]byte(nil), pkt.Data...)
+	buf.Reset()
+	assert.Nil(t, m.WritePacket(pkt))
+	assert.Equal(t, src, pkt.Data, "packet data not modified")
+	assert.False(t, bytes.Contains(buf.Bytes(), src[9+40:9+80]), "slice encrypted")
+
+	// 关闭加密后PMT版本递增, stream_type恢复
+	assert.Nil(t, m.SetSampleEncryption(nil, nil))
+	buf.Reset()
+	assert.Nil(t, m.WriteTables())
+	pmt = buf.Bytes()[PacketSize:]
+	assert.Equal(t, byte(0xc3), pmt[10], "pmt version 1")
+	assert.True(t, bytes.Contains(pmt, []byte{streamTypeH264, 0xe1, 0x00, 0xf0, 0}))
+}
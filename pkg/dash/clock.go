@@ -0,0 +1,68 @@
+package dash
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+多码率组内各流共享的时间轴:
+1. 相同的availabilityStartTime, 以及相同的时间戳到媒体时间的偏移, 时间戳同源的流媒体时间一致, 切片时间($Time$)相同
+2. 第一个对齐的流按墙上时钟确定偏移, 之后的流沿用; 沿用会使媒体时间回退或与墙上时钟相差过大(时间戳不同源, 推流端重连)时重新确定
+*/
+
+// maxClockDrift 沿用共享偏移时媒体时间与墙上时钟的最大差距
+const maxClockDrift = 10 * time.Second
+
+// Clock 可被多个Stream并发使用
+type Clock struct {
+	mu        sync.Mutex
+	startTime time.Time
+	offset    int64
+	valid     bool
+}
+
+// NewClock startTime为零值时取第一个流开始的时间
+func NewClock(startTime time.Time) *Clock {
+	return &Clock{startTime: startTime}
+}
+
+// align 返回availabilityStartTime及timestamp对应的媒体时间偏移, 媒体时间不早于minMs
+func (c *Clock) align(timestamp uint32, minMs int64) (time.Time, int64) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.startTime.IsZero() {
+		c.startTime = now
+	}
+
+	if c.valid {
+		ms := int64(timestamp) + c.offset
+		drift := time.Duration(ms-wallClockMs(c.startTime, now)) * time.Millisecond
+		if ms >= minMs && drift <= maxClockDrift && drift >= -maxClockDrift {
+			return c.startTime, c.offset
+		}
+	}
+
+	c.offset = alignedOffset(c.startTime, now, timestamp, minMs)
+	c.valid = true
+	return c.startTime, c.offset
+}
+
+func wallClockMs(startTime, now time.Time) int64 {
+	return int64(now.Sub(startTime) / time.Millisecond)
+}
+
+// alignedOffset 媒体时间按墙上时钟对齐时的偏移, 不早于minMs
+func alignedOffset(startTime, now time.Time, timestamp uint32, minMs int64) int64 {
+	ms := wallClockMs(startTime, now)
+	if ms < minMs {
+		ms = minMs
+	}
+	if ms < 0 {
+		ms = 0
+	}
+	return ms - int64(timestamp)
+}
@@ -0,0 +1,200 @@
+package dash
+
+import (
+	"bytes"
+	"path"
+	"strconv"
+	"time"
+
+	"fastlive/pkg/av/fmp4"
+)
+
+// representation MPD中一个轨道的Representation
+type representation struct {
+	id       string
+	base     string // 切片相对于MPD的路径前缀, 如stream/
+	kind     string
+	track    *fmp4.Track
+	segments []Segment // MPD窗口内的切片
+}
+
+// manifest 一个流或多码率组的MPD, 音频和视频各一个adaptation set
+type manifest struct {
+	startTime       time.Time
+	segmentDuration time.Duration
+	window          int
+	video, audio    []representation
+}
+
+// representations 当前MPD窗口内有切片的轨道, Representation id为轨道类型
+func (s *Stream) representations() []representation {
+	var reps []representation
+	for _, t := range []*track{s.video, s.audio} {
+		if t == nil {
+			continue
+		}
+		segments := t.segments
+		if len(segments) > s.window {
+			segments = segments[len(segments)-s.window:]
+		}
+		if len(segments) == 0 {
+			continue
+		}
+		reps = append(reps, representation{
+			id:       t.kind,
+			base:     path.Base(s.name) + "/",
+			kind:     t.kind,
+			track:    t.track,
+			segments: append([]Segment(nil), segments...),
+		})
+	}
+	return reps
+}
+
+// renderManifest 生成dynamic MPD, 同时保存多码率组MPD使用的快照
+func (s *Stream) renderManifest(now time.Time) []byte {
+	reps := s.representations()
+	s.mu.Lock()
+	s.reps, s.repsStartTime = reps, s.startTime
+	s.mu.Unlock()
+
+	m := manifest{startTime: s.startTime, segmentDuration: s.segmentDuration, window: s.window}
+	m.add(reps)
+	return m.render(&s.mpd, now)
+}
+
+// GroupManifest 多码率组的MPD, 每个流的每个轨道为对应adaptation set中的一个Representation(id为{stream}-{kind})
+// 各流应使用同一个Clock, 没有可用的切片时返回nil
+func GroupManifest(streams []*Stream, now time.Time) []byte {
+	var m manifest
+	for _, s := range streams {
+		s.mu.Lock()
+		reps, startTime := s.reps, s.repsStartTime
+		s.mu.Unlock()
+		if len(reps) == 0 {
+			continue
+		}
+
+		if m.startTime.IsZero() {
+			m.startTime, m.segmentDuration, m.window = startTime, s.segmentDuration, s.window
+		}
+		for i := range reps {
+			reps[i].id = path.Base(s.name) + "-" + reps[i].kind
+		}
+		m.add(reps)
+	}
+
+	if m.startTime.IsZero() {
+		return nil
+	}
+	return m.render(new(bytes.Buffer), now)
+}
+
+func (m *manifest) add(reps []representation) {
+	for _, rep := range reps {
+		if rep.track.Kind == fmp4.VideoTrack {
+			m.video = append(m.video, rep)
+		} else {
+			m.audio = append(m.audio, rep)
+		}
+	}
+}
+
+func (m *manifest) render(b *bytes.Buffer, now time.Time) []byte {
+	b.Reset()
+
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	b.WriteString(`<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:isoff-live:2011" type="dynamic"`)
+	b.WriteString(` availabilityStartTime="` + formatTime(m.startTime) + `"`)
+	b.WriteString(` publishTime="` + formatTime(now) + `"`)
+	b.WriteString(` minimumUpdatePeriod="` + formatDuration(m.segmentDuration) + `"`)
+	b.WriteString(` minBufferTime="` + formatDuration(m.segmentDuration) + `"`)
+	b.WriteString(` timeShiftBufferDepth="` + formatDuration(m.segmentDuration*time.Duration(m.window)) + `"`)
+	b.WriteString(` suggestedPresentationDelay="` + formatDuration(m.segmentDuration*2) + `">` + "\n")
+	b.WriteString(`  <Period id="0" start="PT0S">` + "\n")
+
+	for i, reps := range [][]representation{m.video, m.audio} {
+		if len(reps) == 0 {
+			continue
+		}
+
+		kind := reps[0].kind
+		b.WriteString(`    <AdaptationSet id="` + strconv.Itoa(i) + `" contentType="` + kind + `" mimeType="` + kind + `/mp4" segmentAlignment="true" startWithSAP="1">` + "\n")
+		for _, rep := range reps {
+			writeRepresentation(b, rep)
+		}
+		b.WriteString("    </AdaptationSet>\n")
+	}
+
+	b.WriteString("  </Period>\n")
+	b.WriteString(`  <UTCTiming schemeIdUri="urn:mpeg:dash:utc:direct:2014" value="` + formatTime(now) + `"/>` + "\n")
+	b.WriteString("</MPD>\n")
+
+	return append([]byte(nil), b.Bytes()...)
+}
+
+func writeRepresentation(b *bytes.Buffer, rep representation) {
+	ft := rep.track
+	b.WriteString(`      <Representation id="` + rep.id + `" codecs="` + ft.Codec + `" bandwidth="` + strconv.Itoa(bandwidth(rep.segments, ft.Timescale)) + `"`)
+	if ft.Kind == fmp4.VideoTrack {
+		b.WriteString(` width="` + strconv.Itoa(ft.Width) + `" height="` + strconv.Itoa(ft.Height) + `">` + "\n")
+	} else {
+		b.WriteString(` audioSamplingRate="` + strconv.Itoa(ft.SampleRate) + `">` + "\n")
+		b.WriteString(`        <AudioChannelConfiguration schemeIdUri="urn:mpeg:dash:23003:3:audio_channel_configuration:2011" value="` + strconv.Itoa(ft.Channels) + `"/>` + "\n")
+	}
+
+	b.WriteString(`        <SegmentTemplate timescale="` + strconv.FormatUint(uint64(ft.Timescale), 10) + `"`)
+	b.WriteString(` initialization="` + rep.base + initUri(rep.kind) + `" media="` + rep.base + rep.kind + `-$Time$.m4s">` + "\n")
+	b.WriteString("          <SegmentTimeline>\n")
+	writeTimeline(b, rep.segments)
+	b.WriteString("          </SegmentTimeline>\n")
+	b.WriteString("        </SegmentTemplate>\n")
+	b.WriteString("      </Representation>\n")
+}
+
+// writeTimeline 连续且时长相同的切片合并为一个S元素(r为重复次数), 不连续时写出t
+func writeTimeline(b *bytes.Buffer, segments []Segment) {
+	for i := 0; i < len(segments); {
+		seg := segments[i]
+		repeat := 0
+		for j := i + 1; j < len(segments); j++ {
+			prev := segments[j-1]
+			if segments[j].Duration != seg.Duration || segments[j].Time != prev.Time+prev.Duration {
+				break
+			}
+			repeat++
+		}
+
+		b.WriteString(`            <S`)
+		if i == 0 || seg.Time != segments[i-1].Time+segments[i-1].Duration {
+			b.WriteString(` t="` + strconv.FormatUint(seg.Time, 10) + `"`)
+		}
+		b.WriteString(` d="` + strconv.FormatUint(seg.Duration, 10) + `"`)
+		if repeat > 0 {
+			b.WriteString(` r="` + strconv.Itoa(repeat) + `"`)
+		}
+		b.WriteString("/>\n")
+		i += repeat + 1
+	}
+}
+
+// bandwidth 切片的平均码率(bps)
+func bandwidth(segments []Segment, timescale uint32) int {
+	var size, duration uint64
+	for _, seg := range segments {
+		size += uint64(seg.Size)
+		duration += seg.Duration
+	}
+	if duration == 0 {
+		return 1
+	}
+	return int(size * 8 * uint64(timescale) / duration)
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func formatDuration(d time.Duration) string {
+	return "PT" + strconv.FormatFloat(d.Seconds(), 'f', 3, 64) + "S"
+}
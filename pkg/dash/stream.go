@@ -0,0 +1,396 @@
+package dash
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"fastlive/pkg/av"
+	"fastlive/pkg/av/fmp4"
+	"fastlive/pkg/hls"
+)
+
+/*
+单个流的DASH输出(dynamic MPD, SegmentTemplate + SegmentTimeline):
+1. 音频和视频为独立的adaptation set, 各自有init segment及fMP4切片
+2. 有视频时在达到目标时长后的第一个关键帧切片, 音频在同一时刻切片; 纯音频流按时长切片; 第一个关键帧之前的数据丢弃
+3. 媒体时间以availabilityStartTime为0点: 第一个packet及每次discontinuity(推流端重连, 时间戳回退, 编码参数变化)后按墙上时钟重新对齐, 时间轴保持单增
+4. MPD保留最近window个切片, 移出MPD的切片再保留keepSegments个后删除
+5. 设置Clock(多码率)时媒体时间由组内共享的Clock确定, 切片边界对齐到segmentDuration网格, 各rendition的切片时间相同
+*/
+
+const keepSegments = 2
+
+// Segment 已完成的切片, 时间单位为轨道timescale
+type Segment struct {
+	Time     uint64
+	Duration uint64
+	Size     int
+}
+
+// track 一个adaptation set的切片状态
+type track struct {
+	kind     string // video/audio, 同时用作Representation id及文件名前缀
+	track    *fmp4.Track
+	config   []byte // sequence header, 用于判断编码参数是否变化
+	queue    fmp4.SampleQueue
+	cur      []fmp4.Sample // 当前切片中时长已确定的sample
+	fragSeq  uint32
+	segments []Segment // 已完成的切片(含已移出MPD暂未删除的)
+	lastMs   int64     // 最近一个sample的媒体时间(ms)
+}
+
+// Stream 单个流的DASH切片状态, 非并发安全(由同一协程写入); 读取通过Store
+type Stream struct {
+	name            string // 存储中的名称前缀, 如vhost/app/stream
+	store           hls.Store
+	segmentDuration time.Duration
+	window          int
+	startTime       time.Time // availabilityStartTime, 为零值时取第一个packet到达时间
+	clock           *Clock    // 多码率组共享的时间轴, 为nil时独立对齐
+
+	video, audio *track
+
+	started    bool  // 已开始切片(有视频时为第一个关键帧之后)
+	aligned    bool  // offset有效, discontinuity后重新对齐
+	offset     int64 // 媒体时间(ms) = packet时间戳 + offset
+	curStartMs int64 // 当前切片的起始媒体时间
+	endMs      int64 // 已完成切片的最大结束媒体时间
+
+	mpd bytes.Buffer
+
+	mu            sync.Mutex // 保护最近一次MPD的快照, 供GroupManifest读取
+	reps          []representation
+	repsStartTime time.Time
+}
+
+func NewStream(opts ...streamOption) (*Stream, error) {
+	return (&Stream{}).loadOptions(opts...)
+}
+
+func (s *Stream) loadOptions(opts ...streamOption) (*Stream, error) {
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.name == "" {
+		return nil, errStreamName
+	}
+
+	if s.store == nil {
+		return nil, errStreamStore
+	}
+
+	if s.segmentDuration <= 0 {
+		s.segmentDuration = 4 * time.Second
+	}
+
+	if s.window <= 0 {
+		s.window = 6
+	}
+
+	return s, nil
+}
+
+// ManifestName MPD在存储中的名称
+func (s *Stream) ManifestName() string {
+	return s.name + ".mpd"
+}
+
+// InitName init segment在存储中的名称
+func (s *Stream) InitName(kind string) string {
+	return s.name + "/" + initUri(kind)
+}
+
+// SegmentName 切片在存储中的名称, MPD中以相对路径引用
+func (s *Stream) SegmentName(kind string, t uint64) string {
+	return s.name + "/" + segmentUri(kind, t)
+}
+
+func initUri(kind string) string {
+	return kind + "-init.mp4"
+}
+
+func segmentUri(kind string, t uint64) string {
+	return kind + "-" + strconv.FormatUint(t, 10) + ".m4s"
+}
+
+// WritePacket 写入一个packet, 满足切片条件时完成当前切片并更新MPD
+func (s *Stream) WritePacket(pkt *av.Packet) error {
+	var t *track
+	switch pkt.PacketType {
+	case av.VideoType:
+		vh, ok := pkt.PacketHeader.(av.VideoPacketHeader)
+		if !ok {
+			return errors.New("dash: video packet header required")
+		}
+		if vh.IsSequenceHeader() {
+			return s.setTrack(&s.video, "video", pkt)
+		}
+		t = s.video
+	case av.AudioType:
+		ah, ok := pkt.PacketHeader.(av.AudioPacketHeader)
+		if !ok {
+			return errors.New("dash: audio packet header required")
+		}
+		if ah.SoundFormat() == 10 && ah.AACPacketType() == 0 {
+			return s.setTrack(&s.audio, "audio", pkt)
+		}
+		t = s.audio
+	default:
+		return nil
+	}
+
+	if t == nil { // 未收到sequence header或不支持的编码
+		return nil
+	}
+	sample, ok := t.track.Sample(pkt)
+	if !ok {
+		return nil
+	}
+
+	if !s.aligned {
+		s.align(pkt.Timestamp)
+	}
+	ms := int64(pkt.Timestamp) + s.offset
+	if ms < t.lastMs { // 时间戳回退
+		if err := s.Discontinuity(); err != nil {
+			return err
+		}
+		s.align(pkt.Timestamp)
+		ms = int64(pkt.Timestamp) + s.offset
+	}
+
+	// 切片起点: 有视频时为关键帧, 纯音频时为任意音频帧
+	cutPoint := t == s.video && sample.Keyframe || t == s.audio && s.video == nil
+	if !s.started {
+		if !cutPoint {
+			return nil
+		}
+		s.started = true
+		s.curStartMs = ms
+	}
+
+	t.lastMs = ms
+	sample.DTS = uint64(ms) * uint64(t.track.Timescale) / 1000
+	t.queue.Push(sample)
+	t.cur = append(t.cur, t.queue.Pop()...)
+
+	if cutPoint && s.reachedTarget(ms) {
+		return s.cut(ms)
+	}
+	return nil
+}
+
+// setTrack 收到sequence header时创建轨道并写入init segment, 编码参数变化时先结束当前切片
+func (s *Stream) setTrack(dst **track, kind string, pkt *av.Packet) error {
+	old := *dst
+	if old != nil && bytes.Equal(old.config, pkt.Data) {
+		return nil
+	}
+
+	ft, err := fmp4.NewTrack(1, pkt)
+	if err != nil {
+		*dst = nil
+		return errors.Wrap(err, "dash: "+kind+" track")
+	}
+
+	if old != nil && s.started {
+		if err := s.Discontinuity(); err != nil {
+			return err
+		}
+	}
+
+	t := &track{kind: kind, track: ft, config: append([]byte(nil), pkt.Data...)}
+	if old != nil {
+		t.fragSeq, t.segments, t.lastMs = old.fragSeq, old.segments, old.lastMs
+	}
+	*dst = t
+
+	return errors.Wrap(s.store.Put(s.InitName(kind), fmp4.InitSegment(ft)), "dash: put init segment")
+}
+
+// align 按墙上时钟(或共享的Clock)确定媒体时间偏移, 不早于已完成切片的结束时间
+func (s *Stream) align(timestamp uint32) {
+	s.aligned = true
+	if s.clock != nil {
+		s.startTime, s.offset = s.clock.align(timestamp, s.endMs)
+		return
+	}
+
+	now := time.Now()
+	if s.startTime.IsZero() {
+		s.startTime = now
+	}
+	s.offset = alignedOffset(s.startTime, now, timestamp, s.endMs)
+}
+
+// reachedTarget 当前切片能否在媒体时间ms处结束: 默认达到目标时长, 共享Clock时跨过网格线
+func (s *Stream) reachedTarget(ms int64) bool {
+	if s.clock != nil {
+		grid := int64(s.segmentDuration / time.Millisecond)
+		return ms/grid > s.curStartMs/grid
+	}
+	return time.Duration(ms-s.curStartMs)*time.Millisecond >= s.segmentDuration
+}
+
+// cut 在媒体时间ms处结束所有轨道的当前切片
+func (s *Stream) cut(ms int64) error {
+	for _, t := range []*track{s.video, s.audio} {
+		if t == nil {
+			continue
+		}
+
+		end := uint64(ms) * uint64(t.track.Timescale) / 1000
+		n := 0
+		for n < len(t.cur) && t.cur[n].DTS < end {
+			n++
+		}
+		if err := s.finishSegment(t, t.cur[:n]); err != nil {
+			return err
+		}
+		t.cur = append(t.cur[:0], t.cur[n:]...)
+	}
+
+	s.curStartMs = ms
+	return s.putManifest()
+}
+
+// Discontinuity 推流端重连: 结束所有切片, 之后从新的关键帧开始并重新对齐时间轴
+func (s *Stream) Discontinuity() error {
+	s.started, s.aligned = false, false
+
+	finished := false
+	for _, t := range []*track{s.video, s.audio} {
+		if t == nil {
+			continue
+		}
+
+		samples := append(t.cur, t.queue.Flush()...)
+		t.cur = nil
+		if len(samples) == 0 {
+			continue
+		}
+		if err := s.finishSegment(t, samples); err != nil {
+			return err
+		}
+		finished = true
+	}
+
+	if !finished {
+		return nil
+	}
+	return s.putManifest()
+}
+
+func (s *Stream) finishSegment(t *track, samples []fmp4.Sample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+
+	frag := fmp4.TrackFragment{Track: t.track, Samples: samples}
+	t.fragSeq++
+	data := fmp4.Fragment(t.fragSeq, frag)
+
+	seg := Segment{Time: samples[0].DTS, Duration: frag.Duration(), Size: len(data)}
+	if err := s.store.Put(s.SegmentName(t.kind, seg.Time), data); err != nil {
+		return errors.Wrap(err, "dash: put segment")
+	}
+	t.segments = append(t.segments, seg)
+
+	if end := int64((seg.Time + seg.Duration) * 1000 / uint64(t.track.Timescale)); end > s.endMs {
+		s.endMs = end
+	}
+
+	for len(t.segments) > s.window+keepSegments {
+		old := t.segments[0]
+		t.segments = t.segments[1:]
+		if err := s.store.Remove(s.SegmentName(t.kind, old.Time)); err != nil {
+			return errors.Wrap(err, "dash: remove segment")
+		}
+	}
+	return nil
+}
+
+func (s *Stream) putManifest() error {
+	return errors.Wrap(s.store.Put(s.ManifestName(), s.renderManifest(time.Now())), "dash: put mpd")
+}
+
+// Close 删除所有切片, init segment及MPD
+func (s *Stream) Close() error {
+	var firstErr error
+	names := []string{s.ManifestName()}
+	for _, t := range []*track{s.video, s.audio} {
+		if t == nil {
+			continue
+		}
+		names = append(names, s.InitName(t.kind))
+		for _, seg := range t.segments {
+			names = append(names, s.SegmentName(t.kind, seg.Time))
+		}
+	}
+	names = append(names, s.name) // 切片目录
+
+	for _, name := range names {
+		if err := s.store.Remove(name); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	s.video, s.audio = nil, nil
+	s.mu.Lock()
+	s.reps = nil
+	s.mu.Unlock()
+	return firstErr
+}
+
+type streamOption func(*Stream)
+
+// WithName 存储中的名称前缀, 如vhost/app/stream
+func WithName(name string) streamOption {
+	return func(s *Stream) {
+		s.name = name
+	}
+}
+
+func WithStore(store hls.Store) streamOption {
+	return func(s *Stream) {
+		s.store = store
+	}
+}
+
+// WithSegmentDuration 目标切片时长(默认4s)
+func WithSegmentDuration(d time.Duration) streamOption {
+	return func(s *Stream) {
+		s.segmentDuration = d
+	}
+}
+
+// WithWindow MPD中每个adaptation set的切片数(默认6)
+func WithWindow(n int) streamOption {
+	return func(s *Stream) {
+		s.window = n
+	}
+}
+
+// WithAvailabilityStartTime 固定的availabilityStartTime, 默认为流开始时间
+func WithAvailabilityStartTime(t time.Time) streamOption {
+	return func(s *Stream) {
+		s.startTime = t
+	}
+}
+
+// WithClock 与多码率组内的其他流共享时间轴, 切片边界对齐到segmentDuration网格
+func WithClock(c *Clock) streamOption {
+	return func(s *Stream) {
+		s.clock = c
+	}
+}
+
+var (
+	errStreamName  = errors.New("dash stream name required")
+	errStreamStore = errors.New("dash stream store required")
+)
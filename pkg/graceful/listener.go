@@ -0,0 +1,161 @@
+package graceful
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+/*
+继承listener的两种来源:
+1. 平滑升级: 父进程通过ExtraFiles传递, 环境变量 FASTLIVE_LISTEN_FDS / FASTLIVE_LISTEN_FDNAMES
+2. systemd socket activation: 环境变量 LISTEN_PID / LISTEN_FDS / LISTEN_FDNAMES
+两者的fd均从3开始连续编号
+*/
+
+const (
+	envListenFds     = "FASTLIVE_LISTEN_FDS"
+	envListenFdNames = "FASTLIVE_LISTEN_FDNAMES"
+
+	envSystemdListenPid     = "LISTEN_PID"
+	envSystemdListenFds     = "LISTEN_FDS"
+	envSystemdListenFdNames = "LISTEN_FDNAMES"
+
+	listenFdsStart = 3
+)
+
+type inheritedListener struct {
+	name string
+	ln   net.Listener
+}
+
+var (
+	inheritOnce sync.Once
+	inheritErr  error
+	inheritMu   sync.Mutex
+	inherited   []*inheritedListener // 尚未被取走的继承listener
+)
+
+// Inherited 返回尚未被取走的继承listener数目
+func Inherited() (int, error) {
+	inheritOnce.Do(loadInherited)
+
+	inheritMu.Lock()
+	defer inheritMu.Unlock()
+	return len(inherited), inheritErr
+}
+
+// Listener 取走名称为name的继承listener, 名称不匹配时按监听地址匹配
+// 每个继承listener只能被取走一次
+func Listener(name, addr string) (net.Listener, bool) {
+	inheritOnce.Do(loadInherited)
+
+	inheritMu.Lock()
+	defer inheritMu.Unlock()
+
+	for idx, il := range inherited {
+		if il.name == name {
+			inherited = append(inherited[:idx], inherited[idx+1:]...)
+			return il.ln, true
+		}
+	}
+
+	for idx, il := range inherited {
+		if addrEqual(il.ln.Addr(), addr) {
+			inherited = append(inherited[:idx], inherited[idx+1:]...)
+			return il.ln, true
+		}
+	}
+
+	return nil, false
+}
+
+func loadInherited() {
+	fds, names, err := inheritedFds()
+	if err != nil {
+		inheritErr = err
+		return
+	}
+
+	for i := 0; i < fds; i++ {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+
+		name := strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(f)
+		f.Close() // FileListener内部dup了fd
+		if err != nil {
+			inheritErr = errors.Wrapf(err, "inherited fd %d(%s) is not a listener", fd, name)
+			return
+		}
+
+		inherited = append(inherited, &inheritedListener{name: name, ln: ln})
+	}
+}
+
+func inheritedFds() (int, []string, error) {
+	if v := os.Getenv(envListenFds); v != "" {
+		defer os.Unsetenv(envListenFds)
+		defer os.Unsetenv(envListenFdNames)
+
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, nil, errors.Errorf("invalid %s: %s", envListenFds, v)
+		}
+		return n, splitNames(os.Getenv(envListenFdNames)), nil
+	}
+
+	if v := os.Getenv(envSystemdListenFds); v != "" {
+		defer os.Unsetenv(envSystemdListenPid)
+		defer os.Unsetenv(envSystemdListenFds)
+		defer os.Unsetenv(envSystemdListenFdNames)
+
+		if pid, err := strconv.Atoi(os.Getenv(envSystemdListenPid)); err != nil || pid != os.Getpid() {
+			return 0, nil, nil // 不是传给本进程的
+		}
+
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, nil, errors.Errorf("invalid %s: %s", envSystemdListenFds, v)
+		}
+		return n, splitNames(os.Getenv(envSystemdListenFdNames)), nil
+	}
+
+	return 0, nil, nil
+}
+
+func splitNames(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ":")
+}
+
+// addrEqual 比较listener地址与配置地址, 未指定IP(如":1935")与"[::]:1935"/"0.0.0.0:1935"视为相同
+func addrEqual(la net.Addr, addr string) bool {
+	tcpAddr, ok := la.(*net.TCPAddr)
+	if !ok {
+		return la.String() == addr
+	}
+
+	want, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil || want.Port != tcpAddr.Port {
+		return false
+	}
+
+	if len(want.IP) == 0 || want.IP.IsUnspecified() {
+		return tcpAddr.IP.IsUnspecified()
+	}
+
+	return want.IP.Equal(tcpAddr.IP)
+}
@@ -0,0 +1,150 @@
+package graceful
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const envReadyFd = "FASTLIVE_READY_FD"
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Upgrade 以相同参数启动新的二进制, 并将listeners传递给子进程
+// 子进程调用Ready()表示已开始服务后返回; readyTimeout内未就绪或子进程退出则返回错误, 调用方应继续服务
+func Upgrade(listeners map[string]net.Listener, readyTimeout time.Duration) (*os.Process, error) {
+	binPath, err := os.Executable()
+	if err != nil {
+		return nil, errors.Wrap(err, "get executable path")
+	}
+
+	names := make([]string, 0, len(listeners))
+	for name := range listeners {
+		if strings.Contains(name, ":") {
+			return nil, errors.Errorf("listener name %q must not contain ':'", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	files := make([]*os.File, 0, len(names)+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, name := range names {
+		ln, ok := listeners[name].(filer)
+		if !ok {
+			return nil, errors.Errorf("listener %s can not be passed to child", name)
+		}
+
+		f, err := ln.File()
+		if err != nil {
+			return nil, errors.Wrapf(err, "get file of listener %s", name)
+		}
+		files = append(files, f)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "create ready pipe")
+	}
+	defer readyR.Close()
+	files = append(files, readyW) // readyW由defer关闭, 子进程持有副本
+
+	env := make([]string, 0, len(os.Environ())+3)
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, envListenFds+"=") ||
+			strings.HasPrefix(kv, envListenFdNames+"=") ||
+			strings.HasPrefix(kv, envReadyFd+"=") ||
+			strings.HasPrefix(kv, envSystemdListenPid+"=") ||
+			strings.HasPrefix(kv, envSystemdListenFds+"=") ||
+			strings.HasPrefix(kv, envSystemdListenFdNames+"=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	env = append(env,
+		envListenFds+"="+strconv.Itoa(len(names)),
+		envListenFdNames+"="+strings.Join(names, ":"),
+		envReadyFd+"="+strconv.Itoa(listenFdsStart+len(names)),
+	)
+
+	cmd := exec.Command(binPath, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = env
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrap(err, "start child process")
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := readyR.Read(buf)
+		ready <- err
+	}()
+
+	// 关闭父进程持有的写端, 子进程退出时读端才能收到EOF
+	readyW.Close()
+	files = files[:len(files)-1]
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			return nil, errors.Wrap(err, "wait child ready")
+		}
+		return cmd.Process, nil
+	case err := <-exited:
+		return nil, errors.Errorf("child process exited before ready: %v", err)
+	case <-time.After(readyTimeout):
+		_ = cmd.Process.Kill()
+		return nil, errors.New("wait child ready timeout")
+	}
+}
+
+var readyOnce sync.Once
+
+// Ready 通知父进程本进程已开始服务(非平滑升级启动时为空操作)
+func Ready() error {
+	var err error
+	readyOnce.Do(func() {
+		v := os.Getenv(envReadyFd)
+		if v == "" {
+			return
+		}
+		os.Unsetenv(envReadyFd)
+
+		fd, e := strconv.Atoi(v)
+		if e != nil {
+			err = errors.Errorf("invalid %s: %s", envReadyFd, v)
+			return
+		}
+
+		f := os.NewFile(uintptr(fd), "ready")
+		defer f.Close()
+		if _, e := f.Write([]byte{1}); e != nil {
+			err = errors.Wrap(e, "notify parent ready")
+		}
+	})
+
+	return err
+}
@@ -0,0 +1,323 @@
+package hls
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+HLS切片加密:
+1. 每个流的密钥每rotation个切片更换一次, 第n个密钥用于序号[n*rotation, (n+1)*rotation)的切片
+2. 密钥由KeyProvider提供(默认随机生成, 可对接KMS), 只保存在内存中, 通过http的密钥接口下发, 不写入存储
+   开始使用第n个密钥时在后台预取第n+1个, 轮换时不在切片协程中等待KMS
+3. AES-128加密整个切片(PKCS7填充), SAMPLE-AES由ts.Muxer加密样本(仅MPEG-TS); IV为切片序号(EXT-X-KEY不带IV属性)
+4. playlist中EXT-X-KEY的URI为{stream}.key?n={n}, 与playlist同目录
+*/
+
+// 加密方式, 即EXT-X-KEY的METHOD
+const (
+	MethodAes128    = "AES-128"
+	MethodSampleAes = "SAMPLE-AES"
+)
+
+const keySize = 16
+
+// KeyProvider 内容密钥来源, 每个密钥通常只调用一次(预取失败时重试), 返回16字节密钥; 可能在后台协程中调用
+type KeyProvider interface {
+	Key(stream string, index uint64) ([]byte, error)
+}
+
+// RandomKeyProvider 随机生成密钥
+type RandomKeyProvider struct{}
+
+func (RandomKeyProvider) Key(stream string, index uint64) ([]byte, error) {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, errors.Wrap(err, "generate key")
+	}
+	return key, nil
+}
+
+// HttpKeyProvider 从KMS获取密钥: GET {url}?stream={stream}&index={index}, 响应体为16字节密钥
+type HttpKeyProvider struct {
+	url    string
+	client *http.Client
+}
+
+func NewHttpKeyProvider(u string, timeout time.Duration) *HttpKeyProvider {
+	return &HttpKeyProvider{url: u, client: &http.Client{Timeout: timeout}}
+}
+
+func (p *HttpKeyProvider) Key(stream string, index uint64) ([]byte, error) {
+	q := url.Values{}
+	q.Set("stream", stream)
+	q.Set("index", strconv.FormatUint(index, 10))
+
+	u := p.url + "?" + q.Encode()
+	if strings.Contains(p.url, "?") {
+		u = p.url + "&" + q.Encode()
+	}
+
+	resp, err := p.client.Get(u)
+	if err != nil {
+		return nil, errors.Wrap(err, "request kms")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("kms response status %d", resp.StatusCode)
+	}
+
+	key, err := ioutil.ReadAll(io.LimitReader(resp.Body, keySize+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "read kms response")
+	}
+	if len(key) != keySize {
+		return nil, errors.Errorf("kms key length %d, want %d", len(key), keySize)
+	}
+	return key, nil
+}
+
+// KeyRing 一个流正在使用的密钥, 由切片协程获取及释放, Key可并发调用
+type KeyRing struct {
+	name     string // 传给KeyProvider的流名称, 如vhost/app/stream
+	method   string
+	provider KeyProvider
+	rotation uint64
+
+	mu      sync.RWMutex
+	keys    map[uint64][]byte
+	pending map[uint64]*keyFetch // 预取中的密钥
+}
+
+// keyFetch 后台获取一个密钥, 完成时关闭done
+type keyFetch struct {
+	done chan struct{}
+}
+
+func NewKeyRing(opts ...keyRingOption) (*KeyRing, error) {
+	return (&KeyRing{
+		keys:    make(map[uint64][]byte),
+		pending: make(map[uint64]*keyFetch),
+	}).loadOptions(opts...)
+}
+
+func (k *KeyRing) loadOptions(opts ...keyRingOption) (*KeyRing, error) {
+	for _, opt := range opts {
+		opt(k)
+	}
+
+	if k.name == "" {
+		return nil, errors.New("hls key ring name required")
+	}
+
+	if k.method != MethodAes128 && k.method != MethodSampleAes {
+		return nil, errors.Errorf("unsupported hls encryption method %q", k.method)
+	}
+
+	if k.provider == nil {
+		k.provider = RandomKeyProvider{}
+	}
+
+	if k.rotation == 0 {
+		k.rotation = 10
+	}
+
+	return k, nil
+}
+
+// Method EXT-X-KEY的METHOD
+func (k *KeyRing) Method() string {
+	return k.method
+}
+
+// index 序号为seq的切片使用的密钥
+func (k *KeyRing) index(seq uint64) uint64 {
+	return seq / k.rotation
+}
+
+// keyFor 序号为seq的切片的密钥, 尚未获取时等待预取完成, 未预取或预取失败时由KeyProvider获取
+func (k *KeyRing) keyFor(seq uint64) ([]byte, error) {
+	n := k.index(seq)
+	k.mu.RLock()
+	key, ok := k.keys[n]
+	f := k.pending[n]
+	k.mu.RUnlock()
+
+	if !ok && f != nil {
+		<-f.done
+		k.mu.RLock()
+		key, ok = k.keys[n]
+		k.mu.RUnlock()
+	}
+
+	if !ok {
+		var err error
+		if key, err = k.fetch(n); err != nil {
+			return nil, err
+		}
+		k.mu.Lock()
+		k.keys[n] = key
+		k.mu.Unlock()
+	}
+
+	k.prefetch(n + 1)
+	return key, nil
+}
+
+// prefetch 在后台获取第n个密钥, 已获取或正在获取时忽略
+func (k *KeyRing) prefetch(n uint64) {
+	k.mu.Lock()
+	if _, ok := k.keys[n]; ok {
+		k.mu.Unlock()
+		return
+	}
+	if _, ok := k.pending[n]; ok {
+		k.mu.Unlock()
+		return
+	}
+	f := &keyFetch{done: make(chan struct{})}
+	k.pending[n] = f
+	k.mu.Unlock()
+
+	go func() {
+		defer close(f.done)
+
+		key, err := k.fetch(n)
+
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		// 期间已被release/clear时丢弃
+		if k.pending[n] != f {
+			return
+		}
+		delete(k.pending, n)
+		if err == nil {
+			k.keys[n] = key
+		}
+	}()
+}
+
+func (k *KeyRing) fetch(n uint64) ([]byte, error) {
+	key, err := k.provider.Key(k.name, n)
+	if err != nil {
+		return nil, errors.Wrapf(err, "hls: get key %d", n)
+	}
+	if len(key) != keySize {
+		return nil, errors.Errorf("hls: key %d length %d, want %d", n, len(key), keySize)
+	}
+	return key, nil
+}
+
+// Key 密钥接口读取第n个密钥, 已释放或尚未获取时返回false
+func (k *KeyRing) Key(n uint64) ([]byte, bool) {
+	k.mu.RLock()
+	key, ok := k.keys[n]
+	k.mu.RUnlock()
+	return key, ok
+}
+
+// release 释放序号小于seq的切片不再使用的密钥
+func (k *KeyRing) release(seq uint64) {
+	n := k.index(seq)
+	k.mu.Lock()
+	for i := range k.keys {
+		if i < n {
+			delete(k.keys, i)
+		}
+	}
+	for i := range k.pending {
+		if i < n {
+			delete(k.pending, i)
+		}
+	}
+	k.mu.Unlock()
+}
+
+// clear 流结束时释放所有密钥
+func (k *KeyRing) clear() {
+	k.mu.Lock()
+	k.keys = make(map[uint64][]byte)
+	k.pending = make(map[uint64]*keyFetch)
+	k.mu.Unlock()
+}
+
+// keyUri playlist中第n个密钥的URI, 相对于playlist
+func (k *KeyRing) keyUri(n uint64) string {
+	return path.Base(k.name) + ".key?n=" + strconv.FormatUint(n, 10)
+}
+
+// writeKeyTag 序号为seq的切片使用的EXT-X-KEY
+func (k *KeyRing) writeKeyTag(b *bytes.Buffer, seq uint64) {
+	b.WriteString("#EXT-X-KEY:METHOD=" + k.method + `,URI="` + k.keyUri(k.index(seq)) + "\"\n")
+}
+
+// segmentIv 未指定IV属性时, IV为切片序号(大端128位)
+func segmentIv(seq uint64) []byte {
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], seq)
+	return iv
+}
+
+// encryptAes128 AES-128 CBC加密整个资源, PKCS7填充
+func encryptAes128(key []byte, seq uint64, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "hls: aes key")
+	}
+
+	pad := aes.BlockSize - len(data)%aes.BlockSize
+	out := make([]byte, len(data)+pad)
+	copy(out, data)
+	for i := len(data); i < len(out); i++ {
+		out[i] = byte(pad)
+	}
+	cipher.NewCBCEncrypter(block, segmentIv(seq)).CryptBlocks(out, out)
+	return out, nil
+}
+
+type keyRingOption func(*KeyRing)
+
+// WithKeyName 流名称, 如vhost/app/stream, 同时决定密钥URI
+func WithKeyName(name string) keyRingOption {
+	return func(k *KeyRing) {
+		k.name = name
+	}
+}
+
+// WithMethod 加密方式, MethodAes128或MethodSampleAes
+func WithMethod(method string) keyRingOption {
+	return func(k *KeyRing) {
+		k.method = method
+	}
+}
+
+// WithKeyProvider 密钥来源(默认RandomKeyProvider)
+func WithKeyProvider(p KeyProvider) keyRingOption {
+	return func(k *KeyRing) {
+		k.provider = p
+	}
+}
+
+// WithKeyRotation 每n个切片更换密钥(默认10)
+func WithKeyRotation(n int) keyRingOption {
+	return func(k *KeyRing) {
+		if n > 0 {
+			k.rotation = uint64(n)
+		}
+	}
+}
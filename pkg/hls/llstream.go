@@ -0,0 +1,977 @@
+package hls
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"fastlive/pkg/av"
+	"fastlive/pkg/av/fmp4"
+)
+
+/*
+单个流的低延迟HLS(LL-HLS)切片, fMP4封装:
+1. 切片内按partDuration切分partial segment(EXT-X-PART), 每个part为一个moof+mdat, 完整切片为所有part的拼接
+2. 有视频时在达到目标时长后的第一个关键帧切片, 纯音频流按时长切片; 音视频在同一个fragment中(muxed)
+3. playlist在每个part完成时生成(完整及delta两种), 阻塞请求(_HLS_msn/_HLS_part)等待广播后直接返回已生成的内容
+4. 最近3个目标时长内的切片列出part, 更早切片的part文件删除; playlist之外的切片再保留keepSegments个后删除
+5. Discontinuity(推流端重连)或时间戳回退时结束当前切片, 下一个切片标记EXT-X-DISCONTINUITY; 编码参数变化时使用新的init segment(EXT-X-MAP)
+6. 对齐模式(多码率)与Stream相同: 切片边界对齐到目标时长网格, 第一个切片的序号为所在网格的序号
+7. 设置KeyRing时以AES-128分别加密part及切片(IV均为切片序号), init segment不加密; 获取密钥失败时丢弃数据到下一个关键帧
+*/
+
+const (
+	llVideoTrackID = 1
+	llAudioTrackID = 2
+
+	// 列出part的时长(目标时长的倍数)
+	llPartListTargets = 3
+	// CAN-SKIP-UNTIL(目标时长的倍数), 规范要求至少6倍
+	llSkipTargets = 6
+)
+
+var (
+	// ErrBadRequest 阻塞请求的参数无效或请求的切片过远
+	ErrBadRequest = errors.New("hls: bad blocking request")
+	// ErrNotReady 尚未生成playlist或流已关闭
+	ErrNotReady = errors.New("hls: playlist not ready")
+)
+
+// PlaylistRequest 播放端请求参数, Msn/Part小于0表示未指定
+type PlaylistRequest struct {
+	Msn  int64
+	Part int64
+	Skip bool // _HLS_skip=YES, 返回delta playlist
+}
+
+// RenditionReport 同组其他rendition的最新进度, 用于EXT-X-RENDITION-REPORT
+type RenditionReport struct {
+	URI      string // 相对于当前playlist
+	LastMsn  uint64
+	LastPart int
+}
+
+type llPart struct {
+	duration    time.Duration
+	independent bool
+}
+
+type llSegment struct {
+	msn           uint64
+	duration      time.Duration
+	parts         []llPart
+	complete      bool
+	discontinuity bool
+	initVersion   int
+	programTime   time.Time
+	partsRemoved  bool
+}
+
+// llTrack 写入协程使用的轨道状态
+type llTrack struct {
+	track  *fmp4.Track
+	config []byte
+	queue  fmp4.SampleQueue
+	cur    []fmp4.Sample // 时长已确定, 尚未写入part
+	lastMs int64
+}
+
+// LLStream 单个流的LL-HLS状态, WritePacket等由同一协程调用, Playlist/File可并发调用
+type LLStream struct {
+	name           string
+	store          Store
+	targetDuration time.Duration
+	partDuration   time.Duration
+	window         int
+	reports        func() []RenditionReport
+	keys           *KeyRing // 为nil时不加密
+	alignSegments  bool     // 切片边界对齐到目标时长网格
+
+	// 以下由写入协程使用
+	video, audio  *llTrack
+	initVersion   int
+	initWritten   bool
+	started       bool
+	aligned       bool
+	pendingDisc   bool
+	offset        int64 // 媒体时间(ms) = packet时间戳 + offset, 保持单增
+	endMs         int64
+	segStartMs    int64
+	segStartTs    uint32 // 当前切片起始packet的时间戳, 用于对齐模式
+	partStartMs   int64
+	lastFrameMs   int64 // 主轨道最近的帧间隔, 用于预测part时长
+	fragSeq       uint32
+	segData       []byte
+	segKey        []byte
+	nextMsn       uint64
+	maxDuration   time.Duration
+	playlistBuild bytes.Buffer
+
+	mu          sync.RWMutex
+	segments    []*llSegment // 已完成及正在生成的切片(最后一个可能未完成)
+	removedDisc uint64
+	playlist    []byte
+	delta       []byte // 无可跳过的切片时为nil
+	update      chan struct{}
+	closed      bool
+}
+
+func NewLLStream(opts ...llStreamOption) (*LLStream, error) {
+	return (&LLStream{}).loadOptions(opts...)
+}
+
+func (s *LLStream) loadOptions(opts ...llStreamOption) (*LLStream, error) {
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.name == "" {
+		return nil, errStreamName
+	}
+
+	if s.store == nil {
+		return nil, errStreamStore
+	}
+
+	if s.targetDuration <= 0 {
+		s.targetDuration = 4 * time.Second
+	}
+
+	if s.partDuration <= 0 {
+		s.partDuration = time.Second
+	}
+
+	if s.partDuration > s.targetDuration {
+		return nil, errors.Errorf("hls part duration %s exceeds target duration %s", s.partDuration, s.targetDuration)
+	}
+
+	if s.window <= 0 {
+		s.window = 6
+	}
+
+	if s.keys != nil && s.keys.Method() != MethodAes128 {
+		return nil, errors.Errorf("ll-hls does not support %s encryption", s.keys.Method())
+	}
+
+	s.update = make(chan struct{})
+	return s, nil
+}
+
+// PlaylistName playlist的名称, 由Playlist生成, 不写入存储
+func (s *LLStream) PlaylistName() string {
+	return s.name + ".m3u8"
+}
+
+func (s *LLStream) fileName(uri string) string {
+	return s.name + "/" + uri
+}
+
+func initUri(version int) string {
+	return "init" + strconv.Itoa(version) + ".mp4"
+}
+
+func llSegmentUri(msn uint64) string {
+	return strconv.FormatUint(msn, 10) + ".m4s"
+}
+
+func partUri(msn uint64, part int) string {
+	return strconv.FormatUint(msn, 10) + "." + strconv.Itoa(part) + ".m4s"
+}
+
+// WritePacket 写入一个packet, 满足条件时完成当前part或切片并更新playlist
+func (s *LLStream) WritePacket(pkt *av.Packet) error {
+	var t *llTrack
+	switch pkt.PacketType {
+	case av.VideoType:
+		vh, ok := pkt.PacketHeader.(av.VideoPacketHeader)
+		if !ok {
+			return errors.New("hls: video packet header required")
+		}
+		if vh.IsSequenceHeader() {
+			return s.setTrack(&s.video, llVideoTrackID, pkt)
+		}
+		t = s.video
+	case av.AudioType:
+		ah, ok := pkt.PacketHeader.(av.AudioPacketHeader)
+		if !ok {
+			return errors.New("hls: audio packet header required")
+		}
+		if ah.SoundFormat() == 10 && ah.AACPacketType() == 0 {
+			return s.setTrack(&s.audio, llAudioTrackID, pkt)
+		}
+		t = s.audio
+	default:
+		return nil
+	}
+
+	if t == nil { // 未收到sequence header或不支持的编码
+		return nil
+	}
+	sample, ok := t.track.Sample(pkt)
+	if !ok {
+		return nil
+	}
+
+	if !s.aligned {
+		s.align(pkt.Timestamp)
+	}
+	ms := int64(pkt.Timestamp) + s.offset
+	if ms < t.lastMs { // 时间戳回退
+		if err := s.Discontinuity(); err != nil {
+			return err
+		}
+		s.align(pkt.Timestamp)
+		ms = int64(pkt.Timestamp) + s.offset
+	}
+
+	// 主轨道(有视频时为视频)决定part及切片边界
+	primary := t == s.video || s.video == nil
+	cutPoint := primary && (sample.Keyframe || t == s.audio)
+	if !s.started {
+		if !cutPoint {
+			return nil
+		}
+		if err := s.startSegment(ms, pkt.Timestamp); err != nil {
+			return err
+		}
+	}
+
+	if primary && t.lastMs > 0 && ms > t.lastMs {
+		s.lastFrameMs = ms - t.lastMs
+	}
+	t.lastMs = ms
+	sample.DTS = uint64(ms) * uint64(t.track.Timescale) / 1000
+	t.queue.Push(sample)
+	t.cur = append(t.cur, t.queue.Pop()...)
+
+	if !primary || ms <= s.partStartMs {
+		return nil
+	}
+
+	if cutPoint && s.reachedTarget(ms, pkt.Timestamp) {
+		if err := s.finishPart(ms, true); err != nil {
+			return err
+		}
+		return s.startSegment(ms, pkt.Timestamp)
+	}
+
+	// 加上下一帧会超过part目标时长时结束当前part, 使part时长不超过PART-TARGET
+	if time.Duration(ms-s.partStartMs+s.lastFrameMs)*time.Millisecond > s.partDuration {
+		return s.finishPart(ms, false)
+	}
+	return nil
+}
+
+// setTrack 收到sequence header时更新轨道, 已开始切片后编码参数变化时结束当前切片并使用新的init segment
+func (s *LLStream) setTrack(dst **llTrack, id uint32, pkt *av.Packet) error {
+	old := *dst
+	if old != nil && bytes.Equal(old.config, pkt.Data) {
+		return nil
+	}
+
+	ft, err := fmp4.NewTrack(id, pkt)
+	if err != nil {
+		*dst = nil
+		return errors.Wrap(err, "hls: fmp4 track")
+	}
+
+	if s.nextMsn > 0 { // 已有切片引用当前init segment
+		if err := s.Discontinuity(); err != nil {
+			return err
+		}
+		s.initVersion++
+	}
+
+	t := &llTrack{track: ft, config: append([]byte(nil), pkt.Data...)}
+	if old != nil {
+		t.lastMs = old.lastMs
+	}
+	*dst = t
+
+	var tracks []*fmp4.Track
+	for _, t := range []*llTrack{s.video, s.audio} {
+		if t != nil {
+			tracks = append(tracks, t.track)
+		}
+	}
+	s.initWritten = true
+	return errors.Wrap(s.store.Put(s.fileName(initUri(s.initVersion)), fmp4.InitSegment(tracks...)), "hls: put init segment")
+}
+
+// align 新的时间轴从已输出的最大媒体时间开始, 保持单增
+func (s *LLStream) align(timestamp uint32) {
+	base := s.endMs
+	for _, t := range []*llTrack{s.video, s.audio} {
+		if t != nil && t.lastMs > base {
+			base = t.lastMs
+		}
+	}
+	s.offset = base - int64(timestamp)
+	s.aligned = true
+}
+
+// reachedTarget 当前切片能否在此结束: 默认达到目标时长, 对齐模式下时间戳跨过网格线
+func (s *LLStream) reachedTarget(ms int64, timestamp uint32) bool {
+	if s.alignSegments {
+		return gridIndex(timestamp, s.targetDuration) > gridIndex(s.segStartTs, s.targetDuration)
+	}
+	return time.Duration(ms-s.segStartMs)*time.Millisecond >= s.targetDuration
+}
+
+func (s *LLStream) startSegment(ms int64, timestamp uint32) error {
+	disc := s.pendingDisc && s.nextMsn > 0
+	if s.alignSegments && s.nextMsn == 0 {
+		s.nextMsn = gridIndex(timestamp, s.targetDuration)
+	}
+
+	if s.keys != nil {
+		key, err := s.keys.keyFor(s.nextMsn)
+		if err != nil {
+			s.dropSamples()
+			return err
+		}
+		s.segKey = key
+	}
+
+	s.started = true
+	s.segStartMs, s.partStartMs = ms, ms
+	s.segStartTs = timestamp
+	s.segData = s.segData[:0]
+
+	seg := &llSegment{
+		msn:           s.nextMsn,
+		discontinuity: disc,
+		initVersion:   s.initVersion,
+		programTime:   time.Now(),
+	}
+	s.nextMsn++
+	s.pendingDisc = false
+
+	s.mu.Lock()
+	s.segments = append(s.segments, seg)
+	s.mu.Unlock()
+	return nil
+}
+
+// dropSamples 无法开始切片时丢弃已缓存的sample, 从下一个关键帧重新开始
+func (s *LLStream) dropSamples() {
+	s.started = false
+	s.pendingDisc = true
+	for _, t := range []*llTrack{s.video, s.audio} {
+		if t != nil {
+			t.cur = nil
+			t.queue.Flush()
+		}
+	}
+}
+
+// encrypt 加密时返回part或切片的密文
+func (s *LLStream) encrypt(msn uint64, data []byte) ([]byte, error) {
+	if s.keys == nil {
+		return data, nil
+	}
+	return encryptAes128(s.segKey, msn, data)
+}
+
+// finishPart 输出媒体时间end之前的sample为一个part, endSegment时同时完成当前切片
+func (s *LLStream) finishPart(end int64, endSegment bool) error {
+	var frags []fmp4.TrackFragment
+	for _, t := range []*llTrack{s.video, s.audio} {
+		if t == nil {
+			continue
+		}
+		limit := uint64(end) * uint64(t.track.Timescale) / 1000
+		n := 0
+		for n < len(t.cur) && t.cur[n].DTS < limit {
+			n++
+		}
+		frags = append(frags, fmp4.TrackFragment{Track: t.track, Samples: append([]fmp4.Sample(nil), t.cur[:n]...)})
+		t.cur = append(t.cur[:0], t.cur[n:]...)
+	}
+	return s.writePart(frags, time.Duration(end-s.partStartMs)*time.Millisecond, end, endSegment)
+}
+
+func (s *LLStream) writePart(frags []fmp4.TrackFragment, duration time.Duration, end int64, endSegment bool) error {
+	s.mu.RLock()
+	seg := s.segments[len(s.segments)-1]
+	partIdx := len(seg.parts)
+	s.mu.RUnlock()
+
+	var part *llPart
+	if hasSamples(frags) {
+		s.fragSeq++
+		data := fmp4.Fragment(s.fragSeq, frags...)
+		s.segData = append(s.segData, data...)
+		data, err := s.encrypt(seg.msn, data)
+		if err != nil {
+			return err
+		}
+		if err := s.store.Put(s.fileName(partUri(seg.msn, partIdx)), data); err != nil {
+			return errors.Wrap(err, "hls: put part")
+		}
+
+		part = &llPart{duration: duration, independent: true}
+		if s.video != nil {
+			// 第一个视频sample为关键帧时part可独立解码
+			for _, f := range frags {
+				if f.Track.Kind == fmp4.VideoTrack {
+					part.independent = len(f.Samples) > 0 && f.Samples[0].Keyframe
+				}
+			}
+		}
+	}
+	s.partStartMs = end
+	if end > s.endMs {
+		s.endMs = end
+	}
+
+	var removed []string
+	if endSegment && (part != nil || partIdx > 0) {
+		data, err := s.encrypt(seg.msn, append([]byte(nil), s.segData...))
+		if err != nil {
+			return err
+		}
+		if err := s.store.Put(s.fileName(llSegmentUri(seg.msn)), data); err != nil {
+			return errors.Wrap(err, "hls: put segment")
+		}
+	}
+	if endSegment && s.keys != nil {
+		// 预先获取下一个切片的密钥, 获取到后preload hint之前即可列出EXT-X-KEY; 不等待KMS, 未完成或失败时由startSegment获取
+		s.keys.prefetch(s.keys.index(seg.msn + 1))
+	}
+
+	s.mu.Lock()
+	if part != nil {
+		seg.parts = append(seg.parts, *part)
+		seg.duration += part.duration
+	}
+	if endSegment {
+		if len(seg.parts) == 0 {
+			// 空切片不输出, 序号及discontinuity标记由下一个切片使用
+			s.segments = s.segments[:len(s.segments)-1]
+			s.nextMsn--
+			s.pendingDisc = s.pendingDisc || seg.discontinuity
+		} else {
+			seg.complete = true
+			if seg.duration > s.maxDuration {
+				s.maxDuration = seg.duration
+			}
+		}
+		removed = s.trimLocked()
+	}
+	if part != nil || endSegment {
+		s.renderLocked()
+		close(s.update)
+		s.update = make(chan struct{})
+	}
+	s.mu.Unlock()
+
+	for _, name := range removed {
+		if err := s.store.Remove(name); err != nil {
+			return errors.Wrap(err, "hls: remove segment")
+		}
+	}
+	return nil
+}
+
+func hasSamples(frags []fmp4.TrackFragment) bool {
+	for _, f := range frags {
+		if len(f.Samples) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// trimLocked 删除过期的切片及不再列出的part, 返回需从存储中删除的文件
+func (s *LLStream) trimLocked() []string {
+	var removed []string
+	complete := len(s.segments)
+	if complete > 0 && !s.segments[complete-1].complete {
+		complete--
+	}
+
+	for complete > s.window+keepSegments {
+		old := s.segments[0]
+		s.segments = s.segments[1:]
+		complete--
+		if old.discontinuity {
+			s.removedDisc++
+		}
+		removed = append(removed, s.fileName(llSegmentUri(old.msn)))
+		if !old.partsRemoved {
+			for i := range old.parts {
+				removed = append(removed, s.fileName(partUri(old.msn, i)))
+			}
+		}
+	}
+	if s.keys != nil && len(s.segments) > 0 {
+		s.keys.release(s.segments[0].msn)
+	}
+
+	// 保留列出part的切片及之前一个切片的part文件(正在下载的客户端不受影响)
+	first := s.partListStart() - 1
+	for i := 0; i < first; i++ {
+		seg := s.segments[i]
+		if seg.complete && !seg.partsRemoved {
+			for j := range seg.parts {
+				removed = append(removed, s.fileName(partUri(seg.msn, j)))
+			}
+			seg.partsRemoved = true
+		}
+	}
+	return removed
+}
+
+// partListStart 从该下标开始的切片列出part: 末尾至少llPartListTargets个目标时长
+func (s *LLStream) partListStart() int {
+	var d time.Duration
+	i := len(s.segments)
+	for i > 0 && d < llPartListTargets*s.targetDuration {
+		i--
+		d += s.segments[i].duration
+	}
+	return i
+}
+
+// Discontinuity 推流端重连: 结束当前切片, 之后从新的关键帧开始并标记discontinuity
+func (s *LLStream) Discontinuity() error {
+	s.pendingDisc = true
+	s.aligned = false
+	if !s.started {
+		return nil
+	}
+	s.started = false
+
+	var frags []fmp4.TrackFragment
+	var duration time.Duration
+	for _, t := range []*llTrack{s.video, s.audio} {
+		if t == nil {
+			continue
+		}
+		samples := append(t.cur, t.queue.Flush()...)
+		t.cur = nil
+		f := fmp4.TrackFragment{Track: t.track, Samples: samples}
+		frags = append(frags, f)
+		if t == s.video || s.video == nil {
+			duration = time.Duration(f.Duration()) * time.Second / time.Duration(t.track.Timescale)
+		}
+	}
+
+	end := s.partStartMs + int64(duration/time.Millisecond)
+	return s.writePart(frags, duration, end, true)
+}
+
+// LastPart 最近一个part的位置, 用于其他rendition的EXT-X-RENDITION-REPORT
+func (s *LLStream) LastPart() (msn uint64, part int, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for i := len(s.segments) - 1; i >= 0; i-- {
+		if seg := s.segments[i]; len(seg.parts) > 0 {
+			return seg.msn, len(seg.parts) - 1, true
+		}
+	}
+	return 0, 0, false
+}
+
+// Playlist 返回playlist, 指定Msn时阻塞到包含该切片(及Part)或ctx结束
+func (s *LLStream) Playlist(ctx context.Context, req PlaylistRequest) ([]byte, error) {
+	if req.Part >= 0 && req.Msn < 0 {
+		return nil, ErrBadRequest
+	}
+
+	for {
+		s.mu.RLock()
+		playlist, delta, update, closed := s.playlist, s.delta, s.update, s.closed
+		ready, bad := s.satisfiedLocked(req)
+		s.mu.RUnlock()
+
+		if closed {
+			return nil, ErrNotReady
+		}
+		if bad {
+			return nil, ErrBadRequest
+		}
+
+		if ready && playlist != nil {
+			if req.Skip && delta != nil {
+				playlist = delta
+			}
+			return s.appendReports(playlist), nil
+		}
+
+		if req.Msn < 0 && playlist == nil {
+			return nil, ErrNotReady
+		}
+
+		select {
+		case <-update:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// satisfiedLocked 判断阻塞请求是否可以返回; 请求的切片超过最新完成的切片+2时为无效请求
+func (s *LLStream) satisfiedLocked(req PlaylistRequest) (ready, bad bool) {
+	if req.Msn < 0 {
+		return true, false
+	}
+	msn := uint64(req.Msn)
+
+	var lastComplete int64 = -1
+	for i := len(s.segments) - 1; i >= 0; i-- {
+		if s.segments[i].complete {
+			lastComplete = int64(s.segments[i].msn)
+			break
+		}
+	}
+	if int64(msn) > lastComplete+2 {
+		return false, true
+	}
+
+	for i := len(s.segments) - 1; i >= 0; i-- {
+		seg := s.segments[i]
+		if seg.msn < msn {
+			break
+		}
+		if req.Part < 0 {
+			if seg.complete {
+				return true, false
+			}
+			continue
+		}
+		if seg.msn > msn && len(seg.parts) > 0 || seg.msn == msn && (seg.complete || int64(len(seg.parts)) > req.Part) {
+			return true, false
+		}
+	}
+	return false, false
+}
+
+func (s *LLStream) nextMsnLocked() uint64 {
+	if len(s.segments) == 0 {
+		return s.nextMsn
+	}
+	last := s.segments[len(s.segments)-1]
+	if last.complete {
+		return last.msn + 1
+	}
+	return last.msn
+}
+
+func (s *LLStream) appendReports(playlist []byte) []byte {
+	if s.reports == nil {
+		return playlist
+	}
+	reports := s.reports()
+	if len(reports) == 0 {
+		return playlist
+	}
+
+	b := bytes.NewBuffer(append(make([]byte, 0, len(playlist)+len(reports)*80), playlist...))
+	for _, r := range reports {
+		b.WriteString(`#EXT-X-RENDITION-REPORT:URI="` + r.URI + `",LAST-MSN=`)
+		b.WriteString(strconv.FormatUint(r.LastMsn, 10))
+		b.WriteString(",LAST-PART=")
+		b.WriteString(strconv.Itoa(r.LastPart))
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// File 读取init segment, 切片或part; 尚未生成的下一个part或切片(preload hint)阻塞到生成或ctx结束
+func (s *LLStream) File(ctx context.Context, uri string) ([]byte, error) {
+	name := s.fileName(uri)
+	for {
+		s.mu.RLock()
+		update, closed := s.update, s.closed
+		pending := s.pendingLocked(uri)
+		s.mu.RUnlock()
+
+		data, err := s.store.Get(name)
+		if err == nil || closed || !pending {
+			return data, err
+		}
+
+		select {
+		case <-update:
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+// pendingLocked uri是否为即将生成的切片或part: 当前切片的后续part, 当前切片本身或下一个切片的第一个part
+func (s *LLStream) pendingLocked(uri string) bool {
+	if !strings.HasSuffix(uri, ".m4s") {
+		return false
+	}
+	elems := strings.Split(strings.TrimSuffix(uri, ".m4s"), ".")
+	if len(elems) > 2 {
+		return false
+	}
+	msn, err := strconv.ParseUint(elems[0], 10, 64)
+	if err != nil {
+		return false
+	}
+	part := -1
+	if len(elems) == 2 {
+		if part, err = strconv.Atoi(elems[1]); err != nil {
+			return false
+		}
+	}
+
+	next := s.nextMsnLocked()
+	switch {
+	case msn == next:
+		return true
+	case msn == next+1:
+		return part == 0
+	}
+	return false
+}
+
+// renderLocked 生成完整及delta playlist
+func (s *LLStream) renderLocked() {
+	if len(s.segments) == 0 {
+		s.playlist, s.delta = nil, nil
+		return
+	}
+
+	first := len(s.segments) - s.window
+	if !s.segments[len(s.segments)-1].complete {
+		first--
+	}
+	if first < 0 {
+		first = 0
+	}
+	segments := s.segments[first:]
+
+	discSeq := s.removedDisc
+	for _, seg := range s.segments[:first] {
+		if seg.discontinuity {
+			discSeq++
+		}
+	}
+
+	// delta playlist跳过距末尾超过CAN-SKIP-UNTIL的完整切片
+	var total time.Duration
+	for _, seg := range segments {
+		total += seg.duration
+	}
+	skipUntil := llSkipTargets * s.targetDuration
+	skip := 0
+	for _, seg := range segments {
+		if !seg.complete || total-seg.duration < skipUntil {
+			break
+		}
+		total -= seg.duration
+		skip++
+	}
+
+	partStart := s.partListStart() - first
+	s.playlist = s.renderPlaylistLocked(segments, discSeq, 0, partStart)
+	s.delta = nil
+	if skip > 0 {
+		s.delta = s.renderPlaylistLocked(segments, discSeq, skip, partStart)
+	}
+}
+
+func (s *LLStream) renderPlaylistLocked(segments []*llSegment, discSeq uint64, skip, partStart int) []byte {
+	target := s.targetDuration
+	if s.maxDuration > target {
+		target = s.maxDuration
+	}
+	targetSecs := int(math.Ceil(target.Seconds()))
+
+	b := &s.playlistBuild
+	b.Reset()
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:9\n#EXT-X-TARGETDURATION:")
+	b.WriteString(strconv.Itoa(targetSecs))
+	b.WriteString("\n#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,CAN-SKIP-UNTIL=")
+	b.WriteString(formatSeconds(llSkipTargets * s.targetDuration))
+	b.WriteString(",PART-HOLD-BACK=")
+	b.WriteString(formatSeconds(3 * s.partDuration))
+	b.WriteString("\n#EXT-X-PART-INF:PART-TARGET=")
+	b.WriteString(formatSeconds(s.partDuration))
+	b.WriteString("\n#EXT-X-MEDIA-SEQUENCE:")
+	b.WriteString(strconv.FormatUint(segments[0].msn, 10))
+	if discSeq > 0 {
+		b.WriteString("\n#EXT-X-DISCONTINUITY-SEQUENCE:")
+		b.WriteString(strconv.FormatUint(discSeq, 10))
+	}
+	b.WriteByte('\n')
+	if skip > 0 {
+		b.WriteString("#EXT-X-SKIP:SKIPPED-SEGMENTS=")
+		b.WriteString(strconv.Itoa(skip))
+		b.WriteByte('\n')
+	}
+
+	base := path.Base(s.name) + "/"
+	initVersion := -1
+	var keyIndex int64 = -1 // 已列出的密钥, -1表示未加密
+	for i, seg := range segments[skip:] {
+		i += skip
+		if seg.discontinuity && i > 0 {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if seg.initVersion != initVersion {
+			// EXT-X-KEY同样作用于其后的EXT-X-MAP, init segment不加密
+			if keyIndex >= 0 {
+				b.WriteString("#EXT-X-KEY:METHOD=NONE\n")
+				keyIndex = -1
+			}
+			b.WriteString(`#EXT-X-MAP:URI="` + base + initUri(seg.initVersion) + "\"\n")
+			initVersion = seg.initVersion
+		}
+		if s.keys != nil && int64(s.keys.index(seg.msn)) != keyIndex {
+			s.keys.writeKeyTag(b, seg.msn)
+			keyIndex = int64(s.keys.index(seg.msn))
+		}
+		b.WriteString("#EXT-X-PROGRAM-DATE-TIME:")
+		b.WriteString(seg.programTime.UTC().Format("2006-01-02T15:04:05.000Z"))
+		b.WriteByte('\n')
+
+		if i >= partStart {
+			for j, part := range seg.parts {
+				b.WriteString("#EXT-X-PART:DURATION=")
+				b.WriteString(formatSeconds(part.duration))
+				b.WriteString(`,URI="` + base + partUri(seg.msn, j) + `"`)
+				if part.independent {
+					b.WriteString(",INDEPENDENT=YES")
+				}
+				b.WriteByte('\n')
+			}
+		}
+
+		if seg.complete {
+			b.WriteString("#EXTINF:")
+			b.WriteString(formatSeconds(seg.duration))
+			b.WriteString(",\n")
+			b.WriteString(base + llSegmentUri(seg.msn))
+			b.WriteByte('\n')
+		}
+	}
+
+	// 下一个part: 当前切片的下一个, 或下一个切片的第一个
+	last := segments[len(segments)-1]
+	if last.complete {
+		next := last.msn + 1
+		if s.keys != nil && int64(s.keys.index(next)) != keyIndex {
+			if _, ok := s.keys.Key(s.keys.index(next)); ok {
+				s.keys.writeKeyTag(b, next)
+			}
+		}
+		b.WriteString(`#EXT-X-PRELOAD-HINT:TYPE=PART,URI="` + base + partUri(last.msn+1, 0) + "\"\n")
+	} else {
+		b.WriteString(`#EXT-X-PRELOAD-HINT:TYPE=PART,URI="` + base + partUri(last.msn, len(last.parts)) + "\"\n")
+	}
+
+	return append([]byte(nil), b.Bytes()...)
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+// Close 唤醒所有等待的请求, 删除所有切片, part及init segment
+func (s *LLStream) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	close(s.update)
+	s.update = make(chan struct{})
+	segments := s.segments
+	s.segments, s.playlist, s.delta = nil, nil, nil
+	s.mu.Unlock()
+
+	var firstErr error
+	names := make([]string, 0, len(segments)*4+2)
+	for v := 0; v <= s.initVersion && s.initWritten; v++ {
+		names = append(names, s.fileName(initUri(v)))
+	}
+	for _, seg := range segments {
+		names = append(names, s.fileName(llSegmentUri(seg.msn)))
+		if !seg.partsRemoved {
+			for i := range seg.parts {
+				names = append(names, s.fileName(partUri(seg.msn, i)))
+			}
+		}
+	}
+	names = append(names, s.name) // 切片目录
+
+	for _, name := range names {
+		if err := s.store.Remove(name); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if s.keys != nil {
+		s.keys.clear()
+	}
+	return firstErr
+}
+
+type llStreamOption func(*LLStream)
+
+// WithLLName 存储中的名称前缀, 如vhost/app/stream
+func WithLLName(name string) llStreamOption {
+	return func(s *LLStream) {
+		s.name = name
+	}
+}
+
+func WithLLStore(store Store) llStreamOption {
+	return func(s *LLStream) {
+		s.store = store
+	}
+}
+
+// WithLLTargetDuration 目标切片时长(默认4s)
+func WithLLTargetDuration(d time.Duration) llStreamOption {
+	return func(s *LLStream) {
+		s.targetDuration = d
+	}
+}
+
+// WithPartDuration part目标时长(默认1s), 不能超过目标切片时长
+func WithPartDuration(d time.Duration) llStreamOption {
+	return func(s *LLStream) {
+		s.partDuration = d
+	}
+}
+
+// WithLLWindow playlist中的完整切片数(默认6)
+func WithLLWindow(n int) llStreamOption {
+	return func(s *LLStream) {
+		s.window = n
+	}
+}
+
+// WithRenditionReports 同组其他rendition的进度, 每次返回playlist时调用
+func WithRenditionReports(reports func() []RenditionReport) llStreamOption {
+	return func(s *LLStream) {
+		s.reports = reports
+	}
+}
+
+// WithLLAlignedSegments 切片边界对齐到目标时长网格, 用于多码率的各rendition
+func WithLLAlignedSegments(aligned bool) llStreamOption {
+	return func(s *LLStream) {
+		s.alignSegments = aligned
+	}
+}
+
+// WithLLKeyRing AES-128加密part及切片
+func WithLLKeyRing(k *KeyRing) llStreamOption {
+	return func(s *LLStream) {
+		s.keys = k
+	}
+}
@@ -0,0 +1,99 @@
+package hls
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Store 切片及playlist的存储, name为"/"分隔的相对路径; 不存在时Get返回os.ErrNotExist
+type Store interface {
+	Put(name string, data []byte) error
+	Get(name string) ([]byte, error)
+	Remove(name string) error
+}
+
+// MemoryStore 内存存储, Put之后data不可再修改
+type MemoryStore struct {
+	mu    sync.RWMutex
+	files map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{files: make(map[string][]byte)}
+}
+
+func (ms *MemoryStore) Put(name string, data []byte) error {
+	ms.mu.Lock()
+	ms.files[cleanName(name)] = data
+	ms.mu.Unlock()
+	return nil
+}
+
+func (ms *MemoryStore) Get(name string) ([]byte, error) {
+	ms.mu.RLock()
+	data, ok := ms.files[cleanName(name)]
+	ms.mu.RUnlock()
+
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return data, nil
+}
+
+func (ms *MemoryStore) Remove(name string) error {
+	ms.mu.Lock()
+	delete(ms.files, cleanName(name))
+	ms.mu.Unlock()
+	return nil
+}
+
+// DiskStore 磁盘存储, 文件先写临时文件再rename, 读取方不会看到不完整的文件
+type DiskStore struct {
+	root string
+}
+
+func NewDiskStore(root string) (*DiskStore, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, errors.Wrap(err, "create hls directory")
+	}
+	return &DiskStore{root: root}, nil
+}
+
+// path name限制在root之内
+func (ds *DiskStore) path(name string) string {
+	return filepath.Join(ds.root, filepath.FromSlash(cleanName(name)))
+}
+
+func (ds *DiskStore) Put(name string, data []byte) error {
+	p := ds.path(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return errors.Wrap(err, "create directory")
+	}
+
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrap(err, "write file")
+	}
+	return errors.Wrap(os.Rename(tmp, p), "rename file")
+}
+
+func (ds *DiskStore) Get(name string) ([]byte, error) {
+	return ioutil.ReadFile(ds.path(name))
+}
+
+// Remove 删除文件或空目录, 不存在时忽略
+func (ds *DiskStore) Remove(name string) error {
+	if err := os.Remove(ds.path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func cleanName(name string) string {
+	return path.Clean("/" + name)[1:]
+}
@@ -0,0 +1,391 @@
+package hls
+
+import (
+	"bytes"
+	"math"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"fastlive/pkg/av"
+	"fastlive/pkg/av/ts"
+)
+
+/*
+单个流的HLS切片:
+1. 有视频时在达到目标时长后的第一个关键帧切片, 纯音频流按时长切片; 第一个关键帧之前的数据丢弃
+2. playlist保留最近window个切片, 移出playlist的切片再保留keepSegments个后删除(正在下载的客户端不受影响)
+3. Discontinuity(推流端重连)或时间戳回退时结束当前切片, 下一个切片标记EXT-X-DISCONTINUITY
+4. 设置KeyRing时加密切片(见key.go), 获取密钥失败时不输出该切片, 在下一个可切片位置重试
+5. 对齐模式(多码率): 时间戳跨过目标时长网格线后的第一个可切片位置切片, 第一个切片的序号为所在网格的序号,
+   时间戳同源且关键帧一致的多个流切片边界及序号相同
+*/
+
+const keepSegments = 2
+
+// Segment 已完成的切片
+type Segment struct {
+	Seq           uint64
+	Duration      time.Duration
+	Discontinuity bool
+	Size          int
+}
+
+// Stream 单个流的切片状态, 非并发安全(由同一协程写入); 读取通过Store
+type Stream struct {
+	name           string // 存储中的名称前缀, 如vhost/app/stream
+	store          Store
+	targetDuration time.Duration
+	window         int
+
+	muxer    *ts.Muxer
+	buf      bytes.Buffer
+	hasVideo bool
+	keys     *KeyRing // 为nil时不加密
+	curKey   []byte   // 当前切片的密钥
+	aligned  bool     // 切片边界对齐到目标时长网格
+
+	cur         *Segment // 正在生成的切片, 等待第一个关键帧时为nil
+	curStart    uint32   // 当前切片的起始/最近时间戳(ms)
+	curLast     uint32
+	pendingDisc bool // 下一个切片标记discontinuity
+
+	segments    []*Segment // 已完成的切片(含已移出playlist暂未删除的)
+	nextSeq     uint64
+	removedDisc uint64        // 已删除切片中的discontinuity数
+	maxDuration time.Duration // 出现过的最长切片, 决定EXT-X-TARGETDURATION
+	playlist    bytes.Buffer
+}
+
+func NewStream(opts ...streamOption) (*Stream, error) {
+	return (&Stream{}).loadOptions(opts...)
+}
+
+func (s *Stream) loadOptions(opts ...streamOption) (*Stream, error) {
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.name == "" {
+		return nil, errStreamName
+	}
+
+	if s.store == nil {
+		return nil, errStreamStore
+	}
+
+	if s.targetDuration <= 0 {
+		s.targetDuration = 4 * time.Second
+	}
+
+	if s.window <= 0 {
+		s.window = 6
+	}
+
+	s.muxer = ts.NewMuxer(&s.buf)
+	return s, nil
+}
+
+// PlaylistName playlist在存储中的名称
+func (s *Stream) PlaylistName() string {
+	return s.name + ".m3u8"
+}
+
+// SegmentName 切片在存储中的名称, playlist中以相对路径引用
+func (s *Stream) SegmentName(seq uint64) string {
+	return s.name + "/" + s.segmentUri(seq)
+}
+
+func (s *Stream) segmentUri(seq uint64) string {
+	return strconv.FormatUint(seq, 10) + ".ts"
+}
+
+// WritePacket 写入一个packet, 满足切片条件时完成当前切片并更新playlist
+func (s *Stream) WritePacket(pkt *av.Packet) error {
+	switch pkt.PacketType {
+	case av.VideoType:
+		vh, ok := pkt.PacketHeader.(av.VideoPacketHeader)
+		if !ok {
+			return errors.New("hls: video packet header required")
+		}
+
+		if vh.IsSequenceHeader() {
+			err := s.muxer.WritePacket(pkt)
+			s.hasVideo = err == nil
+			return err
+		}
+
+		if vh.IsKeyFrame() {
+			if err := s.cutIfNeeded(pkt.Timestamp); err != nil {
+				return err
+			}
+		}
+	case av.AudioType:
+		if ah, ok := pkt.PacketHeader.(av.AudioPacketHeader); ok && ah.SoundFormat() == 10 && ah.AACPacketType() == 0 {
+			return s.muxer.WritePacket(pkt)
+		}
+
+		if !s.hasVideo {
+			if err := s.cutIfNeeded(pkt.Timestamp); err != nil {
+				return err
+			}
+		}
+	default:
+		return nil
+	}
+
+	if s.cur == nil {
+		return nil
+	}
+
+	if pkt.Timestamp > s.curLast {
+		s.curLast = pkt.Timestamp
+	}
+	return s.muxer.WritePacket(pkt)
+}
+
+// cutIfNeeded 在可切片的位置(关键帧, 纯音频时的音频帧)判断是否开始新切片
+func (s *Stream) cutIfNeeded(timestamp uint32) error {
+	if s.cur != nil {
+		if timestamp < s.curStart { // 时间戳回退
+			s.pendingDisc = true
+		} else if !s.reachedTarget(timestamp) {
+			return nil
+		}
+
+		end := timestamp
+		if s.pendingDisc {
+			end = s.curLast
+		}
+		if err := s.finishSegment(end); err != nil {
+			return err
+		}
+	}
+
+	disc := s.pendingDisc && s.nextSeq > 0
+	if s.aligned && s.nextSeq == 0 {
+		s.nextSeq = gridIndex(timestamp, s.targetDuration)
+	}
+
+	if err := s.setKey(s.nextSeq); err != nil {
+		s.pendingDisc = true
+		return err
+	}
+
+	s.cur = &Segment{Seq: s.nextSeq, Discontinuity: disc}
+	s.nextSeq++
+	s.pendingDisc = false
+	s.curStart, s.curLast = timestamp, timestamp
+
+	s.buf.Reset()
+	return errors.Wrap(s.muxer.WriteTables(), "hls: write pat/pmt")
+}
+
+// reachedTarget 当前切片能否在timestamp处结束: 默认达到目标时长, 对齐模式下跨过网格线
+func (s *Stream) reachedTarget(timestamp uint32) bool {
+	if s.aligned {
+		return gridIndex(timestamp, s.targetDuration) > gridIndex(s.curStart, s.targetDuration)
+	}
+	return time.Duration(timestamp-s.curStart)*time.Millisecond >= s.targetDuration
+}
+
+// gridIndex 时间戳所在的目标时长网格
+func gridIndex(timestamp uint32, target time.Duration) uint64 {
+	return uint64(time.Duration(timestamp) * time.Millisecond / target)
+}
+
+// setKey 获取切片seq的密钥, SAMPLE-AES时设置给muxer(随后的PAT/PMT生效)
+func (s *Stream) setKey(seq uint64) error {
+	if s.keys == nil {
+		return nil
+	}
+
+	key, err := s.keys.keyFor(seq)
+	if err != nil {
+		return err
+	}
+	s.curKey = key
+
+	if s.keys.Method() == MethodSampleAes {
+		return errors.Wrap(s.muxer.SetSampleEncryption(key, segmentIv(seq)), "hls: set sample encryption")
+	}
+	return nil
+}
+
+// Discontinuity 推流端重连: 结束当前切片, 之后从新的关键帧开始并标记discontinuity
+func (s *Stream) Discontinuity() error {
+	s.pendingDisc = true
+	if s.cur == nil {
+		return nil
+	}
+	return s.finishSegment(s.curLast)
+}
+
+func (s *Stream) finishSegment(end uint32) error {
+	seg := s.cur
+	s.cur = nil
+
+	seg.Duration = time.Duration(end-s.curStart) * time.Millisecond
+	seg.Size = s.buf.Len()
+	if seg.Size == 0 {
+		return nil
+	}
+
+	var data []byte
+	if s.keys != nil && s.keys.Method() == MethodAes128 {
+		var err error
+		if data, err = encryptAes128(s.curKey, seg.Seq, s.buf.Bytes()); err != nil {
+			return err
+		}
+	} else {
+		data = append([]byte(nil), s.buf.Bytes()...)
+	}
+	if err := s.store.Put(s.SegmentName(seg.Seq), data); err != nil {
+		return errors.Wrap(err, "hls: put segment")
+	}
+
+	s.segments = append(s.segments, seg)
+	if seg.Duration > s.maxDuration {
+		s.maxDuration = seg.Duration
+	}
+
+	for len(s.segments) > s.window+keepSegments {
+		old := s.segments[0]
+		s.segments = s.segments[1:]
+		if old.Discontinuity {
+			s.removedDisc++
+		}
+		if err := s.store.Remove(s.SegmentName(old.Seq)); err != nil {
+			return errors.Wrap(err, "hls: remove segment")
+		}
+	}
+	if s.keys != nil {
+		s.keys.release(s.segments[0].Seq)
+	}
+
+	return errors.Wrap(s.store.Put(s.PlaylistName(), s.renderPlaylist()), "hls: put playlist")
+}
+
+func (s *Stream) renderPlaylist() []byte {
+	segments := s.segments
+	discSeq := s.removedDisc
+	if len(segments) > s.window {
+		for _, seg := range segments[:len(segments)-s.window] {
+			if seg.Discontinuity {
+				discSeq++
+			}
+		}
+		segments = segments[len(segments)-s.window:]
+	}
+
+	target := s.targetDuration
+	if s.maxDuration > target {
+		target = s.maxDuration
+	}
+
+	b := &s.playlist
+	b.Reset()
+	version := "3"
+	if s.keys != nil && s.keys.Method() == MethodSampleAes {
+		version = "5"
+	}
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:" + version + "\n#EXT-X-TARGETDURATION:")
+	b.WriteString(strconv.Itoa(int(math.Ceil(target.Seconds()))))
+	b.WriteString("\n#EXT-X-MEDIA-SEQUENCE:")
+	b.WriteString(strconv.FormatUint(segments[0].Seq, 10))
+	if discSeq > 0 {
+		b.WriteString("\n#EXT-X-DISCONTINUITY-SEQUENCE:")
+		b.WriteString(strconv.FormatUint(discSeq, 10))
+	}
+	b.WriteByte('\n')
+
+	base := path.Base(s.name) + "/"
+	for i, seg := range segments {
+		if seg.Discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if s.keys != nil && (i == 0 || s.keys.index(seg.Seq) != s.keys.index(segments[i-1].Seq)) {
+			s.keys.writeKeyTag(b, seg.Seq)
+		}
+		b.WriteString("#EXTINF:")
+		b.WriteString(strconv.FormatFloat(seg.Duration.Seconds(), 'f', 3, 64))
+		b.WriteString(",\n")
+		b.WriteString(base + s.segmentUri(seg.Seq))
+		b.WriteByte('\n')
+	}
+
+	return append([]byte(nil), b.Bytes()...)
+}
+
+// Close 删除所有切片及playlist
+func (s *Stream) Close() error {
+	var firstErr error
+	names := make([]string, 0, len(s.segments)+2)
+	names = append(names, s.PlaylistName())
+	for _, seg := range s.segments {
+		names = append(names, s.SegmentName(seg.Seq))
+	}
+	names = append(names, s.name) // 切片目录
+
+	for _, name := range names {
+		if err := s.store.Remove(name); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	s.segments, s.cur = nil, nil
+	if s.keys != nil {
+		s.keys.clear()
+	}
+	return firstErr
+}
+
+type streamOption func(*Stream)
+
+// WithName 存储中的名称前缀, 如vhost/app/stream
+func WithName(name string) streamOption {
+	return func(s *Stream) {
+		s.name = name
+	}
+}
+
+func WithStore(store Store) streamOption {
+	return func(s *Stream) {
+		s.store = store
+	}
+}
+
+// WithTargetDuration 目标切片时长(默认4s)
+func WithTargetDuration(d time.Duration) streamOption {
+	return func(s *Stream) {
+		s.targetDuration = d
+	}
+}
+
+// WithWindow playlist中的切片数(默认6)
+func WithWindow(n int) streamOption {
+	return func(s *Stream) {
+		s.window = n
+	}
+}
+
+// WithKeyRing 加密切片
+func WithKeyRing(k *KeyRing) streamOption {
+	return func(s *Stream) {
+		s.keys = k
+	}
+}
+
+// WithAlignedSegments 切片边界对齐到目标时长网格, 用于多码率的各rendition
+func WithAlignedSegments(aligned bool) streamOption {
+	return func(s *Stream) {
+		s.aligned = aligned
+	}
+}
+
+var (
+	errStreamName  = errors.New("hls stream name required")
+	errStreamStore = errors.New("hls stream store required")
+)
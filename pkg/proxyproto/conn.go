@@ -0,0 +1,97 @@
+package proxyproto
+
+import (
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Conn 带PROXY头的连接, ReadHeader成功后RemoteAddr/LocalAddr返回代理传递的地址
+type Conn struct {
+	net.Conn
+	header *Header
+}
+
+func NewConn(c net.Conn) *Conn {
+	return &Conn{Conn: c}
+}
+
+// ReadHeader 读取PROXY头, 必须在读取其他数据前调用
+func (c *Conn) ReadHeader() (*Header, error) {
+	header, err := ReadHeader(c.Conn)
+	if err != nil {
+		return nil, err
+	}
+
+	c.header = header
+	return header, nil
+}
+
+func (c *Conn) Header() *Header {
+	return c.header
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.header != nil && c.header.SrcAddr != nil {
+		return c.header.SrcAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	if c.header != nil && c.header.DstAddr != nil {
+		return c.header.DstAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// TrustedNets 允许发送PROXY头的来源地址, 为空表示不信任任何来源
+type TrustedNets []*net.IPNet
+
+// ParseTrustedNets 解析CIDR列表, 也接受单个IP
+func ParseTrustedNets(cidrs []string) (TrustedNets, error) {
+	nets := make(TrustedNets, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errors.Errorf("invalid trusted ip %q", cidr)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid trusted cidr %q", cidr)
+		}
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+func (t TrustedNets) Contains(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return false
+	}
+
+	for _, n := range t {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package proxyproto
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrustedNets(t *testing.T) {
+	nets, err := ParseTrustedNets([]string{"10.0.0.0/8", "192.168.1.5", "2001:db8::/32"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tests := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.5"), Port: 1}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.6"), Port: 1}, false},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::9"), Port: 1}, true},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db9::9"), Port: 1}, false},
+		{&net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1}, true},
+		{&net.UnixAddr{Name: "/tmp/x", Net: "unix"}, false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, nets.Contains(tt.addr), tt.addr.String())
+	}
+
+	// 空列表不信任任何来源
+	assert.False(t, TrustedNets(nil).Contains(&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1}))
+
+	for _, invalid := range []string{"10.0.0.0/33", "not-an-ip", "300.1.1.1"} {
+		_, err := ParseTrustedNets([]string{invalid})
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestConnAddrs(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		_, _ = client.Write([]byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324 1935\r\nC0"))
+	}()
+
+	c := NewConn(server)
+	assert.Equal(t, server.RemoteAddr(), c.RemoteAddr()) // 读取头部前为代理地址
+
+	header, err := c.ReadHeader()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, header, c.Header())
+	assert.Equal(t, "192.168.0.1:56324", c.RemoteAddr().String())
+	assert.Equal(t, "10.0.0.1:1935", c.LocalAddr().String())
+
+	b := make([]byte, 2)
+	_, err = c.Read(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "C0", string(b))
+}
@@ -0,0 +1,192 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+/*
+PROXY protocol v1/v2 解析, 参考 https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+v1: "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", 最长107字节
+v2: 12字节签名 + ver_cmd(1) + fam(1) + len(2) + 地址(len字节, 可能含TLV), len超过v2MaxLength时拒绝
+*/
+
+const (
+	v1MaxLength = 107
+	v2HeaderLen = 16
+	v2MaxLength = 4096 // 地址及TLV的最大长度
+)
+
+var v2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+var ErrInvalidHeader = errors.New("proxyproto: invalid header")
+
+// Header 解析得到的PROXY头
+type Header struct {
+	Version int
+	Local   bool     // v2 LOCAL命令或v1 UNKNOWN, 连接由代理自身发起(如健康检查), 无地址信息
+	SrcAddr net.Addr // 真实客户端地址
+	DstAddr net.Addr // 代理接受连接的地址
+}
+
+// ReadHeader 从r中读取并解析PROXY头, 不会多读头部之后的数据
+func ReadHeader(r io.Reader) (*Header, error) {
+	var first [1]byte
+	if _, err := io.ReadFull(r, first[:]); err != nil {
+		return nil, errors.Wrap(err, "read first byte")
+	}
+
+	switch first[0] {
+	case 'P':
+		return readV1(r)
+	case v2Signature[0]:
+		return readV2(r)
+	default:
+		return nil, errors.Wrapf(ErrInvalidHeader, "unexpected first byte 0x%02x", first[0])
+	}
+}
+
+func readV1(r io.Reader) (*Header, error) {
+	line := make([]byte, 1, v1MaxLength)
+	line[0] = 'P'
+
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, errors.Wrap(err, "read v1 header")
+		}
+		line = append(line, b[0])
+
+		if b[0] == '\n' {
+			break
+		}
+
+		if len(line) >= v1MaxLength {
+			return nil, errors.Wrap(ErrInvalidHeader, "v1 header too long")
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.Wrap(ErrInvalidHeader, "v1 header not terminated by CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, errors.Wrapf(ErrInvalidHeader, "v1 header %q", line)
+	}
+
+	header := &Header{Version: 1}
+	switch fields[1] {
+	case "UNKNOWN":
+		header.Local = true
+		return header, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, errors.Wrapf(ErrInvalidHeader, "v1 unsupported protocol %q", fields[1])
+	}
+
+	if len(fields) != 6 {
+		return nil, errors.Wrapf(ErrInvalidHeader, "v1 header %q", line)
+	}
+
+	src, err := parseV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+
+	dst, err := parseV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+
+	header.SrcAddr, header.DstAddr = src, dst
+	return header, nil
+}
+
+func parseV1Addr(proto, ip, port string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil || (proto == "TCP4") != (addr.To4() != nil) {
+		return nil, errors.Wrapf(ErrInvalidHeader, "v1 invalid %s address %q", proto, ip)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errors.Wrapf(ErrInvalidHeader, "v1 invalid port %q", port)
+	}
+
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+func readV2(r io.Reader) (*Header, error) {
+	var buf [v2HeaderLen]byte
+	buf[0] = v2Signature[0]
+	if _, err := io.ReadFull(r, buf[1:]); err != nil {
+		return nil, errors.Wrap(err, "read v2 header")
+	}
+
+	if !bytes.Equal(buf[:12], v2Signature) {
+		return nil, errors.Wrap(ErrInvalidHeader, "v2 signature mismatch")
+	}
+
+	if buf[12]>>4 != 2 {
+		return nil, errors.Wrapf(ErrInvalidHeader, "v2 unsupported version %d", buf[12]>>4)
+	}
+
+	command := buf[12] & 0x0f
+	family := buf[13]
+	length := binary.BigEndian.Uint16(buf[14:16])
+	if length > v2MaxLength {
+		return nil, errors.Wrapf(ErrInvalidHeader, "v2 header length %d too large", length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, errors.Wrap(err, "read v2 addresses")
+	}
+
+	header := &Header{Version: 2}
+	switch command {
+	case 0x0: // LOCAL
+		header.Local = true
+		return header, nil
+	case 0x1: // PROXY
+	default:
+		return nil, errors.Wrapf(ErrInvalidHeader, "v2 unsupported command %d", command)
+	}
+
+	switch family {
+	case 0x11, 0x12: // TCP/UDP over IPv4
+		if len(payload) < 12 {
+			return nil, errors.Wrap(ErrInvalidHeader, "v2 ipv4 addresses truncated")
+		}
+		header.SrcAddr = v2Addr(family, payload[0:4], payload[8:10])
+		header.DstAddr = v2Addr(family, payload[4:8], payload[10:12])
+	case 0x21, 0x22: // TCP/UDP over IPv6
+		if len(payload) < 36 {
+			return nil, errors.Wrap(ErrInvalidHeader, "v2 ipv6 addresses truncated")
+		}
+		header.SrcAddr = v2Addr(family, payload[0:16], payload[32:34])
+		header.DstAddr = v2Addr(family, payload[16:32], payload[34:36])
+	default: // UNSPEC/unix socket, 按LOCAL处理
+		header.Local = true
+	}
+
+	return header, nil
+}
+
+func v2Addr(family byte, ip, port []byte) net.Addr {
+	addrIP := make(net.IP, len(ip))
+	copy(addrIP, ip)
+	p := int(binary.BigEndian.Uint16(port))
+
+	if family&0x0f == 0x2 {
+		return &net.UDPAddr{IP: addrIP, Port: p}
+	}
+	return &net.TCPAddr{IP: addrIP, Port: p}
+}
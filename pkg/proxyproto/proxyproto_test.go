@@ -0,0 +1,152 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// v2Header 构造v2头, payload为地址及TLV
+func v2Header(verCmd, family byte, payload []byte) []byte {
+	b := append([]byte(nil), v2Signature...)
+	b = append(b, verCmd, family, 0, 0)
+	binary.BigEndian.PutUint16(b[14:16], uint16(len(payload)))
+	return append(b, payload...)
+}
+
+func v2Ipv4Payload() []byte {
+	return []byte{
+		192, 168, 0, 1, // src
+		10, 0, 0, 1, // dst
+		0xdc, 0x04, // src port 56324
+		0x01, 0xbb, // dst port 443
+	}
+}
+
+func v2Ipv6Payload() []byte {
+	src := net.ParseIP("2001:db8::1")
+	dst := net.ParseIP("2001:db8::2")
+	b := append(append([]byte(nil), src...), dst...)
+	return append(b, 0xdc, 0x04, 0x07, 0x8f) // 56324, 1935
+}
+
+func TestReadHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		want    *Header
+		invalid bool // ErrInvalidHeader
+		ioErr   bool // 数据不完整
+	}{
+		{
+			name:  "v1 tcp4",
+			input: []byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\r\n"),
+			want: &Header{Version: 1,
+				SrcAddr: &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324},
+				DstAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}},
+		},
+		{
+			name:  "v1 tcp6",
+			input: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 1935\r\n"),
+			want: &Header{Version: 1,
+				SrcAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+				DstAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 1935}},
+		},
+		{
+			name:  "v1 unknown",
+			input: []byte("PROXY UNKNOWN\r\n"),
+			want:  &Header{Version: 1, Local: true},
+		},
+		{
+			name:  "v1 unknown with addresses",
+			input: []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"),
+			want:  &Header{Version: 1, Local: true},
+		},
+		{name: "v1 truncated", input: []byte("PROXY TCP4 192.168.0.1"), ioErr: true},
+		{name: "v1 missing cr", input: []byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\n"), invalid: true},
+		{name: "v1 oversized", input: []byte("PROXY TCP6 " + strings.Repeat("f", 120) + "\r\n"), invalid: true},
+		{name: "v1 bad protocol", input: []byte("PROXY UDP4 192.168.0.1 10.0.0.1 1 2\r\n"), invalid: true},
+		{name: "v1 bad keyword", input: []byte("PROXX TCP4 192.168.0.1 10.0.0.1 1 2\r\n"), invalid: true},
+		{name: "v1 missing port", input: []byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324\r\n"), invalid: true},
+		{name: "v1 family mismatch", input: []byte("PROXY TCP4 2001:db8::1 10.0.0.1 1 2\r\n"), invalid: true},
+		{name: "v1 bad port", input: []byte("PROXY TCP4 192.168.0.1 10.0.0.1 65536 443\r\n"), invalid: true},
+		{
+			name:  "v2 tcp4",
+			input: v2Header(0x21, 0x11, v2Ipv4Payload()),
+			want: &Header{Version: 2,
+				SrcAddr: &net.TCPAddr{IP: net.IP{192, 168, 0, 1}, Port: 56324},
+				DstAddr: &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 443}},
+		},
+		{
+			name:  "v2 udp4",
+			input: v2Header(0x21, 0x12, v2Ipv4Payload()),
+			want: &Header{Version: 2,
+				SrcAddr: &net.UDPAddr{IP: net.IP{192, 168, 0, 1}, Port: 56324},
+				DstAddr: &net.UDPAddr{IP: net.IP{10, 0, 0, 1}, Port: 443}},
+		},
+		{
+			name:  "v2 tcp6",
+			input: v2Header(0x21, 0x21, v2Ipv6Payload()),
+			want: &Header{Version: 2,
+				SrcAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+				DstAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 1935}},
+		},
+		{
+			name:  "v2 tcp4 with tlv",
+			input: v2Header(0x21, 0x11, append(v2Ipv4Payload(), 0x04, 0x00, 0x01, 0x00)), // PP2_TYPE_NOOP
+			want: &Header{Version: 2,
+				SrcAddr: &net.TCPAddr{IP: net.IP{192, 168, 0, 1}, Port: 56324},
+				DstAddr: &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 443}},
+		},
+		{name: "v2 local", input: v2Header(0x20, 0x00, nil), want: &Header{Version: 2, Local: true}},
+		{name: "v2 local with addresses", input: v2Header(0x20, 0x11, v2Ipv4Payload()), want: &Header{Version: 2, Local: true}},
+		{name: "v2 unspec family", input: v2Header(0x21, 0x00, nil), want: &Header{Version: 2, Local: true}},
+		{name: "v2 unix family", input: v2Header(0x21, 0x31, make([]byte, 216)), want: &Header{Version: 2, Local: true}},
+		{name: "v2 truncated header", input: v2Header(0x21, 0x11, nil)[:10], ioErr: true},
+		{name: "v2 truncated payload", input: v2Header(0x21, 0x11, v2Ipv4Payload())[:v2HeaderLen+6], ioErr: true},
+		{name: "v2 ipv4 payload too short", input: v2Header(0x21, 0x11, v2Ipv4Payload()[:8]), invalid: true},
+		{name: "v2 ipv6 payload too short", input: v2Header(0x21, 0x21, v2Ipv6Payload()[:20]), invalid: true},
+		{name: "v2 oversized", input: v2Header(0x21, 0x11, make([]byte, v2MaxLength+1)), invalid: true},
+		{name: "v2 bad signature", input: append([]byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0B}, 0x21, 0x11, 0, 0), invalid: true},
+		{name: "v2 bad version", input: v2Header(0x11, 0x11, v2Ipv4Payload()), invalid: true},
+		{name: "v2 bad command", input: v2Header(0x22, 0x11, v2Ipv4Payload()), invalid: true},
+		{name: "no header", input: []byte{0x03, 0x00, 0x00}, invalid: true},
+		{name: "empty", input: nil, ioErr: true},
+	}
+
+	trailing := []byte("rtmp handshake")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bytes.NewReader(append(append([]byte(nil), tt.input...), trailing...))
+			if tt.ioErr {
+				r = bytes.NewReader(tt.input)
+			}
+
+			header, err := ReadHeader(r)
+			switch {
+			case tt.invalid:
+				assert.Equal(t, ErrInvalidHeader, errors.Cause(err))
+				return
+			case tt.ioErr:
+				cause := errors.Cause(err)
+				assert.True(t, cause == io.EOF || cause == io.ErrUnexpectedEOF, "err: %v", err)
+				return
+			}
+
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.want, header)
+			}
+
+			// 不多读头部之后的数据
+			rest, _ := ioutil.ReadAll(r)
+			assert.Equal(t, trailing, rest)
+		})
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gwuhaolin/livego/protocol/amf"
 	"github.com/pkg/errors"
@@ -16,8 +18,15 @@ import (
 
 type Connection struct {
 	Rwc    net.Conn
+	Wc     net.Conn // Flush写入的连接, 为nil时使用Rwc; Rwc为包装后的连接时设置为底层连接, 以使用writev
 	Logger *zap.Logger
 
+	// 超时控制, 0表示不超时
+	ReadTimeout  time.Duration // 读空闲超时, 每次需要从网络读取数据时续期
+	WriteTimeout time.Duration // Flush写超时
+	readWakeup   uint32        // WakeupRead之后不再续期读deadline(原子操作)
+	readDeadline bool          // 当前是否设置了读deadline
+
 	// read
 	ReadBufSize     int
 	Reader          *bufio.Reader
@@ -37,6 +46,20 @@ type Connection struct {
 	DecodeHdrPool *sync.Pool
 	EncodeHdrPool *sync.Pool
 	NewChunkPool  *sync.Pool
+
+	// 流量统计(原子操作)
+	inBytes  uint64
+	outBytes uint64
+
+	Stats Stats // 可选, 全局统计
+}
+
+// Stats 连接统计回调, 实现需并发安全且足够轻量
+type Stats interface {
+	AddInBytes(n int)
+	AddOutBytes(n int)
+	IncInMessage(typeId chunk.RtmpMessageTypeID)
+	IncOutMessage(typeId chunk.RtmpMessageTypeID)
 }
 
 var (
@@ -93,6 +116,20 @@ func (c *Connection) Init() error {
 }
 
 func (c *Connection) Read(p []byte) (n int, err error) {
+	if c.Reader.Buffered() < len(p) && atomic.LoadUint32(&c.readWakeup) == 0 && (c.ReadTimeout > 0 || c.readDeadline) {
+		// ReadTimeout改为0(如进入播放阶段)时清除之前设置的deadline
+		var deadline time.Time
+		if c.ReadTimeout > 0 {
+			deadline = time.Now().Add(c.ReadTimeout)
+		}
+		c.readDeadline = c.ReadTimeout > 0
+
+		_ = c.Rwc.SetReadDeadline(deadline)
+		if atomic.LoadUint32(&c.readWakeup) == 1 { // 与WakeupRead并发, 不能覆盖其deadline
+			_ = c.Rwc.SetReadDeadline(time.Now())
+		}
+	}
+
 	n, err = io.ReadAtLeast(c.Reader, p, len(p))
 	if err != nil {
 		if err == io.EOF { // peer close
@@ -101,6 +138,10 @@ func (c *Connection) Read(p []byte) (n int, err error) {
 
 		return n, err
 	}
+	atomic.AddUint64(&c.inBytes, uint64(n))
+	if c.Stats != nil {
+		c.Stats.AddInBytes(n)
+	}
 
 	//TODO: 记录inAck信息
 	return n, nil
@@ -126,8 +167,21 @@ func (c *Connection) Flush() (n int64, err error) {
 		}(p)
 	}
 
+	wc := c.Wc
+	if wc == nil {
+		wc = c.Rwc
+	}
+
+	if c.WriteTimeout > 0 {
+		_ = wc.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
+	}
+
 	//TODO: 记录outAck信息
-	nw, err := c.writeBuf.WriteTo(c.Rwc)
+	nw, err := c.writeBuf.WriteTo(wc)
+	atomic.AddUint64(&c.outBytes, uint64(nw))
+	if c.Stats != nil {
+		c.Stats.AddOutBytes(int(nw))
+	}
 	if cap(c.writeBuf) < 64 {
 		c.writeBuf = make(net.Buffers, 0, 128)
 	}
@@ -135,6 +189,22 @@ func (c *Connection) Flush() (n int64, err error) {
 	return nw, err
 }
 
+// InBytes 已接收的字节数(不含握手)
+func (c *Connection) InBytes() uint64 {
+	return atomic.LoadUint64(&c.inBytes)
+}
+
+// OutBytes 已发送的字节数(不含握手)
+func (c *Connection) OutBytes() uint64 {
+	return atomic.LoadUint64(&c.outBytes)
+}
+
+// WakeupRead 唤醒阻塞在读操作上的协程(读返回超时错误), 之后ReadTimeout不再续期, 可并发调用
+func (c *Connection) WakeupRead() {
+	atomic.StoreUint32(&c.readWakeup, 1)
+	_ = c.Rwc.SetReadDeadline(time.Now())
+}
+
 func (c *Connection) Close() error {
 	return c.Rwc.Close()
 }
@@ -191,6 +261,9 @@ func (c *Connection) RecvIntegralMessage() (*chunk.Stream, error) {
 		}
 
 		if msg.IsIntergral { //接收到完整的message
+			if c.Stats != nil {
+				c.Stats.IncInMessage(msg.GetChunkMessageTypeID())
+			}
 			return msg, nil
 		}
 	}
@@ -469,6 +542,10 @@ func (c *Connection) SendIntegralMessage(msg *chunk.Chunk) (int, error) {
 		}
 	}
 
+	if c.Stats != nil {
+		c.Stats.IncOutMessage(msg.GetChunkMessageTypeID())
+	}
+
 	return writeSize, nil
 }
 
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
-	"fmt"
 	"io"
 	"math/rand"
 	"time"
@@ -24,10 +23,16 @@ func WithClient(rw io.ReadWriter, handshakeTimeout time.Duration) error {
 	case err := <-ch:
 		return err
 	case <-time.After(handshakeTimeout):
-		return errors.New("handshake timeout")
+		return ErrTimeout
 	}
 }
 
+var (
+	ErrTimeout   = errors.New("rtmp: handshake timeout")
+	ErrVersion   = errors.New("rtmp: handshake version invalid")
+	ErrInvalidC1 = errors.New("rtmp: handshake server: C1 invalid")
+)
+
 func serverHandshke(rw io.ReadWriter) error {
 	/* random:
 	1. c0c1c2: c0(1) + c1(1536) + c2(1536)
@@ -53,7 +58,7 @@ func serverHandshke(rw io.ReadWriter) error {
 	}
 
 	if c0[0] != 3 {
-		return fmt.Errorf("rtmp: handshake version=%d invalid", c0[0])
+		return errors.Wrapf(ErrVersion, "version=%d", c0[0])
 	}
 	s0[0] = 3
 
@@ -63,7 +68,7 @@ func serverHandshke(rw io.ReadWriter) error {
 		var ok bool
 		var digest []byte
 		if ok, digest = complexHandshakeParseC1(c1, hsClientPartialKey, hsServerFullKey); !ok {
-			return fmt.Errorf("rtmp: handshake server: C1 invalid")
+			return ErrInvalidC1
 		}
 
 		srvTime := cliTime
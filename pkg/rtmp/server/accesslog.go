@@ -0,0 +1,225 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	accessLogJson = "json"
+	accessLogText = "text"
+)
+
+// 连接结束原因
+const (
+	closeReasonClient    = "client_close" // 客户端断开
+	closeReasonTimeout   = "timeout"      // 读写超时
+	closeReasonShutdown  = "shutdown"     // server关闭
+	closeReasonStreamEnd = "stream_end"   // 播放的session被删除
+	closeReasonKicked    = "kicked"       // 管理API踢出
+	closeReasonWatchdog  = "watchdog"     // 看门狗断开静默的推流端
+	closeReasonError     = "error"
+)
+
+const (
+	accessRolePublish = "publish"
+	accessRolePlay    = "play"
+)
+
+// accessRecord 一次推流/播放的访问日志
+type accessRecord struct {
+	Protocol   string    `json:"protocol"` // rtmp / http-flv / ws-flv
+	Role       string    `json:"role"`     // publish / play
+	ClientIp   string    `json:"clientIp"`
+	ClientAddr string    `json:"clientAddr"`
+	Vhost      string    `json:"vhost"`
+	App        string    `json:"app"`
+	Stream     string    `json:"stream"`
+	SessionId  string    `json:"sessionId"`
+	StartTime  time.Time `json:"startTime"`
+	EndTime    time.Time `json:"endTime"`
+	Duration   float64   `json:"duration"` // 秒
+	BytesIn    uint64    `json:"bytesIn"`
+	BytesOut   uint64    `json:"bytesOut"`
+	Dropped    uint64    `json:"dropped"` // 播放端消费过慢丢弃的packet数
+	Reason     string    `json:"reason"`
+	Error      string    `json:"error,omitempty"`
+	Encoder    string    `json:"encoder,omitempty"` // 推流端onMetaData
+	FlashVer   string    `json:"flashVer,omitempty"`
+	UserAgent  string    `json:"userAgent,omitempty"` // http播放端
+	TcUrl      string    `json:"tcUrl,omitempty"`     // http播放端为请求url(不含token参数)
+}
+
+// accessLogger 访问日志, 写入独立的切割文件
+type accessLogger struct {
+	mu  sync.Mutex
+	w   io.WriteCloser
+	buf bytes.Buffer
+}
+
+func newAccessLogger(cfg AccessLogConfig) (*accessLogger, error) {
+	rotator, err := newRotator(cfg.Path, cfg.RotationTime, cfg.Age)
+	if err != nil {
+		return nil, errors.Wrap(err, "create access log rotator")
+	}
+
+	return &accessLogger{w: rotator}, nil
+}
+
+func (l *accessLogger) write(format string, rec *accessRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.buf.Reset()
+	if format == accessLogText {
+		rec.appendText(&l.buf)
+	} else if err := json.NewEncoder(&l.buf).Encode(rec); err != nil {
+		return errors.Wrap(err, "encode access record")
+	}
+
+	_, err := l.w.Write(l.buf.Bytes())
+	return err
+}
+
+func (l *accessLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Close()
+}
+
+// appendText 类似nginx combined格式:
+// ip - - [time] "ROLE /vhost/app/stream PROTOCOL" reason bytesOut "tcUrl" "flashVer或userAgent" bytesIn duration dropped sessionId "encoder" "error"
+func (rec *accessRecord) appendText(buf *bytes.Buffer) {
+	buf.WriteString(rec.ClientIp)
+	buf.WriteString(" - - [")
+	buf.WriteString(rec.EndTime.Format("02/Jan/2006:15:04:05 -0700"))
+	buf.WriteString("] \"")
+	if rec.Role == accessRolePublish {
+		buf.WriteString("PUBLISH /")
+	} else {
+		buf.WriteString("PLAY /")
+	}
+	buf.WriteString(rec.Vhost + "/" + rec.App + "/" + rec.Stream + " ")
+	buf.WriteString(strings.ToUpper(rec.Protocol))
+	buf.WriteString("\" ")
+	buf.WriteString(rec.Reason)
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatUint(rec.BytesOut, 10))
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.Quote(rec.TcUrl))
+	buf.WriteByte(' ')
+	if rec.FlashVer != "" {
+		buf.WriteString(strconv.Quote(rec.FlashVer))
+	} else {
+		buf.WriteString(strconv.Quote(rec.UserAgent))
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatUint(rec.BytesIn, 10))
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatFloat(rec.Duration, 'f', 3, 64))
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatUint(rec.Dropped, 10))
+	buf.WriteByte(' ')
+	if rec.SessionId == "" {
+		buf.WriteByte('-')
+	} else {
+		buf.WriteString(rec.SessionId)
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.Quote(rec.Encoder))
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.Quote(rec.Error))
+	buf.WriteByte('\n')
+}
+
+// writeAccessLog 未配置访问日志时忽略
+func (s *Server) writeAccessLog(rec *accessRecord) {
+	if s.accessLog == nil {
+		return
+	}
+
+	if err := s.accessLog.write(s.getConfig().AccessLog.Format, rec); err != nil {
+		s.logger.Warn("write access log", zap.Error(err))
+	}
+}
+
+// closeWithReason server主动断开连接, 记录原因供访问日志使用
+func (c *conn) closeWithReason(reason string) error {
+	c.closeReason.Store(reason)
+	return c.Connection.Close()
+}
+
+// setCloseReason 连接结束原因, server主动断开时以stored中记录的原因为准; 异常结束时记录错误信息
+func (rec *accessRecord) setCloseReason(s *Server, stored *atomic.Value, err error) {
+	cause := errors.Cause(err)
+	if reason, ok := stored.Load().(string); ok {
+		rec.Reason = reason
+	} else {
+		switch {
+		case s.shuttingDown() || cause == ErrServerClosed:
+			rec.Reason = closeReasonShutdown
+		case err == nil || cause == io.EOF:
+			rec.Reason = closeReasonClient
+		case cause == errPlayerBufferClosed:
+			rec.Reason = closeReasonStreamEnd
+		case isTimeout(err):
+			rec.Reason = closeReasonTimeout
+		default:
+			rec.Reason = closeReasonError
+		}
+	}
+
+	if err != nil && (rec.Reason == closeReasonError || rec.Reason == closeReasonTimeout) {
+		rec.Error = err.Error()
+	}
+}
+
+// accessRecord 以连接信息填充访问日志, 在推流/播放结束时调用
+func (c *conn) accessRecord(role string, start time.Time, err error) *accessRecord {
+	now := time.Now()
+	addr := c.Connection.Rwc.RemoteAddr().String()
+
+	rec := &accessRecord{
+		Protocol:   protocolRtmp,
+		Role:       role,
+		ClientIp:   hostOf(addr),
+		ClientAddr: addr,
+		Vhost:      c.vhost(),
+		App:        c.clientConnectInfo.app,
+		Stream:     c.clientPublishOrPlayInfo.stream,
+		StartTime:  start,
+		EndTime:    now,
+		Duration:   now.Sub(start).Seconds(),
+		BytesIn:    c.Connection.InBytes(),
+		BytesOut:   c.Connection.OutBytes(),
+		FlashVer:   c.clientConnectInfo.flashVer,
+		TcUrl:      c.clientConnectInfo.tcUrl,
+	}
+
+	rec.setCloseReason(c.server, &c.closeReason, err)
+
+	if role == accessRolePublish {
+		rec.Encoder = c.onMetaData.Encoder
+	}
+
+	return rec
+}
+
+// hostOf 去掉地址中的端口
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,375 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+HTTP管理API
+GET    /api/v1/summary                                   server概况
+GET    /api/v1/vhosts                                    vhost/app/stream列表
+GET    /api/v1/streams?vhost=&app=                       流列表(可按vhost/app过滤)
+GET    /api/v1/streams/{vhost}/{app}/{stream}            流详情
+DELETE /api/v1/streams/{vhost}/{app}/{stream}            踢掉推流端
+GET    /api/v1/streams/{vhost}/{app}/{stream}/players    播放端列表
+DELETE /api/v1/streams/{vhost}/{app}/{stream}/players/{id} 踢掉播放端(id: 播放端地址)
+GET    /api/v1/events?vhost=&app=&stream=&types=&lastEventId= 事件流(SSE/websocket, 见api_events.go)
+*/
+
+const apiPrefix = "/api/v1/"
+
+type apiResponse struct {
+	Code int         `json:"code"`
+	Msg  string      `json:"msg"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+type apiSummary struct {
+	StartTime   time.Time `json:"startTime"`
+	Uptime      int64     `json:"uptime"` // 秒
+	Connections int32     `json:"connections"`
+	Sessions    int32     `json:"sessions"`
+	Publishers  int       `json:"publishers"`
+	Players     int       `json:"players"`
+	BitrateKbps uint64    `json:"bitrateKbps"` // 推流总码率
+}
+
+type apiVhost struct {
+	Name string    `json:"name"`
+	Apps []*apiApp `json:"apps"`
+}
+
+type apiApp struct {
+	Name    string       `json:"name"`
+	Streams []*apiStream `json:"streams"`
+}
+
+type apiStream struct {
+	Vhost      string        `json:"vhost"`
+	App        string        `json:"app"`
+	Stream     string        `json:"stream"`
+	SessionId  string        `json:"sessionId"`
+	CreateTime time.Time     `json:"createTime"`
+	Online     bool          `json:"online"` // 是否有推流端
+	Players    int32         `json:"players"`
+	Publisher  *apiPublisher `json:"publisher,omitempty"`
+}
+
+type apiPublisher struct {
+	ClientAddr  string    `json:"clientAddr"`
+	FlashVer    string    `json:"flashVer"`
+	TcUrl       string    `json:"tcUrl"`
+	Encoder     string    `json:"encoder"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	Framerate   float64   `json:"framerate"`
+	VideoCodec  string    `json:"videoCodec"`
+	AudioCodec  string    `json:"audioCodec"`
+	BitrateKbps uint64    `json:"bitrateKbps"`
+	BytesIn     uint64    `json:"bytesIn"`
+	StartTime   time.Time `json:"startTime"`
+	Uptime      int64     `json:"uptime"` // 秒
+}
+
+type apiPlayer struct {
+	Id         string    `json:"id"`
+	Protocol   string    `json:"protocol"` // rtmp / http-flv / ws-flv / http-ts / udp-ts
+	ClientAddr string    `json:"clientAddr"`
+	FlashVer   string    `json:"flashVer"`
+	BytesOut   uint64    `json:"bytesOut"`
+	Dropped    uint64    `json:"dropped"` // 消费过慢丢弃的packet数
+	StartTime  time.Time `json:"startTime"`
+	Uptime     int64     `json:"uptime"` // 秒
+}
+
+func (s *Server) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiPrefix+"summary", s.handleApiSummary)
+	mux.HandleFunc(apiPrefix+"vhosts", s.handleApiVhosts)
+	mux.HandleFunc(apiPrefix+"streams", s.handleApiStreams)
+	mux.HandleFunc(apiPrefix+"streams/", s.handleApiStream)
+	mux.HandleFunc(apiPrefix+"events", s.handleApiEvents)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+
+	if cfg := s.getConfig(); cfg.EnablePprof && cfg.PprofAddr == "" {
+		mountPprof(mux)
+	}
+	return mux
+}
+
+// mountPprof 在mux上挂载/debug/pprof/, 不使用http.DefaultServeMux以免多个Server实例冲突
+func mountPprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+func (s *Server) handleApiSummary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeApiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	now := time.Now()
+	summary := &apiSummary{
+		StartTime:   s.startTime,
+		Uptime:      int64(now.Sub(s.startTime) / time.Second),
+		Connections: atomic.LoadInt32(&s.connTotal),
+		Sessions:    s.broker.getSessionTotalNumber(),
+	}
+
+	s.broker.rangeSessions(func(sess *session) bool {
+		if sess.getPublisher() != nil {
+			summary.Publishers++
+			summary.BitrateKbps += sess.bitrate.Kbps()
+		}
+		summary.Players += int(atomic.LoadInt32(&sess.playerTotal))
+		return true
+	})
+
+	s.writeApiData(w, summary)
+}
+
+func (s *Server) handleApiVhosts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeApiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	vhosts := make([]*apiVhost, 0)
+	for _, stream := range s.listApiStreams("", "") {
+		var vhost *apiVhost
+		for _, v := range vhosts {
+			if v.Name == stream.Vhost {
+				vhost = v
+				break
+			}
+		}
+		if vhost == nil {
+			vhost = &apiVhost{Name: stream.Vhost}
+			vhosts = append(vhosts, vhost)
+		}
+
+		var app *apiApp
+		for _, a := range vhost.Apps {
+			if a.Name == stream.App {
+				app = a
+				break
+			}
+		}
+		if app == nil {
+			app = &apiApp{Name: stream.App}
+			vhost.Apps = append(vhost.Apps, app)
+		}
+
+		app.Streams = append(app.Streams, stream)
+	}
+
+	s.writeApiData(w, vhosts)
+}
+
+func (s *Server) handleApiStreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeApiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	s.writeApiData(w, s.listApiStreams(query.Get("vhost"), query.Get("app")))
+}
+
+// handleApiStream 处理 /api/v1/streams/{vhost}/{app}/{stream}[/players[/{id}]]
+func (s *Server) handleApiStream(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, apiPrefix+"streams/"), "/", 5)
+	if len(parts) < 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		s.writeApiError(w, http.StatusNotFound, "vhost, app and stream required")
+		return
+	}
+
+	sess, ok := s.broker.getSession(genStreamKey(parts[0], parts[1], parts[2]))
+	if !ok {
+		s.writeApiError(w, http.StatusNotFound, "stream not found")
+		return
+	}
+
+	switch {
+	case len(parts) == 3 && r.Method == http.MethodGet:
+		s.writeApiData(w, newApiStream(sess))
+	case len(parts) == 3 && r.Method == http.MethodDelete:
+		publisher := sess.getPublisher()
+		if publisher == nil {
+			s.writeApiError(w, http.StatusNotFound, "publisher not found")
+			return
+		}
+
+		s.logger.Info("kick publisher by api",
+			zap.String("streamKey", sess.streamKey),
+			zap.String("client", publisher.Connection.Rwc.RemoteAddr().String()))
+		_ = publisher.closeWithReason(closeReasonKicked)
+		s.writeApiData(w, nil)
+	case len(parts) == 4 && parts[3] == "players" && r.Method == http.MethodGet:
+		s.writeApiData(w, newApiPlayers(sess))
+	case len(parts) == 5 && parts[3] == "players" && r.Method == http.MethodDelete:
+		value, ok := sess.players.Load(parts[4])
+		if !ok {
+			s.writeApiError(w, http.StatusNotFound, "player not found")
+			return
+		}
+
+		s.logger.Info("kick player by api",
+			zap.String("streamKey", sess.streamKey),
+			zap.String("client", parts[4]))
+		_ = value.(sessionPlayer).kick(closeReasonKicked)
+		s.writeApiData(w, nil)
+	default:
+		s.writeApiError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (s *Server) listApiStreams(vhost, app string) []*apiStream {
+	streams := make([]*apiStream, 0)
+	s.broker.rangeSessions(func(sess *session) bool {
+		if (vhost == "" || sess.vhost == vhost) && (app == "" || sess.appName == app) {
+			streams = append(streams, newApiStream(sess))
+		}
+		return true
+	})
+
+	sort.Slice(streams, func(i, j int) bool {
+		a, b := streams[i], streams[j]
+		if a.Vhost != b.Vhost {
+			return a.Vhost < b.Vhost
+		}
+		if a.App != b.App {
+			return a.App < b.App
+		}
+		return a.Stream < b.Stream
+	})
+
+	return streams
+}
+
+func newApiStream(sess *session) *apiStream {
+	now := time.Now()
+
+	sess.mutex.RLock()
+	defer sess.mutex.RUnlock()
+
+	stream := &apiStream{
+		Vhost:      sess.vhost,
+		App:        sess.appName,
+		Stream:     sess.streamName,
+		SessionId:  sess.id,
+		CreateTime: sess.createTime,
+		Online:     sess.publisher != nil,
+		Players:    atomic.LoadInt32(&sess.playerTotal),
+	}
+
+	if c := sess.publisher; c != nil {
+		meta := sess.metaInfo
+		stream.Publisher = &apiPublisher{
+			ClientAddr:  c.Connection.Rwc.RemoteAddr().String(),
+			FlashVer:    c.clientConnectInfo.flashVer,
+			TcUrl:       c.clientConnectInfo.tcUrl,
+			Encoder:     meta.Encoder,
+			Width:       int(meta.Width),
+			Height:      int(meta.Height),
+			Framerate:   meta.Framerate,
+			VideoCodec:  videoCodecName(sess.videoCodecId, meta.VideoCodecID),
+			AudioCodec:  audioCodecName(sess.audioCodecId, meta.AudioCodecID),
+			BitrateKbps: sess.bitrate.Kbps(),
+			BytesIn:     c.Connection.InBytes(),
+			StartTime:   sess.publishTime,
+			Uptime:      int64(now.Sub(sess.publishTime) / time.Second),
+		}
+	}
+
+	return stream
+}
+
+func newApiPlayers(sess *session) []*apiPlayer {
+	now := time.Now()
+
+	players := make([]*apiPlayer, 0)
+	sess.players.Range(func(k, v interface{}) bool {
+		players = append(players, v.(sessionPlayer).apiInfo(now))
+		return true
+	})
+
+	sort.Slice(players, func(i, j int) bool {
+		return players[i].StartTime.Before(players[j].StartTime)
+	})
+
+	return players
+}
+
+// 优先使用sequence header中的编码ID, 其次使用onMetaData中的
+func videoCodecName(seqHdrCodecId uint8, metaCodecId int) string {
+	id := int(seqHdrCodecId)
+	if id == 0 {
+		id = metaCodecId
+	}
+
+	switch id {
+	case 0:
+		return ""
+	case 2:
+		return "H263"
+	case 3:
+		return "ScreenVideo"
+	case 4:
+		return "VP6"
+	case 7:
+		return "H264"
+	case 12:
+		return "H265"
+	default:
+		return "unknown"
+	}
+}
+
+func audioCodecName(seqHdrCodecId uint8, metaCodecId int) string {
+	id := int(seqHdrCodecId)
+	if id == 0 {
+		id = metaCodecId
+	}
+
+	switch id {
+	case 0:
+		return ""
+	case 2:
+		return "MP3"
+	case 10:
+		return "AAC"
+	case 11:
+		return "Speex"
+	default:
+		return "unknown"
+	}
+}
+
+func (s *Server) writeApiData(w http.ResponseWriter, data interface{}) {
+	s.writeApiResponse(w, http.StatusOK, &apiResponse{Code: 0, Msg: "success", Data: data})
+}
+
+func (s *Server) writeApiError(w http.ResponseWriter, status int, msg string) {
+	s.writeApiResponse(w, status, &apiResponse{Code: status, Msg: msg})
+}
+
+func (s *Server) writeApiResponse(w http.ResponseWriter, status int, resp *apiResponse) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.logger.Debug("write api response", zap.Error(err))
+	}
+}
@@ -0,0 +1,288 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"fastlive/pkg/websocket"
+)
+
+/*
+事件流 GET /api/v1/events?vhost=&app=&stream=&types=&lastEventId=
+1. 默认以SSE(text/event-stream)推送, 请求带websocket握手时以websocket文本消息推送
+2. vhost/app/stream为空表示不过滤, types为逗号分隔的事件类型名(如publish_start,bitrate)
+3. 续传: SSE重连时的Last-Event-ID头或lastEventId参数, 先补发history中之后的事件再推送实时事件
+   history已不包含lastEventId之后的全部事件, 或lastEventId大于最新的id(server重启后id重新开始)时,
+   先推送一个lost消息, 后者从history中最早的事件开始补发
+4. 消费过慢丢弃事件时, 在之后的第一个事件前推送lost消息
+*/
+
+const (
+	eventsBufSize       = 256              // 单个事件流的缓冲, 消费过慢时丢弃事件
+	eventsHeartbeat     = 15 * time.Second // 心跳间隔, 防止中间代理断开空闲连接
+	eventsWriteDeadline = 10 * time.Second // websocket单次发送超时
+)
+
+type eventFilter struct {
+	vhost  string
+	app    string
+	stream string
+	types  []EventType
+}
+
+func (f *eventFilter) match(ev *Event) bool {
+	return (f.vhost == "" || f.vhost == ev.Vhost) &&
+		(f.app == "" || f.app == ev.App) &&
+		(f.stream == "" || f.stream == ev.Stream)
+}
+
+// eventsLost 续传时history不完整, 部分事件已丢失
+type eventsLost struct {
+	Type        string `json:"type"` // 固定为lost
+	LastEventId uint64 `json:"lastEventId"`
+}
+
+// eventWriter 事件流的输出方式(SSE/websocket)
+type eventWriter interface {
+	writeEvent(ev *Event) error
+	writeLost(lost *eventsLost) error
+	heartbeat() error
+	close() error // server关闭时调用
+}
+
+func (s *Server) handleApiEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeApiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	filter := &eventFilter{
+		vhost:  query.Get("vhost"),
+		app:    query.Get("app"),
+		stream: query.Get("stream"),
+	}
+
+	if types := query.Get("types"); types != "" {
+		for _, name := range strings.Split(types, ",") {
+			t, ok := parseEventType(strings.TrimSpace(name))
+			if !ok {
+				s.writeApiError(w, http.StatusBadRequest, "unknown event type: "+name)
+				return
+			}
+			filter.types = append(filter.types, t)
+		}
+	}
+
+	resume := false
+	lastId := uint64(0)
+	if v := r.Header.Get("Last-Event-ID"); v != "" || query.Get("lastEventId") != "" {
+		if v == "" {
+			v = query.Get("lastEventId")
+		}
+
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			s.writeApiError(w, http.StatusBadRequest, "invalid lastEventId")
+			return
+		}
+		resume, lastId = true, id
+	}
+
+	var (
+		ew     eventWriter
+		closed <-chan struct{} // 客户端断开
+	)
+
+	if websocket.IsUpgrade(r) {
+		ws, err := websocket.Upgrade(w, r)
+		if err != nil {
+			s.logger.Debug("events websocket upgrade", zap.Error(err))
+			return
+		}
+		defer ws.Close()
+
+		wsClosed := make(chan struct{})
+		go func() {
+			// 仅处理ping/close, 丢弃客户端发送的数据消息
+			defer close(wsClosed)
+			for {
+				if _, _, err := ws.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		ew, closed = &wsEventWriter{ws: ws}, wsClosed
+	} else {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			s.writeApiError(w, http.StatusInternalServerError, "streaming unsupported")
+			return
+		}
+
+		h := w.Header()
+		h.Set("Content-Type", "text/event-stream")
+		h.Set("Cache-Control", "no-cache")
+		h.Set("Connection", "keep-alive")
+		h.Set("X-Accel-Buffering", "no") // 关闭nginx缓冲
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		ew, closed = &sseEventWriter{w: w, flusher: flusher}, r.Context().Done()
+	}
+
+	if err := s.streamEvents(ew, closed, filter, resume, lastId); err != nil {
+		s.logger.Debug("events stream done", zap.String("client", r.RemoteAddr), zap.Error(err))
+	}
+}
+
+// streamEvents 先订阅再补发history, 实时事件中id不大于已发送id的跳过, 保证不重不漏
+func (s *Server) streamEvents(ew eventWriter, closed <-chan struct{}, filter *eventFilter, resume bool, lastId uint64) error {
+	ch, cancel := s.events.subscribe(eventsBufSize, filter.types)
+	defer cancel()
+
+	if resume {
+		history, ok := s.events.since(lastId)
+		if !ok {
+			if err := ew.writeLost(&eventsLost{Type: "lost", LastEventId: lastId}); err != nil {
+				return err
+			}
+			lastId = 0 // 实时事件以补发的history为准去重
+		}
+
+		for i := range history {
+			ev := &history[i]
+			lastId = ev.Id
+			if !filter.match(ev) || !typeMatch(filter.types, ev.Type) {
+				continue
+			}
+			if err := ew.writeEvent(ev); err != nil {
+				return err
+			}
+		}
+	}
+
+	ticker := time.NewTicker(eventsHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return nil
+		case <-s.httpDone:
+			return ew.close()
+		case <-ticker.C:
+			if err := ew.heartbeat(); err != nil {
+				return err
+			}
+		case ev := <-ch:
+			if ev.Type == EventLost {
+				if err := ew.writeLost(&eventsLost{Type: "lost", LastEventId: lastId}); err != nil {
+					return err
+				}
+				continue
+			}
+			if ev.Id <= lastId {
+				continue
+			}
+			lastId = ev.Id
+			if !filter.match(&ev) {
+				continue
+			}
+			if err := ew.writeEvent(&ev); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func typeMatch(types []EventType, t EventType) bool {
+	if len(types) == 0 {
+		return true
+	}
+	for _, v := range types {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+type sseEventWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (e *sseEventWriter) writeEvent(ev *Event) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	return e.write("id: " + strconv.FormatUint(ev.Id, 10) + "\nevent: " + ev.Type.String() + "\ndata: " + string(data) + "\n\n")
+}
+
+func (e *sseEventWriter) writeLost(lost *eventsLost) error {
+	data, err := json.Marshal(lost)
+	if err != nil {
+		return err
+	}
+
+	return e.write("event: lost\ndata: " + string(data) + "\n\n")
+}
+
+func (e *sseEventWriter) heartbeat() error {
+	return e.write(": ping\n\n")
+}
+
+func (e *sseEventWriter) close() error {
+	return nil
+}
+
+func (e *sseEventWriter) write(s string) error {
+	if _, err := e.w.Write([]byte(s)); err != nil {
+		return err
+	}
+	e.flusher.Flush()
+	return nil
+}
+
+type wsEventWriter struct {
+	ws *websocket.Conn
+}
+
+func (e *wsEventWriter) writeEvent(ev *Event) error {
+	return e.writeJson(ev)
+}
+
+func (e *wsEventWriter) writeLost(lost *eventsLost) error {
+	return e.writeJson(lost)
+}
+
+func (e *wsEventWriter) heartbeat() error {
+	return e.write(websocket.OpPing, nil)
+}
+
+func (e *wsEventWriter) close() error {
+	_ = e.ws.SetWriteDeadline(time.Now().Add(time.Second))
+	return e.ws.WriteClose(websocket.CloseGoingAway, "server shutting down")
+}
+
+func (e *wsEventWriter) writeJson(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return e.write(websocket.OpText, data)
+}
+
+func (e *wsEventWriter) write(opcode int, data []byte) error {
+	_ = e.ws.SetWriteDeadline(time.Now().Add(eventsWriteDeadline))
+	return e.ws.WriteMessage(opcode, data)
+}
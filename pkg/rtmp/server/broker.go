@@ -25,16 +25,12 @@ func (b *broker) createSession(publisher *conn, vhost, streamKey, sessionId stri
 
 	if value, ok := b.sessionMap.Load(streamKey); ok {
 		sess := value.(*session)
-		if sess.publisher == nil { // session短暂中断, publisher软删除被重置为nil
-			sess.publisher = publisher
-			if sess.id != sessionId {
-				//TODO: warn
-				sess.id = sessionId
-			}
+		if sess.resumePublisher(publisher, sessionId) { // session短暂中断, publisher软删除被重置为nil
+			b.publishEvent(sess, EventPublishStart, publisher.remoteAddr())
 			return sess, nil
 		}
 
-		return nil, errors.Errorf("session exists, vhost: %s, app: %s, stream: %s", vhost, appName, streamName)
+		return nil, errors.Wrapf(errSessionExists, "vhost: %s, app: %s, stream: %s", vhost, appName, streamName)
 	}
 
 	sess, err := newSession(
@@ -49,8 +45,14 @@ func (b *broker) createSession(publisher *conn, vhost, streamKey, sessionId stri
 	if err != nil {
 		return nil, errors.Wrap(err, "new session instance")
 	} else {
+		sess.appMetrics = b.server.metrics.acquireApp(appName)
+		sess.group = b.server.joinRenditionGroup(sess)
+		sess.packagers = b.server.newPackagers(sess)
 		b.sessionMap.Store(streamKey, sess)
 		atomic.AddInt32(&b.sessionTotal, 1)
+		atomic.AddInt64(&sess.appMetrics.sessions, 1)
+		b.publishEvent(sess, EventPublishStart, publisher.remoteAddr())
+		b.server.startUdpOutputs(sess)
 	}
 
 	return sess, nil
@@ -63,44 +65,93 @@ func (b *broker) softDelSession(streamKey string) error {
 	}
 
 	sess := value.(*session)
-	sess.publisher = nil
+	publisher := sess.getPublisher()
+	sess.resetPublisher()
 	sess.offline <- true
+	b.publishEvent(sess, EventPublishStop, publisher.remoteAddr())
 
 	return nil
 }
 
 func (b *broker) delSession(streamKey string) {
-	b.sessionMap.Delete(streamKey)
+	value, loaded := b.sessionMap.LoadAndDelete(streamKey)
+	if !loaded {
+		return
+	}
+
+	sess := value.(*session)
 	atomic.AddInt32(&b.sessionTotal, -1)
+	atomic.AddInt64(&sess.appMetrics.sessions, -1)
+	b.server.metrics.releaseApp(sess.appMetrics)
+	b.publishEvent(sess, EventSessionDelete, "")
+
+	b.server.leaveRenditionGroup(sess)
+	if b.server.usage != nil {
+		b.server.usage.release(sess)
+	}
 }
 
 func (b *broker) addSessionPlayer(c *conn, streamKey string) (*player, error) {
+	p, err := b.attachPlayer(streamKey, func(sess *session) (sessionPlayer, error) {
+		return newPlayer(
+			withPlayerConn(c),
+			withPlayerSession(sess),
+			withPlayerPacketBufSize(150),                 //TODO: config
+			withMergeWriteWaitTime(350*time.Millisecond), //TODO:config
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return p.(*player), nil
+}
+
+// attachPlayer 查找session并加入播放端, 各协议播放端共用
+func (b *broker) attachPlayer(streamKey string, create func(sess *session) (sessionPlayer, error)) (sessionPlayer, error) {
 	value, ok := b.sessionMap.Load(streamKey)
 	if !ok {
-		return nil, errors.Errorf("session not exists, streamKey: %s", streamKey)
+		return nil, errors.Wrapf(errSessionNotExists, "streamKey: %s", streamKey)
 	}
 	sess := value.(*session)
 
-	player, err := newPlayer(
-		withPlayerConn(c),
-		withPlayerSession(sess),
-		withPlayerPacketBufSize(150),                 //TODO: config
-		withMergeWriteWaitTime(350*time.Millisecond), //TODO:config
-	)
+	player, err := create(sess)
 	if err != nil {
 		return nil, errors.Wrap(err, "create player")
 	}
 
 	sess.addPlayer(player)
+	b.publishEvent(sess, EventPlayStart, player.key())
 
 	return player, nil
 }
 
-/*
+// publishEvent 发布session相关事件, clientAddr为触发事件的客户端地址(可为空)
+func (b *broker) publishEvent(sess *session, t EventType, clientAddr string) {
+	ev := sess.event(t)
+	ev.ClientAddr = clientAddr
+	b.server.events.publish(ev)
+}
+
 func (b *broker) getSessionTotalNumber() int32 {
 	return atomic.LoadInt32(&b.sessionTotal)
 }
-*/
+
+func (b *broker) getSession(streamKey string) (*session, bool) {
+	value, ok := b.sessionMap.Load(streamKey)
+	if !ok {
+		return nil, false
+	}
+
+	return value.(*session), true
+}
+
+// rangeSessions 遍历所有session, f返回false时停止
+func (b *broker) rangeSessions(f func(sess *session) bool) {
+	b.sessionMap.Range(func(k, v interface{}) bool {
+		return f(v.(*session))
+	})
+}
 
 func newBroker(opts ...brokerOption) (*broker, error) {
 	return (&broker{}).loadOptions(opts...)
@@ -131,5 +182,7 @@ func WithBrokerServer(server *Server) brokerOption {
 }
 
 var (
-	errBrokerServer = errors.New("broker belongs to server required")
+	errBrokerServer     = errors.New("broker belongs to server required")
+	errSessionExists    = errors.New("session exists")
+	errSessionNotExists = errors.New("session not exists")
 )
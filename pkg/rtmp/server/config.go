@@ -1,57 +1,782 @@
 package server
 
 import (
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v2"
+
+	"fastlive/pkg/hls"
+	"fastlive/pkg/proxyproto"
 )
 
-type config struct {
-	Addr           string // 监听地址，默认 ":1935"
-	ReadBufSize    int    // server创建的连接读数据缓冲区大小(默认8192字节)
-	LocalChunkSize uint32 //for chunk Multiplexing(默认60000字节)
+// Config server配置, 可由配置文件加载(WithConfigPath), 也可直接构造(WithConfig)
+type Config struct {
+	Addr           string           // 监听地址，默认 ":1935", 未配置Listeners时使用
+	Listeners      []ListenerConfig // 多监听配置, 为空时按Addr监听rtmp
+	ReadBufSize    int              // server创建的连接读数据缓冲区大小(默认8192字节)
+	LocalChunkSize uint32           //for chunk Multiplexing(默认60000字节)
 
 	// 超时控制参数
 	HandshakeTimeout     time.Duration
 	PlayorPublishTimeout time.Duration
+	PublishIdleTimeout   time.Duration // 推流端读空闲超时(默认30s)
+	PlayIdleTimeout      time.Duration // 播放端读空闲超时(默认0, 不开启), 需大于播放端发送ack的间隔
+	WriteTimeout         time.Duration // 单次发送超时(默认10s), 播放端长时间无法写入时断开
+	ShutdownTimeout      time.Duration // 优雅关闭等待连接退出的最长时间(默认10s)
+	DrainTimeout         time.Duration // 平滑升级时旧进程等待存量连接结束的最长时间(默认5m)
+
+	// 推流端媒体看门狗
+	Watchdog WatchdogConfig
+
+	// 事件流(/api/v1/events)
+	Events EventsConfig
 
 	// 日志配置
-	Log log
+	Log LogConfig
+
+	// http播放(protocol为http的listener)
+	Http HttpConfig
+
+	// HLS输出, 通过http listener访问
+	Hls HlsConfig
+
+	// DASH输出, 通过http listener访问
+	Dash DashConfig
+
+	// 多码率组: 名称匹配的流作为同一组的不同rendition, 提供HLS master playlist及多Representation的DASH MPD
+	Renditions []RenditionGroupConfig
+
+	// MPEG-TS UDP单播/组播输出, 流开始时自动开始
+	UdpOutputs []UdpOutputConfig
+
+	// 访问日志, 每个结束的推流/播放记录一行
+	AccessLog AccessLogConfig
+
+	// 用量统计, 按分钟写入JSON-lines文件
+	Usage UsageConfig
+
+	// 管理API配置
+	Api ApiConfig
 
 	// pprof debug开关
 	EnablePprof bool
+	// pprof监听地址, 为空时挂载到管理API的/debug/pprof/下(未开启管理API时使用localhost:6060)
+	PprofAddr string
+
+	// 配置文件变化时自动热更新(SIGHUP始终触发热更新)
+	WatchConfig bool
+}
+
+// ListenerConfig 单个监听配置
+type ListenerConfig struct {
+	Name      string // 名称, 平滑升级传递listener时使用, 默认为协议名(重复时追加序号)
+	Network   string // tcp(默认, 未指定IP时双栈) / tcp4 / tcp6
+	Addr      string // 监听地址
+	Protocol  string // 协议: rtmp(默认) / http(HTTP-FLV等播放)
+	Vhost     string // 绑定的vhost, 非空时该listener上的连接均使用该vhost
+	ReusePort int    // 大于1时以SO_REUSEPORT打开多个socket, 每个socket独立accept(仅linux)
+
+	// PROXY protocol v1/v2: 来自可信地址的连接必须先发送PROXY头, 其余连接按普通连接处理
+	ProxyProtocol bool
+	ProxyTrusted  []string // 可信来源CIDR或IP, 开启ProxyProtocol时必须配置
+}
+
+// WatchdogConfig 推流端媒体看门狗配置
+type WatchdogConfig struct {
+	SilenceTimeout    time.Duration // 音频/视频静默多久告警(默认10s), 小于0关闭看门狗
+	DisconnectTimeout time.Duration // 静默多久断开publisher(默认0, 不断开), 应大于SilenceTimeout
+}
+
+// EventsConfig 事件总线及事件流配置
+type EventsConfig struct {
+	HistorySize     int           // 保留最近的事件数(默认1000), 用于事件流断线后按id续传
+	BitrateInterval time.Duration // 推流码率采样事件间隔(默认5s), 小于0不发送
+}
+
+type ApiConfig struct {
+	Addr string // HTTP管理API监听地址, 为空则不开启
+}
+
+// HttpConfig http播放配置
+type HttpConfig struct {
+	AllowOrigin string   // CORS Access-Control-Allow-Origin(默认*), 同时用于crossdomain.xml
+	TokenSecret string   `redact:"true"` // 播放token的HMAC-SHA256密钥, 为空时不校验token
+	TokenApps   []string // 需要token的app, 为空时所有app
+}
+
+func (hc *HttpConfig) tokenRequired(app string) bool {
+	return hc.TokenSecret != "" && appInList(hc.TokenApps, app)
+}
+
+// HlsConfig HLS输出配置
+type HlsConfig struct {
+	Enable         bool
+	Apps           []string      // 开启HLS的app, 为空时所有app
+	Path           string        // 切片目录, 为空时保存在内存中
+	TargetDuration time.Duration // 目标切片时长(默认4s), 达到后在下一个关键帧切片
+	Window         int           // playlist中的切片数(默认6)
+	LowLatency     bool          // LL-HLS: fMP4切片及partial segment, 支持阻塞请求
+	PartDuration   time.Duration // LL-HLS part目标时长(默认1s)
+	Encryption     HlsEncryptionConfig
+}
+
+func (hc *HlsConfig) appEnabled(app string) bool {
+	return appInList(hc.Apps, app)
+}
+
+// HlsEncryptionConfig HLS切片加密配置, 密钥只保存在内存中, 通过 /{app}/{stream}.key 下发
+type HlsEncryptionConfig struct {
+	Method      string        // AES-128 / SAMPLE-AES(仅MPEG-TS切片), 为空时不加密
+	Apps        []string      // 加密的app, 为空时所有app
+	KeyRotation int           // 每多少个切片更换密钥(默认10)
+	KmsUrl      string        `redact:"true"` // 从KMS获取密钥, 为空时随机生成(地址可能包含凭证)
+	KmsTimeout  time.Duration // 请求KMS超时(默认3s)
 }
 
-type log struct {
-	Path         string
+func (ec *HlsEncryptionConfig) appEnabled(app string) bool {
+	return ec.Method != "" && appInList(ec.Apps, app)
+}
+
+// DashConfig DASH输出配置
+type DashConfig struct {
+	Enable                bool
+	Apps                  []string      // 开启DASH的app, 为空时所有app
+	Path                  string        // 切片目录, 为空时保存在内存中
+	SegmentDuration       time.Duration // 目标切片时长(默认4s), 达到后在下一个关键帧切片
+	Window                int           // MPD中的切片数(默认6)
+	AvailabilityStartTime string        // RFC 3339格式的固定availabilityStartTime, 为空时取各流开始时间
+}
+
+func (dc *DashConfig) appEnabled(app string) bool {
+	return appInList(dc.Apps, app)
+}
+
+// availabilityStartTime validate已校验格式
+func (dc *DashConfig) availabilityStartTime() time.Time {
+	t, _ := time.Parse(time.RFC3339, dc.AvailabilityStartTime)
+	return t
+}
+
+// RenditionGroupConfig app下名称匹配Pattern的流属于同一个多码率组, 如event_1080, event_720属于组event
+type RenditionGroupConfig struct {
+	App     string
+	Pattern string // 正则, 第一个捕获组为组名, 如 ^(.+)_(1080|720|480)$
+
+	re *regexp.Regexp // setDefaults时编译, 无效时为nil(validate报错)
+}
+
+// renditionGroup 返回app下的stream所属的组名, 组名不能与流名称相同
+func (c *Config) renditionGroup(app, stream string) (string, bool) {
+	for _, rc := range c.Renditions {
+		if rc.App != app {
+			continue
+		}
+		if rc.re == nil {
+			continue
+		}
+		if m := rc.re.FindStringSubmatch(stream); len(m) > 1 && m[1] != "" && m[1] != stream {
+			return m[1], true
+		}
+	}
+	return "", false
+}
+
+// UdpOutputConfig 将一个流以MPEG-TS输出到UDP单播或组播地址
+type UdpOutputConfig struct {
+	Vhost     string // 为空时匹配所有vhost
+	App       string
+	Stream    string
+	Addr      string // 目标地址, 如 239.1.1.1:1234
+	Ttl       int    // 单播TTL/组播TTL(默认16)
+	Interface string // 组播输出网卡名称, 为空时由路由决定(仅linux)
+}
+
+// udpOutputs 流开始时需要输出的UDP目标
+func (c *Config) udpOutputs(vhost, app, stream string) []UdpOutputConfig {
+	var outputs []UdpOutputConfig
+	for _, oc := range c.UdpOutputs {
+		if (oc.Vhost == "" || oc.Vhost == vhost) && oc.App == app && oc.Stream == stream {
+			outputs = append(outputs, oc)
+		}
+	}
+	return outputs
+}
+
+// appInList apps为空时匹配所有app
+func appInList(apps []string, app string) bool {
+	if len(apps) == 0 {
+		return true
+	}
+
+	for _, a := range apps {
+		if a == app {
+			return true
+		}
+	}
+	return false
+}
+
+// AccessLogConfig 访问日志配置
+type AccessLogConfig struct {
+	Path         string // 为空时不记录
+	Format       string // json(默认) / text(类似combined格式)
+	RotationTime time.Duration
+	Age          int
+}
+
+// UsageConfig 用量统计配置
+type UsageConfig struct {
+	Path string // 为空时不统计, 文件按天切割
+	Age  int    // 保留天数(默认90)
+}
+
+type LogConfig struct {
+	Path         string // 为空时输出到stderr
 	Level        string
 	RotationTime time.Duration
 	Age          int
 }
 
-func (s *Server) loadConfig(configPath string) error {
-	viper.SetConfigFile("config.yaml")
-	viper.SetConfigName("config")
-	viper.AddConfigPath(configPath)
+func (s *Server) loadConfig() error {
+	if s.configValue.Load() != nil { // WithConfig直接指定, 不读配置文件
+		return errors.Wrap(s.getConfig().validate(), "validate config")
+	}
+
+	if s.configPath == "" {
+		var err error
+		if s.configPath, err = getAbsConfigPath(); err != nil {
+			return errors.Wrap(err, "get abs config path while config path not assigned")
+		}
+	}
+
+	s.viper = viper.New()
+	configFile := s.configPath
+	if filepath.Ext(configFile) == "" { // 目录
+		configFile = filepath.Join(configFile, "config.yaml")
+	}
+	s.viper.SetConfigFile(configFile)
+
+	// 环境变量覆盖配置文件, 如 FASTLIVE_ADDR / FASTLIVE_LOG_LEVEL
+	s.viper.SetEnvPrefix(envPrefix)
+	s.viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	bindEnvs(s.viper, reflect.TypeOf(Config{}), "")
+
+	// 命令行参数覆盖优先级最高, Reload后仍然有效
+	for key, value := range s.configOverrides {
+		s.viper.Set(key, value)
+	}
+
+	cfg, err := s.readConfig()
+	if err != nil {
+		return err
+	}
+
+	s.configValue.Store(cfg)
+	return nil
+}
+
+// getConfig 当前生效的配置快照, 热更新时整体替换, 调用方不可修改
+func (s *Server) getConfig() *Config {
+	return s.configValue.Load().(*Config)
+}
+
+// Reload 重新读取配置文件, 校验通过后原子地替换当前配置(仅对新连接生效), 日志级别立即生效
+// 不可热更新的字段(监听地址、日志文件等)发生变化时保留原值并告警, 需重启生效
+func (s *Server) Reload() error {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
 
-	if err := viper.ReadInConfig(); err != nil {
-		return errors.Wrap(err, "read in config")
+	if s.viper == nil {
+		return errors.New("reload config: server not created from config file")
 	}
 
-	if s.config == nil {
-		s.config = new(config)
+	cfg, err := s.readConfig()
+	if err != nil {
+		s.logger.Error("reload config", zap.Error(err))
+		return errors.Wrap(err, "reload config")
+	}
+
+	old := s.getConfig()
+	for _, field := range cfg.keepNonReloadable(old) {
+		s.logger.Warn("config changed but not reloadable, restart required", zap.String("field", field))
 	}
 
-	if err := viper.Unmarshal(s.config); err != nil {
-		return errors.Wrap(err, "Unmarshal config")
+	if err := s.logLevel.UnmarshalText([]byte(cfg.Log.Level)); err != nil {
+		return errors.Wrap(err, "set log level") // validate已校验, 不应发生
 	}
+	s.configValue.Store(cfg)
 
+	s.logger.Info("config reloaded", zap.String("logLevel", cfg.Log.Level))
 	return nil
 }
 
+const envPrefix = "FASTLIVE"
+
+// bindEnvs 为Config的每个字段绑定环境变量, 配置文件中未出现的字段也可以通过环境变量设置
+func bindEnvs(v *viper.Viper, t reflect.Type, prefix string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := prefix + strings.ToLower(field.Name)
+
+		switch field.Type.Kind() {
+		case reflect.Struct:
+			bindEnvs(v, field.Type, key+".")
+		case reflect.Slice: // 列表只能在配置文件中设置
+		default:
+			_ = v.BindEnv(key)
+		}
+	}
+}
+
+// LoadConfig 按照与New相同的方式加载并校验配置, 不创建Server
+func LoadConfig(opts ...ServerOption) (*Config, error) {
+	s := &Server{}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if err := s.loadConfig(); err != nil {
+		return nil, err
+	}
+
+	cfg := *s.getConfig()
+	return &cfg, nil
+}
+
+func (s *Server) readConfig() (*Config, error) {
+	if err := s.viper.ReadInConfig(); err != nil {
+		return nil, errors.Wrap(err, "read in config")
+	}
+
+	cfg := new(Config)
+	if err := s.viper.Unmarshal(cfg); err != nil {
+		return nil, errors.Wrap(err, "Unmarshal config")
+	}
+
+	cfg.setDefaults()
+	if err := cfg.validate(); err != nil {
+		return nil, errors.Wrap(err, "validate config")
+	}
+
+	return cfg, nil
+}
+
+func (c *Config) setDefaults() {
+	// 每次推流/播放都要匹配, 预先编译; 复制一份, 不修改WithConfig调用方的slice
+	if len(c.Renditions) > 0 {
+		renditions := make([]RenditionGroupConfig, len(c.Renditions))
+		for i, rc := range c.Renditions {
+			rc.re, _ = regexp.Compile(rc.Pattern)
+			renditions[i] = rc
+		}
+		c.Renditions = renditions
+	}
+
+	if c.Addr == "" {
+		c.Addr = ":1935"
+	}
+
+	if c.ReadBufSize <= 0 {
+		c.ReadBufSize = 8192
+	}
+
+	if c.LocalChunkSize <= 0 {
+		c.LocalChunkSize = 60000 //bytes
+	}
+
+	if c.HandshakeTimeout <= 0 {
+		c.HandshakeTimeout = 3 * time.Second
+	}
+
+	if c.PlayorPublishTimeout <= 0 {
+		c.PlayorPublishTimeout = 3 * time.Second
+	}
+
+	if c.PublishIdleTimeout <= 0 {
+		c.PublishIdleTimeout = 30 * time.Second
+	}
+
+	if c.PlayIdleTimeout < 0 {
+		c.PlayIdleTimeout = 0
+	}
+
+	if c.WriteTimeout <= 0 {
+		c.WriteTimeout = 10 * time.Second
+	}
+
+	if c.ShutdownTimeout <= 0 {
+		c.ShutdownTimeout = 10 * time.Second
+	}
+
+	if c.DrainTimeout <= 0 {
+		c.DrainTimeout = 5 * time.Minute
+	}
+
+	if c.Watchdog.SilenceTimeout == 0 {
+		c.Watchdog.SilenceTimeout = 10 * time.Second
+	}
+
+	if c.Events.HistorySize <= 0 {
+		c.Events.HistorySize = 1000
+	}
+
+	if c.Events.BitrateInterval == 0 {
+		c.Events.BitrateInterval = 5 * time.Second
+	}
+
+	if c.Log.Level == "" {
+		c.Log.Level = "info"
+	}
+
+	if c.Http.AllowOrigin == "" {
+		c.Http.AllowOrigin = "*"
+	}
+
+	if c.Hls.TargetDuration <= 0 {
+		c.Hls.TargetDuration = 4 * time.Second
+	}
+
+	if c.Hls.Window <= 0 {
+		c.Hls.Window = 6
+	}
+
+	if c.Hls.PartDuration <= 0 {
+		c.Hls.PartDuration = time.Second
+	}
+
+	if c.Hls.Encryption.KeyRotation <= 0 {
+		c.Hls.Encryption.KeyRotation = 10
+	}
+
+	if c.Hls.Encryption.KmsTimeout <= 0 {
+		c.Hls.Encryption.KmsTimeout = 3 * time.Second
+	}
+
+	if c.Dash.SegmentDuration <= 0 {
+		c.Dash.SegmentDuration = 4 * time.Second
+	}
+
+	if c.Dash.Window <= 0 {
+		c.Dash.Window = 6
+	}
+
+	for i := range c.UdpOutputs {
+		if c.UdpOutputs[i].Ttl == 0 {
+			c.UdpOutputs[i].Ttl = 16
+		}
+	}
+
+	if c.Usage.Age <= 0 {
+		c.Usage.Age = 90
+	}
+
+	if c.AccessLog.Format == "" {
+		c.AccessLog.Format = accessLogJson
+	}
+
+	if len(c.Listeners) == 0 {
+		c.Listeners = []ListenerConfig{{Addr: c.Addr}}
+	} else {
+		c.Listeners = append([]ListenerConfig(nil), c.Listeners...) // 避免修改调用方的slice
+	}
+
+	for idx := range c.Listeners {
+		lc := &c.Listeners[idx]
+		if lc.Network == "" {
+			lc.Network = "tcp"
+		}
+
+		if lc.Protocol == "" {
+			lc.Protocol = protocolRtmp
+		}
+
+		if lc.Name == "" {
+			lc.Name = lc.Protocol
+			if idx > 0 {
+				lc.Name += strconv.Itoa(idx)
+			}
+		}
+	}
+}
+
+func (c *Config) validate() error {
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		return errors.Wrapf(err, "invalid addr %q", c.Addr)
+	}
+
+	names := make(map[string]bool, len(c.Listeners))
+	for _, lc := range c.Listeners {
+		if err := lc.validate(); err != nil {
+			return errors.Wrapf(err, "listener %s", lc.Name)
+		}
+
+		if names[lc.Name] {
+			return errors.Errorf("duplicate listener name %q", lc.Name)
+		}
+		names[lc.Name] = true
+	}
+
+	if c.Api.Addr != "" {
+		if _, _, err := net.SplitHostPort(c.Api.Addr); err != nil {
+			return errors.Wrapf(err, "invalid api addr %q", c.Api.Addr)
+		}
+	}
+
+	if c.PprofAddr != "" {
+		if _, _, err := net.SplitHostPort(c.PprofAddr); err != nil {
+			return errors.Wrapf(err, "invalid pprof addr %q", c.PprofAddr)
+		}
+	}
+
+	if c.LocalChunkSize < 128 || c.LocalChunkSize > 0xffffff {
+		return errors.Errorf("localChunkSize %d out of range [128, 16777215]", c.LocalChunkSize)
+	}
+
+	if c.Watchdog.DisconnectTimeout > 0 && c.Watchdog.SilenceTimeout > 0 && c.Watchdog.DisconnectTimeout < c.Watchdog.SilenceTimeout {
+		return errors.Errorf("watchdog.disconnectTimeout %s must not be less than watchdog.silenceTimeout %s",
+			c.Watchdog.DisconnectTimeout, c.Watchdog.SilenceTimeout)
+	}
+
+	if c.Hls.LowLatency && c.Hls.PartDuration > c.Hls.TargetDuration {
+		return errors.Errorf("hls.partDuration %s exceeds hls.targetDuration %s", c.Hls.PartDuration, c.Hls.TargetDuration)
+	}
+
+	switch c.Hls.Encryption.Method {
+	case "", hls.MethodAes128:
+	case hls.MethodSampleAes:
+		if c.Hls.LowLatency {
+			return errors.New("hls.encryption.method SAMPLE-AES is not supported with hls.lowLatency")
+		}
+	default:
+		return errors.Errorf("invalid hls.encryption.method %q, must be %s or %s", c.Hls.Encryption.Method, hls.MethodAes128, hls.MethodSampleAes)
+	}
+
+	if c.Hls.Encryption.KmsUrl != "" {
+		if u, err := url.Parse(c.Hls.Encryption.KmsUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.Errorf("invalid hls.encryption.kmsUrl %q", c.Hls.Encryption.KmsUrl)
+		}
+	}
+
+	if c.Dash.AvailabilityStartTime != "" {
+		if _, err := time.Parse(time.RFC3339, c.Dash.AvailabilityStartTime); err != nil {
+			return errors.Wrapf(err, "invalid dash.availabilityStartTime %q", c.Dash.AvailabilityStartTime)
+		}
+	}
+
+	for i, rc := range c.Renditions {
+		if rc.App == "" {
+			return errors.Errorf("renditions[%d].app required", i)
+		}
+		if rc.re == nil {
+			_, err := regexp.Compile(rc.Pattern)
+			return errors.Wrapf(err, "invalid renditions[%d].pattern %q", i, rc.Pattern)
+		}
+		if rc.re.NumSubexp() < 1 {
+			return errors.Errorf("renditions[%d].pattern %q must capture the group name", i, rc.Pattern)
+		}
+	}
+
+	for i, oc := range c.UdpOutputs {
+		if oc.App == "" || oc.Stream == "" {
+			return errors.Errorf("udpOutputs[%d].app and stream required", i)
+		}
+		if _, err := net.ResolveUDPAddr("udp", oc.Addr); err != nil {
+			return errors.Wrapf(err, "invalid udpOutputs[%d].addr %q", i, oc.Addr)
+		}
+		if oc.Ttl < 1 || oc.Ttl > 255 {
+			return errors.Errorf("udpOutputs[%d].ttl %d out of range [1, 255]", i, oc.Ttl)
+		}
+		if oc.Interface != "" && !udpInterfaceSupported {
+			return errors.Errorf("udpOutputs[%d].interface is only supported on linux", i)
+		}
+	}
+
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		return errors.Wrapf(err, "invalid log level %q", c.Log.Level)
+	}
+
+	if c.AccessLog.Format != accessLogJson && c.AccessLog.Format != accessLogText {
+		return errors.Errorf("invalid accessLog.format %q, must be %s or %s", c.AccessLog.Format, accessLogJson, accessLogText)
+	}
+
+	return nil
+}
+
+func (lc *ListenerConfig) validate() error {
+	if _, _, err := net.SplitHostPort(lc.Addr); err != nil {
+		return errors.Wrapf(err, "invalid addr %q", lc.Addr)
+	}
+
+	switch lc.Network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return errors.Errorf("unsupported network %q", lc.Network)
+	}
+
+	switch lc.Protocol {
+	case protocolRtmp:
+	case protocolHttp:
+		if lc.ProxyProtocol {
+			return errors.New("proxyProtocol is only supported on rtmp listeners")
+		}
+	default:
+		return errors.Errorf("unsupported protocol %q", lc.Protocol)
+	}
+
+	if strings.ContainsAny(lc.Name, ":-") {
+		return errors.Errorf("name %q must not contain ':' or '-'", lc.Name)
+	}
+
+	if lc.ProxyProtocol && len(lc.ProxyTrusted) == 0 {
+		return errors.New("proxyTrusted required when proxyProtocol is enabled")
+	}
+
+	if _, err := proxyproto.ParseTrustedNets(lc.ProxyTrusted); err != nil {
+		return errors.Wrap(err, "proxyTrusted")
+	}
+
+	if lc.ReusePort < 0 {
+		return errors.Errorf("reusePort %d must not be negative", lc.ReusePort)
+	}
+
+	if lc.ReusePort > 1 && !reusePortSupported {
+		return errors.New("reusePort is only supported on linux")
+	}
+
+	return nil
+}
+
+// keepNonReloadable 不可热更新的字段沿用old中的值, 返回发生变化的字段名
+func (c *Config) keepNonReloadable(old *Config) []string {
+	changed := make([]string, 0)
+
+	if c.Addr != old.Addr {
+		changed = append(changed, "addr")
+		c.Addr = old.Addr
+	}
+
+	if !reflect.DeepEqual(c.Listeners, old.Listeners) {
+		changed = append(changed, "listeners")
+		c.Listeners = old.Listeners
+	}
+
+	if c.Api.Addr != old.Api.Addr {
+		changed = append(changed, "api.addr")
+		c.Api.Addr = old.Api.Addr
+	}
+
+	if c.EnablePprof != old.EnablePprof || c.PprofAddr != old.PprofAddr {
+		changed = append(changed, "enablePprof/pprofAddr")
+		c.EnablePprof, c.PprofAddr = old.EnablePprof, old.PprofAddr
+	}
+
+	if c.Events.HistorySize != old.Events.HistorySize {
+		changed = append(changed, "events.historySize")
+		c.Events.HistorySize = old.Events.HistorySize
+	}
+
+	if c.Hls.Path != old.Hls.Path {
+		changed = append(changed, "hls.path")
+		c.Hls.Path = old.Hls.Path
+	}
+
+	if c.Dash.Path != old.Dash.Path {
+		changed = append(changed, "dash.path")
+		c.Dash.Path = old.Dash.Path
+	}
+
+	if c.WatchConfig != old.WatchConfig {
+		changed = append(changed, "watchConfig")
+		c.WatchConfig = old.WatchConfig
+	}
+
+	if c.Log.Path != old.Log.Path || c.Log.RotationTime != old.Log.RotationTime || c.Log.Age != old.Log.Age {
+		changed = append(changed, "log.path/rotationTime/age")
+		c.Log.Path, c.Log.RotationTime, c.Log.Age = old.Log.Path, old.Log.RotationTime, old.Log.Age
+	}
+
+	if c.Usage != old.Usage {
+		changed = append(changed, "usage")
+		c.Usage = old.Usage
+	}
+
+	// 访问日志文件在启动时打开, 格式也保持不变, 避免同一文件中混用两种格式
+	if c.AccessLog != old.AccessLog {
+		changed = append(changed, "accessLog")
+		c.AccessLog = old.AccessLog
+	}
+
+	return changed
+}
+
+// MarshalYAML 输出与配置文件一致的key(首字母小写), 时长输出为"3s"形式; 带redact tag的非空字段(密钥等)以redactedValue代替
+func (c Config) MarshalYAML() (interface{}, error) {
+	return yamlMapSlice(reflect.ValueOf(c)), nil
+}
+
+const redactedValue = "<redacted>"
+
+func yamlMapSlice(v reflect.Value) yaml.MapSlice {
+	t := v.Type()
+	ms := make(yaml.MapSlice, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" { // 未导出字段(如编译后的正则)不输出
+			continue
+		}
+		key := strings.ToLower(f.Name[:1]) + f.Name[1:]
+
+		var value interface{}
+		if f.Tag.Get("redact") == "true" && !v.Field(i).IsZero() {
+			value = redactedValue
+		} else {
+			value = yamlValue(v.Field(i))
+		}
+		ms = append(ms, yaml.MapItem{Key: key, Value: value})
+	}
+	return ms
+}
+
+func yamlValue(v reflect.Value) interface{} {
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		return time.Duration(v.Int()).String()
+	case v.Kind() == reflect.Struct:
+		return yamlMapSlice(v)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct:
+		items := make([]interface{}, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			items = append(items, yamlValue(v.Index(i)))
+		}
+		return items
+	default:
+		return v.Interface()
+	}
+}
+
+// watchConfig 配置文件变化时自动Reload
+func (s *Server) watchConfig() {
+	s.viper.OnConfigChange(func(e fsnotify.Event) {
+		s.logger.Info("config file changed", zap.String("file", e.Name), zap.String("op", e.Op.String()))
+		_ = s.Reload()
+	})
+	s.viper.WatchConfig()
+}
+
 func getAbsConfigPath() (string, error) {
 	binPath, err := filepath.Abs(filepath.Dir(os.Args[0]))
 	if err != nil {
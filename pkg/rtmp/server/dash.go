@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"path"
+
+	"go.uber.org/zap"
+
+	"fastlive/pkg/dash"
+)
+
+/*
+DASH输出: 由packager驱动dash.Stream切片, 文件保存在dashStore
+http listener上提供 /{app}/{stream}.mpd 及 /{app}/{stream}/ 下的init segment和fMP4切片
+多码率组的MPD见rendition.go
+*/
+
+// newDashPackager 未开启DASH或app不在配置中时返回nil
+func (s *Server) newDashPackager(sess *session) *packager {
+	cfg := s.getConfig().Dash
+	if !cfg.Enable || !cfg.appEnabled(sess.appName) {
+		return nil
+	}
+
+	name := path.Join(sess.vhost, sess.appName, sess.streamName)
+	if !validOutputName(name) {
+		s.logger.Warn("dash disabled for invalid stream name", zap.String("name", name))
+		return nil
+	}
+
+	stream, err := dash.NewStream(
+		dash.WithName(name),
+		dash.WithStore(s.dashStore),
+		dash.WithSegmentDuration(cfg.SegmentDuration),
+		dash.WithWindow(cfg.Window),
+		dash.WithAvailabilityStartTime(cfg.availabilityStartTime()),
+		dash.WithClock(sess.group.dashClock()),
+	)
+	if err != nil {
+		s.logger.Error("create dash stream", zap.String("name", name), zap.Error(err))
+		return nil
+	}
+
+	s.addGroupDash(sess, stream)
+	return s.startPackager(sess, "dash", name, stream)
+}
+
+// handleDash 从存储中读取MPD, init segment或切片
+func (s *Server) handleDash(w http.ResponseWriter, r *http.Request, hs *httpStream) {
+	name := path.Join(hs.vhost, hs.app, hs.stream+hs.ext)
+	data, err := s.dashStore.Get(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.logger.Warn("read dash file", zap.String("name", name), zap.Error(err))
+		} else if hs.ext == ".mpd" && s.handleGroupManifest(w, r, hs) {
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	h := w.Header()
+	switch hs.ext {
+	case ".mpd":
+		data = s.withManifestTokens(r, hs, data, hs.stream)
+		h.Set("Content-Type", "application/dash+xml")
+		h.Set("Cache-Control", "no-cache")
+	case ".mp4":
+		// init segment在编码参数变化时会被覆盖
+		h.Set("Content-Type", "video/mp4")
+		h.Set("Cache-Control", "no-cache")
+	default:
+		h.Set("Content-Type", "video/iso.segment")
+		h.Set("Cache-Control", "max-age=60")
+	}
+
+	s.serveFile(w, r, hs, data)
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType 流生命周期事件类型
+type EventType int
+
+const (
+	EventConnect        EventType = iota + 1 // 客户端connect成功
+	EventPublishStart                        // 开始推流(含session短暂中断后恢复)
+	EventPublishStop                         // 推流端断开, session进入下线等待
+	EventPlayStart                           // 开始播放
+	EventPlayStop                            // 播放结束
+	EventSequenceHeader                      // 音视频sequence header变化
+	EventMetaData                            // onMetaData更新
+	EventSessionDelete                       // session删除
+	EventTrackSilent                         // 看门狗: 推流端track静默
+	EventTrackRecovered                      // 看门狗: 推流端track恢复
+	EventBitrate                             // 推流码率周期采样
+	EventLost                                // 订阅方缓冲满, 之前有事件被丢弃(只发给该订阅方, 不论订阅的类型)
+)
+
+var eventTypeNames = map[EventType]string{
+	EventConnect:        "connect",
+	EventPublishStart:   "publish_start",
+	EventPublishStop:    "publish_stop",
+	EventPlayStart:      "play_start",
+	EventPlayStop:       "play_stop",
+	EventSequenceHeader: "sequence_header",
+	EventMetaData:       "metadata",
+	EventSessionDelete:  "session_delete",
+	EventTrackSilent:    "track_silent",
+	EventTrackRecovered: "track_recovered",
+	EventBitrate:        "bitrate",
+	EventLost:           "lost",
+}
+
+// parseEventType 由名称解析事件类型
+func parseEventType(name string) (EventType, bool) {
+	for t, n := range eventTypeNames {
+		if n == name {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+func (t EventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// Event 流生命周期事件, 订阅方不可修改
+type Event struct {
+	Id         uint64    `json:"id"` // server内单调递增
+	Type       EventType `json:"type"`
+	Time       time.Time `json:"time"`
+	Vhost      string    `json:"vhost,omitempty"`
+	App        string    `json:"app,omitempty"`
+	Stream     string    `json:"stream,omitempty"`
+	SessionId  string    `json:"sessionId,omitempty"`
+	ClientAddr string    `json:"clientAddr,omitempty"`
+
+	Track    string        `json:"track,omitempty"`    // sequence header/看门狗事件: audio, video
+	Codec    string        `json:"codec,omitempty"`    // sequence header事件
+	MetaData *MetaData     `json:"metaData,omitempty"` // metadata事件
+	Silence  time.Duration `json:"silence,omitempty"`  // 看门狗事件
+
+	BitrateKbps uint64 `json:"bitrateKbps,omitempty"` // bitrate事件
+	BytesIn     uint64 `json:"bytesIn,omitempty"`     // bitrate事件
+	Players     int32  `json:"players,omitempty"`     // bitrate事件
+}
+
+// MetaData 推流端onMetaData中的常用字段
+type MetaData struct {
+	Encoder       string  `json:"encoder,omitempty"`
+	Width         float64 `json:"width,omitempty"`
+	Height        float64 `json:"height,omitempty"`
+	Framerate     float64 `json:"framerate,omitempty"`
+	VideodataRate float64 `json:"videodatarate,omitempty"`
+	Audiodatarate float64 `json:"audiodatarate,omitempty"`
+}
+
+// eventBus 进程内事件总线, 发布不阻塞: 订阅方缓冲满时丢弃事件
+// 保留最近historySize个事件, 供事件流断线后续传
+type eventBus struct {
+	dropped uint64 // 因订阅方缓冲满丢弃的事件数(原子操作)
+
+	mu      sync.Mutex // 保证事件id与投递顺序一致
+	seq     uint64
+	history []Event // 环形缓冲
+	head    int     // 下一个写入位置
+	nextId  int
+	subs    map[int]*eventSubscriber
+}
+
+type eventSubscriber struct {
+	ch       chan Event
+	types    map[EventType]bool // 为空表示订阅全部类型
+	overflow bool               // 有事件被丢弃, 下一个事件前先投递EventLost(由eventBus.mu保护)
+}
+
+func newEventBus(historySize int) *eventBus {
+	return &eventBus{
+		history: make([]Event, 0, historySize),
+		subs:    make(map[int]*eventSubscriber),
+	}
+}
+
+func (b *eventBus) publish(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	ev.Id = b.seq
+
+	if size := cap(b.history); size > 0 {
+		if len(b.history) < size {
+			b.history = append(b.history, ev)
+		} else {
+			b.history[b.head] = ev
+		}
+		b.head = (b.head + 1) % size
+	}
+
+	for _, sub := range b.subs {
+		if len(sub.types) > 0 && !sub.types[ev.Type] {
+			continue
+		}
+
+		if sub.overflow {
+			select {
+			case sub.ch <- Event{Type: EventLost, Time: ev.Time}:
+				sub.overflow = false
+			default:
+				atomic.AddUint64(&b.dropped, 1)
+				continue
+			}
+		}
+
+		select {
+		case sub.ch <- ev:
+		default:
+			atomic.AddUint64(&b.dropped, 1)
+			sub.overflow = true
+		}
+	}
+}
+
+// since 返回history中id大于lastId的事件, 按id升序
+// lastId早于history最早的事件时, ok为false(部分事件已丢失);
+// lastId大于最新的id(server重启后id重新开始)时, ok为false并返回history中的全部事件
+func (b *eventBus) since(lastId uint64) (events []Event, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ok = true
+	if lastId > b.seq {
+		lastId, ok = 0, false
+	}
+
+	n := len(b.history)
+	if n == 0 {
+		return nil, ok && lastId >= b.seq
+	}
+
+	start := 0
+	if n == cap(b.history) {
+		start = b.head
+	}
+
+	oldest := b.history[start].Id
+	ok = ok && lastId+1 >= oldest
+	for i := 0; i < n; i++ {
+		ev := b.history[(start+i)%n]
+		if ev.Id > lastId {
+			events = append(events, ev)
+		}
+	}
+
+	return events, ok
+}
+
+func (b *eventBus) subscribe(bufSize int, types []EventType) (<-chan Event, func()) {
+	if bufSize <= 0 {
+		bufSize = 64
+	}
+
+	sub := &eventSubscriber{ch: make(chan Event, bufSize)}
+	if len(types) > 0 {
+		sub.types = make(map[EventType]bool, len(types))
+		for _, t := range types {
+			sub.types[t] = true
+		}
+	}
+
+	b.mu.Lock()
+	id := b.nextId
+	b.nextId++
+	b.subs[id] = sub
+	b.mu.Unlock()
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, id)
+			b.mu.Unlock()
+			close(sub.ch)
+		})
+	}
+}
+
+// Subscribe 订阅事件(types为空时订阅全部), 返回的channel最多缓冲bufSize个事件,
+// 消费不及时时新事件被丢弃, 之后的第一个事件前收到EventLost; 调用cancel后channel关闭
+func (s *Server) Subscribe(bufSize int, types ...EventType) (events <-chan Event, cancel func()) {
+	return s.events.subscribe(bufSize, types)
+}
+
+// SubscribeFunc 订阅事件并在独立协程中依次回调fn, fn执行过慢时事件被丢弃
+func (s *Server) SubscribeFunc(bufSize int, fn func(Event), types ...EventType) (cancel func()) {
+	ch, cancel := s.events.subscribe(bufSize, types)
+	go func() {
+		for ev := range ch {
+			fn(ev)
+		}
+	}()
+	return cancel
+}
+
+// event 以session信息填充事件
+func (s *session) event(t EventType) Event {
+	return Event{
+		Type:      t,
+		Vhost:     s.vhost,
+		App:       s.appName,
+		Stream:    s.streamName,
+		SessionId: s.getId(),
+	}
+}
+
+// runBitrateEvents 周期发送在线session的推流码率事件, server关闭时退出
+// 间隔支持热更新, 每秒检查一次是否到期
+func (b *broker) runBitrateEvents() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var last time.Time
+	for {
+		select {
+		case <-b.server.done:
+			return
+		case now := <-ticker.C:
+			interval := b.server.getConfig().Events.BitrateInterval
+			if interval <= 0 || now.Sub(last) < interval {
+				continue
+			}
+			last = now
+
+			b.rangeSessions(func(sess *session) bool {
+				publisher := sess.getPublisher()
+				if publisher == nil {
+					return true
+				}
+
+				ev := sess.event(EventBitrate)
+				ev.Time = now
+				ev.ClientAddr = publisher.Connection.Rwc.RemoteAddr().String()
+				ev.BitrateKbps = sess.bitrate.Kbps()
+				ev.BytesIn = atomic.LoadUint64(&sess.bytesIn)
+				ev.Players = atomic.LoadInt32(&sess.playerTotal)
+				b.server.events.publish(ev)
+				return true
+			})
+		}
+	}
+}
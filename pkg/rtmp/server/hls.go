@@ -0,0 +1,269 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"fastlive/pkg/hls"
+)
+
+/*
+HLS输出: 由packager驱动hls.Stream(MPEG-TS)或hls.LLStream(LL-HLS, fMP4)切片, 文件保存在hlsStore
+http listener上提供 /{app}/{stream}.m3u8 及 /{app}/{stream}/ 下的切片
+LL-HLS的playlist由流状态生成, 支持阻塞请求(_HLS_msn/_HLS_part)及delta更新(_HLS_skip)
+开启加密(hls.encryption)时每个流一个hls.KeyRing, 密钥通过 /{app}/{stream}.key?n= 下发, 与playlist同样校验播放token
+多码率组的master playlist见rendition.go
+*/
+
+// newHlsPackager 未开启HLS或app不在配置中时返回nil
+func (s *Server) newHlsPackager(sess *session) *packager {
+	cfg := s.getConfig().Hls
+	if !cfg.Enable || !cfg.appEnabled(sess.appName) {
+		return nil
+	}
+
+	name := path.Join(sess.vhost, sess.appName, sess.streamName)
+	if !validOutputName(name) {
+		s.logger.Warn("hls disabled for invalid stream name", zap.String("name", name))
+		return nil
+	}
+
+	// 需要加密但无法创建KeyRing时不输出明文切片
+	keys, err := s.newHlsKeyRing(sess, name, cfg.Encryption)
+	if err != nil {
+		s.logger.Error("create hls key ring", zap.String("name", name), zap.Error(err))
+		return nil
+	}
+
+	if cfg.LowLatency {
+		return s.newLLHlsPackager(sess, name, cfg, keys)
+	}
+
+	stream, err := hls.NewStream(
+		hls.WithName(name),
+		hls.WithStore(s.hlsStore),
+		hls.WithTargetDuration(cfg.TargetDuration),
+		hls.WithWindow(cfg.Window),
+		hls.WithKeyRing(keys),
+		hls.WithAlignedSegments(sess.group != nil),
+	)
+	if err != nil {
+		s.logger.Error("create hls stream", zap.String("name", name), zap.Error(err))
+		return nil
+	}
+
+	s.registerHlsKeys(name, keys)
+	return s.startPackager(sess, "hls", name, &hlsOutput{streamOutput: stream, server: s, name: name})
+}
+
+func (s *Server) newLLHlsPackager(sess *session, name string, cfg HlsConfig, keys *hls.KeyRing) *packager {
+	stream, err := hls.NewLLStream(
+		hls.WithLLName(name),
+		hls.WithLLStore(s.hlsStore),
+		hls.WithLLTargetDuration(cfg.TargetDuration),
+		hls.WithPartDuration(cfg.PartDuration),
+		hls.WithLLWindow(cfg.Window),
+		hls.WithLLKeyRing(keys),
+		hls.WithLLAlignedSegments(sess.group != nil),
+		hls.WithRenditionReports(s.renditionReports(sess)),
+	)
+	if err != nil {
+		s.logger.Error("create ll-hls stream", zap.String("name", name), zap.Error(err))
+		return nil
+	}
+
+	s.registerHlsKeys(name, keys)
+	s.llHlsStreams.Store(name, stream)
+	return s.startPackager(sess, "ll-hls", name, &hlsOutput{streamOutput: stream, server: s, name: name})
+}
+
+// newHlsKeyRing app未开启加密时返回nil
+func (s *Server) newHlsKeyRing(sess *session, name string, cfg HlsEncryptionConfig) (*hls.KeyRing, error) {
+	if !cfg.appEnabled(sess.appName) {
+		return nil, nil
+	}
+
+	provider := s.keyProvider
+	if provider == nil && cfg.KmsUrl != "" {
+		provider = hls.NewHttpKeyProvider(cfg.KmsUrl, cfg.KmsTimeout)
+	}
+
+	return hls.NewKeyRing(
+		hls.WithKeyName(name),
+		hls.WithMethod(cfg.Method),
+		hls.WithKeyProvider(provider),
+		hls.WithKeyRotation(cfg.KeyRotation),
+	)
+}
+
+func (s *Server) registerHlsKeys(name string, keys *hls.KeyRing) {
+	if keys != nil {
+		s.hlsKeys.Store(name, keys)
+	}
+}
+
+// hlsOutput 关闭时从server中注销密钥及LL-HLS流, 之后的请求不再访问该流(session删除后才能以同名创建新的session)
+type hlsOutput struct {
+	streamOutput
+	server *Server
+	name   string
+}
+
+func (o *hlsOutput) Close() error {
+	o.server.hlsKeys.Delete(o.name)
+	o.server.llHlsStreams.Delete(o.name)
+	return o.streamOutput.Close()
+}
+
+func (s *Server) llHlsStream(name string) *hls.LLStream {
+	if v, ok := s.llHlsStreams.Load(name); ok {
+		return v.(*hls.LLStream)
+	}
+	return nil
+}
+
+// handleHls 从存储中读取playlist或切片
+func (s *Server) handleHls(w http.ResponseWriter, r *http.Request, hs *httpStream) {
+	if hs.ext == ".m3u8" {
+		if stream := s.llHlsStream(path.Join(hs.vhost, hs.app, hs.stream)); stream != nil {
+			s.handleLLHlsPlaylist(w, r, stream, hs)
+			return
+		}
+	}
+
+	name := path.Join(hs.vhost, hs.app, hs.stream+hs.ext)
+	data, err := s.hlsStore.Get(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.logger.Warn("read hls file", zap.String("name", name), zap.Error(err))
+		} else if hs.ext == ".m3u8" && s.handleMasterPlaylist(w, r, hs) {
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	h := w.Header()
+	if hs.ext == ".m3u8" {
+		data = s.withPlaylistTokens(r, hs, data)
+		h.Set("Content-Type", "application/vnd.apple.mpegurl")
+		h.Set("Cache-Control", "no-cache")
+	} else {
+		h.Set("Content-Type", "video/mp2t")
+		h.Set("Cache-Control", "max-age=60")
+	}
+
+	s.serveFile(w, r, hs, data)
+}
+
+// handleHlsKey 返回加密HLS流的第n个密钥, 只在切片仍可访问时有效
+func (s *Server) handleHlsKey(w http.ResponseWriter, r *http.Request, hs *httpStream) {
+	var keys *hls.KeyRing
+	if v, ok := s.hlsKeys.Load(path.Join(hs.vhost, hs.app, hs.stream)); ok {
+		keys = v.(*hls.KeyRing)
+	}
+
+	n, err := strconv.ParseUint(r.URL.Query().Get("n"), 10, 64)
+	if keys == nil || err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	key, ok := keys.Key(n)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Cache-Control", "no-store")
+	_, _ = w.Write(key)
+}
+
+// llHlsBlockTimeout 阻塞请求最长等待时间, 超时返回503
+func (s *Server) llHlsBlockTimeout() time.Duration {
+	return 3 * s.getConfig().Hls.TargetDuration
+}
+
+// llHlsContext 请求结束, 超时或server关闭时结束等待
+func (s *Server) llHlsContext(r *http.Request) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(r.Context(), s.llHlsBlockTimeout())
+	go func() {
+		select {
+		case <-s.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func (s *Server) handleLLHlsPlaylist(w http.ResponseWriter, r *http.Request, stream *hls.LLStream, hs *httpStream) {
+	req := hls.PlaylistRequest{Msn: -1, Part: -1}
+	q := r.URL.Query()
+	for _, p := range []struct {
+		key string
+		dst *int64
+	}{{"_HLS_msn", &req.Msn}, {"_HLS_part", &req.Part}} {
+		if v := q.Get(p.key); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid "+p.key, http.StatusBadRequest)
+				return
+			}
+			*p.dst = n
+		}
+	}
+	req.Skip = q.Get("_HLS_skip") == "YES" || q.Get("_HLS_skip") == "v2"
+
+	ctx, cancel := s.llHlsContext(r)
+	defer cancel()
+
+	data, err := stream.Playlist(ctx, req)
+	switch {
+	case err == hls.ErrBadRequest:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err == hls.ErrNotReady:
+		http.NotFound(w, r)
+		return
+	case err != nil:
+		if r.Context().Err() == nil {
+			http.Error(w, "playlist update timeout", http.StatusServiceUnavailable)
+		}
+		return
+	}
+
+	data = s.withPlaylistTokens(r, hs, data)
+	h := w.Header()
+	h.Set("Content-Type", "application/vnd.apple.mpegurl")
+	h.Set("Cache-Control", "no-cache")
+	s.serveFile(w, r, hs, data)
+}
+
+// handleLLHlsFile 读取init segment, 切片或part, preload hint指向的part阻塞到生成
+func (s *Server) handleLLHlsFile(w http.ResponseWriter, r *http.Request, stream *hls.LLStream, hs *httpStream) {
+	ctx, cancel := s.llHlsContext(r)
+	defer cancel()
+
+	data, err := stream.File(ctx, hs.stream+hs.ext)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.logger.Warn("read ll-hls file", zap.String("name", path.Join(hs.vhost, hs.app, hs.stream+hs.ext)), zap.Error(err))
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "video/mp4")
+	h.Set("Cache-Control", "max-age=60")
+	s.serveFile(w, r, hs, data)
+}
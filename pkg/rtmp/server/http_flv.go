@@ -0,0 +1,356 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"fastlive/pkg/av"
+	"fastlive/pkg/av/flv"
+)
+
+/*
+HTTP-FLV播放:
+1. 与rtmp播放相同的准入(流必须存在)及拒绝指标, 以player身份加入session, 共用packet队列及丢帧策略
+2. 接管(hijack)连接后自行输出chunked响应, 每次写入使用WriteTimeout
+3. 依次发送FLV header, metadata, sequence header, GOP, 之后为实时数据; 队列中积压的tag合并为一个chunk发送
+*/
+
+const (
+	protocolHttpFlv = "http-flv"
+
+	flvMergeBytes = 64 << 10 // 单次合并发送的最大字节数
+)
+
+// flvTagWriter FLV tag的输出方式
+type flvTagWriter interface {
+	writeTags(b []byte) error
+	close() error // 正常结束响应
+}
+
+// flvPlayer http-flv播放端
+type flvPlayer struct {
+	packetQueue
+	avTimestamp
+
+	server    *Server
+	session   *session
+	protocol  string
+	conn      net.Conn
+	w         flvTagWriter
+	closed    chan struct{} // 客户端断开
+	readErr   error         // 客户端断开原因, closed关闭后可读
+	startTime time.Time
+	bytesOut  uint64 // 原子操作
+
+	closeReason atomic.Value // 同conn.closeReason
+	buf         []byte
+}
+
+func (p *flvPlayer) key() string {
+	return p.conn.RemoteAddr().String()
+}
+
+func (p *flvPlayer) queue() *packetQueue {
+	return &p.packetQueue
+}
+
+func (p *flvPlayer) kick(reason string) error {
+	p.closeReason.Store(reason)
+	return p.conn.Close()
+}
+
+func (p *flvPlayer) apiInfo(now time.Time) *apiPlayer {
+	return &apiPlayer{
+		Id:         p.key(),
+		Protocol:   p.protocol,
+		ClientAddr: p.key(),
+		BytesOut:   atomic.LoadUint64(&p.bytesOut),
+		Dropped:    p.droppedPackets(),
+		StartTime:  p.startTime,
+		Uptime:     int64(now.Sub(p.startTime) / time.Second),
+	}
+}
+
+func (s *Server) handleHttpFlv(w http.ResponseWriter, r *http.Request, hs *httpStream) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	if _, ok := s.broker.getSession(hs.streamKey()); !ok {
+		s.metrics.incPlayRejection(playRejectStreamNotFound)
+		http.NotFound(w, r)
+		return
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		s.logger.Debug("http-flv hijack", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+
+	if !s.trackHttpConn(conn, true) {
+		return
+	}
+	defer s.trackHttpConn(conn, false)
+
+	chunked := r.ProtoAtLeast(1, 1)
+	if err := writeStreamResponseHeader(conn, w.Header(), "video/x-flv", chunked, s.getConfig().WriteTimeout); err != nil {
+		s.logger.Debug("write http-flv response header", zap.Error(err))
+		return
+	}
+
+	var tw flvTagWriter = &rawFlvWriter{conn: conn}
+	if chunked {
+		tw = &chunkedFlvWriter{conn: conn}
+	}
+
+	// 读取客户端数据只为感知断开
+	readLoop := func() error {
+		if _, err := io.Copy(ioutil.Discard, brw.Reader); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	s.playFlv(conn, readLoop, tw, r, hs, protocolHttpFlv)
+}
+
+// writeStreamResponseHeader 接管连接后手动输出响应头, HTTP/1.0客户端不使用chunked, 以关闭连接结束
+func writeStreamResponseHeader(conn net.Conn, header http.Header, contentType string, chunked bool, timeout time.Duration) error {
+	header.Set("Content-Type", contentType)
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "close")
+	if chunked {
+		header.Set("Transfer-Encoding", "chunked")
+	}
+
+	bw := bufio.NewWriter(conn)
+	bw.WriteString("HTTP/1.1 200 OK\r\n")
+	if err := header.Write(bw); err != nil {
+		return err
+	}
+	bw.WriteString("\r\n")
+
+	if timeout > 0 {
+		_ = conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	return bw.Flush()
+}
+
+// playFlv 加入session并持续发送FLV tag, 结束时记录访问日志; http-flv与websocket-flv共用
+// readLoop读取客户端数据, 返回即认为客户端已断开
+func (s *Server) playFlv(conn net.Conn, readLoop func() error, tw flvTagWriter, r *http.Request, hs *httpStream, protocol string) {
+	cfg := s.getConfig()
+	sp, err := s.broker.attachPlayer(hs.streamKey(), func(sess *session) (sessionPlayer, error) {
+		p := &flvPlayer{
+			server:    s,
+			session:   sess,
+			protocol:  protocol,
+			conn:      conn,
+			w:         tw,
+			closed:    make(chan struct{}),
+			startTime: time.Now(),
+		}
+		p.initQueue(150, sess.appMetrics) //TODO: config, 与rtmp播放端一致
+		return p, nil
+	})
+	if err != nil {
+		// 响应头已发送, 只能断开
+		if errors.Cause(err) == errSessionNotExists {
+			s.metrics.incPlayRejection(playRejectStreamNotFound)
+		} else {
+			s.metrics.incPlayRejection(playRejectError)
+		}
+		return
+	}
+	p := sp.(*flvPlayer)
+
+	go func() {
+		defer close(p.closed)
+		p.readErr = readLoop()
+	}()
+
+	err = p.play(cfg.WriteTimeout)
+
+	rec := p.accessRecord(r, hs, err)
+	s.writeAccessLog(rec)
+
+	if rec.Reason == closeReasonError {
+		s.logger.Error("play flv", zap.String("client", p.key()), zap.String("protocol", protocol), zap.Error(err))
+	}
+}
+
+func (p *flvPlayer) play(writeTimeout time.Duration) error {
+	defer p.session.delPlayer(p)
+
+	hasAudio, hasVideo := false, false
+	for _, pkt := range p.startPackets {
+		hasAudio = hasAudio || pkt.PacketType == av.AudioType
+		hasVideo = hasVideo || pkt.PacketType == av.VideoType
+	}
+	if !hasAudio && !hasVideo { // 推流端尚未发送音视频
+		hasAudio, hasVideo = true, true
+	}
+
+	p.buf = append(p.buf[:0], flv.Header(hasAudio, hasVideo)...)
+	for _, pkt := range p.startPackets {
+		if err := p.appendTag(pkt); err != nil {
+			return err
+		}
+	}
+	p.startPackets = nil
+
+	if err := p.flush(writeTimeout); err != nil {
+		return errors.Wrap(err, "send flv header and start packets")
+	}
+
+	for {
+		select {
+		case <-p.server.done:
+			p.closeWriter()
+			return ErrServerClosed
+		case <-p.closed:
+			return p.readErr
+		case pkt, ok := <-p.packetBuffer:
+			if !ok {
+				p.closeWriter()
+				return errPlayerBufferClosed
+			}
+
+			if err := p.appendTag(pkt); err != nil {
+				return err
+			}
+
+			// 合并队列中积压的packet
+		merge:
+			for len(p.buf) < flvMergeBytes {
+				select {
+				case pkt, ok := <-p.packetBuffer:
+					if !ok {
+						break merge
+					}
+					if err := p.appendTag(pkt); err != nil {
+						return err
+					}
+				default:
+					break merge
+				}
+			}
+
+			if err := p.flush(writeTimeout); err != nil {
+				return errors.Wrap(err, "write flv tags")
+			}
+		}
+	}
+}
+
+// closeWriter 正常结束响应, 之前flush设置的写超时可能已过期
+func (p *flvPlayer) closeWriter() {
+	_ = p.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_ = p.w.close()
+}
+
+func (p *flvPlayer) appendTag(pkt *av.Packet) error {
+	data := pkt.Data
+	if pkt.PacketType == av.MetaData {
+		var err error
+		if data, err = amf.MetaDataReform(data, amf.DEL); err != nil {
+			return errors.Wrap(err, "amf encode metaData")
+		}
+	}
+
+	p.buf = flv.AppendTag(p.buf, pkt.PacketType, p.next(pkt), data)
+	return nil
+}
+
+func (p *flvPlayer) flush(writeTimeout time.Duration) error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+
+	if writeTimeout > 0 {
+		_ = p.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	}
+
+	if err := p.w.writeTags(p.buf); err != nil {
+		return err
+	}
+
+	atomic.AddUint64(&p.bytesOut, uint64(len(p.buf)))
+	atomic.AddUint64(&p.session.bytesOut, uint64(len(p.buf)))
+	p.server.metrics.AddOutBytes(len(p.buf))
+	p.buf = p.buf[:0]
+	return nil
+}
+
+func (p *flvPlayer) accessRecord(r *http.Request, hs *httpStream, err error) *accessRecord {
+	now := time.Now()
+	addr := p.key()
+
+	rec := &accessRecord{
+		Protocol:   p.protocol,
+		Role:       accessRolePlay,
+		ClientIp:   hostOf(addr),
+		ClientAddr: addr,
+		Vhost:      hs.vhost,
+		App:        hs.app,
+		Stream:     hs.stream,
+		SessionId:  p.session.getId(),
+		StartTime:  p.startTime,
+		EndTime:    now,
+		Duration:   now.Sub(p.startTime).Seconds(),
+		BytesOut:   atomic.LoadUint64(&p.bytesOut),
+		Dropped:    p.droppedPackets(),
+		UserAgent:  r.UserAgent(),
+		TcUrl:      logUrl(r.URL),
+	}
+
+	rec.setCloseReason(p.server, &p.closeReason, err)
+	return rec
+}
+
+// chunkedFlvWriter 每次写入作为一个chunk
+type chunkedFlvWriter struct {
+	conn net.Conn
+	hdr  []byte
+}
+
+func (cw *chunkedFlvWriter) writeTags(b []byte) error {
+	cw.hdr = strconv.AppendInt(cw.hdr[:0], int64(len(b)), 16)
+	cw.hdr = append(cw.hdr, '\r', '\n')
+
+	bufs := net.Buffers{cw.hdr, b, []byte("\r\n")}
+	_, err := bufs.WriteTo(cw.conn)
+	return err
+}
+
+func (cw *chunkedFlvWriter) close() error {
+	_, err := cw.conn.Write([]byte("0\r\n\r\n"))
+	return err
+}
+
+// rawFlvWriter HTTP/1.0客户端, 直接输出
+type rawFlvWriter struct {
+	conn net.Conn
+}
+
+func (rw *rawFlvWriter) writeTags(b []byte) error {
+	_, err := rw.conn.Write(b)
+	return err
+}
+
+func (rw *rawFlvWriter) close() error {
+	return nil
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"fastlive/pkg/websocket"
+)
+
+/*
+http播放listener(protocol: http)
+GET /crossdomain.xml          flash跨域策略
+GET /{app}/{stream}.flv       HTTP-FLV, websocket握手时为WebSocket-FLV
+GET /{app}/{stream}.ts        HTTP-TS(流存在时), 见http_ts.go
+GET /{app}/{stream}.m3u8      HLS playlist
+GET /{app}/{stream}/{seq}.ts  HLS切片
+GET /{app}/{stream}.key?n=    HLS加密密钥(hls.encryption)
+GET /{app}/{stream}/{msn}.m4s, /{app}/{stream}/{msn}.{part}.m4s  LL-HLS切片及part(hls.lowLatency)
+GET /{app}/{stream}.mpd       DASH MPD
+GET /{app}/{stream}/{kind}-init.mp4, /{app}/{stream}/{kind}-{time}.m4s  DASH init segment及切片
+GET /{app}/{group}.m3u8, /{app}/{group}.mpd  多码率组的HLS master playlist及DASH MPD(renditions), 见rendition.go
+开启http.tokenSecret时播放地址, 密钥及切片需要携带token, 见token.go
+*/
+
+const (
+	protocolRtmp = "rtmp"
+	protocolHttp = "http"
+)
+
+// httpStream http播放请求解析出的流信息
+type httpStream struct {
+	vhost  string
+	app    string
+	stream string
+	ext    string // 扩展名, 如.flv
+}
+
+func (hs *httpStream) streamKey() string {
+	return genStreamKey(hs.vhost, hs.app, hs.stream)
+}
+
+// fileOwner 切片/{app}/{stream}/{file}所属的流
+func (hs *httpStream) fileOwner() *httpStream {
+	i := strings.LastIndexByte(hs.app, '/')
+	if i < 0 {
+		return hs
+	}
+	return &httpStream{vhost: hs.vhost, app: hs.app[:i], stream: hs.app[i+1:], ext: hs.ext}
+}
+
+// fileStreamKey HLS/DASH文件所属流: playlist/MPD为/{app}/{stream}.ext, 切片在/{app}/{stream}/目录下
+func (hs *httpStream) fileStreamKey() string {
+	switch hs.ext {
+	case ".m3u8", ".mpd":
+		return hs.streamKey()
+	default:
+		return hs.fileOwner().streamKey()
+	}
+}
+
+// countingResponseWriter 记录响应body实际写入的字节数
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n int
+}
+
+func (cw *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(b)
+	cw.n += n
+	return n, err
+}
+
+// serveFile 发送HLS/DASH文件(支持Range及条件请求), 发送的字节数计入server指标及所属session的bytesOut(用量统计)
+// session已删除时不再计入, 多码率组的master playlist不属于单个流也不计入
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, hs *httpStream, data []byte) {
+	cw := &countingResponseWriter{ResponseWriter: w}
+	http.ServeContent(cw, r, "", time.Time{}, bytes.NewReader(data))
+
+	if cw.n <= 0 {
+		return
+	}
+	s.metrics.AddOutBytes(cw.n)
+	if sess, ok := s.broker.getSession(hs.fileStreamKey()); ok {
+		atomic.AddUint64(&sess.bytesOut, uint64(cw.n))
+	}
+}
+
+func (s *Server) httpLiveHandler(lc ListenerConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.setCorsHeaders(w)
+
+		if r.URL.Path == "/crossdomain.xml" {
+			s.handleCrossDomain(w, r)
+			return
+		}
+
+		if r.Method == http.MethodOptions { // CORS预检
+			w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "*")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		hs, ok := parseHttpStream(r, lc)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		// app或stream含"."/".."等路径元素时, token按字面app校验而读取文件时会被解析到其他流
+		if !validOutputName(hs.app + "/" + hs.stream) {
+			http.Error(w, "invalid stream path", http.StatusForbidden)
+			return
+		}
+
+		liveTs := false // 与HLS切片(/{app}/{stream}/{seq}.ts)以流是否存在区分
+		if hs.ext == ".ts" {
+			_, liveTs = s.broker.getSession(hs.streamKey())
+		}
+
+		// 切片使用所在流的token
+		tokenStream := hs
+		if (hs.ext == ".ts" && !liveTs) || hs.ext == ".m4s" || hs.ext == ".mp4" {
+			tokenStream = hs.fileOwner()
+		}
+		if !s.checkPlayToken(r, tokenStream) {
+			http.Error(w, "invalid or expired token", http.StatusForbidden)
+			return
+		}
+
+		switch hs.ext {
+		case ".flv":
+			if websocket.IsUpgrade(r) {
+				s.handleWsFlv(w, r, hs)
+			} else {
+				s.handleHttpFlv(w, r, hs)
+			}
+		case ".ts":
+			if liveTs {
+				s.handleHttpTs(w, r, hs)
+			} else {
+				s.handleHls(w, r, hs)
+			}
+		case ".m3u8":
+			s.handleHls(w, r, hs)
+		case ".key":
+			s.handleHlsKey(w, r, hs)
+		case ".mpd":
+			s.handleDash(w, r, hs)
+		case ".mp4", ".m4s":
+			// LL-HLS与DASH的fMP4文件以所在目录对应的流区分
+			if stream := s.llHlsStream(path.Join(hs.vhost, hs.app)); stream != nil {
+				s.handleLLHlsFile(w, r, stream, hs)
+			} else {
+				s.handleDash(w, r, hs)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// parseHttpStream 解析/{app}/{stream}.{ext}, app可包含"/"
+func parseHttpStream(r *http.Request, lc ListenerConfig) (*httpStream, bool) {
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	idx := strings.LastIndexByte(p, '/')
+	if idx <= 0 {
+		return nil, false
+	}
+
+	app, name := p[:idx], p[idx+1:]
+	dot := strings.LastIndexByte(name, '.')
+	if dot <= 0 {
+		return nil, false
+	}
+
+	vhost := lc.Vhost
+	if vhost == "" {
+		vhost, _ = parseVhost("http://" + r.Host)
+	}
+
+	return &httpStream{vhost: vhost, app: app, stream: name[:dot], ext: name[dot:]}, true
+}
+
+func (s *Server) setCorsHeaders(w http.ResponseWriter) {
+	h := w.Header()
+	h.Set("Access-Control-Allow-Origin", s.getConfig().Http.AllowOrigin)
+	h.Set("Access-Control-Expose-Headers", "Content-Length, Content-Type")
+}
+
+func (s *Server) handleCrossDomain(w http.ResponseWriter, r *http.Request) {
+	domain := s.getConfig().Http.AllowOrigin
+	if idx := strings.Index(domain, "://"); idx >= 0 {
+		domain = domain[idx+3:]
+	}
+
+	w.Header().Set("Content-Type", "text/xml")
+	_, _ = w.Write([]byte(`<?xml version="1.0"?>
+<cross-domain-policy>
+    <allow-access-from domain="` + domain + `"/>
+    <allow-http-request-headers-from domain="` + domain + `" headers="*"/>
+</cross-domain-policy>
+`))
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestHttpLiveTokenPath(t *testing.T) {
+	s, err := New(WithLogger(zap.NewNop()), WithConfig(Config{
+		Hls:  HlsConfig{Enable: true},
+		Http: HttpConfig{TokenSecret: "sec", TokenApps: []string{"paid"}},
+	}))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, name := range []string{"default/paid/ev.m3u8", "default/paid/ev.key", "default/paid/ev/0.ts", "default/free/ev.m3u8"} {
+		assert.NoError(t, s.hlsStore.Put(name, []byte("#EXTM3U\n")))
+	}
+
+	expires := time.Now().Add(time.Minute).Unix()
+	token := "?expires=" + strconv.FormatInt(expires, 10) + "&token=" + PlayToken("sec", "paid", "ev", expires)
+
+	handler := s.httpLiveHandler(ListenerConfig{Vhost: "default"})
+	for _, tt := range []struct {
+		path string
+		want int
+	}{
+		{"/free/ev.m3u8", http.StatusOK},
+		{"/paid/ev.m3u8", http.StatusForbidden},
+		{"/paid/ev.m3u8" + token, http.StatusOK},
+		{"/paid/ev/0.ts", http.StatusForbidden},
+		{"/paid/ev/0.ts" + token, http.StatusOK},
+		// 路径中的..不能绕过token
+		{"/free/../paid/ev.m3u8", http.StatusForbidden},
+		{"/free/../paid/ev/0.ts", http.StatusForbidden},
+		{"/free/../paid/ev.mpd", http.StatusForbidden},
+		{"/free/x/../../paid/ev.key?n=0", http.StatusForbidden},
+		{"/free/./ev.m3u8", http.StatusForbidden},
+		{"/free//ev.m3u8", http.StatusForbidden},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		assert.Equal(t, tt.want, w.Code, tt.path)
+	}
+}
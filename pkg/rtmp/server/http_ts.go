@@ -0,0 +1,104 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+/*
+HTTP-TS播放: GET /{app}/{stream}.ts 连续的MPEG-TS流(IRD, IPTV头端等)
+1. 与HTTP-FLV相同的准入, 接管连接及chunked输出; 流存在时.ts请求为HTTP-TS, 否则为HLS切片
+2. 与HTTP-FLV相同的token校验
+*/
+
+func (s *Server) handleHttpTs(w http.ResponseWriter, r *http.Request, hs *httpStream) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		s.logger.Debug("http-ts hijack", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+
+	if !s.trackHttpConn(conn, true) {
+		return
+	}
+	defer s.trackHttpConn(conn, false)
+
+	cfg := s.getConfig()
+	chunked := r.ProtoAtLeast(1, 1)
+	if err := writeStreamResponseHeader(conn, w.Header(), "video/mp2t", chunked, cfg.WriteTimeout); err != nil {
+		s.logger.Debug("write http-ts response header", zap.Error(err))
+		return
+	}
+
+	out := &httpTsOutput{conn: conn, timeout: cfg.WriteTimeout, w: &rawFlvWriter{conn: conn}}
+	if chunked {
+		out.w = &chunkedFlvWriter{conn: conn}
+	}
+
+	addr := conn.RemoteAddr().String()
+	sp, err := s.broker.attachPlayer(hs.streamKey(), func(sess *session) (sessionPlayer, error) {
+		return s.newTsPlayer(sess, protocolHttpTs, addr, out, conn.Close), nil
+	})
+	if err != nil {
+		// 响应头已发送, 只能断开
+		if errors.Cause(err) == errSessionNotExists {
+			s.metrics.incPlayRejection(playRejectStreamNotFound)
+		} else {
+			s.metrics.incPlayRejection(playRejectError)
+		}
+		return
+	}
+	p := sp.(*tsPlayer)
+
+	// 读取客户端数据只为感知断开
+	go func() {
+		defer close(p.closed)
+		if _, err := io.Copy(ioutil.Discard, brw.Reader); err != nil {
+			p.closeErr = err
+		} else {
+			p.closeErr = io.EOF
+		}
+	}()
+
+	err = p.play()
+
+	rec := p.accessRecord(r.UserAgent(), logUrl(r.URL), err)
+	s.writeAccessLog(rec)
+
+	if rec.Reason == closeReasonError {
+		s.logger.Error("play ts", zap.String("client", p.key()), zap.String("protocol", protocolHttpTs), zap.Error(err))
+	}
+}
+
+// httpTsOutput 以HTTP-FLV相同的方式(chunked或直接输出)写入TS数据, 每次写入使用WriteTimeout
+type httpTsOutput struct {
+	conn    net.Conn
+	timeout time.Duration
+	w       flvTagWriter
+}
+
+func (o *httpTsOutput) writeTs(b []byte) error {
+	if o.timeout > 0 {
+		_ = o.conn.SetWriteDeadline(time.Now().Add(o.timeout))
+	}
+	return o.w.writeTags(b)
+}
+
+// close 正常结束响应, 之前设置的写超时可能已过期
+func (o *httpTsOutput) close() error {
+	_ = o.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	return o.w.close()
+}
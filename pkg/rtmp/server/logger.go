@@ -13,54 +13,70 @@ import (
 )
 
 func (s *Server) initLogger() error {
-	log := s.config.Log
-	logPath, err := getAbsLogPath(log.Path)
-	if err != nil {
-		return errors.Wrap(err, "get abs log path")
-	}
+	log := s.getConfig().Log
 
-	age := log.Age
-	if age <= 0 {
-		age = 7
+	s.logLevel = zap.NewAtomicLevel()
+	if err := s.logLevel.UnmarshalText([]byte(log.Level)); err != nil {
+		return errors.Wrap(err, "invalid log level")
 	}
-	maxAge := time.Duration(age) * 24 * time.Hour
 
-	rotationTime := log.RotationTime
-	if rotationTime <= 0 {
-		rotationTime = 24 * time.Hour
+	encoderCfg := zap.NewProductionEncoderConfig()
+	encoderCfg.TimeKey = "time"
+	encoderCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+
+	// 未配置日志路径(如前台运行)时输出到stderr
+	if log.Path == "" {
+		core := zapcore.NewCore(
+			zapcore.NewJSONEncoder(encoderCfg),
+			zapcore.Lock(os.Stderr),
+			s.logLevel,
+		)
+		s.logger = zap.New(core, zap.AddCaller())
+		return nil
 	}
 
-	rotator, err := rotatelogs.New(
-		logPath+"_%Y%m%d",
-		rotatelogs.WithLinkName(logPath),
-		rotatelogs.WithMaxAge(maxAge),
-		rotatelogs.WithRotationTime(rotationTime),
-	)
+	rotator, err := newRotator(log.Path, log.RotationTime, log.Age)
 	if err != nil {
 		return errors.Wrap(err, "create log rotator")
 	}
 
-	level := zap.NewAtomicLevel()
-	if err := level.UnmarshalText([]byte(log.Level)); err != nil {
-		return errors.Wrap(err, "invalid log level")
-	}
-
-	encoderCfg := zap.NewProductionEncoderConfig()
-	encoderCfg.TimeKey = "time"
-	encoderCfg.EncodeTime = zapcore.ISO8601TimeEncoder
-
 	w := zapcore.AddSync(rotator)
 	core := zapcore.NewCore(
 		zapcore.NewJSONEncoder(encoderCfg),
 		w,
-		level.Level(),
+		s.logLevel,
 	)
 
 	s.logger = zap.New(core, zap.AddCaller())
+	s.logCloser = rotator
 
 	return nil
 }
 
+// newRotator 按时间切割的日志文件, 默认每天切割并保留7天
+func newRotator(p string, rotationTime time.Duration, age int) (*rotatelogs.RotateLogs, error) {
+	logPath, err := getAbsLogPath(p)
+	if err != nil {
+		return nil, errors.Wrap(err, "get abs log path")
+	}
+
+	if age <= 0 {
+		age = 7
+	}
+	maxAge := time.Duration(age) * 24 * time.Hour
+
+	if rotationTime <= 0 {
+		rotationTime = 24 * time.Hour
+	}
+
+	return rotatelogs.New(
+		logPath+"_%Y%m%d",
+		rotatelogs.WithLinkName(logPath),
+		rotatelogs.WithMaxAge(maxAge),
+		rotatelogs.WithRotationTime(rotationTime),
+	)
+}
+
 func getAbsLogPath(p string) (string, error) {
 	if path.IsAbs(p) {
 		return p, nil
@@ -0,0 +1,347 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"fastlive/pkg/proxyproto"
+	"fastlive/pkg/rtmp/chunk"
+	"fastlive/pkg/rtmp/handshake"
+)
+
+// metrics server运行指标(Prometheus文本格式输出)
+// 所有计数均为原子操作, 采集时只遍历app维度, 不遍历连接/session
+type metrics struct {
+	bytesIn  uint64
+	bytesOut uint64 // rtmp连接及HTTP-FLV/WS-FLV/HTTP-TS/UDP-TS/HLS/DASH发送的字节数
+
+	droppedPackets uint64 // 所有app播放端丢弃的packet数, 不随app指标删除而丢失
+
+	inMessages  [maxMetricsMessageTypeId + 1]uint64
+	outMessages [maxMetricsMessageTypeId + 1]uint64
+
+	handshakeFailures [len(handshakeFailureReasons)]uint64
+	handshakeLatency  *histogram // 秒
+
+	publishRejections [len(publishRejectReasons)]uint64
+	playRejections    [len(playRejectReasons)]uint64
+
+	flushBytes    *histogram // player合并写每次flush的字节数
+	flushMessages *histogram // player合并写每次flush的message数
+
+	watchdogAlarms      [len(trackNames)]uint64 // 推流端track静默告警次数
+	watchdogDisconnects uint64                  // 因静默断开的publisher数
+
+	appsMu sync.Mutex
+	apps   map[string]*appMetrics // 由appsMu保护
+}
+
+// appMetrics app维度指标, 由连接及session引用, 没有引用时删除
+type appMetrics struct {
+	name string
+	refs int // 由metrics.appsMu保护
+
+	connections    int64
+	sessions       int64
+	players        int64
+	droppedPackets uint64 // 播放端因消费过慢丢弃的packet数
+
+	m *metrics
+}
+
+const maxMetricsMessageTypeId = chunk.MsgAggregateMessage
+
+var messageTypeNames = map[chunk.RtmpMessageTypeID]string{
+	chunk.MsgSetChunkSize:               "set_chunk_size",
+	chunk.MsgAbortMessage:               "abort",
+	chunk.MsgAcknowledgement:            "ack",
+	chunk.MsgUserControlMessage:         "user_control",
+	chunk.MsgWindowAcknowledgementSize:  "window_ack_size",
+	chunk.MsgSetPeerBandwidth:           "set_peer_bandwidth",
+	chunk.MsgEdgeAndOriginServerCommand: "edge_origin",
+	chunk.MsgAudioMessage:               "audio",
+	chunk.MsgVideoMessage:               "video",
+	chunk.MsgAMF3DataMessage:            "amf3_data",
+	chunk.MsgAMF3SharedObject:           "amf3_shared_object",
+	chunk.MsgAMF3CommandMessage:         "amf3_command",
+	chunk.MSGAMF0DataMessage:            "amf0_data",
+	chunk.MSGAMF0SharedObject:           "amf0_shared_object",
+	chunk.MsgAMF0CommandMessage:         "amf0_command",
+	chunk.MsgAggregateMessage:           "aggregate",
+}
+
+// 握手失败原因
+const (
+	handshakeFailTimeout = iota
+	handshakeFailVersion
+	handshakeFailC1
+	handshakeFailIO
+	handshakeFailProxy
+)
+
+var handshakeFailureReasons = [...]string{"timeout", "version", "c1_invalid", "io", "proxy_protocol"}
+
+// 推流/播放拒绝原因
+const (
+	publishRejectSessionExists = iota
+	publishRejectError
+)
+
+var publishRejectReasons = [...]string{"session_exists", "error"}
+
+const (
+	playRejectStreamNotFound = iota
+	playRejectError
+)
+
+var playRejectReasons = [...]string{"stream_not_found", "error"}
+
+func newMetrics() *metrics {
+	return &metrics{
+		handshakeLatency: newHistogram(0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5),
+		flushBytes:       newHistogram(1024, 4096, 16384, 65536, 262144, 1048576),
+		flushMessages:    newHistogram(1, 2, 5, 10, 20, 50, 100),
+		apps:             make(map[string]*appMetrics),
+	}
+}
+
+// 实现 connection.Stats
+func (m *metrics) AddInBytes(n int) {
+	atomic.AddUint64(&m.bytesIn, uint64(n))
+}
+
+func (m *metrics) AddOutBytes(n int) {
+	atomic.AddUint64(&m.bytesOut, uint64(n))
+}
+
+func (m *metrics) IncInMessage(typeId chunk.RtmpMessageTypeID) {
+	if typeId <= maxMetricsMessageTypeId {
+		atomic.AddUint64(&m.inMessages[typeId], 1)
+	}
+}
+
+func (m *metrics) IncOutMessage(typeId chunk.RtmpMessageTypeID) {
+	if typeId <= maxMetricsMessageTypeId {
+		atomic.AddUint64(&m.outMessages[typeId], 1)
+	}
+}
+
+// acquireApp 获取(不存在时创建)app维度指标并增加引用, 不再使用时调用releaseApp
+// app名称来自客户端connect, 没有引用时删除, 避免任意名称使内存及标签数无限增长(丢包计数随之清零)
+func (m *metrics) acquireApp(name string) *appMetrics {
+	m.appsMu.Lock()
+	defer m.appsMu.Unlock()
+
+	am := m.apps[name]
+	if am == nil {
+		am = &appMetrics{name: name, m: m}
+		m.apps[name] = am
+	}
+	am.refs++
+	return am
+}
+
+// addDroppedPacket 同时计入server总数, app指标删除后总数仍然保留
+func (am *appMetrics) addDroppedPacket() {
+	atomic.AddUint64(&am.droppedPackets, 1)
+	if am.m != nil {
+		atomic.AddUint64(&am.m.droppedPackets, 1)
+	}
+}
+
+func (m *metrics) releaseApp(am *appMetrics) {
+	m.appsMu.Lock()
+	defer m.appsMu.Unlock()
+
+	am.refs--
+	if am.refs <= 0 && m.apps[am.name] == am {
+		delete(m.apps, am.name)
+	}
+}
+
+func (m *metrics) incHandshakeFailure(err error) {
+	reason := handshakeFailIO
+	switch errors.Cause(err) {
+	case handshake.ErrTimeout:
+		reason = handshakeFailTimeout
+	case handshake.ErrVersion:
+		reason = handshakeFailVersion
+	case handshake.ErrInvalidC1:
+		reason = handshakeFailC1
+	case proxyproto.ErrInvalidHeader:
+		reason = handshakeFailProxy
+	}
+
+	atomic.AddUint64(&m.handshakeFailures[reason], 1)
+}
+
+func (m *metrics) incPublishRejection(reason int) {
+	atomic.AddUint64(&m.publishRejections[reason], 1)
+}
+
+func (m *metrics) incPlayRejection(reason int) {
+	atomic.AddUint64(&m.playRejections[reason], 1)
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	bw := bufio.NewWriter(w)
+	s.metrics.writeTo(bw, s)
+	if err := bw.Flush(); err != nil {
+		s.logger.Debug("write metrics", zap.Error(err))
+	}
+}
+
+func (m *metrics) writeTo(w io.Writer, s *Server) {
+	writeMetricHeader(w, "fastlive_connections", "gauge", "Active connections.")
+	fmt.Fprintf(w, "fastlive_connections %d\n", atomic.LoadInt32(&s.connTotal))
+
+	writeMetricHeader(w, "fastlive_sessions", "gauge", "Active stream sessions.")
+	fmt.Fprintf(w, "fastlive_sessions %d\n", s.broker.getSessionTotalNumber())
+
+	m.appsMu.Lock()
+	apps := make([]*appMetrics, 0, len(m.apps))
+	for _, am := range m.apps {
+		apps = append(apps, am)
+	}
+	m.appsMu.Unlock()
+	sort.Slice(apps, func(i, j int) bool { return apps[i].name < apps[j].name })
+
+	appGauges := []struct {
+		name, typ, help string
+		value           func(am *appMetrics) uint64
+	}{
+		{"fastlive_app_connections", "gauge", "Active connections per app.", func(am *appMetrics) uint64 {
+			return uint64(atomic.LoadInt64(&am.connections))
+		}},
+		{"fastlive_app_sessions", "gauge", "Active stream sessions per app.", func(am *appMetrics) uint64 {
+			return uint64(atomic.LoadInt64(&am.sessions))
+		}},
+		{"fastlive_app_players", "gauge", "Active players per app.", func(am *appMetrics) uint64 {
+			return uint64(atomic.LoadInt64(&am.players))
+		}},
+		{"fastlive_player_dropped_packets_total", "counter", "Packets dropped by slow players per app, not per player (per-player counts are in the API player list). Removed with the app's other series when unreferenced.", func(am *appMetrics) uint64 {
+			return atomic.LoadUint64(&am.droppedPackets)
+		}},
+	}
+	for _, g := range appGauges {
+		writeMetricHeader(w, g.name, g.typ, g.help)
+		for _, am := range apps {
+			fmt.Fprintf(w, "%s{app=\"%s\"} %d\n", g.name, escapeLabelValue(am.name), g.value(am))
+		}
+	}
+
+	writeMetricHeader(w, "fastlive_dropped_packets_total", "counter", "Packets dropped by slow players across all apps.")
+	fmt.Fprintf(w, "fastlive_dropped_packets_total %d\n", atomic.LoadUint64(&m.droppedPackets))
+
+	writeMetricHeader(w, "fastlive_bytes_in_total", "counter", "Bytes received from clients (excluding handshake).")
+	fmt.Fprintf(w, "fastlive_bytes_in_total %d\n", atomic.LoadUint64(&m.bytesIn))
+	writeMetricHeader(w, "fastlive_bytes_out_total", "counter", "Bytes sent to RTMP, HTTP-FLV, WebSocket-FLV, HTTP-TS, HLS and DASH clients and UDP outputs (excluding handshake).")
+	fmt.Fprintf(w, "fastlive_bytes_out_total %d\n", atomic.LoadUint64(&m.bytesOut))
+
+	writeMetricHeader(w, "fastlive_messages_total", "counter", "RTMP messages by direction and type.")
+	for typeId := chunk.RtmpMessageTypeID(0); typeId <= maxMetricsMessageTypeId; typeId++ {
+		name, ok := messageTypeNames[typeId]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(w, "fastlive_messages_total{direction=\"in\",type=\"%s\"} %d\n", name, atomic.LoadUint64(&m.inMessages[typeId]))
+		fmt.Fprintf(w, "fastlive_messages_total{direction=\"out\",type=\"%s\"} %d\n", name, atomic.LoadUint64(&m.outMessages[typeId]))
+	}
+
+	writeMetricHeader(w, "fastlive_handshake_failures_total", "counter", "RTMP handshake failures by reason.")
+	for reason, name := range handshakeFailureReasons {
+		fmt.Fprintf(w, "fastlive_handshake_failures_total{reason=\"%s\"} %d\n", name, atomic.LoadUint64(&m.handshakeFailures[reason]))
+	}
+
+	writeMetricHeader(w, "fastlive_handshake_duration_seconds", "histogram", "Successful RTMP handshake latency.")
+	m.handshakeLatency.writeTo(w, "fastlive_handshake_duration_seconds")
+
+	writeMetricHeader(w, "fastlive_publish_rejections_total", "counter", "Rejected publish requests by reason.")
+	for reason, name := range publishRejectReasons {
+		fmt.Fprintf(w, "fastlive_publish_rejections_total{reason=\"%s\"} %d\n", name, atomic.LoadUint64(&m.publishRejections[reason]))
+	}
+
+	writeMetricHeader(w, "fastlive_play_rejections_total", "counter", "Rejected play requests by reason.")
+	for reason, name := range playRejectReasons {
+		fmt.Fprintf(w, "fastlive_play_rejections_total{reason=\"%s\"} %d\n", name, atomic.LoadUint64(&m.playRejections[reason]))
+	}
+
+	writeMetricHeader(w, "fastlive_watchdog_silence_alarms_total", "counter", "Publisher tracks that went silent past watchdog.silenceTimeout.")
+	for track, name := range trackNames {
+		fmt.Fprintf(w, "fastlive_watchdog_silence_alarms_total{track=\"%s\"} %d\n", name, atomic.LoadUint64(&m.watchdogAlarms[track]))
+	}
+
+	writeMetricHeader(w, "fastlive_watchdog_disconnects_total", "counter", "Publishers disconnected by the media watchdog.")
+	fmt.Fprintf(w, "fastlive_watchdog_disconnects_total %d\n", atomic.LoadUint64(&m.watchdogDisconnects))
+
+	writeMetricHeader(w, "fastlive_events_dropped_total", "counter", "Lifecycle events dropped because a subscriber buffer was full.")
+	fmt.Fprintf(w, "fastlive_events_dropped_total %d\n", atomic.LoadUint64(&s.events.dropped))
+
+	writeMetricHeader(w, "fastlive_merge_write_flush_bytes", "histogram", "Bytes per player merged-write flush.")
+	m.flushBytes.writeTo(w, "fastlive_merge_write_flush_bytes")
+
+	writeMetricHeader(w, "fastlive_merge_write_flush_messages", "histogram", "Messages per player merged-write flush.")
+	m.flushMessages.writeTo(w, "fastlive_merge_write_flush_messages")
+}
+
+func writeMetricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueReplacer.Replace(v)
+}
+
+// histogram 固定桶直方图, observe无锁
+type histogram struct {
+	bounds  []float64
+	buckets []uint64 // 每个桶(非累积)的计数, 最后一个为+Inf
+	sumBits uint64   // math.Float64bits(sum)
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{
+		bounds:  bounds,
+		buckets: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	idx := sort.SearchFloat64s(h.bounds, v)
+	atomic.AddUint64(&h.buckets[idx], 1)
+
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		sum := math.Float64frombits(old) + v
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, math.Float64bits(sum)) {
+			return
+		}
+	}
+}
+
+func (h *histogram) writeTo(w io.Writer, name string) {
+	cumulative := uint64(0)
+	for idx, bound := range h.bounds {
+		cumulative += atomic.LoadUint64(&h.buckets[idx])
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'f', -1, 64), cumulative)
+	}
+	cumulative += atomic.LoadUint64(&h.buckets[len(h.bounds)])
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, cumulative)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(math.Float64frombits(atomic.LoadUint64(&h.sumBits)), 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, cumulative)
+}
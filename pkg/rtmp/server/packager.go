@@ -0,0 +1,108 @@
+package server
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+
+	"fastlive/pkg/av"
+)
+
+/*
+session的切片输出(HLS, DASH):
+1. session创建时按配置创建, 独立协程从packet队列读取并写入输出, 不阻塞推流
+2. publisher断开后恢复推流时通知输出discontinuity
+3. session删除及server关闭时停止并删除该流的输出文件
+*/
+
+const packagerQueueSize = 1024
+
+// streamOutput 切片输出, 只在packager协程中调用
+type streamOutput interface {
+	WritePacket(pkt *av.Packet) error
+	Discontinuity() error
+	Close() error
+}
+
+// packager 将session的packet写入一个streamOutput
+type packager struct {
+	packetQueue
+
+	server        *Server
+	kind          string // 输出类型, 用于日志, 如hls
+	name          string
+	output        streamOutput
+	discontinuity uint32 // 原子操作, publisher恢复推流时置1
+	done          chan struct{}
+}
+
+// newPackagers 创建session开启的所有输出
+func (s *Server) newPackagers(sess *session) []*packager {
+	var packagers []*packager
+	for _, newPackager := range []func(*session) *packager{s.newHlsPackager, s.newDashPackager} {
+		if p := newPackager(sess); p != nil {
+			packagers = append(packagers, p)
+		}
+	}
+	return packagers
+}
+
+func (s *Server) startPackager(sess *session, kind, name string, output streamOutput) *packager {
+	p := &packager{
+		server: s,
+		kind:   kind,
+		name:   name,
+		output: output,
+		done:   make(chan struct{}),
+	}
+	p.initQueue(packagerQueueSize, sess.appMetrics)
+
+	go p.run()
+	return p
+}
+
+func (p *packager) run() {
+	defer close(p.done)
+
+	logged := false
+	for pkt := range p.packetBuffer {
+		var err error
+		if atomic.CompareAndSwapUint32(&p.discontinuity, 1, 0) {
+			err = p.output.Discontinuity()
+		}
+		if err == nil {
+			err = p.output.WritePacket(pkt)
+		}
+
+		// 同一问题(如不支持的编码)会持续出现, 只记录一次
+		if err != nil && !logged {
+			p.server.logger.Warn(p.kind+" packager", zap.String("name", p.name), zap.Error(err))
+			logged = true
+		}
+	}
+
+	if err := p.output.Close(); err != nil {
+		p.server.logger.Warn("remove "+p.kind+" files", zap.String("name", p.name), zap.Error(err))
+	}
+}
+
+func (p *packager) markDiscontinuity() {
+	atomic.StoreUint32(&p.discontinuity, 1)
+}
+
+// stop 停止切片并删除文件, 等待协程退出
+func (p *packager) stop() {
+	p.closePacketBuffer()
+	<-p.done
+}
+
+// validOutputName 名称中不能包含空的或"."/".."路径元素
+func validOutputName(name string) bool {
+	for _, elem := range strings.Split(name, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return false
+		}
+	}
+	return true
+}
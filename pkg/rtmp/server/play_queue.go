@@ -0,0 +1,115 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fastlive/pkg/av"
+)
+
+// sessionPlayer session的播放端(rtmp, http-flv, websocket-flv)
+type sessionPlayer interface {
+	key() string // 播放端地址, session内唯一
+	queue() *packetQueue
+	kick(reason string) error // 管理API踢出
+	apiInfo(now time.Time) *apiPlayer
+}
+
+// packetQueue 播放端packet队列: 消费过慢时丢弃packet, 丢帧后视频从关键帧恢复
+type packetQueue struct {
+	packetBufSize int             // packet队列大小
+	packetBuffer  chan *av.Packet // packet队列
+	bufferClosed  uint32
+	bufferMutex   sync.Mutex
+	dropped       uint64 // 队列满时丢弃的packet数(原子操作)
+	waitKeyFrame  bool   // 丢帧后等待下一个关键帧再恢复视频
+
+	appMetrics *appMetrics
+
+	startPackets []*av.Packet // 加入session时的metadata/sequence header/GOP, 先于队列发送
+}
+
+func (q *packetQueue) initQueue(size int, am *appMetrics) {
+	q.packetBufSize = size
+	q.packetBuffer = make(chan *av.Packet, size)
+	q.appMetrics = am
+}
+
+func (q *packetQueue) buffPackets(avPacket *av.Packet) {
+	q.bufferMutex.Lock()
+	defer q.bufferMutex.Unlock()
+
+	if atomic.LoadUint32(&q.bufferClosed) == 1 {
+		return
+	}
+
+	// 丢帧后视频需从关键帧恢复, 否则播放端花屏
+	if q.waitKeyFrame && avPacket.PacketType == av.VideoType {
+		if vh, ok := avPacket.PacketHeader.(av.VideoPacketHeader); !ok || !vh.IsKeyFrame() {
+			q.dropPacket()
+			return
+		}
+	}
+
+	select {
+	case q.packetBuffer <- avPacket:
+		if avPacket.PacketType == av.VideoType {
+			q.waitKeyFrame = false
+		}
+	default: // 播放端消费过慢, 丢弃
+		q.dropPacket()
+		q.waitKeyFrame = true
+	}
+}
+
+func (q *packetQueue) dropPacket() {
+	atomic.AddUint64(&q.dropped, 1)
+	q.appMetrics.addDroppedPacket()
+}
+
+func (q *packetQueue) closePacketBuffer() {
+	q.bufferMutex.Lock()
+	defer q.bufferMutex.Unlock()
+
+	if atomic.LoadUint32(&q.bufferClosed) == 1 {
+		return
+	}
+
+	q.bufferClosed++
+	close(q.packetBuffer)
+}
+
+func (q *packetQueue) droppedPackets() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
+
+// avTimestamp 保持发送给播放端的时间戳(audio/video整体)单增
+type avTimestamp struct {
+	basicTimestamp      uint32
+	basicAudioTimestamp uint32
+	basicVideoTimestamp uint32
+}
+
+// next 返回packet的发送时间戳并更新基准
+func (t *avTimestamp) next(avPacket *av.Packet) uint32 {
+	timestamp := avPacket.Timestamp
+	if timestamp < t.basicTimestamp {
+		timestamp = t.basicTimestamp + 40 //40ms
+	}
+
+	switch avPacket.PacketType {
+	case av.AudioType:
+		t.basicAudioTimestamp = timestamp
+	case av.VideoType:
+		t.basicVideoTimestamp = timestamp
+	}
+
+	if t.basicAudioTimestamp > t.basicVideoTimestamp {
+		t.basicTimestamp = t.basicAudioTimestamp
+	} else {
+		t.basicTimestamp = t.basicVideoTimestamp
+	}
+
+	return timestamp
+}
@@ -2,7 +2,6 @@ package server
 
 import (
 	"context"
-	"sync"
 	"sync/atomic"
 	"time"
 
@@ -14,36 +13,33 @@ import (
 	"fastlive/pkg/rtmp/chunk"
 )
 
+// player rtmp播放端
 type player struct {
 	c       *conn
 	session *session
 
-	packetBufSize int             // packet队列大小
-	packetBuffer  chan *av.Packet // packet队列
-	bufferClosed  uint32
-	bufferMutex   sync.Mutex
-
-	basicTimestamp      uint32
-	basicAudioTimestamp uint32
-	basicVideoTimestamp uint32
+	packetQueue
+	avTimestamp
 
 	msgCount   int           // 缓冲区有几个message需要发送
 	bytesCount int           // 缓冲区待发送字节数
 	mwWaitTime time.Duration // 合并发送等待时间
 	lastMwTime time.Time     // 前一次flush时间
+
+	startTime time.Time // 开始播放时间
 }
 
 func (p *player) doPlaying() error {
 	defer p.session.delPlayer(p)
 
-	if err := p.sendAvMetaPacket(); err != nil {
-		return errors.Wrap(err, "send meta/audio/video packet")
+	if err := p.sendStartPackets(); err != nil {
+		return errors.Wrap(err, "send start packets")
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	ch := make(chan error)
+	ch := make(chan error, 1)
 	go func(ctx context.Context) {
 		for {
 			select {
@@ -65,17 +61,21 @@ func (p *player) doPlaying() error {
 	}(ctx)
 
 	for {
+		if err := p.flushAvPacket(); err != nil {
+			return errors.Wrap(err, "flush av packet to player")
+		}
+
 		select {
 		case err := <-ch:
-			return err
-		default:
-			if err := p.flushAvPacket(); err != nil {
-				return errors.Wrap(err, "flush av packet to player")
+			if p.c.server.shuttingDown() {
+				return p.notifyServerShutdown()
 			}
-
-			avPacket, ok := <-p.packetBuffer
+			return err
+		case <-p.c.server.done:
+			return p.notifyServerShutdown()
+		case avPacket, ok := <-p.packetBuffer:
 			if avPacket == nil && !ok {
-				return errors.New("channel closed by writer")
+				return errPlayerBufferClosed
 			}
 
 			if avPacket != nil {
@@ -88,24 +88,44 @@ func (p *player) doPlaying() error {
 	}
 }
 
-func (p *player) sendAvMetaPacket() error {
-	if p.session.metaData != nil {
-		if err := p.sendAvPacket(p.session.metaData); err != nil {
-			return errors.Wrap(err, "send onMeta packet to player")
-		}
+// notifyServerShutdown server关闭时发送缓冲中的数据, 并通知播放端流结束
+func (p *player) notifyServerShutdown() error {
+	p.c.Connection.WriteTimeout = time.Second
+
+	event := make(amf.Object)
+	event["level"] = "status"
+	event["code"] = "NetStream.Play.UnpublishNotify"
+	event["description"] = "Server shutting down."
+	cmdMsg, _ := chunk.NewCommandMessage(
+		p.c.Connection.AmfEncoder,
+		p.c.clientPublishOrPlayInfo.csid,
+		p.c.clientPublishOrPlayInfo.streamId,
+		"onStatus", 0, nil, event,
+	)
+	if _, err := p.c.Connection.SendIntegralMessage(cmdMsg); err != nil {
+		return errors.Wrap(err, "send NetStream.Play.UnpublishNotify command message")
 	}
 
-	if p.session.audioSeqHeader != nil {
-		if err := p.sendAvPacket(p.session.audioSeqHeader); err != nil {
-			return errors.Wrap(err, "send audio sequence header to player")
-		}
+	ucMsg, _ := chunk.NewlUserControlMessage(1, 6) //streamEOF = 1
+	if _, err := p.c.Connection.SendIntegralMessage(ucMsg); err != nil {
+		return errors.Wrap(err, "send streamEOF user control message")
+	}
+
+	if _, err := p.c.Connection.Flush(); err != nil {
+		return errors.Wrap(err, "flush merged chunk message data")
 	}
 
-	if p.session.videoSeqHeader != nil {
-		if err := p.sendAvPacket(p.session.videoSeqHeader); err != nil {
-			return errors.Wrap(err, "send video sequence header to player")
+	return ErrServerClosed
+}
+
+// sendStartPackets 发送加入session时的metadata/sequence header/GOP
+func (p *player) sendStartPackets() error {
+	for _, avPacket := range p.startPackets {
+		if err := p.sendAvPacket(avPacket); err != nil {
+			return errors.Wrap(err, "send metadata/sequence header/gop packet to player")
 		}
 	}
+	p.startPackets = nil
 
 	return nil
 }
@@ -125,11 +145,7 @@ func (p *player) sendAvPacket(avPacket *av.Packet) error {
 		messageTypeId = chunk.MSGAMF0DataMessage
 	}
 
-	timestamp := avPacket.Timestamp
-	baseTimestamp := p.getBaseTimestamp()
-	if timestamp < baseTimestamp {
-		timestamp = baseTimestamp + 40 //40ms
-	}
+	timestamp := p.next(avPacket)
 
 	msg := p.c.Connection.NewChunkPool.Get().(*chunk.Chunk)
 	defer p.c.Connection.NewChunkPool.Put(msg)
@@ -159,13 +175,12 @@ func (p *player) sendAvPacket(avPacket *av.Packet) error {
 		}
 	}
 
-	p.updateBaseTimestamp(msg.GetChunkMessageTypeID(), msg.GetChunkTimestamp())
-
 	if nw, err := p.c.Connection.SendIntegralMessage(msg); err != nil {
 		return errors.Wrap(err, "write chunk message")
 	} else {
 		p.bytesCount += nw
 		p.msgCount++
+		atomic.AddUint64(&p.session.bytesOut, uint64(nw))
 	}
 
 	return nil
@@ -185,6 +200,9 @@ func (p *player) flushAvPacket() error {
 		return errors.Errorf("need write %d, actual: %d", p.bytesCount, nf)
 	}
 
+	p.c.server.metrics.flushBytes.observe(float64(nf))
+	p.c.server.metrics.flushMessages.observe(float64(p.msgCount))
+
 	p.c.server.logger.Debug("merge write message",
 		zap.Int("count", p.msgCount),
 		zap.Duration("ms", p.mwWaitTime),
@@ -197,47 +215,29 @@ func (p *player) flushAvPacket() error {
 	return nil
 }
 
-func (p *player) buffPackets(avPacket *av.Packet) {
-	p.bufferMutex.Lock()
-	defer p.bufferMutex.Unlock()
-
-	if atomic.LoadUint32(&p.bufferClosed) == 1 {
-		return
-	}
-
-	p.packetBuffer <- avPacket //TODO: 丢帧处理
+func (p *player) key() string {
+	return p.c.Rwc.RemoteAddr().String()
 }
 
-func (p *player) closePacketBuffer() {
-	p.bufferMutex.Lock()
-	defer p.bufferMutex.Unlock()
-
-	if atomic.LoadUint32(&p.bufferClosed) == 1 {
-		return
-	}
-
-	p.bufferClosed++
-	close(p.packetBuffer)
+func (p *player) queue() *packetQueue {
+	return &p.packetQueue
 }
 
-func (p *player) updateBaseTimestamp(messageTypeId chunk.RtmpMessageTypeID, timestamp uint32) {
-	switch messageTypeId {
-	case chunk.MsgAudioMessage:
-		p.basicAudioTimestamp = timestamp
-	case chunk.MsgVideoMessage:
-		p.basicVideoTimestamp = timestamp
-	}
-
-	// 保持流(audio/video)整体时间戳单增
-	if p.basicAudioTimestamp > p.basicVideoTimestamp {
-		p.basicTimestamp = p.basicAudioTimestamp
-	} else {
-		p.basicTimestamp = p.basicVideoTimestamp
-	}
+func (p *player) kick(reason string) error {
+	return p.c.closeWithReason(reason)
 }
 
-func (p *player) getBaseTimestamp() uint32 {
-	return p.basicTimestamp
+func (p *player) apiInfo(now time.Time) *apiPlayer {
+	return &apiPlayer{
+		Id:         p.key(),
+		Protocol:   protocolRtmp,
+		ClientAddr: p.c.Connection.Rwc.RemoteAddr().String(),
+		FlashVer:   p.c.clientConnectInfo.flashVer,
+		BytesOut:   p.c.Connection.OutBytes(),
+		Dropped:    p.droppedPackets(),
+		StartTime:  p.startTime,
+		Uptime:     int64(now.Sub(p.startTime) / time.Second),
+	}
 }
 
 func newPlayer(opts ...playerOption) (*player, error) {
@@ -245,7 +245,9 @@ func newPlayer(opts ...playerOption) (*player, error) {
 }
 
 var (
-	errPlayerConn = errors.New("player conn require")
+	errPlayerConn         = errors.New("player conn require")
+	errPlayerSession      = errors.New("player session require")
+	errPlayerBufferClosed = errors.New("channel closed by writer") // session删除
 )
 
 func (p *player) loadOptions(opts ...playerOption) (*player, error) {
@@ -257,16 +259,22 @@ func (p *player) loadOptions(opts ...playerOption) (*player, error) {
 		return nil, errPlayerConn
 	}
 
+	if p.session == nil {
+		return nil, errPlayerSession
+	}
+
 	if p.packetBufSize <= 0 {
 		p.packetBufSize = 10 //TODO: 更合理的默认值？
 	}
 
-	p.packetBuffer = make(chan *av.Packet, p.packetBufSize)
+	p.initQueue(p.packetBufSize, p.session.appMetrics)
 
 	if p.mwWaitTime <= 0 {
 		p.mwWaitTime = 350 * time.Millisecond //默认:250ms
 	}
 
+	p.startTime = time.Now()
+
 	return p, nil
 }
 
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// rateSampler 按固定窗口对累计字节数采样得到码率
+// update仅由单个协程(publisher)调用, Kbps可并发读取
+type rateSampler struct {
+	lastTime  time.Time
+	lastBytes uint64
+	kbps      uint64 // 原子读写
+
+	history [rateHistorySize]uint64 // 最近的采样(原子读写), 用于Peak/Average
+	samples uint64                  // 采样次数(原子读写)
+}
+
+const (
+	rateSampleWindow = time.Second
+	rateHistorySize  = 10
+)
+
+// update 返回true表示完成了一次新的采样
+func (r *rateSampler) update(now time.Time, totalBytes uint64) bool {
+	if r.lastTime.IsZero() {
+		r.lastTime = now
+		r.lastBytes = totalBytes
+		return false
+	}
+
+	elapsed := now.Sub(r.lastTime)
+	if elapsed < rateSampleWindow {
+		return false
+	}
+
+	kbps := (totalBytes - r.lastBytes) * 8 * uint64(time.Millisecond) / uint64(elapsed)
+	atomic.StoreUint64(&r.kbps, kbps)
+	n := atomic.LoadUint64(&r.samples)
+	atomic.StoreUint64(&r.history[n%rateHistorySize], kbps)
+	atomic.StoreUint64(&r.samples, n+1)
+
+	r.lastTime = now
+	r.lastBytes = totalBytes
+
+	return true
+}
+
+func (r *rateSampler) Kbps() uint64 {
+	return atomic.LoadUint64(&r.kbps)
+}
+
+// Peak 最近rateHistorySize次采样中的最大码率
+func (r *rateSampler) Peak() uint64 {
+	var peak uint64
+	for i := range r.history {
+		if v := atomic.LoadUint64(&r.history[i]); v > peak {
+			peak = v
+		}
+	}
+	return peak
+}
+
+// Average 最近rateHistorySize次采样的平均码率
+func (r *rateSampler) Average() uint64 {
+	n := atomic.LoadUint64(&r.samples)
+	if n > rateHistorySize {
+		n = rateHistorySize
+	}
+	if n == 0 {
+		return 0
+	}
+
+	var total uint64
+	for i := range r.history {
+		total += atomic.LoadUint64(&r.history[i])
+	}
+	return total / n
+}
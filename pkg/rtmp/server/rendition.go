@@ -0,0 +1,266 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"fastlive/pkg/av"
+	"fastlive/pkg/av/fmp4"
+	"fastlive/pkg/dash"
+	"fastlive/pkg/hls"
+)
+
+/*
+多码率(renditions配置): app下名称匹配pattern的流为同一组的不同rendition, 如event_1080/event_720/event_480组成event
+1. GET /{app}/{group}.m3u8 为HLS master playlist, GET /{app}/{group}.mpd 为包含所有rendition的DASH MPD, 同名的流优先
+2. BANDWIDTH/RESOLUTION/CODECS由各流的sequence header及推流码率得到, 尚未采样到码率的流不列出
+3. 组内各流的切片边界对齐到目标时长网格(要求编码器各路输出时间戳同源, 关键帧对齐), DASH共享时间轴
+4. LL-HLS playlist带同组其他rendition的EXT-X-RENDITION-REPORT
+5. 组在第一个流创建时建立, 最后一个流的session删除时移除; 流所属的组在session创建时确定
+*/
+
+type renditionGroup struct {
+	name  string // vhost/app/group
+	clock *dash.Clock
+
+	// 以下由Server.groupMu保护
+	members map[string]*session     // 组内的流 <stream>
+	dash    map[string]*dash.Stream // 组内流的DASH输出 <stream>
+}
+
+// dashClock 组内DASH流共享的时间轴, 不属于任何组时为nil
+func (g *renditionGroup) dashClock() *dash.Clock {
+	if g == nil {
+		return nil
+	}
+	return g.clock
+}
+
+// joinRenditionGroup 流名称匹配多码率组时加入该组
+func (s *Server) joinRenditionGroup(sess *session) *renditionGroup {
+	cfg := s.getConfig()
+	group, ok := cfg.renditionGroup(sess.appName, sess.streamName)
+	if !ok {
+		return nil
+	}
+	name := path.Join(sess.vhost, sess.appName, group)
+
+	s.groupMu.Lock()
+	defer s.groupMu.Unlock()
+
+	if s.renditionGroups == nil {
+		s.renditionGroups = make(map[string]*renditionGroup)
+	}
+	g := s.renditionGroups[name]
+	if g == nil {
+		g = &renditionGroup{
+			name:    name,
+			clock:   dash.NewClock(cfg.Dash.availabilityStartTime()),
+			members: make(map[string]*session),
+			dash:    make(map[string]*dash.Stream),
+		}
+		s.renditionGroups[name] = g
+	}
+	g.members[sess.streamName] = sess
+	return g
+}
+
+func (s *Server) leaveRenditionGroup(sess *session) {
+	g := sess.group
+	if g == nil {
+		return
+	}
+
+	s.groupMu.Lock()
+	defer s.groupMu.Unlock()
+
+	if g.members[sess.streamName] == sess {
+		delete(g.members, sess.streamName)
+		delete(g.dash, sess.streamName)
+	}
+	if len(g.members) == 0 && s.renditionGroups[g.name] == g {
+		delete(s.renditionGroups, g.name)
+	}
+}
+
+// addGroupDash 记录组内流的DASH输出, 用于生成组的MPD
+func (s *Server) addGroupDash(sess *session, stream *dash.Stream) {
+	if sess.group == nil {
+		return
+	}
+	s.groupMu.Lock()
+	sess.group.dash[sess.streamName] = stream
+	s.groupMu.Unlock()
+}
+
+// renditionMembers 组内的流, 按名称排序
+func (s *Server) renditionMembers(name string) []*session {
+	s.groupMu.Lock()
+	g := s.renditionGroups[name]
+	var members []*session
+	if g != nil {
+		for _, sess := range g.members {
+			members = append(members, sess)
+		}
+	}
+	s.groupMu.Unlock()
+
+	sort.Slice(members, func(i, j int) bool { return members[i].streamName < members[j].streamName })
+	return members
+}
+
+// renditionReports LL-HLS playlist中同组其他rendition的进度, 不属于任何组时为nil
+func (s *Server) renditionReports(sess *session) func() []hls.RenditionReport {
+	if sess.group == nil {
+		return nil
+	}
+
+	return func() []hls.RenditionReport {
+		var reports []hls.RenditionReport
+		for _, m := range s.renditionMembers(sess.group.name) {
+			if m == sess {
+				continue
+			}
+			stream := s.llHlsStream(path.Join(m.vhost, m.appName, m.streamName))
+			if stream == nil {
+				continue
+			}
+			if msn, part, ok := stream.LastPart(); ok {
+				reports = append(reports, hls.RenditionReport{URI: m.streamName + ".m3u8", LastMsn: msn, LastPart: part})
+			}
+		}
+		return reports
+	}
+}
+
+// variant master playlist中的一个rendition
+type variant struct {
+	stream        string
+	bandwidth     uint64 // 峰值码率(bps)
+	average       uint64
+	width, height int
+	frameRate     float64
+	codecs        []string
+}
+
+// variant 由sequence header及推流码率得到的rendition属性, 尚无码率时返回false
+func (sess *session) variant() (variant, bool) {
+	v := variant{
+		stream:    sess.streamName,
+		bandwidth: sess.bitrate.Peak() * 1000,
+		average:   sess.bitrate.Average() * 1000,
+	}
+
+	sess.mutex.RLock()
+	meta := sess.metaInfo
+	sess.mutex.RUnlock()
+	v.frameRate = meta.Framerate
+	if v.bandwidth == 0 { // 尚未完成采样时使用onMetaData中的码率
+		v.bandwidth = uint64((meta.VideodataRate + meta.Audiodatarate) * 1000)
+		v.average = v.bandwidth
+	}
+	if v.bandwidth == 0 {
+		return v, false
+	}
+
+	sess.avMutex.Lock()
+	seqHeaders := []*av.Packet{sess.videoSeqHeader, sess.audioSeqHeader}
+	sess.avMutex.Unlock()
+
+	for _, pkt := range seqHeaders {
+		if pkt == nil {
+			continue
+		}
+		t, err := fmp4.NewTrack(1, pkt)
+		if err != nil {
+			continue
+		}
+		v.codecs = append(v.codecs, t.Codec)
+		if t.Kind == fmp4.VideoTrack {
+			v.width, v.height = t.Width, t.Height
+		}
+	}
+	return v, true
+}
+
+// handleMasterPlaylist 多码率组的master playlist, 组不存在或没有可用的rendition时返回false
+func (s *Server) handleMasterPlaylist(w http.ResponseWriter, r *http.Request, hs *httpStream) bool {
+	if cfg := s.getConfig().Hls; !cfg.Enable || !cfg.appEnabled(hs.app) {
+		return false
+	}
+
+	var variants []variant
+	for _, sess := range s.renditionMembers(path.Join(hs.vhost, hs.app, hs.stream)) {
+		if v, ok := sess.variant(); ok {
+			variants = append(variants, v)
+		}
+	}
+	if len(variants) == 0 {
+		return false
+	}
+	sort.SliceStable(variants, func(i, j int) bool { return variants[i].bandwidth > variants[j].bandwidth })
+
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+	for _, v := range variants {
+		b.WriteString("#EXT-X-STREAM-INF:BANDWIDTH=" + strconv.FormatUint(v.bandwidth, 10))
+		if v.average > 0 {
+			b.WriteString(",AVERAGE-BANDWIDTH=" + strconv.FormatUint(v.average, 10))
+		}
+		if v.width > 0 && v.height > 0 {
+			b.WriteString(",RESOLUTION=" + strconv.Itoa(v.width) + "x" + strconv.Itoa(v.height))
+		}
+		if v.frameRate > 0 {
+			b.WriteString(",FRAME-RATE=" + strconv.FormatFloat(v.frameRate, 'f', 3, 64))
+		}
+		if len(v.codecs) > 0 {
+			b.WriteString(`,CODECS="` + strings.Join(v.codecs, ",") + `"`)
+		}
+		b.WriteString("\n" + v.stream + ".m3u8")
+		if q := s.tokenQuery(r, hs, v.stream); q != "" {
+			b.WriteString("?" + q)
+		}
+		b.WriteByte('\n')
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "application/vnd.apple.mpegurl")
+	h.Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b.Bytes()))
+	return true
+}
+
+// handleGroupManifest 多码率组的MPD, 由组内各流最近一次MPD的状态生成, 组不存在或没有切片时返回false
+func (s *Server) handleGroupManifest(w http.ResponseWriter, r *http.Request, hs *httpStream) bool {
+	var streams []*dash.Stream
+	s.groupMu.Lock()
+	if g := s.renditionGroups[path.Join(hs.vhost, hs.app, hs.stream)]; g != nil {
+		for _, stream := range g.dash {
+			streams = append(streams, stream)
+		}
+	}
+	s.groupMu.Unlock()
+	sort.Slice(streams, func(i, j int) bool { return streams[i].ManifestName() < streams[j].ManifestName() })
+
+	data := dash.GroupManifest(streams, time.Now())
+	if data == nil {
+		return false
+	}
+
+	names := make([]string, 0, len(streams))
+	for _, stream := range streams {
+		names = append(names, path.Base(strings.TrimSuffix(stream.ManifestName(), ".mpd")))
+	}
+	data = s.withManifestTokens(r, hs, data, names...)
+
+	h := w.Header()
+	h.Set("Content-Type", "application/dash+xml")
+	h.Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	return true
+}
@@ -0,0 +1,23 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const reusePortSupported = true
+
+// controlReusePort 监听前设置SO_REUSEPORT, 同一地址的多个socket由内核分发新连接
+func controlReusePort(network, address string, c syscall.RawConn) error {
+	var err error
+	if e := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); e != nil {
+		return e
+	}
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"syscall"
+)
+
+const reusePortSupported = false
+
+func controlReusePort(network, address string, c syscall.RawConn) error {
+	return nil
+}
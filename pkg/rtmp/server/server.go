@@ -1,72 +1,280 @@
 package server
 
 import (
+	"context"
+	"io"
 	"net"
 	"net/http"
-	_ "net/http/pprof"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/spf13/viper"
 	"go.uber.org/zap"
 
+	"fastlive/pkg/graceful"
+	"fastlive/pkg/hls"
+	"fastlive/pkg/proxyproto"
 	"fastlive/pkg/rtmp/chunk"
 )
 
 type Server struct {
-	configPath string
-	config     *config
-	logger     *zap.Logger
+	configPath      string            // 配置文件或其所在目录
+	configOverrides map[string]string // 命令行覆盖的配置项, key如"addr", "log.level"
+	viper           *viper.Viper      // 从配置文件加载时非nil
+	configValue     atomic.Value      // *Config, 热更新时整体替换
+	reloadMutex     sync.Mutex
+	logger          *zap.Logger
+	logLevel        zap.AtomicLevel // 可热更新的日志级别
+	logCloser       io.Closer       // 日志rotator, shutdown时关闭
+	accessLog       *accessLogger   // 访问日志, 未配置时为nil
+	usage           *usageTracker   // 用量统计, 未配置时为nil
+	hlsStore        hls.Store       // HLS切片及playlist存储
+	dashStore       hls.Store       // DASH切片及MPD存储
+	llHlsStreams    sync.Map        // LL-HLS流 <vhost/app/stream>*hls.LLStream, 阻塞请求需要访问流状态
+	hlsKeys         sync.Map        // 加密HLS流的密钥 <vhost/app/stream>*hls.KeyRing
+	keyProvider     hls.KeyProvider // WithKeyProvider指定的密钥来源, 优先于配置
+	groupMu         sync.Mutex
+	renditionGroups map[string]*renditionGroup // 多码率组 <vhost/app/group>
 
-	broker *broker //流会话管理器
+	broker  *broker   //流会话管理器
+	metrics *metrics  //运行指标
+	events  *eventBus //流生命周期事件
+
+	startTime time.Time // server启动时间
+	connTotal int32     // 当前连接数(原子操作)
+
+	mu          sync.Mutex
+	inShutdown  int32                   // 原子操作
+	done        chan struct{}           // shutdown开始时关闭
+	inDrain     int32                   // 原子操作, 平滑升级时不再accept
+	listeners   map[net.Listener]string // 正在accept的listener, value: 名称(用于平滑升级传递)
+	activeConns map[*conn]struct{}      // 活跃连接
+	httpConns   map[net.Conn]struct{}   // http播放端接管(hijack)的连接, 不受http.Server管理
+	connWg      sync.WaitGroup          // 连接协程
+	httpServers []*http.Server          // api/pprof等http服务
+	httpDone    chan struct{}           // http服务关闭(shutdown/drain)时关闭, 通知长连接handler退出
+	httpOnce    sync.Once
 
 	decodeHdrPool *sync.Pool //读取rtmp chunk头部时使用的[]byte池
 	encodeHdrPool *sync.Pool //rtmp chunk header编码使用的[]byte池 (at most 18 bytes)
 	newChunkPool  *sync.Pool //创建chunk块时使用
 }
 
+// ErrServerClosed Shutdown之后Serve/ListenAndServe返回该错误
+var ErrServerClosed = errors.New("rtmp: Server closed")
+
 func (s *Server) ListenAndServe() error {
-	ln, err := net.Listen("tcp", s.config.Addr)
-	if err != nil {
-		return errors.Wrap(err, "net listen")
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+
+	cfg := s.getConfig()
+	type listenerWithConfig struct {
+		name string
+		ln   net.Listener
+		lc   ListenerConfig
+	}
+	lns := make([]listenerWithConfig, 0, len(cfg.Listeners))
+	closeAll := func() {
+		for _, l := range lns {
+			l.ln.Close()
+		}
+	}
+
+	for _, lc := range cfg.Listeners {
+		n := 1
+		if lc.ReusePort > 1 {
+			n = lc.ReusePort
+		}
+
+		for idx := 0; idx < n; idx++ {
+			name := lc.Name
+			if idx > 0 {
+				name += "-" + strconv.Itoa(idx)
+			}
+
+			ln, err := s.listen(name, lc.Network, lc.Addr, lc.ReusePort > 1)
+			if err != nil {
+				closeAll()
+				return errors.Wrapf(err, "listener %s listen", name)
+			}
+			lns = append(lns, listenerWithConfig{name: name, ln: ln, lc: lc})
+		}
+	}
+
+	if cfg.Api.Addr != "" {
+		if err := s.goServeHttp("api", cfg.Api.Addr, s.apiHandler()); err != nil {
+			closeAll()
+			return errors.Wrap(err, "serve http api")
+		}
+	}
+
+	if cfg.EnablePprof && (cfg.PprofAddr != "" || cfg.Api.Addr == "") {
+		pprofAddr := cfg.PprofAddr
+		if pprofAddr == "" {
+			pprofAddr = "localhost:6060"
+		}
+
+		mux := http.NewServeMux()
+		mountPprof(mux)
+		if err := s.goServeHttp("pprof", pprofAddr, mux); err != nil {
+			s.logger.Error("serve http pprof", zap.Error(err))
+		}
+	}
+
+	if err := graceful.Ready(); err != nil {
+		s.logger.Error("notify parent process ready", zap.Error(err))
 	}
 
-	if s.config.EnablePprof {
-		go func() {
-			if err := http.ListenAndServe("localhost:6060", nil); err != nil {
-				s.logger.Error("listen http pprof", zap.Error(err))
+	// 每个listener一个accept协程, 任一listener异常退出时关闭全部
+	errCh := make(chan error, len(lns))
+	for _, l := range lns {
+		go func(l listenerWithConfig) {
+			if l.lc.Protocol == protocolHttp {
+				errCh <- s.serveHttp(l.name, l.ln, s.httpLiveHandler(l.lc))
+			} else {
+				errCh <- s.serve(l.name, l.ln, l.lc)
 			}
-		}()
+		}(l)
 	}
 
-	return s.Serve(ln)
+	var err error
+	for range lns {
+		if e := <-errCh; e != ErrServerClosed && err == nil {
+			err = e
+			closeAll()
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+	return ErrServerClosed
 }
 
+// listen 优先使用继承自父进程/systemd的listener
+func (s *Server) listen(name, network, addr string, reusePort bool) (net.Listener, error) {
+	if ln, ok := graceful.Listener(name, addr); ok {
+		s.logger.Info("use inherited listener", zap.String("name", name), zap.String("addr", ln.Addr().String()))
+		return ln, nil
+	}
+
+	var lc net.ListenConfig
+	if reusePort {
+		lc.Control = controlReusePort
+	}
+	return lc.Listen(context.Background(), network, addr)
+}
+
+// goServeHttp 监听addr并在后台协程提供http服务, shutdown时一并关闭
+func (s *Server) goServeHttp(name, addr string, handler http.Handler) error {
+	ln, err := s.listen(name, "tcp", addr, false)
+	if err != nil {
+		return errors.Wrapf(err, "%s listen", name)
+	}
+
+	go func() {
+		if err := s.serveHttp(name, ln, handler); err != ErrServerClosed {
+			s.logger.Error("serve http", zap.String("name", name), zap.Error(err))
+		}
+	}()
+
+	return nil
+}
+
+const (
+	httpReadHeaderTimeout = 10 * time.Second // 读取请求头超时, 防止慢速连接占用
+	httpIdleTimeout       = 60 * time.Second // keep-alive空闲超时
+)
+
+// serveHttp 在ln上提供http服务, shutdown/drain时返回ErrServerClosed
+// 不设置ReadTimeout/WriteTimeout: 读完请求头后http.Server会清除读超时,
+// 被hijack的FLV/WS/TS长连接由各自的写超时管理
+func (s *Server) serveHttp(name string, ln net.Listener, handler http.Handler) error {
+	hs := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
+	s.mu.Lock()
+	s.httpServers = append(s.httpServers, hs)
+	s.mu.Unlock()
+
+	// http.Server关闭时会关闭listener, 此处仅登记用于平滑升级传递
+	if !s.trackListener(name, ln, true) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(name, ln, false)
+
+	if err := hs.Serve(ln); err != nil && err != http.ErrServerClosed && !s.shuttingDown() && !s.draining() {
+		return err
+	}
+	return ErrServerClosed
+}
+
+// Serve 在l上提供rtmp服务
 func (s *Server) Serve(l net.Listener) error {
+	return s.serve(protocolRtmp, l, ListenerConfig{Name: protocolRtmp, Protocol: protocolRtmp})
+}
+
+func (s *Server) serve(name string, l net.Listener, lc ListenerConfig) error {
+	if !s.trackListener(name, l, true) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(name, l, false)
+
+	proxyTrusted, err := proxyproto.ParseTrustedNets(lc.ProxyTrusted)
+	if err != nil {
+		return errors.Wrap(err, "parse proxy protocol trusted nets")
+	}
+
 	for {
 		rwc, err := l.Accept()
 		if err != nil {
+			if s.shuttingDown() || s.draining() {
+				return ErrServerClosed
+			}
 			return errors.Wrap(err, "listener accept")
 		}
 
+		// 真实客户端地址在握手前读取PROXY头后可用
+		if lc.ProxyProtocol && proxyTrusted.Contains(rwc.RemoteAddr()) {
+			rwc = proxyproto.NewConn(rwc)
+		}
+
+		cfg := s.getConfig()
 		serverConn, err := newServerConn(
 			WithServerConnServer(s),
+			WithServerConnConfig(cfg),
+			WithServerConnListener(lc),
 			WithServerConnRawConn(rwc),
-			WithServerConnReadBufSize(s.config.ReadBufSize),
-			WithServerConnLocalChunkSize(s.config.LocalChunkSize),
+			WithServerConnReadBufSize(cfg.ReadBufSize),
+			WithServerConnLocalChunkSize(cfg.LocalChunkSize),
 			WithServerConnReadHdrPoll(s.decodeHdrPool),
 			WithServerConnChunkEncodePool(s.encodeHdrPool),
 			WithServerConnNewChunkPool(s.newChunkPool),
 		)
 		if err != nil {
+			rwc.Close()
 			return errors.Wrap(err, "create server conn")
 		}
 
+		if !s.trackConn(serverConn, true) {
+			rwc.Close()
+			return ErrServerClosed
+		}
+
 		go serverConn.serve()
 	}
 }
 
-func New(opts ...serverOption) (*Server, error) {
+func New(opts ...ServerOption) (*Server, error) {
 	s, err := (&Server{}).loadOptions(opts...)
 	if err != nil {
 		return nil, errors.Wrap(err, "load options")
@@ -75,43 +283,75 @@ func New(opts ...serverOption) (*Server, error) {
 	return s, nil
 }
 
-func (s *Server) loadOptions(opts ...serverOption) (*Server, error) {
+func (s *Server) loadOptions(opts ...ServerOption) (*Server, error) {
 	for _, opt := range opts {
 		opt(s)
 	}
 
-	if s.configPath == "" {
-		var err error
-		if s.configPath, err = getAbsConfigPath(); err != nil {
-			return nil, errors.Wrap(err, "get abs config path while config path not assigned")
+	if err := s.loadConfig(); err != nil {
+		return nil, errors.Wrap(err, "load config")
+	}
+
+	if s.logger == nil {
+		if err := s.initLogger(); err != nil {
+			return nil, errors.Wrap(err, "init logger")
 		}
+	} else {
+		s.logLevel = zap.NewAtomicLevel() // 外部logger, 仅占位
 	}
-	if err := s.loadConfig(s.configPath); err != nil {
-		return nil, errors.Wrap(err, "load config")
+
+	if cfg := s.getConfig().AccessLog; cfg.Path != "" && s.accessLog == nil {
+		accessLog, err := newAccessLogger(cfg)
+		if err != nil {
+			return nil, errors.Wrap(err, "init access log")
+		}
+		s.accessLog = accessLog
 	}
 
-	if err := s.initLogger(); err != nil {
-		return nil, errors.Wrap(err, "init logger")
+	if s.hlsStore == nil {
+		if path := s.getConfig().Hls.Path; path != "" {
+			store, err := hls.NewDiskStore(path)
+			if err != nil {
+				return nil, errors.Wrap(err, "init hls store")
+			}
+			s.hlsStore = store
+		} else {
+			s.hlsStore = hls.NewMemoryStore()
+		}
 	}
 
-	if s.config.Addr == "" {
-		s.config.Addr = ":1935"
+	if s.dashStore == nil {
+		if path := s.getConfig().Dash.Path; path != "" {
+			store, err := hls.NewDiskStore(path)
+			if err != nil {
+				return nil, errors.Wrap(err, "init dash store")
+			}
+			s.dashStore = store
+		} else {
+			s.dashStore = hls.NewMemoryStore()
+		}
 	}
 
-	if s.config.ReadBufSize <= 0 {
-		s.config.ReadBufSize = 8192
+	if s.getConfig().WatchConfig {
+		if s.viper == nil { // WithConfig创建, 没有可监听的配置文件
+			return nil, errors.New("watchConfig requires a config file")
+		}
+		s.watchConfig()
 	}
 
-	if s.config.LocalChunkSize <= 0 {
-		s.config.LocalChunkSize = 60000 //bytes
+	s.startTime = time.Now()
+
+	if s.done == nil {
+		s.done = make(chan struct{})
+		s.httpDone = make(chan struct{})
 	}
 
-	if s.config.HandshakeTimeout <= 0 {
-		s.config.HandshakeTimeout = 3 * time.Second
+	if s.metrics == nil {
+		s.metrics = newMetrics()
 	}
 
-	if s.config.PlayorPublishTimeout <= 0 {
-		s.config.PlayorPublishTimeout = 3 * time.Second
+	if s.events == nil {
+		s.events = newEventBus(s.getConfig().Events.HistorySize)
 	}
 
 	if s.broker == nil {
@@ -122,6 +362,19 @@ func (s *Server) loadOptions(opts ...serverOption) (*Server, error) {
 		} else {
 			s.broker = b
 		}
+
+		// 依赖server的配置, 由server在配置加载后启动
+		go s.broker.runWatchdog()
+		go s.broker.runBitrateEvents()
+	}
+
+	if cfg := s.getConfig().Usage; cfg.Path != "" && s.usage == nil {
+		usage, err := newUsageTracker(s, cfg)
+		if err != nil {
+			return nil, errors.Wrap(err, "init usage tracker")
+		}
+		s.usage = usage
+		go usage.run()
 	}
 
 	if s.decodeHdrPool == nil {
@@ -154,10 +407,45 @@ func (s *Server) loadOptions(opts ...serverOption) (*Server, error) {
 	return s, nil
 }
 
-type serverOption func(*Server)
+// ServerOption New/LoadConfig的可选参数
+type ServerOption func(*Server)
 
-func WithConfigPath(p string) serverOption {
+// WithConfigPath 配置文件路径, 可以是文件或其所在目录(目录下的config.yaml), 默认为二进制上级目录下的config目录
+func WithConfigPath(p string) ServerOption {
 	return func(s *Server) {
 		s.configPath = p
 	}
 }
+
+// WithConfigOverride 覆盖配置文件中的key(如"addr", "log.level"), 优先级高于环境变量
+func WithConfigOverride(key, value string) ServerOption {
+	return func(s *Server) {
+		if s.configOverrides == nil {
+			s.configOverrides = make(map[string]string)
+		}
+		s.configOverrides[strings.ToLower(key)] = value
+	}
+}
+
+// WithLogger 使用调用方的logger, 忽略日志配置, 此时日志级别不随Reload变化
+func WithLogger(logger *zap.Logger) ServerOption {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// WithKeyProvider HLS加密的密钥来源(如对接KMS), 优先于hls.encryption.kmsUrl
+func WithKeyProvider(p hls.KeyProvider) ServerOption {
+	return func(s *Server) {
+		s.keyProvider = p
+	}
+}
+
+// WithConfig 直接使用cfg而不读取配置文件, 此时不支持Reload
+func WithConfig(cfg Config) ServerOption {
+	return func(s *Server) {
+		c := cfg
+		c.setDefaults()
+		s.configValue.Store(&c)
+	}
+}
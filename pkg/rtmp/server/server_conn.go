@@ -12,13 +12,16 @@ import (
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 
+	"fastlive/pkg/proxyproto"
 	"fastlive/pkg/rtmp/chunk"
 	"fastlive/pkg/rtmp/connection"
 	"fastlive/pkg/rtmp/handshake"
 )
 
 type conn struct {
-	server *Server
+	server   *Server
+	config   *Config        // 连接建立时的配置快照
+	listener ListenerConfig // 接受该连接的listener配置
 
 	connection.Connection
 
@@ -31,10 +34,31 @@ type conn struct {
 	onMetaData              //客户端onMetaData数据
 
 	sess *session
+
+	createTime  time.Time    // 连接建立时间
+	appMetrics  *appMetrics  // connect成功后所属app的指标
+	closeReason atomic.Value // server主动断开的原因(string), 见closeWithReason
 }
 
 func (c *conn) serve() {
+	defer c.server.trackConn(c, false)
+
+	atomic.AddInt32(&c.server.connTotal, 1)
+	defer atomic.AddInt32(&c.server.connTotal, -1)
+	defer func() {
+		if c.appMetrics != nil {
+			atomic.AddInt64(&c.appMetrics.connections, -1)
+			c.server.metrics.releaseApp(c.appMetrics)
+		}
+	}()
+
 	defer c.Connection.Close()
+	if err := c.readProxyHeader(); err != nil {
+		c.server.metrics.incHandshakeFailure(err)
+		c.server.logger.Error("read proxy protocol header", zap.Error(err))
+		return
+	}
+
 	if err := c.handshake(); err != nil {
 		c.server.logger.Error("handshake", zap.Error(err))
 		return
@@ -42,7 +66,14 @@ func (c *conn) serve() {
 	c.server.logger.Debug("handshake success.")
 
 	if err := c.recvChunkStream(); err != nil {
-		if errors.Cause(err) != io.EOF {
+		if c.server.shuttingDown() {
+			c.server.logger.Debug("serve done by server shutdown", zap.String("client", c.Connection.Rwc.RemoteAddr().String()))
+		} else if isTimeout(err) {
+			c.server.logger.Info("serve done by timeout",
+				zap.String("client", c.Connection.Rwc.RemoteAddr().String()),
+				zap.Uint8("clientType", c.clientPublishOrPlayInfo.clientType),
+				zap.Error(err))
+		} else if errors.Cause(err) != io.EOF {
 			c.server.logger.Error("recv Chunk stream", zap.Error(err))
 		} else {
 			c.server.logger.Debug("serve done", zap.String("client", c.Connection.Rwc.RemoteAddr().String()))
@@ -53,19 +84,22 @@ func (c *conn) serve() {
 func (c *conn) recvChunkStream() error {
 	startTime := time.Now()
 
+	// 收到publish/play命令前, 半开连接也需在PlayorPublishTimeout后释放
+	c.Connection.ReadTimeout = c.config.PlayorPublishTimeout
+
 	for {
-		msg, err := c.Connection.RecvIntegralMessage() //TODO: 超时控制，配置net.Conn读超时?
+		msg, err := c.Connection.RecvIntegralMessage()
 		if err != nil {
 			return errors.Wrap(err, "recv intergral message")
 		}
 
 		if err := c.onRecvIntegralMessage(msg); err != nil {
-			return errors.Wrap(err, "on recv intergral message") //TODO: 超时控制，配置net.Conn写超时?
+			return errors.Wrap(err, "on recv intergral message")
 		}
 
 		switch c.clientPublishOrPlayInfo.clientType {
 		case 0:
-			if time.Since(startTime) > c.server.config.PlayorPublishTimeout {
+			if time.Since(startTime) > c.config.PlayorPublishTimeout {
 				return errors.Errorf("recv publish/play command message timeout")
 			}
 		case 1: // publish
@@ -80,14 +114,20 @@ func (c *conn) recvChunkStream() error {
 	}
 }
 
-func (c *conn) publishCycle() error {
-	vhost, _ := parseVhost(c.clientConnectInfo.tcUrl)
+func (c *conn) publishCycle() (err error) {
+	vhost := c.vhost()
 	// TODO: vhost定制配置
 	streamKey := genStreamKey(vhost, c.clientConnectInfo.app, c.clientPublishOrPlayInfo.stream)
 	sessionId := "E21A4829-6AAF-43FF-8405-3DB2B470FA13" //TODO: uuid or 调度赋值？
 
+	start := time.Now()
 	sess, err := c.server.broker.createSession(c, vhost, streamKey, sessionId)
 	if err != nil {
+		if errors.Cause(err) == errSessionExists {
+			c.server.metrics.incPublishRejection(publishRejectSessionExists)
+		} else {
+			c.server.metrics.incPublishRejection(publishRejectError)
+		}
 		return errors.Wrap(err, "create session in server's broker")
 	} else {
 		c.sess = sess
@@ -99,28 +139,98 @@ func (c *conn) publishCycle() error {
 		}
 	}()
 
+	defer func() {
+		rec := c.accessRecord(accessRolePublish, start, err)
+		rec.SessionId = sessionId
+		c.server.writeAccessLog(rec)
+	}()
+
+	// 推流端持续发送音视频, 读空闲即认为推流端异常(如半开连接)
+	c.Connection.ReadTimeout = c.config.PublishIdleTimeout
+
 	for {
-		msg, err := c.Connection.RecvIntegralMessage() //TODO: 超时控制，配置net.Conn读超时?
+		msg, err := c.Connection.RecvIntegralMessage()
 		if err != nil {
+			if c.server.shuttingDown() {
+				return c.notifyPublisherClose()
+			}
 			return errors.Wrap(err, "recv intergral message")
 		}
 
 		if err := c.onRecvIntegralMessage(msg); err != nil {
-			return errors.Wrap(err, "on recv intergral message") //TODO: 超时控制，配置net.Conn写超时?
+			return errors.Wrap(err, "on recv intergral message")
 		}
 	}
 }
 
+// notifyPublisherClose server关闭时通知推流端
+func (c *conn) notifyPublisherClose() error {
+	c.Connection.WriteTimeout = time.Second
+
+	event := make(amf.Object)
+	event["level"] = "status"
+	event["code"] = "NetStream.Unpublish.Success"
+	event["description"] = "Server shutting down."
+	cmdMsg, _ := chunk.NewCommandMessage(
+		c.Connection.AmfEncoder,
+		c.clientPublishOrPlayInfo.csid,
+		c.clientPublishOrPlayInfo.streamId,
+		"onStatus", 0, nil, event,
+	)
+	if _, err := c.Connection.SendIntegralMessage(cmdMsg); err != nil {
+		return errors.Wrap(err, "send NetStream.Unpublish.Success command message")
+	}
+
+	if _, err := c.Connection.Flush(); err != nil {
+		return errors.Wrap(err, "flush NetStream.Unpublish.Success command message data")
+	}
+
+	return ErrServerClosed
+}
+
 func (c *conn) playCycle() error {
-	vhost, _ := parseVhost(c.clientConnectInfo.tcUrl)
+	vhost := c.vhost()
 	// TODO: vhost定制配置
 	streamKey := genStreamKey(vhost, c.clientConnectInfo.app, c.clientPublishOrPlayInfo.stream)
 	player, err := c.server.broker.addSessionPlayer(c, streamKey)
 	if err != nil {
+		if errors.Cause(err) == errSessionNotExists {
+			c.server.metrics.incPlayRejection(playRejectStreamNotFound)
+		} else {
+			c.server.metrics.incPlayRejection(playRejectError)
+		}
 		return errors.Wrap(err, "add session player in server's broker")
 	}
 
-	return player.doPlaying()
+	// 播放端仅定期发送ack等少量消息, 空闲超时需大于ack间隔, 默认不开启
+	c.Connection.ReadTimeout = c.config.PlayIdleTimeout
+
+	err = player.doPlaying()
+
+	rec := c.accessRecord(accessRolePlay, player.startTime, err)
+	rec.SessionId = player.session.getId()
+	rec.Dropped = atomic.LoadUint64(&player.dropped)
+	c.server.writeAccessLog(rec)
+
+	return err
+}
+
+// remoteAddr 客户端地址, c为nil时返回空
+func (c *conn) remoteAddr() string {
+	if c == nil {
+		return ""
+	}
+	return c.Connection.Rwc.RemoteAddr().String()
+}
+
+// vhost listener绑定了vhost时使用绑定值, 否则从tcUrl解析
+func (c *conn) vhost() string {
+	if c.listener.Vhost != "" {
+		return c.listener.Vhost
+	}
+
+	vhost, _ := parseVhost(c.clientConnectInfo.tcUrl)
+	return vhost
 }
 
 func (c *conn) onRecvIntegralMessage(msg *chunk.Stream) error {
@@ -286,6 +396,18 @@ func (c *conn) handleConnectCommandMessage(msg *chunk.Stream, vs []interface{})
 		return errors.Wrap(err, "response connect command message")
 	}
 
+	if c.appMetrics == nil {
+		c.appMetrics = c.server.metrics.acquireApp(c.clientConnectInfo.app)
+		atomic.AddInt64(&c.appMetrics.connections, 1)
+	}
+
+	c.server.events.publish(Event{
+		Type:       EventConnect,
+		Vhost:      c.vhost(),
+		App:        c.clientConnectInfo.app,
+		ClientAddr: c.Connection.Rwc.RemoteAddr().String(),
+	})
+
 	return nil
 }
 
@@ -407,6 +529,8 @@ func (c *conn) handlePublishCommandMessage(msg *chunk.Stream, vs []interface{})
 		return errors.New("stream empty after publish command message decoded")
 	}
 	c.clientPublishOrPlayInfo.clientType = 1
+	c.clientPublishOrPlayInfo.csid = msg.GetChunkCsid()
+	c.clientPublishOrPlayInfo.streamId = msg.GetChunkMessageStreamID()
 
 	if err := c.respPublishCommandMessage(msg); err != nil {
 		return errors.Wrap(err, "response publish command message")
@@ -462,6 +586,8 @@ func (c *conn) handlePlayCommandMessage(msg *chunk.Stream, vs []interface{}) err
 		return errors.New("stream empty after play command message decoded")
 	}
 	c.clientPublishOrPlayInfo.clientType = 2
+	c.clientPublishOrPlayInfo.csid = msg.GetChunkCsid()
+	c.clientPublishOrPlayInfo.streamId = msg.GetChunkMessageStreamID()
 
 	if err := c.respPlayCommandMessage(msg); err != nil {
 		return errors.Wrap(err, "response play command message")
@@ -654,6 +780,35 @@ func (c *conn) handleSetDataFrameDataMessage(msg *chunk.Stream, vs []interface{}
 	return nil
 }
 
+// readProxyHeader 来自可信代理的连接在握手前解析PROXY头, 之后Rwc.RemoteAddr()即为真实客户端地址
+func (c *conn) readProxyHeader() error {
+	pc, ok := c.Connection.Rwc.(*proxyproto.Conn)
+	if !ok {
+		return nil
+	}
+
+	proxyAddr := pc.Conn.RemoteAddr().String()
+	_ = pc.SetReadDeadline(time.Now().Add(c.config.HandshakeTimeout))
+	header, err := pc.ReadHeader()
+	if err != nil {
+		return errors.Wrapf(err, "from %s", proxyAddr)
+	}
+
+	// shutdown时设置的deadline不能被覆盖
+	if !c.server.shuttingDown() {
+		_ = pc.SetReadDeadline(time.Time{})
+	}
+
+	// 之后的数据直接写入底层连接(net.Buffers在*net.TCPConn上使用writev)
+	c.Connection.Wc = pc.Conn
+
+	c.server.logger.Debug("proxy protocol header",
+		zap.Int("version", header.Version),
+		zap.String("proxy", proxyAddr),
+		zap.String("client", pc.RemoteAddr().String()))
+	return nil
+}
+
 func (c *conn) handshake() error {
 	handshakeComplete := func(handshakeStatus uint32) bool {
 		return atomic.LoadUint32(&handshakeStatus) == 1
@@ -670,9 +825,13 @@ func (c *conn) handshake() error {
 		return nil
 	}
 
-	c.handshakeErr = handshake.WithClient(c.Connection.Rwc, c.server.config.HandshakeTimeout)
+	startTime := time.Now()
+	c.handshakeErr = handshake.WithClient(c.Connection.Rwc, c.config.HandshakeTimeout)
 	if c.handshakeErr == nil {
 		c.handshakeStatus++
+		c.server.metrics.handshakeLatency.observe(time.Since(startTime).Seconds())
+	} else {
+		c.server.metrics.incHandshakeFailure(c.handshakeErr)
 	}
 
 	if c.handshakeErr == nil && !handshakeComplete(c.handshakeStatus) {
@@ -709,7 +868,17 @@ func (c *conn) loadOptions(opts ...serverConnOption) (*conn, error) {
 		return nil, errServer
 	}
 
+	if c.config == nil {
+		c.config = c.server.getConfig()
+	}
+
 	c.Connection.Logger = c.server.logger
+	c.Connection.Stats = c.server.metrics
+	c.Connection.WriteTimeout = c.config.WriteTimeout
+
+	if c.createTime.IsZero() {
+		c.createTime = time.Now()
+	}
 
 	return c, nil
 }
@@ -722,6 +891,18 @@ func WithServerConnServer(server *Server) serverConnOption {
 	}
 }
 
+func WithServerConnConfig(cfg *Config) serverConnOption {
+	return func(c *conn) {
+		c.config = cfg
+	}
+}
+
+func WithServerConnListener(lc ListenerConfig) serverConnOption {
+	return func(c *conn) {
+		c.listener = lc
+	}
+}
+
 func WithServerConnRawConn(rwc net.Conn) serverConnOption {
 	return func(c *conn) {
 		c.Connection.Rwc = rwc // must
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+func TestNewWithConfig(t *testing.T) {
+	s, err := New(WithLogger(zap.NewNop()), WithConfig(Config{Hls: HlsConfig{Enable: true}}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, s.getConfig().Hls.Enable)
+	assert.Equal(t, 10*time.Second, s.getConfig().WriteTimeout) // 已填充默认值
+	assert.Error(t, s.Reload())
+
+	// 没有配置文件时无法监听变化
+	_, err = New(WithLogger(zap.NewNop()), WithConfig(Config{WatchConfig: true}))
+	assert.Error(t, err)
+}
+
+func TestRenditionGroupConfig(t *testing.T) {
+	renditions := []RenditionGroupConfig{{App: "live", Pattern: `^(.+)_(1080|720)$`}}
+	s, err := New(WithLogger(zap.NewNop()), WithConfig(Config{Renditions: renditions}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Nil(t, renditions[0].re) // 不修改调用方的配置
+
+	cfg := s.getConfig()
+	for _, tt := range []struct {
+		app, stream, group string
+	}{
+		{"live", "event_1080", "event"},
+		{"live", "event_720", "event"},
+		{"live", "event_480", ""},
+		{"other", "event_1080", ""},
+	} {
+		group, ok := cfg.renditionGroup(tt.app, tt.stream)
+		assert.Equal(t, tt.group != "", ok, tt.stream)
+		assert.Equal(t, tt.group, group, tt.stream)
+	}
+
+	// 编译后的正则不输出
+	out, err := yaml.Marshal(cfg)
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(out), "pattern: ^(.+)_(1080|720)$")
+		assert.NotContains(t, string(out), "re:")
+	}
+
+	for _, pattern := range []string{`^(.+_`, `^.+_1080$`} {
+		_, err = New(WithLogger(zap.NewNop()), WithConfig(Config{Renditions: []RenditionGroupConfig{{App: "live", Pattern: pattern}}}))
+		assert.Error(t, err, pattern)
+	}
+}
+
+func TestKeepNonReloadable(t *testing.T) {
+	old := &Config{AccessLog: AccessLogConfig{Path: "logs/access", Format: accessLogJson}, WriteTimeout: time.Second}
+	c := &Config{AccessLog: AccessLogConfig{Path: "logs/access", Format: accessLogText}, WriteTimeout: 2 * time.Second}
+
+	// 访问日志格式与已打开的文件保持一致
+	assert.Equal(t, []string{"accessLog"}, c.keepNonReloadable(old))
+	assert.Equal(t, old.AccessLog, c.AccessLog)
+	assert.Equal(t, 2*time.Second, c.WriteTimeout)
+}
@@ -1,7 +1,9 @@
 package server
 
 import (
+	"bytes"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -16,15 +18,42 @@ type session struct {
 	appName    string
 	streamName string
 
-	publisher *conn     //收流端
-	players   sync.Map  //播流端 <player地址>
-	offline   chan bool //流会话下线
-	broker    *broker   //session管理器
-	streamKey string    //session在管理器中的索引,方便删除
+	publisher   *conn     //收流端
+	players     sync.Map  //播流端 <player地址>
+	playerTotal int32     //播流端数目(原子操作)
+	offline     chan bool //流会话下线
+	broker      *broker   //session管理器
+	streamKey   string    //session在管理器中的索引,方便删除
 
+	closed    chan struct{} // session删除时关闭
+	closeOnce sync.Once
+	packagers []*packager     // HLS/DASH等切片输出, 创建session时确定
+	group     *renditionGroup // 所属的多码率组, 创建session时确定
+
+	appMetrics *appMetrics // 所属app的指标, 创建session时引用, 删除时释放
+
+	// 新播放端加入时先发送的数据, 由avMutex保护, 保证与fanOut的顺序一致(不重不漏)
+	avMutex        sync.Mutex
 	metaData       *av.Packet
 	audioSeqHeader *av.Packet
 	videoSeqHeader *av.Packet
+	gop            []*av.Packet // 最近一个视频关键帧开始的音视频packet
+	gopBytes       int
+
+	mutex        sync.RWMutex // 保护publisher及以下流信息, 与avMutex同时持有时后加锁
+	createTime   time.Time    // session创建时间
+	publishTime  time.Time    // 当前publisher开始推流时间
+	offlineTime  time.Time    // publisher最近一次下线时间
+	metaInfo     onMetaData   // publisher上报的onMetaData快照
+	audioCodecId uint8        // 由音视频sequence header解析
+	videoCodecId uint8
+
+	bytesIn  uint64      // 接收的音视频数据字节数(原子操作)
+	bytesOut uint64      // 发送给所有播放端的字节数(原子操作)
+	bitrate  rateSampler // 推流码率采样
+
+	audioWatch trackWatch // 媒体看门狗, 记录音视频最近到达时间
+	videoWatch trackWatch
 }
 
 func (s *session) onRecvAVMessage(msg *chunk.Stream, messageTypeId chunk.RtmpMessageTypeID) error {
@@ -45,86 +74,254 @@ func (s *session) onRecvAVMessage(msg *chunk.Stream, messageTypeId chunk.RtmpMes
 		return errors.Wrap(err, "decode avpacket header")
 	}
 
+	now := time.Now()
+	total := atomic.AddUint64(&s.bytesIn, uint64(len(avPacket.Data)))
+	s.bitrate.update(now, total)
+
+	s.avMutex.Lock()
+	defer s.avMutex.Unlock()
+
 	switch avPacket.PacketType {
 	case av.AudioType:
+		s.audioWatch.touch(now)
 		ah, ok := avPacket.PacketHeader.(av.AudioPacketHeader)
 		if ok {
 			if ah.SoundFormat() == 10 /* AAC */ && ah.AACPacketType() == 0 /* sequence header */ {
+				changed := s.audioSeqHeader == nil || !bytes.Equal(s.audioSeqHeader.Data, avPacket.Data)
 				s.audioSeqHeader = avPacket
+				s.mutex.Lock()
+				s.audioCodecId = ah.SoundFormat()
+				s.mutex.Unlock()
+
+				if changed {
+					ev := s.event(EventSequenceHeader)
+					ev.Track, ev.Codec = trackNames[trackAudio], audioCodecName(ah.SoundFormat(), 0)
+					s.broker.server.events.publish(ev)
+				}
 			}
 		}
 	case av.VideoType:
-		bSh := avPacket.PacketHeader.(av.VideoPacketHeader).IsSequenceHeader()
-		if bSh {
+		s.videoWatch.touch(now)
+		vh := avPacket.PacketHeader.(av.VideoPacketHeader)
+		if vh.IsSequenceHeader() {
+			changed := s.videoSeqHeader == nil || !bytes.Equal(s.videoSeqHeader.Data, avPacket.Data)
 			s.videoSeqHeader = avPacket
+			s.mutex.Lock()
+			s.videoCodecId = vh.CodecID()
+			s.mutex.Unlock()
+
+			if changed {
+				ev := s.event(EventSequenceHeader)
+				ev.Track, ev.Codec = trackNames[trackVideo], videoCodecName(vh.CodecID(), 0)
+				s.broker.server.events.publish(ev)
+			}
 		}
 	}
 
-	// TODO: GOP
-
+	s.cacheGop(avPacket)
 	s.fanOut(avPacket)
 
 	return nil
 }
 
 func (s *session) onRecvDataMessage(msg *chunk.Stream, messageTypeId chunk.RtmpMessageTypeID) error {
-	if s.publisher != nil {
-		if err := s.publisher.handleDataMessage(msg, messageTypeId); err != nil {
+	if publisher := s.getPublisher(); publisher != nil {
+		if err := publisher.handleDataMessage(msg, messageTypeId); err != nil {
 			return errors.Wrap(err, "handle data message")
 		}
 
+		s.mutex.Lock()
+		s.metaInfo = publisher.onMetaData
+		s.mutex.Unlock()
+
+		ev := s.event(EventMetaData)
+		ev.ClientAddr = publisher.Connection.Rwc.RemoteAddr().String()
+		ev.MetaData = &MetaData{
+			Encoder:       publisher.onMetaData.Encoder,
+			Width:         publisher.onMetaData.Width,
+			Height:        publisher.onMetaData.Height,
+			Framerate:     publisher.onMetaData.Framerate,
+			VideodataRate: publisher.onMetaData.VideodataRate,
+			Audiodatarate: publisher.onMetaData.Audiodatarate,
+		}
+		s.broker.server.events.publish(ev)
+
 		avPacket := new(av.Packet)
 		avPacket.PacketType = av.MetaData
 		avPacket.StreamID = msg.GetChunkMessageStreamID()
 		avPacket.Data = msg.ChunkData
 		avPacket.Timestamp = msg.GetChunkTimestamp()
 
+		s.avMutex.Lock()
 		s.metaData = avPacket
 		s.fanOut(avPacket)
+		s.avMutex.Unlock()
 	}
 
 	return nil
 }
 
+// cacheGop 缓存最近一个GOP, 新播放端可立即从关键帧开始解码; 需持有avMutex
+func (s *session) cacheGop(avPacket *av.Packet) {
+	if avPacket.PacketType == av.VideoType {
+		vh := avPacket.PacketHeader.(av.VideoPacketHeader)
+		if vh.IsSequenceHeader() {
+			return
+		}
+		if vh.IsKeyFrame() {
+			s.resetGop()
+		}
+	} else if ah, ok := avPacket.PacketHeader.(av.AudioPacketHeader); ok && ah.SoundFormat() == 10 && ah.AACPacketType() == 0 {
+		return
+	}
+
+	// 纯音频流或GOP过大时不缓存, 直到下一个关键帧
+	if s.gopBytes+len(avPacket.Data) > maxGopBytes || len(s.gop) >= maxGopPackets {
+		s.resetGop()
+		return
+	}
+
+	s.gop = append(s.gop, avPacket)
+	s.gopBytes += len(avPacket.Data)
+}
+
+func (s *session) resetGop() {
+	s.gop = nil
+	s.gopBytes = 0
+}
+
 func (s *session) fanOut(avPacket *av.Packet) {
+	for _, p := range s.packagers {
+		p.buffPackets(avPacket)
+	}
+
 	s.players.Range(func(k, v interface{}) bool {
-		player := v.(*player)
-		player.buffPackets(avPacket)
+		v.(sessionPlayer).queue().buffPackets(avPacket)
 		return true
 	})
 }
 
-func (s *session) addPlayer(player *player) *session {
-	key := player.c.Rwc.RemoteAddr().String()
-	s.players.Store(key, player)
+// addPlayer 记录播放端需先发送的metadata/sequence header/GOP, 与加入players在同一临界区内
+func (s *session) addPlayer(player sessionPlayer) *session {
+	s.avMutex.Lock()
+	q := player.queue()
+	q.startPackets = make([]*av.Packet, 0, len(s.gop)+3)
+	for _, pkt := range []*av.Packet{s.metaData, s.audioSeqHeader, s.videoSeqHeader} {
+		if pkt != nil {
+			q.startPackets = append(q.startPackets, pkt)
+		}
+	}
+	q.startPackets = append(q.startPackets, s.gop...)
+	s.players.Store(player.key(), player)
+	s.avMutex.Unlock()
+
+	atomic.AddInt32(&s.playerTotal, 1)
+	atomic.AddInt64(&q.appMetrics.players, 1)
 	return s
 }
 
-func (s *session) delPlayer(player *player) *session {
-	player.closePacketBuffer()
+func (s *session) delPlayer(player sessionPlayer) *session {
+	q := player.queue()
+	q.closePacketBuffer()
 
-	key := player.c.Rwc.RemoteAddr().String()
-	s.players.Delete(key)
+	if _, loaded := s.players.LoadAndDelete(player.key()); loaded {
+		atomic.AddInt32(&s.playerTotal, -1)
+		atomic.AddInt64(&q.appMetrics.players, -1)
+		s.broker.publishEvent(s, EventPlayStop, player.key())
+	}
 	return s
 }
 
+func (s *session) getId() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.id
+}
+
+func (s *session) getPublisher() *conn {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.publisher
+}
+
+// resumePublisher session短暂中断后由新的publisher接管, 已有publisher时返回false
+func (s *session) resumePublisher(publisher *conn, sessionId string) bool {
+	// 与onRecvAVMessage的加锁顺序一致: 先avMutex后mutex
+	s.avMutex.Lock()
+	defer s.avMutex.Unlock()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.publisher != nil {
+		return false
+	}
+
+	s.publisher = publisher
+	s.publishTime = time.Now()
+	s.resetGop()
+	s.metaInfo = onMetaData{}
+	s.audioWatch.reset()
+	s.videoWatch.reset()
+	for _, p := range s.packagers {
+		p.markDiscontinuity()
+	}
+	if s.id != sessionId {
+		//TODO: warn
+		s.id = sessionId
+	}
+
+	return true
+}
+
+func (s *session) resetPublisher() {
+	s.mutex.Lock()
+	s.publisher = nil
+	s.offlineTime = time.Now()
+	s.mutex.Unlock()
+}
+
+// checkOffline publisher每次下线后等待一段时间, 期间未恢复上线则删除session
 func (s *session) checkOffline() {
-	<-s.offline
+	const offlineTimeout = 30 * time.Second //TODO: config
 
-	time.AfterFunc(30*time.Second, func() { //TODO: config
-		if s.publisher != nil { //session恢复上线 TODO:mutex
+	for {
+		select {
+		case <-s.offline:
+		case <-s.closed:
 			return
 		}
 
-		// clean up
+		time.AfterFunc(offlineTimeout, func() {
+			s.mutex.RLock()
+			online, offlineTime := s.publisher != nil, s.offlineTime
+			s.mutex.RUnlock()
+
+			// session恢复上线, 或恢复后再次下线(由之后的timer处理)
+			if online || time.Since(offlineTime) < offlineTimeout {
+				return
+			}
+
+			s.close()
+		})
+	}
+}
+
+// close 移除所有player, 删除HLS/DASH文件并从broker中删除session
+func (s *session) close() {
+	s.closeOnce.Do(func() {
 		s.players.Range(func(k, v interface{}) bool {
-			if player, ok := v.(*player); ok {
+			if player, ok := v.(sessionPlayer); ok {
 				s.delPlayer(player)
 			}
 			return true
 		})
 
+		for _, p := range s.packagers {
+			p.stop()
+		}
+
 		s.broker.delSession(s.streamKey)
+		close(s.closed)
 	})
 }
 
@@ -159,6 +356,7 @@ func (s *session) loadOptions(opts ...sessionOption) (*session, error) {
 
 	if s.offline == nil {
 		s.offline = make(chan bool, 1)
+		s.closed = make(chan struct{})
 		go s.checkOffline()
 	}
 
@@ -166,6 +364,11 @@ func (s *session) loadOptions(opts ...sessionOption) (*session, error) {
 		return nil, errSessionBroker
 	}
 
+	if s.createTime.IsZero() {
+		s.createTime = time.Now()
+		s.publishTime = s.createTime
+	}
+
 	if s.streamKey == "" {
 		return nil, errSessionStreamKey
 	}
@@ -217,6 +420,11 @@ func WithSessionStreamKey(sk string) sessionOption {
 	}
 }
 
+const (
+	maxGopBytes   = 8 << 20 // GOP缓存上限
+	maxGopPackets = 4096
+)
+
 var (
 	errSessionId         = errors.New("session id required")
 	errSessionVhost      = errors.New("session belongs to vhost required")
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Shutdown 优雅关闭server:
+// 1. 关闭listener及http服务, 不再接受新连接
+// 2. 通知播放端流结束(NetStream.Play.UnpublishNotify/StreamEOF), 通知推流端连接关闭, 并flush合并写缓冲
+// 3. 等待连接协程退出, ctx超时后强制关闭剩余连接
+// 4. 删除HLS/DASH文件, 写入未满一分钟的用量记录, 关闭日志/访问日志/用量rotator
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if !atomic.CompareAndSwapInt32(&s.inShutdown, 0, 1) {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	close(s.done)
+	s.closeListeners()
+
+	httpServers := s.httpServers
+	conns := make([]*conn, 0, len(s.activeConns))
+	for c := range s.activeConns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	s.logger.Info("server shutting down", zap.Int("connections", len(conns)))
+
+	s.shutdownHttp(ctx, httpServers)
+
+	// 唤醒阻塞在读操作上的连接协程, 由其自行发送关闭通知后退出
+	for _, c := range conns {
+		c.Connection.WakeupRead()
+	}
+
+	err := s.waitConns(ctx)
+
+	s.broker.rangeSessions(func(sess *session) bool {
+		for _, p := range sess.packagers {
+			p.stop()
+		}
+		return true
+	})
+
+	s.logger.Info("server shutdown", zap.Error(err))
+	_ = s.logger.Sync()
+	if s.logCloser != nil {
+		_ = s.logCloser.Close()
+	}
+	if s.accessLog != nil {
+		_ = s.accessLog.Close()
+	}
+	if s.usage != nil {
+		if err := s.usage.close(); err != nil {
+			s.logger.Warn("close usage tracker", zap.Error(err))
+		}
+	}
+
+	return err
+}
+
+// Drain 平滑升级时使用: 停止accept及http服务, 等待存量连接自然结束
+// 所有连接结束或ctx结束后执行Shutdown(超时时间为ShutdownTimeout)
+func (s *Server) Drain(ctx context.Context) error {
+	s.mu.Lock()
+	if s.shuttingDown() || !atomic.CompareAndSwapInt32(&s.inDrain, 0, 1) {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.closeListeners()
+	httpServers := s.httpServers
+	conns := len(s.activeConns) + len(s.httpConns)
+	s.mu.Unlock()
+
+	s.logger.Info("server draining", zap.Int("connections", conns))
+
+	s.shutdownHttp(ctx, httpServers)
+
+	select {
+	case <-s.connsDone():
+	case <-ctx.Done():
+		s.logger.Info("drain timeout, shutting down")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.getConfig().ShutdownTimeout)
+	defer cancel()
+	return s.Shutdown(shutdownCtx)
+}
+
+// shutdownHttp 通知事件流等长连接handler退出, 再关闭http服务
+func (s *Server) shutdownHttp(ctx context.Context, httpServers []*http.Server) {
+	s.httpOnce.Do(func() { close(s.httpDone) })
+
+	for _, hs := range httpServers {
+		if err := hs.Shutdown(ctx); err != nil {
+			s.logger.Warn("shutdown http server", zap.Error(err))
+		}
+	}
+}
+
+// Listeners 返回正在使用的listener(含http服务), key为名称, 用于平滑升级时传递给新进程
+func (s *Server) Listeners() map[string]net.Listener {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lns := make(map[string]net.Listener, len(s.listeners))
+	for l, name := range s.listeners {
+		lns[name] = l
+	}
+
+	return lns
+}
+
+// DrainTimeout 配置的平滑升级等待时间
+func (s *Server) DrainTimeout() time.Duration {
+	return s.getConfig().DrainTimeout
+}
+
+// closeListeners 需持有s.mu
+func (s *Server) closeListeners() {
+	for l, name := range s.listeners {
+		if err := l.Close(); err != nil {
+			s.logger.Debug("close listener", zap.String("name", name), zap.Error(err))
+		}
+	}
+}
+
+func (s *Server) connsDone() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		s.connWg.Wait()
+		close(done)
+	}()
+
+	return done
+}
+
+// waitConns 等待所有连接协程退出, ctx结束时强制关闭剩余连接
+func (s *Server) waitConns(ctx context.Context) error {
+	select {
+	case <-s.connsDone():
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for c := range s.activeConns {
+			_ = c.Connection.Close()
+		}
+		for c := range s.httpConns {
+			_ = c.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (s *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&s.inShutdown) != 0
+}
+
+func (s *Server) draining() bool {
+	return atomic.LoadInt32(&s.inDrain) != 0
+}
+
+// trackListener shutdown/drain开始后不再接受新listener, 返回false
+func (s *Server) trackListener(name string, l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]string)
+	}
+
+	if add {
+		if s.shuttingDown() || s.draining() {
+			return false
+		}
+
+		// 名称重复时追加序号, 保证传递给新进程时可区分
+		used := make(map[string]bool, len(s.listeners))
+		for _, n := range s.listeners {
+			used[n] = true
+		}
+		for idx, base := 1, name; used[name]; idx++ {
+			name = base + "-" + strconv.Itoa(idx)
+		}
+
+		s.listeners[l] = name
+	} else {
+		delete(s.listeners, l)
+	}
+
+	return true
+}
+
+// trackConn shutdown/drain开始后不再接受新连接, 返回false
+func (s *Server) trackConn(c *conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.activeConns == nil {
+		s.activeConns = make(map[*conn]struct{})
+	}
+
+	if add {
+		if s.shuttingDown() || s.draining() {
+			return false
+		}
+		s.activeConns[c] = struct{}{}
+		s.connWg.Add(1)
+	} else {
+		delete(s.activeConns, c)
+		s.connWg.Done()
+	}
+
+	return true
+}
+
+// trackHttpConn 与trackConn相同, 用于http播放端接管的连接
+// 这类连接在server.done关闭时自行结束, shutdown超时后强制关闭
+func (s *Server) trackHttpConn(c net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.httpConns == nil {
+		s.httpConns = make(map[net.Conn]struct{})
+	}
+
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		s.httpConns[c] = struct{}{}
+		s.connWg.Add(1)
+	} else {
+		delete(s.httpConns, c)
+		s.connWg.Done()
+	}
+
+	return true
+}
+
+// ShutdownTimeout 配置的优雅关闭超时时间
+func (s *Server) ShutdownTimeout() time.Duration {
+	return s.getConfig().ShutdownTimeout
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+http播放token(http.tokenSecret): ?expires={unix秒}&token={hex(HMAC-SHA256(secret, "{app}/{stream}:{expires}"))}
+1. FLV, WebSocket-FLV, HTTP-TS, HLS playlist, DASH MPD, HLS密钥及切片请求均校验token
+2. token对该流的所有请求有效: /{app}/{stream}/下的切片使用所在流的token, playlist/MPD中的切片及密钥URI附带请求中的token
+3. 多码率组的token对组内所有流有效: master playlist中的variant URI及LL-HLS的rendition report URI附带为对应流生成的同有效期token
+*/
+
+// PlayToken 生成app/stream在expires之前有效的播放token
+func PlayToken(secret, app, stream string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(app + "/" + stream + ":" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkPlayToken 未开启token或token有效时返回true
+func (s *Server) checkPlayToken(r *http.Request, hs *httpStream) bool {
+	cfg := s.getConfig().Http
+	if !cfg.tokenRequired(hs.app) {
+		return true
+	}
+
+	q := r.URL.Query()
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	token, err := hex.DecodeString(q.Get("token"))
+	if err != nil {
+		return false
+	}
+	expected, _ := hex.DecodeString(PlayToken(cfg.TokenSecret, hs.app, hs.stream, expires))
+	return hmac.Equal(token, expected)
+}
+
+// logUrl 访问日志中记录的请求url, 去掉token参数, 防止读取日志者重放
+func logUrl(u *url.URL) string {
+	q := u.Query()
+	if _, ok := q["token"]; !ok {
+		return u.String()
+	}
+
+	q.Del("token")
+	c := *u
+	c.RawQuery = q.Encode()
+	return c.String()
+}
+
+// tokenQuery 开启token时为同app下的stream生成与请求有效期相同的token参数, 请求已通过checkPlayToken校验
+func (s *Server) tokenQuery(r *http.Request, hs *httpStream, stream string) string {
+	cfg := s.getConfig().Http
+	if !cfg.tokenRequired(hs.app) {
+		return ""
+	}
+
+	expires, _ := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	return "expires=" + strconv.FormatInt(expires, 10) + "&token=" + PlayToken(cfg.TokenSecret, hs.app, stream, expires)
+}
+
+// appendUriQuery 为{stream}/下的切片URI附加参数q: HLS playlist中单独一行的URI, 以及URI="..."/media="..."等属性值
+func appendUriQuery(data []byte, stream, q string) []byte {
+	prefix := []byte(stream + "/")
+	attr := []byte(`="` + stream + "/")
+
+	var b bytes.Buffer
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n') + 1
+		if end == 0 {
+			end = len(data)
+		}
+		line := data[:end]
+		data = data[end:]
+
+		if bytes.HasPrefix(line, prefix) {
+			uri := bytes.TrimRight(line, "\r\n")
+			b.Write(uri)
+			b.WriteString("?" + q)
+			b.Write(line[len(uri):])
+			continue
+		}
+
+		for {
+			i := bytes.Index(line, attr)
+			if i < 0 {
+				break
+			}
+			start := i + len(attr)
+			j := bytes.IndexByte(line[start:], '"')
+			if j < 0 {
+				break
+			}
+			b.Write(line[:start+j])
+			b.WriteString("?" + q)
+			line = line[start+j:]
+		}
+		b.Write(line)
+	}
+	return b.Bytes()
+}
+
+// withManifestTokens 开启token时MPD中各流的切片URI附带对应流的token, streams为MPD包含的流(多码率组为组内各流)
+func (s *Server) withManifestTokens(r *http.Request, hs *httpStream, manifest []byte, streams ...string) []byte {
+	for _, stream := range streams {
+		q := s.tokenQuery(r, hs, stream)
+		if q == "" {
+			return manifest
+		}
+		manifest = appendUriQuery(manifest, stream, strings.Replace(q, "&", "&amp;", -1)) // XML属性值
+	}
+	return manifest
+}
+
+var renditionReportUri = []byte(`#EXT-X-RENDITION-REPORT:URI="`)
+
+// withPlaylistTokens 开启token时playlist中的切片URI, 密钥URI及rendition report URI附带token, 播放端请求这些URI时不会带上playlist URL的参数
+func (s *Server) withPlaylistTokens(r *http.Request, hs *httpStream, playlist []byte) []byte {
+	q := s.tokenQuery(r, hs, hs.stream)
+	if q == "" {
+		return playlist
+	}
+
+	playlist = appendUriQuery(playlist, hs.stream, q)
+	playlist = bytes.Replace(playlist, []byte(".key?n="), []byte(".key?"+q+"&n="), -1)
+	if !bytes.Contains(playlist, renditionReportUri) {
+		return playlist
+	}
+
+	// rendition report URI为{stream}.m3u8, 附带该流的token
+	var b bytes.Buffer
+	for {
+		i := bytes.Index(playlist, renditionReportUri)
+		if i < 0 {
+			break
+		}
+		start := i + len(renditionReportUri)
+		end := bytes.IndexByte(playlist[start:], '"')
+		if end < 0 {
+			break
+		}
+		uri := string(playlist[start : start+end])
+
+		b.Write(playlist[:start])
+		b.WriteString(uri + "?" + s.tokenQuery(r, hs, strings.TrimSuffix(uri, ".m3u8")))
+		playlist = playlist[start+end:]
+	}
+	b.Write(playlist)
+	return b.Bytes()
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppendUriQuery(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{
+			name: "hls segment line",
+			in:   "#EXTINF:2.000,\ns1/3.ts\n",
+			want: "#EXTINF:2.000,\ns1/3.ts?q=1\n",
+		},
+		{
+			name: "crlf",
+			in:   "s1/3.ts\r\n",
+			want: "s1/3.ts?q=1\r\n",
+		},
+		{
+			name: "ll-hls attributes",
+			in: "#EXT-X-MAP:URI=\"s1/init0.mp4\"\n#EXT-X-PART:DURATION=0.5,URI=\"s1/3.0.m4s\",INDEPENDENT=YES\n" +
+				"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"s1/3.1.m4s\"\n",
+			want: "#EXT-X-MAP:URI=\"s1/init0.mp4?q=1\"\n#EXT-X-PART:DURATION=0.5,URI=\"s1/3.0.m4s?q=1\",INDEPENDENT=YES\n" +
+				"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"s1/3.1.m4s?q=1\"\n",
+		},
+		{
+			name: "mpd template",
+			in:   `<SegmentTemplate initialization="s1/video-init.mp4" media="s1/video-$Time$.m4s">`,
+			want: `<SegmentTemplate initialization="s1/video-init.mp4?q=1" media="s1/video-$Time$.m4s?q=1">`,
+		},
+		{
+			name: "other streams and keys untouched",
+			in:   "#EXT-X-KEY:METHOD=AES-128,URI=\"s1.key?n=0\"\n#EXT-X-RENDITION-REPORT:URI=\"s2.m3u8\"\ns2/3.ts\nxs1/3.ts\n",
+			want: "#EXT-X-KEY:METHOD=AES-128,URI=\"s1.key?n=0\"\n#EXT-X-RENDITION-REPORT:URI=\"s2.m3u8\"\ns2/3.ts\nxs1/3.ts\n",
+		},
+		{
+			name: "no trailing newline",
+			in:   "s1/3.ts",
+			want: "s1/3.ts?q=1",
+		},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, string(appendUriQuery([]byte(tt.in), "s1", "q=1")), tt.name)
+	}
+}
+
+func TestLogUrl(t *testing.T) {
+	for in, want := range map[string]string{
+		"/live/s1.flv": "/live/s1.flv",
+		"/live/s1.flv?expires=1760000000&token=abc": "/live/s1.flv?expires=1760000000",
+		"/live/s1.ts?token=abc":                     "/live/s1.ts",
+		"/live/s1.flv?a=1":                          "/live/s1.flv?a=1",
+	} {
+		u, err := url.Parse(in)
+		if assert.NoError(t, err) {
+			assert.Equal(t, want, logUrl(u), in)
+		}
+	}
+}
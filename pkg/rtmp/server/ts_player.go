@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bytes"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"fastlive/pkg/av"
+	"fastlive/pkg/av/ts"
+)
+
+/*
+MPEG-TS播放端(HTTP-TS, UDP):
+1. 以player身份加入session, 共用packet队列及丢帧策略, 依次输出sequence header, GOP及实时数据
+2. 连续TS流: PAT/PMT在开始、编码变化、关键帧前及每tsTableInterval写入, 时间戳保持单增(推流端重连不回退)
+3. 队列中积压的packet合并后一次输出
+*/
+
+const (
+	protocolHttpTs = "http-ts"
+	protocolUdpTs  = "udp-ts"
+
+	tsTableInterval = 100 * time.Millisecond
+	tsMergeBytes    = 64 << 10 // 单次合并输出的最大字节数
+)
+
+// tsOutput TS数据的输出方式
+type tsOutput interface {
+	writeTs(b []byte) error
+	close() error // 正常结束输出
+}
+
+type tsPlayer struct {
+	packetQueue
+	avTimestamp
+
+	server    *Server
+	session   *session
+	protocol  string
+	id        string // HTTP-TS为客户端地址, UDP为目标地址
+	out       tsOutput
+	stop      func() error  // 管理API踢出时调用
+	closed    chan struct{} // 客户端断开或输出停止
+	closeErr  error         // closed关闭后可读
+	startTime time.Time
+	bytesOut  uint64 // 原子操作
+
+	closeReason atomic.Value // 同conn.closeReason
+	muxer       *ts.Muxer
+	buf         bytes.Buffer
+}
+
+func (s *Server) newTsPlayer(sess *session, protocol, id string, out tsOutput, stop func() error) *tsPlayer {
+	p := &tsPlayer{
+		server:    s,
+		session:   sess,
+		protocol:  protocol,
+		id:        id,
+		out:       out,
+		stop:      stop,
+		closed:    make(chan struct{}),
+		startTime: time.Now(),
+	}
+	p.muxer = ts.NewMuxer(&p.buf, ts.WithTableInterval(tsTableInterval))
+	p.initQueue(150, sess.appMetrics) //TODO: config, 与rtmp播放端一致
+	return p
+}
+
+func (p *tsPlayer) key() string {
+	return p.id
+}
+
+func (p *tsPlayer) queue() *packetQueue {
+	return &p.packetQueue
+}
+
+func (p *tsPlayer) kick(reason string) error {
+	p.closeReason.Store(reason)
+	return p.stop()
+}
+
+func (p *tsPlayer) apiInfo(now time.Time) *apiPlayer {
+	return &apiPlayer{
+		Id:         p.key(),
+		Protocol:   p.protocol,
+		ClientAddr: p.key(),
+		BytesOut:   atomic.LoadUint64(&p.bytesOut),
+		Dropped:    p.droppedPackets(),
+		StartTime:  p.startTime,
+		Uptime:     int64(now.Sub(p.startTime) / time.Second),
+	}
+}
+
+func (p *tsPlayer) play() error {
+	defer p.session.delPlayer(p)
+
+	for _, pkt := range p.startPackets {
+		if err := p.mux(pkt); err != nil {
+			return err
+		}
+	}
+	p.startPackets = nil
+
+	if err := p.flush(); err != nil {
+		return errors.Wrap(err, "send start packets")
+	}
+
+	for {
+		select {
+		case <-p.server.done:
+			_ = p.out.close()
+			return ErrServerClosed
+		case <-p.closed:
+			return p.closeErr
+		case pkt, ok := <-p.packetBuffer:
+			if !ok {
+				_ = p.out.close()
+				return errPlayerBufferClosed
+			}
+
+			if err := p.mux(pkt); err != nil {
+				return err
+			}
+
+			// 合并队列中积压的packet
+		merge:
+			for p.buf.Len() < tsMergeBytes {
+				select {
+				case pkt, ok := <-p.packetBuffer:
+					if !ok {
+						break merge
+					}
+					if err := p.mux(pkt); err != nil {
+						return err
+					}
+				default:
+					break merge
+				}
+			}
+
+			if err := p.flush(); err != nil {
+				return errors.Wrap(err, "write ts")
+			}
+		}
+	}
+}
+
+// mux 以单增的时间戳封装packet, 不修改session中共享的packet
+func (p *tsPlayer) mux(pkt *av.Packet) error {
+	if pkt.PacketType != av.VideoType && pkt.PacketType != av.AudioType {
+		return nil
+	}
+
+	rebased := *pkt
+	rebased.Timestamp = p.next(pkt)
+	return errors.Wrap(p.muxer.WritePacket(&rebased), "mux ts")
+}
+
+func (p *tsPlayer) flush() error {
+	if p.buf.Len() == 0 {
+		return nil
+	}
+
+	if err := p.out.writeTs(p.buf.Bytes()); err != nil {
+		return err
+	}
+
+	atomic.AddUint64(&p.bytesOut, uint64(p.buf.Len()))
+	atomic.AddUint64(&p.session.bytesOut, uint64(p.buf.Len()))
+	p.server.metrics.AddOutBytes(p.buf.Len())
+	p.buf.Reset()
+	return nil
+}
+
+// accessRecord userAgent/url只对HTTP-TS有效
+func (p *tsPlayer) accessRecord(userAgent, url string, err error) *accessRecord {
+	now := time.Now()
+	sess := p.session
+
+	rec := &accessRecord{
+		Protocol:   p.protocol,
+		Role:       accessRolePlay,
+		ClientIp:   hostOf(p.id),
+		ClientAddr: p.id,
+		Vhost:      sess.vhost,
+		App:        sess.appName,
+		Stream:     sess.streamName,
+		SessionId:  sess.getId(),
+		StartTime:  p.startTime,
+		EndTime:    now,
+		Duration:   now.Sub(p.startTime).Seconds(),
+		BytesOut:   atomic.LoadUint64(&p.bytesOut),
+		Dropped:    p.droppedPackets(),
+		UserAgent:  userAgent,
+		TcUrl:      url,
+	}
+
+	rec.setCloseReason(p.server, &p.closeReason, err)
+	return rec
+}
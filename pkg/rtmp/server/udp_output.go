@@ -0,0 +1,236 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+/*
+MPEG-TS UDP输出(udpOutputs配置): 流开始时向配置的单播/组播地址输出, 以udp-ts播放端身份加入session
+1. 每个datagram 7个TS包(1316字节), 不足部分与下一次输出合并; 推流端重连期间session保留, 输出不中断
+2. 发送协程平滑发送: 速率为近1秒输入码率的udpPaceHeadroom倍, 另加在udpPaceDrain内发完积压数据所需的速率;
+   落后过多时重新计时, 不补发突发
+3. 发送队列满时不再读取packet, 由packet队列按播放端策略丢帧
+4. 发送失败(如目标不可达)只记录一次日志, 不停止输出; 管理API踢出后停止, 直到下一次推流
+*/
+
+const (
+	udpDatagramSize = 7 * 188
+	udpQueueSize    = 1024 // 发送队列中的datagram数
+
+	udpPaceHeadroom = 1.2
+	udpPaceDrain    = 500 * time.Millisecond
+	udpPaceMinWait  = 500 * time.Microsecond // 小于此等待时间时直接发送
+	udpPaceMaxLag   = 200 * time.Millisecond // 落后超过此时间时重新计时
+	udpRateInterval = time.Second            // 输入码率的测量间隔
+	udpCloseTimeout = time.Second            // 正常结束时等待发完积压数据的最长时间
+)
+
+var errUdpOutputStopped = errors.New("udp output stopped")
+
+// startUdpOutputs 按配置开始session的UDP输出
+func (s *Server) startUdpOutputs(sess *session) {
+	for _, oc := range s.getConfig().udpOutputs(sess.vhost, sess.appName, sess.streamName) {
+		go s.runUdpOutput(sess, oc)
+	}
+}
+
+func (s *Server) runUdpOutput(sess *session, oc UdpOutputConfig) {
+	logger := s.logger.With(zap.String("stream", sess.streamKey), zap.String("addr", oc.Addr))
+
+	d := net.Dialer{Control: controlUdpOutput(oc.Ttl, oc.Interface)}
+	c, err := d.DialContext(context.Background(), "udp", oc.Addr)
+	if err != nil {
+		logger.Error("dial udp output", zap.Error(err))
+		return
+	}
+	defer c.Close()
+
+	out := newUdpOutput(c.(*net.UDPConn), logger)
+	sp, err := s.broker.attachPlayer(sess.streamKey, func(sess *session) (sessionPlayer, error) {
+		return s.newTsPlayer(sess, protocolUdpTs, oc.Addr, out, out.stop), nil
+	})
+	if err != nil {
+		out.stop()
+		logger.Error("attach udp output", zap.Error(err))
+		return
+	}
+	p := sp.(*tsPlayer)
+
+	go func() {
+		defer close(p.closed)
+		<-out.stopped
+		p.closeErr = errUdpOutputStopped
+	}()
+
+	logger.Info("udp output started", zap.Int("ttl", oc.Ttl), zap.String("interface", oc.Interface))
+	err = p.play()
+	out.stop()
+	<-out.done
+
+	rec := p.accessRecord("", "", err)
+	s.writeAccessLog(rec)
+
+	if rec.Reason == closeReasonError {
+		logger.Error("udp output", zap.Error(err))
+	} else {
+		logger.Info("udp output stopped", zap.String("reason", rec.Reason))
+	}
+}
+
+// udpOutput 将TS数据拆分为datagram, 由发送协程平滑发送
+type udpOutput struct {
+	conn   *net.UDPConn
+	logger *zap.Logger
+
+	pending  []byte // 不足一个datagram的数据
+	queue    chan []byte
+	stopped  chan struct{} // 停止发送
+	stopOnce sync.Once
+	done     chan struct{} // 发送协程退出
+	bytesIn  uint64        // 原子操作, 已进入发送队列的字节数
+}
+
+func newUdpOutput(conn *net.UDPConn, logger *zap.Logger) *udpOutput {
+	o := &udpOutput{
+		conn:    conn,
+		logger:  logger,
+		queue:   make(chan []byte, udpQueueSize),
+		stopped: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go o.sendLoop()
+	return o
+}
+
+// writeTs 拷贝b并拆分为datagram, 发送队列满时等待
+func (o *udpOutput) writeTs(b []byte) error {
+	if len(o.pending) > 0 {
+		n := udpDatagramSize - len(o.pending)
+		if n > len(b) {
+			n = len(b)
+		}
+		o.pending = append(o.pending, b[:n]...)
+		b = b[n:]
+		if len(o.pending) < udpDatagramSize {
+			return nil
+		}
+		if err := o.enqueue(o.pending); err != nil {
+			return err
+		}
+		o.pending = nil
+	}
+
+	for len(b) >= udpDatagramSize {
+		if err := o.enqueue(append([]byte(nil), b[:udpDatagramSize]...)); err != nil {
+			return err
+		}
+		b = b[udpDatagramSize:]
+	}
+
+	if len(b) > 0 {
+		o.pending = append(make([]byte, 0, udpDatagramSize), b...)
+	}
+	return nil
+}
+
+func (o *udpOutput) enqueue(datagram []byte) error {
+	select {
+	case o.queue <- datagram:
+	case <-o.stopped:
+		return errUdpOutputStopped
+	}
+	atomic.AddUint64(&o.bytesIn, uint64(len(datagram)))
+	return nil
+}
+
+// close 正常结束输出, 等待发完积压数据; 与writeTs由同一协程调用
+func (o *udpOutput) close() error {
+	if len(o.pending) > 0 {
+		_ = o.enqueue(o.pending)
+		o.pending = nil
+	}
+	close(o.queue)
+	select {
+	case <-o.done:
+	case <-time.After(udpCloseTimeout):
+	}
+	return o.stop()
+}
+
+func (o *udpOutput) stop() error {
+	o.stopOnce.Do(func() { close(o.stopped) })
+	return nil
+}
+
+func (o *udpOutput) sendLoop() {
+	defer close(o.done)
+
+	var (
+		next      time.Time // 下一个datagram的发送时间
+		rate      float64   // 近期输入码率(字节/秒)
+		lastIn    uint64
+		lastMeter = time.Now()
+		logged    bool
+		timer     = time.NewTimer(time.Hour)
+	)
+	defer timer.Stop()
+
+	for {
+		var data []byte
+		select {
+		case <-o.stopped:
+			return
+		case b, ok := <-o.queue:
+			if !ok {
+				return
+			}
+			data = b
+		}
+
+		now := time.Now()
+		if elapsed := now.Sub(lastMeter); elapsed >= udpRateInterval {
+			in := atomic.LoadUint64(&o.bytesIn)
+			rate = float64(in-lastIn) / elapsed.Seconds()
+			lastIn, lastMeter = in, now
+		}
+
+		if wait := next.Sub(now); wait >= udpPaceMinWait {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(wait)
+			select {
+			case <-o.stopped:
+				return
+			case <-timer.C:
+			}
+		} else if wait < -udpPaceMaxLag {
+			next = now
+		}
+
+		if _, err := o.conn.Write(data); err != nil && !logged {
+			o.logger.Warn("send udp output", zap.Error(err))
+			logged = true
+		}
+
+		if next.IsZero() {
+			next = now
+		}
+		sendRate := rate*udpPaceHeadroom + float64(len(o.queue)*udpDatagramSize)/udpPaceDrain.Seconds()
+		if sendRate > 0 {
+			next = next.Add(time.Duration(float64(len(data)) / sendRate * float64(time.Second)))
+		} else {
+			next = time.Now()
+		}
+	}
+}
@@ -0,0 +1,56 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const udpInterfaceSupported = true
+
+// controlUdpOutput 连接前设置TTL(单播及组播)及组播输出网卡
+func controlUdpOutput(ttl int, ifname string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var ifi *net.Interface
+		if ifname != "" {
+			var err error
+			if ifi, err = net.InterfaceByName(ifname); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		if e := c.Control(func(fd uintptr) {
+			s := int(fd)
+			if network == "udp6" {
+				if err = unix.SetsockoptInt(s, unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, ttl); err != nil {
+					return
+				}
+				if err = unix.SetsockoptInt(s, unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_HOPS, ttl); err != nil {
+					return
+				}
+				if ifi != nil {
+					err = unix.SetsockoptInt(s, unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_IF, ifi.Index)
+				}
+				return
+			}
+
+			if err = unix.SetsockoptInt(s, unix.IPPROTO_IP, unix.IP_TTL, ttl); err != nil {
+				return
+			}
+			if err = unix.SetsockoptInt(s, unix.IPPROTO_IP, unix.IP_MULTICAST_TTL, ttl); err != nil {
+				return
+			}
+			if ifi != nil {
+				err = unix.SetsockoptIPMreqn(s, unix.IPPROTO_IP, unix.IP_MULTICAST_IF, &unix.IPMreqn{Ifindex: int32(ifi.Index)})
+			}
+		}); e != nil {
+			return e
+		}
+		return err
+	}
+}
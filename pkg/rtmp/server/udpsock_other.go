@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"syscall"
+)
+
+const udpInterfaceSupported = false
+
+// controlUdpOutput 非linux平台使用系统默认的TTL及组播网卡
+func controlUdpOutput(ttl int, ifname string) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
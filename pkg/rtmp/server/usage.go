@@ -0,0 +1,286 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	rotatelogs "github.com/lestrrat-go/file-rotatelogs"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+/*
+用量统计(计费):
+1. 每秒采样所有session: 推流接收字节数/播放发送字节数(含HLS/DASH文件)的增量, 当前播放端数
+2. 按分钟汇总为stream及app两级记录(app记录的stream为空), 每分钟追加写入JSON-lines文件(按天切割)
+3. 观看时长按每秒采样的播放端数累加(viewer-seconds), 峰值为该分钟内采样的最大并发
+4. session删除及server关闭时补齐最后一次增量
+*/
+
+// UsageRecord 一分钟内某个stream(或app, Stream为空)的用量
+type UsageRecord struct {
+	Time          time.Time `json:"time"` // 分钟起始时间
+	Vhost         string    `json:"vhost"`
+	App           string    `json:"app"`
+	Stream        string    `json:"stream,omitempty"`
+	IngestBytes   uint64    `json:"ingestBytes"`
+	EgressBytes   uint64    `json:"egressBytes"`
+	ViewerSeconds uint64    `json:"viewerSeconds"`
+	PeakViewers   int32     `json:"peakViewers"`
+}
+
+// ViewerMinutes 观看分钟数
+func (r *UsageRecord) ViewerMinutes() float64 {
+	return float64(r.ViewerSeconds) / 60
+}
+
+func (r *UsageRecord) empty() bool {
+	return r.IngestBytes == 0 && r.EgressBytes == 0 && r.ViewerSeconds == 0 && r.PeakViewers == 0
+}
+
+// usageSeen session上次采样时的累计字节数
+type usageSeen struct {
+	bytesIn  uint64
+	bytesOut uint64
+}
+
+type usageTracker struct {
+	server *Server
+
+	mu      sync.Mutex
+	closed  bool
+	minute  time.Time               // 当前汇总的分钟
+	streams map[string]*UsageRecord // key: streamKey
+	apps    map[string]*UsageRecord // key: vhost/app
+	seen    map[*session]*usageSeen
+	w       *rotatelogs.RotateLogs
+}
+
+func newUsageTracker(server *Server, cfg UsageConfig) (*usageTracker, error) {
+	w, err := newRotator(cfg.Path, 24*time.Hour, cfg.Age)
+	if err != nil {
+		return nil, errors.Wrap(err, "create usage rotator")
+	}
+
+	return &usageTracker{
+		server:  server,
+		minute:  time.Now().Truncate(time.Minute),
+		streams: make(map[string]*UsageRecord),
+		apps:    make(map[string]*UsageRecord),
+		seen:    make(map[*session]*usageSeen),
+		w:       w,
+	}, nil
+}
+
+// run 每秒采样, server关闭时退出
+func (u *usageTracker) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-u.server.done:
+			return
+		case now := <-ticker.C:
+			if !u.sample(now) {
+				return
+			}
+		}
+	}
+}
+
+// sample 采样一次, 跨分钟时先写入上一分钟的记录; 已关闭返回false
+func (u *usageTracker) sample(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.closed {
+		return false
+	}
+
+	if minute := now.Truncate(time.Minute); minute.After(u.minute) {
+		u.flushLocked()
+		u.minute = minute
+	}
+
+	appViewers := make(map[string]int32)
+	u.server.broker.rangeSessions(func(sess *session) bool {
+		stream := u.collectLocked(sess)
+		players := atomic.LoadInt32(&sess.playerTotal)
+
+		stream.ViewerSeconds += uint64(players)
+		if players > stream.PeakViewers {
+			stream.PeakViewers = players
+		}
+		appViewers[sess.vhost+"/"+sess.appName] += players
+		return true
+	})
+
+	for key, viewers := range appViewers {
+		app := u.apps[key]
+		app.ViewerSeconds += uint64(viewers)
+		if viewers > app.PeakViewers {
+			app.PeakViewers = viewers
+		}
+	}
+
+	return true
+}
+
+// collectLocked 累加session自上次采样以来的字节数, 返回所属的stream记录
+func (u *usageTracker) collectLocked(sess *session) *UsageRecord {
+	stream, ok := u.streams[sess.streamKey]
+	if !ok {
+		stream = &UsageRecord{Vhost: sess.vhost, App: sess.appName, Stream: sess.streamName}
+		u.streams[sess.streamKey] = stream
+	}
+
+	appKey := sess.vhost + "/" + sess.appName
+	app, ok := u.apps[appKey]
+	if !ok {
+		app = &UsageRecord{Vhost: sess.vhost, App: sess.appName}
+		u.apps[appKey] = app
+	}
+
+	seen, ok := u.seen[sess]
+	if !ok {
+		seen = &usageSeen{}
+		u.seen[sess] = seen
+	}
+
+	in, out := atomic.LoadUint64(&sess.bytesIn), atomic.LoadUint64(&sess.bytesOut)
+	stream.IngestBytes += in - seen.bytesIn
+	stream.EgressBytes += out - seen.bytesOut
+	app.IngestBytes += in - seen.bytesIn
+	app.EgressBytes += out - seen.bytesOut
+	seen.bytesIn, seen.bytesOut = in, out
+
+	return stream
+}
+
+// release session删除时补齐最后的增量
+func (u *usageTracker) release(sess *session) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.closed {
+		return
+	}
+
+	u.collectLocked(sess)
+	delete(u.seen, sess)
+}
+
+// flushLocked 写入当前分钟的记录并重置
+func (u *usageTracker) flushLocked() {
+	bw := bufio.NewWriter(u.w)
+	enc := json.NewEncoder(bw)
+
+	for _, records := range []map[string]*UsageRecord{u.streams, u.apps} {
+		for _, rec := range records {
+			if rec.empty() {
+				continue
+			}
+			rec.Time = u.minute
+			if err := enc.Encode(rec); err != nil {
+				u.server.logger.Warn("encode usage record", zap.Error(err))
+			}
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		u.server.logger.Warn("write usage records", zap.Error(err))
+	}
+
+	u.streams = make(map[string]*UsageRecord, len(u.streams))
+	u.apps = make(map[string]*UsageRecord, len(u.apps))
+}
+
+// close server关闭时写入未满一分钟的记录
+func (u *usageTracker) close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.closed {
+		return nil
+	}
+	u.closed = true
+
+	u.server.broker.rangeSessions(func(sess *session) bool {
+		u.collectLocked(sess)
+		return true
+	})
+	u.flushLocked()
+
+	return u.w.Close()
+}
+
+// LoadUsage 读取cfg.Usage.Path下[from, to)之间的用量记录, 按时间排序
+// 进程异常退出可能留下写了一半的行, 跳过无法解析的行并记录日志
+func LoadUsage(cfg *Config, from, to time.Time, logger *zap.Logger) ([]UsageRecord, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	if cfg.Usage.Path == "" {
+		return nil, errors.New("usage.path not configured")
+	}
+
+	usagePath, err := getAbsLogPath(cfg.Usage.Path)
+	if err != nil {
+		return nil, errors.Wrap(err, "get abs usage path")
+	}
+
+	files, err := filepath.Glob(usagePath + "_*")
+	if err != nil {
+		return nil, errors.Wrap(err, "glob usage files")
+	}
+
+	records := make([]UsageRecord, 0)
+	for _, file := range files {
+		if records, err = readUsageFile(file, from, to, records, logger); err != nil {
+			return nil, errors.Wrapf(err, "read %s", file)
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+
+	return records, nil
+}
+
+func readUsageFile(file string, from, to time.Time, records []UsageRecord, logger *zap.Logger) ([]UsageRecord, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return records, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var rec UsageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			logger.Warn("skip bad usage record",
+				zap.String("file", file), zap.Int("line", line), zap.Error(err))
+			continue
+		}
+
+		if rec.Time.Before(from) || !rec.Time.Before(to) {
+			continue
+		}
+		records = append(records, rec)
+	}
+
+	return records, scanner.Err()
+}
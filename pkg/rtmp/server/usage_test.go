@@ -0,0 +1,180 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func newTestUsageTracker(t *testing.T) (*usageTracker, *Config) {
+	cfg := &Config{Usage: UsageConfig{Path: filepath.Join(t.TempDir(), "usage")}}
+	cfg.setDefaults()
+
+	s := &Server{logger: zap.NewNop(), done: make(chan struct{}), metrics: newMetrics()}
+	s.configValue.Store(cfg)
+	broker, err := newBroker(WithBrokerServer(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.broker = broker
+
+	u, err := newUsageTracker(s, cfg.Usage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u, cfg
+}
+
+func addTestSession(u *usageTracker, app, stream string) *session {
+	sess := &session{vhost: "default", appName: app, streamName: stream, streamKey: "default/" + app + "/" + stream}
+	u.server.broker.sessionMap.Store(sess.streamKey, sess)
+	return sess
+}
+
+func TestUsageCollect(t *testing.T) {
+	u, _ := newTestUsageTracker(t)
+	a := addTestSession(u, "live", "a")
+	b := addTestSession(u, "live", "b")
+
+	a.bytesIn, a.bytesOut = 100, 1000
+	b.bytesIn, b.bytesOut = 50, 0
+	assert.True(t, u.sample(u.minute.Add(time.Second)))
+
+	a.bytesIn, a.bytesOut = 300, 1500
+	assert.True(t, u.sample(u.minute.Add(2*time.Second)))
+
+	assert.Equal(t, uint64(300), u.streams[a.streamKey].IngestBytes)
+	assert.Equal(t, uint64(1500), u.streams[a.streamKey].EgressBytes)
+	assert.Equal(t, uint64(50), u.streams[b.streamKey].IngestBytes)
+	assert.Equal(t, uint64(350), u.apps["default/live"].IngestBytes)
+	assert.Equal(t, uint64(1500), u.apps["default/live"].EgressBytes)
+
+	// 删除时补齐最后一次采样之后的增量
+	a.bytesIn, a.bytesOut = 400, 1600
+	u.server.broker.sessionMap.Delete(a.streamKey)
+	u.release(a)
+	assert.Equal(t, uint64(400), u.streams[a.streamKey].IngestBytes)
+	assert.Equal(t, uint64(1600), u.streams[a.streamKey].EgressBytes)
+	assert.NotContains(t, u.seen, a)
+
+	// 同名流重新推流, 新session从0开始计数
+	a2 := addTestSession(u, "live", "a")
+	a2.bytesIn = 10
+	assert.True(t, u.sample(u.minute.Add(3*time.Second)))
+	assert.Equal(t, uint64(410), u.streams[a.streamKey].IngestBytes)
+	assert.Equal(t, uint64(460), u.apps["default/live"].IngestBytes)
+
+	assert.NoError(t, u.close())
+	assert.False(t, u.sample(u.minute.Add(4*time.Second)))
+}
+
+func TestUsageFileEgress(t *testing.T) {
+	u, _ := newTestUsageTracker(t)
+	sess := addTestSession(u, "live", "a")
+	data := make([]byte, 1000)
+
+	for _, tt := range []struct {
+		path, rng string
+		want      uint64
+	}{
+		{"/live/a.m3u8", "", 1000},
+		{"/live/a/3.ts", "", 2000},
+		{"/live/a/video-0.m4s", "bytes=0-99", 2100},
+		{"/live/b/3.ts", "", 2100}, // 流不存在
+	} {
+		hs, ok := parseHttpStream(httptest.NewRequest("GET", tt.path, nil), ListenerConfig{Vhost: "default"})
+		if !assert.True(t, ok, tt.path) {
+			continue
+		}
+
+		r := httptest.NewRequest("GET", tt.path, nil)
+		if tt.rng != "" {
+			r.Header.Set("Range", tt.rng)
+		}
+		u.server.serveFile(httptest.NewRecorder(), r, hs, data)
+		assert.Equal(t, tt.want, sess.bytesOut, tt.path)
+	}
+}
+
+func TestUsageMinuteRollover(t *testing.T) {
+	u, cfg := newTestUsageTracker(t)
+	minute := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	u.minute = minute
+
+	a := addTestSession(u, "live", "a")
+	b := addTestSession(u, "live", "b")
+
+	a.bytesIn, a.playerTotal, b.playerTotal = 100, 2, 1
+	u.sample(minute.Add(10 * time.Second))
+	a.bytesIn, a.playerTotal, b.playerTotal = 200, 3, 0
+	u.sample(minute.Add(20 * time.Second))
+
+	// 跨分钟: 写入上一分钟的记录, 新分钟重新累加
+	a.bytesIn = 250
+	u.sample(minute.Add(time.Minute + time.Second))
+	assert.Equal(t, minute.Add(time.Minute), u.minute)
+	assert.Equal(t, uint64(50), u.streams[a.streamKey].IngestBytes)
+	assert.Equal(t, uint64(3), u.streams[a.streamKey].ViewerSeconds)
+	assert.NoError(t, u.close())
+
+	records, err := LoadUsage(cfg, minute, minute.Add(time.Minute), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	byStream := make(map[string]UsageRecord)
+	for _, rec := range records {
+		assert.True(t, rec.Time.Equal(minute))
+		byStream[rec.Stream] = rec
+	}
+	assert.Len(t, records, 3) // stream a, stream b, app
+
+	assert.Equal(t, uint64(200), byStream["a"].IngestBytes)
+	assert.Equal(t, uint64(5), byStream["a"].ViewerSeconds)
+	assert.Equal(t, int32(3), byStream["a"].PeakViewers)
+	assert.Equal(t, uint64(1), byStream["b"].ViewerSeconds)
+	assert.Equal(t, uint64(6), byStream[""].ViewerSeconds)
+	assert.Equal(t, int32(3), byStream[""].PeakViewers) // 同一时刻各stream并发之和
+}
+
+func TestLoadUsage(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{Usage: UsageConfig{Path: filepath.Join(dir, "usage")}}
+
+	day1 := `{"time":"2026-10-01T23:58:00Z","vhost":"default","app":"live","stream":"a","ingestBytes":1}
+{"time":"2026-10-01T23:59:00Z","vhost":"default","app":"live","stream":"a","ingestBytes":2}
+
+{"time":"2026-10-01T23:59:00Z","vhost":"default","app":"live","ingestBytes":2}
+{"time":"2026-10-01T23:59:30Z","vhost":"def`
+	day2 := `{"time":"2026-10-02T00:00:00Z","vhost":"default","app":"live","stream":"a","ingestBytes":3}
+not json
+{"time":"2026-10-02T00:01:00Z","vhost":"default","app":"live","stream":"a","ingestBytes":4}
+`
+	// 后一天的文件先写入, 验证结果按时间排序
+	for name, data := range map[string]string{"usage_20261002": day2, "usage_20261001": day1, "usage": "not json"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	from := time.Date(2026, 10, 1, 23, 59, 0, 0, time.UTC)
+	to := time.Date(2026, 10, 2, 0, 1, 0, 0, time.UTC)
+	records, err := LoadUsage(cfg, from, to, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var ingest []uint64
+	for _, rec := range records {
+		ingest = append(ingest, rec.IngestBytes)
+	}
+	assert.Equal(t, []uint64{2, 2, 3}, ingest)
+
+	_, err = LoadUsage(&Config{}, from, to, nil)
+	assert.Error(t, err)
+}
@@ -1,5 +1,11 @@
 package server
 
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
 type clientConnectInfo struct {
 	app            string
 	flashVer       string
@@ -17,6 +23,10 @@ type clientPublishOrPlayInfo struct {
 	clientType uint8 //value: 0, 1(publish), 2(play)
 	stream     string
 	app        string
+
+	// publish/play命令消息所在的chunk stream及message stream, 用于后续发送onStatus
+	csid     uint32
+	streamId uint32
 }
 
 type onMetaData struct {
@@ -38,6 +48,12 @@ type onMetaData struct {
 	Audiosamplesize float64
 }
 
+// isTimeout 是否为网络读写超时(含shutdown时唤醒读操作)
+func isTimeout(err error) bool {
+	ne, ok := errors.Cause(err).(net.Error)
+	return ok && ne.Timeout()
+}
+
 func genStreamKey(vhost, appName, streamName string) string {
 	return vhost + "/" + appName + "/" + streamName
 }
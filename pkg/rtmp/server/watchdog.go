@@ -0,0 +1,120 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+推流端媒体看门狗
+publisher连接正常但长时间收不到音频/视频(如编码器卡死)时, 播放端会一直卡住:
+1. 已收到过的track静默超过watchdog.silenceTimeout时告警, 恢复后再次通知
+2. 开启watchdog.disconnectTimeout时, 静默超过该时长断开publisher, 促使其重连
+*/
+
+const (
+	trackAudio = iota
+	trackVideo
+)
+
+var trackNames = [...]string{"audio", "video"}
+
+// trackWatch 单个track的到达时间记录
+type trackWatch struct {
+	last   int64  // 最近一次收到数据的时间(UnixNano), 0表示尚未收到(原子操作)
+	silent uint32 // 已发出静默告警(原子操作)
+}
+
+func (t *trackWatch) touch(now time.Time) {
+	atomic.StoreInt64(&t.last, now.UnixNano())
+}
+
+func (t *trackWatch) reset() {
+	atomic.StoreInt64(&t.last, 0)
+	atomic.StoreUint32(&t.silent, 0)
+}
+
+// silence 距最近一次收到数据的时长, 从未收到时返回0
+func (t *trackWatch) silence(now time.Time) time.Duration {
+	last := atomic.LoadInt64(&t.last)
+	if last == 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, last))
+}
+
+// runWatchdog 每秒检查所有session, server关闭时退出
+func (b *broker) runWatchdog() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.server.done:
+			return
+		case now := <-ticker.C:
+			cfg := b.server.getConfig().Watchdog
+			if cfg.SilenceTimeout <= 0 {
+				continue
+			}
+
+			b.rangeSessions(func(sess *session) bool {
+				sess.checkMedia(now, cfg)
+				return true
+			})
+		}
+	}
+}
+
+func (s *session) checkMedia(now time.Time, cfg WatchdogConfig) {
+	publisher := s.getPublisher()
+	if publisher == nil {
+		return
+	}
+
+	logger := s.broker.server.logger
+	disconnect := false
+	for track, watch := range s.trackWatches() {
+		silence := watch.silence(now)
+
+		if silence >= cfg.SilenceTimeout {
+			if atomic.CompareAndSwapUint32(&watch.silent, 0, 1) {
+				atomic.AddUint64(&s.broker.server.metrics.watchdogAlarms[track], 1)
+				logger.Warn("publisher track silent",
+					zap.String("streamKey", s.streamKey),
+					zap.String("track", trackNames[track]),
+					zap.Duration("silence", silence))
+
+				ev := s.event(EventTrackSilent)
+				ev.Track, ev.Silence = trackNames[track], silence
+				s.broker.server.events.publish(ev)
+			}
+		} else if atomic.CompareAndSwapUint32(&watch.silent, 1, 0) {
+			logger.Info("publisher track recovered",
+				zap.String("streamKey", s.streamKey),
+				zap.String("track", trackNames[track]))
+
+			ev := s.event(EventTrackRecovered)
+			ev.Track = trackNames[track]
+			s.broker.server.events.publish(ev)
+		}
+
+		if cfg.DisconnectTimeout > 0 && silence >= cfg.DisconnectTimeout {
+			disconnect = true
+		}
+	}
+
+	if disconnect {
+		atomic.AddUint64(&s.broker.server.metrics.watchdogDisconnects, 1)
+		logger.Warn("disconnect silent publisher",
+			zap.String("streamKey", s.streamKey),
+			zap.String("client", publisher.Connection.Rwc.RemoteAddr().String()))
+		_ = publisher.closeWithReason(closeReasonWatchdog)
+	}
+}
+
+func (s *session) trackWatches() [2]*trackWatch {
+	return [2]*trackWatch{trackAudio: &s.audioWatch, trackVideo: &s.videoWatch}
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"fastlive/pkg/av/flv"
+	"fastlive/pkg/websocket"
+)
+
+/*
+WebSocket-FLV播放(ws://host/{app}/{stream}.flv):
+1. 准入, session加入, 丢帧策略及访问日志与http-flv相同
+2. FLV header及每个FLV tag各为一个binary消息
+3. 定时发送ping, 超过wsFlvReadTimeout未收到任何数据(含pong)则断开
+*/
+
+const (
+	protocolWsFlv = "ws-flv"
+
+	wsFlvPingInterval = 10 * time.Second
+	wsFlvReadTimeout  = 3 * wsFlvPingInterval
+)
+
+func (s *Server) handleWsFlv(w http.ResponseWriter, r *http.Request, hs *httpStream) {
+	if _, ok := s.broker.getSession(hs.streamKey()); !ok {
+		s.metrics.incPlayRejection(playRejectStreamNotFound)
+		http.NotFound(w, r)
+		return
+	}
+
+	ws, err := websocket.Upgrade(w, r)
+	if err != nil {
+		s.logger.Debug("ws-flv upgrade", zap.Error(err))
+		return
+	}
+	conn := ws.UnderlyingConn()
+	defer conn.Close()
+
+	if !s.trackHttpConn(conn, true) {
+		return
+	}
+	defer s.trackHttpConn(conn, false)
+
+	done := make(chan struct{})
+	defer close(done)
+	go wsKeepalive(ws, s.getConfig().WriteTimeout, done)
+
+	extendDeadline := func() {
+		_ = ws.SetReadDeadline(time.Now().Add(wsFlvReadTimeout))
+	}
+	ws.SetPongHandler(func([]byte) { extendDeadline() })
+
+	// 客户端发送的消息忽略, 只用于感知断开及保活
+	readLoop := func() error {
+		for {
+			extendDeadline()
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return err
+			}
+		}
+	}
+
+	s.playFlv(conn, readLoop, &wsFlvWriter{ws: ws}, r, hs, protocolWsFlv)
+}
+
+// wsKeepalive 定时发送ping直到done关闭
+func wsKeepalive(ws *websocket.Conn, writeTimeout time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(wsFlvPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if writeTimeout > 0 {
+				_ = ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+			}
+			if err := ws.WriteMessage(websocket.OpPing, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// wsFlvWriter 将合并的FLV数据按header/tag拆分, 每个为一个binary消息
+type wsFlvWriter struct {
+	ws   *websocket.Conn
+	msgs [][]byte
+}
+
+func (ww *wsFlvWriter) writeTags(b []byte) error {
+	ww.msgs = ww.msgs[:0]
+
+	if len(b) >= flv.HeaderSize && string(b[:3]) == "FLV" {
+		ww.msgs = append(ww.msgs, b[:flv.HeaderSize])
+		b = b[flv.HeaderSize:]
+	}
+
+	for len(b) > 0 {
+		n := flv.TagSize(int(b[1])<<16 | int(b[2])<<8 | int(b[3]))
+		ww.msgs = append(ww.msgs, b[:n])
+		b = b[n:]
+	}
+
+	return ww.ws.WriteMessages(websocket.OpBinary, ww.msgs)
+}
+
+func (ww *wsFlvWriter) close() error {
+	return ww.ws.WriteClose(websocket.CloseNormal, "")
+}
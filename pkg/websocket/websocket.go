@@ -0,0 +1,357 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+最小化的websocket服务端实现(RFC 6455), 仅满足推送场景:
+1. 不支持扩展(permessage-deflate等)及子协议协商
+2. 收到ping自动回复pong, 收到close回复close后返回io.EOF
+*/
+
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xa
+)
+
+// close状态码
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+	closeStatusNoPayload = 1005
+)
+
+const acceptGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// MaxMessageSize 读取的单个消息最大长度
+var MaxMessageSize = 1 << 20
+
+var (
+	ErrNotWebsocket   = errors.New("websocket: not a websocket handshake")
+	ErrMessageTooBig  = errors.New("websocket: message too big")
+	ErrProtocol       = errors.New("websocket: protocol error")
+	errHijackNotAllow = errors.New("websocket: response does not implement http.Hijacker")
+)
+
+// IsUpgrade 请求是否为websocket握手
+func IsUpgrade(r *http.Request) bool {
+	return headerContains(r.Header, "Connection", "upgrade") && headerContains(r.Header, "Upgrade", "websocket")
+}
+
+// Conn websocket连接, 写操作并发安全, 读操作只能由单个协程调用
+type Conn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	wmu    sync.Mutex
+	closed bool // 已发送close帧
+
+	pongHandler func(data []byte)
+}
+
+// Upgrade 完成服务端握手并接管底层连接
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet || !IsUpgrade(r) {
+		http.Error(w, "websocket handshake required", http.StatusBadRequest)
+		return nil, ErrNotWebsocket
+	}
+
+	if r.Header.Get("Sec-Websocket-Version") != "13" {
+		w.Header().Set("Sec-Websocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, errors.Wrap(ErrNotWebsocket, "unsupported version")
+	}
+
+	key := r.Header.Get("Sec-Websocket-Key")
+	if key == "" {
+		http.Error(w, "Sec-WebSocket-Key required", http.StatusBadRequest)
+		return nil, errors.Wrap(ErrNotWebsocket, "Sec-WebSocket-Key required")
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errHijackNotAllow
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, errors.Wrap(err, "hijack")
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "write handshake response")
+	}
+
+	return &Conn{conn: conn, br: brw.Reader}, nil
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGuid))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WriteMessage 发送一个完整消息(单帧, 服务端不加掩码)
+func (c *Conn) WriteMessage(opcode int, data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closed {
+		return errors.New("websocket: write on closed connection")
+	}
+
+	return c.writeFrame(opcode, data)
+}
+
+// WriteMessages 发送多个消息(各自单帧), 合并为一次写入
+func (c *Conn) WriteMessages(opcode int, msgs [][]byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closed {
+		return errors.New("websocket: write on closed connection")
+	}
+
+	hdrs := make([]byte, 0, 10*len(msgs))
+	bufs := make(net.Buffers, 0, 2*len(msgs))
+	for _, data := range msgs {
+		start := len(hdrs)
+		hdrs = appendFrameHeader(hdrs, opcode, len(data))
+		bufs = append(bufs, hdrs[start:], data)
+	}
+
+	_, err := bufs.WriteTo(c.conn)
+	return err
+}
+
+func (c *Conn) writeFrame(opcode int, data []byte) error {
+	var hdr [10]byte
+	bufs := net.Buffers{appendFrameHeader(hdr[:0], opcode, len(data)), data}
+	_, err := bufs.WriteTo(c.conn)
+	return err
+}
+
+func appendFrameHeader(dst []byte, opcode, length int) []byte {
+	dst = append(dst, 0x80|byte(opcode)) // FIN
+	switch {
+	case length <= 125:
+		return append(dst, byte(length))
+	case length <= 0xffff:
+		return append(dst, 126, byte(length>>8), byte(length))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(length))
+		return append(append(dst, 127), ext[:]...)
+	}
+}
+
+// WriteClose 发送close帧, 之后不能再写
+func (c *Conn) WriteClose(code int, reason string) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	payload := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	copy(payload[2:], reason)
+	return c.writeFrame(OpClose, payload)
+}
+
+// ReadMessage 读取一个完整的数据消息(text/binary), 控制帧在内部处理
+// 对端关闭时返回io.EOF
+func (c *Conn) ReadMessage() (opcode int, data []byte, err error) {
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case OpPing:
+			if err := c.WriteMessage(OpPong, payload); err != nil {
+				return 0, nil, errors.Wrap(err, "write pong")
+			}
+			continue
+		case OpPong:
+			c.handlePong(payload)
+			continue
+		case OpClose:
+			code := closeStatusNoPayload
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			_ = c.WriteClose(code, "")
+			return 0, nil, io.EOF
+		case OpText, OpBinary:
+		default:
+			return 0, nil, errors.Wrapf(ErrProtocol, "unexpected opcode %d", op)
+		}
+
+		// 分片消息
+		for !fin {
+			var contOp int
+			var more []byte
+			fin, contOp, more, err = c.readFrame()
+			if err != nil {
+				return 0, nil, err
+			}
+
+			switch contOp {
+			case OpContinuation:
+			case OpPing:
+				if err := c.WriteMessage(OpPong, more); err != nil {
+					return 0, nil, errors.Wrap(err, "write pong")
+				}
+				fin = false
+				continue
+			case OpPong:
+				c.handlePong(more)
+				fin = false
+				continue
+			default:
+				return 0, nil, errors.Wrapf(ErrProtocol, "unexpected opcode %d in fragmented message", contOp)
+			}
+
+			if len(payload)+len(more) > MaxMessageSize {
+				return 0, nil, ErrMessageTooBig
+			}
+			payload = append(payload, more...)
+		}
+
+		return op, payload, nil
+	}
+}
+
+// SetPongHandler 收到pong时的回调(在ReadMessage协程中执行), 用于保活检测
+func (c *Conn) SetPongHandler(h func(data []byte)) {
+	c.pongHandler = h
+}
+
+func (c *Conn) handlePong(data []byte) {
+	if c.pongHandler != nil {
+		c.pongHandler(data)
+	}
+}
+
+func (c *Conn) readFrame() (fin bool, opcode int, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(c.br, hdr[:]); err != nil {
+		return
+	}
+
+	fin = hdr[0]&0x80 != 0
+	opcode = int(hdr[0] & 0x0f)
+	if hdr[0]&0x70 != 0 {
+		err = errors.Wrap(ErrProtocol, "reserved bits set")
+		return
+	}
+
+	masked := hdr[1]&0x80 != 0
+	if !masked { // 客户端帧必须加掩码
+		err = errors.Wrap(ErrProtocol, "client frame not masked")
+		return
+	}
+
+	length := uint64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if opcode >= OpClose && (length > 125 || !fin) {
+		err = errors.Wrap(ErrProtocol, "invalid control frame")
+		return
+	}
+
+	if length > uint64(MaxMessageSize) {
+		err = ErrMessageTooBig
+		return
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+		return
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+
+	for i := range payload {
+		payload[i] ^= mask[i&3]
+	}
+
+	return
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// UnderlyingConn 底层连接
+func (c *Conn) UnderlyingConn() net.Conn {
+	return c.conn
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}